@@ -182,6 +182,8 @@ func New(ac *Config) (*API, error) {
 
 // EnableExponentialBackoff enables use of exponential backoff for next API call(s)
 // and use exponential backoff for all API calls until exponential backoff is disabled.
+// Note, checkmgr does not use it, check initialization is retried by checkmgr
+// itself (see checkmgr.InitConfig) which, unlike this, gives up on permanent errors.
 func (a *API) EnableExponentialBackoff() {
 	a.useExponentialBackoffmu.Lock()
 	a.useExponentialBackoff = true
@@ -0,0 +1,181 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitest
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// searchTerm is a (key:value) search term or, without a key, a word
+type searchTerm struct {
+	key   string
+	value string
+}
+
+// parseSearch parses search criteria, e.g. (active:1)(type:"httptrap")(tags:a,b:c) foo
+func parseSearch(search string) []searchTerm {
+	var terms []searchTerm
+	s := strings.TrimSpace(search)
+	for s != "" {
+		if s[0] == '(' {
+			end := strings.Index(s, ")")
+			if end < 0 {
+				end = len(s)
+			}
+			term := s[1:end]
+			if end < len(s) {
+				end++
+			}
+			s = strings.TrimSpace(s[end:])
+			if idx := strings.Index(term, ":"); idx > 0 {
+				terms = append(terms, searchTerm{
+					key:   strings.TrimSpace(term[:idx]),
+					value: unquote(strings.TrimSpace(term[idx+1:])),
+				})
+			} else if term != "" {
+				terms = append(terms, searchTerm{value: unquote(term)})
+			}
+			continue
+		}
+		end := strings.IndexAny(s, " (")
+		if s[0] == '"' {
+			if q := strings.Index(s[1:], `"`); q >= 0 {
+				end = q + 2
+			}
+		}
+		if end < 0 {
+			end = len(s)
+		}
+		terms = append(terms, searchTerm{value: unquote(s[:end])})
+		s = strings.TrimSpace(s[end:])
+	}
+	return terms
+}
+
+func unquote(s string) string {
+	if v, err := strconv.Unquote(s); err == nil {
+		return v
+	}
+	return s
+}
+
+// matchSearch reports whether an object matches all search terms
+func matchSearch(obj object, search string) bool {
+	for _, term := range parseSearch(search) {
+		if !matchTerm(obj, term) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchTerm(obj object, term searchTerm) bool {
+	switch term.key {
+	case "":
+		// a word, matches any (top level) string attribute
+		word := strings.ToLower(term.value)
+		for _, v := range obj {
+			if s, ok := v.(string); ok && strings.Contains(strings.ToLower(s), word) {
+				return true
+			}
+		}
+		return false
+	case "active":
+		want := term.value == "1" || term.value == "true"
+		return isActive(obj) == want
+	case "host":
+		return field(obj, "target") == term.value
+	case "tags":
+		tags := append(stringList(obj["tags"]), stringList(obj["_tags"])...)
+		for _, tag := range strings.Split(term.value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !contains(tags, tag) {
+				return false
+			}
+		}
+		return true
+	case "name", "display_name", "title":
+		want := strings.ToLower(term.value)
+		for _, k := range []string{"display_name", "name", "_name", "title"} {
+			if strings.Contains(strings.ToLower(field(obj, k)), want) {
+				return true
+			}
+		}
+		return false
+	}
+	return field(obj, term.key) == term.value
+}
+
+// isActive reports whether an object is active, by status or _active
+func isActive(obj object) bool {
+	if status, ok := obj["status"].(string); ok {
+		return status == "active"
+	}
+	if active, ok := obj["_active"].(bool); ok {
+		return active
+	}
+	return true
+}
+
+// matchFilters reports whether an object matches all f_ filters, e.g.
+// f_notes=x (attribute equal to one of the values) or f__tags_has=a
+// (array attribute containing one of the values)
+func matchFilters(obj object, query url.Values) bool {
+	for k, values := range query {
+		if !strings.HasPrefix(k, "f_") {
+			continue
+		}
+		name := strings.TrimPrefix(k, "f_")
+		match := false
+		if strings.HasSuffix(name, "_has") {
+			items := stringList(obj[strings.TrimSuffix(name, "_has")])
+			for _, v := range values {
+				if contains(items, v) {
+					match = true
+					break
+				}
+			}
+		} else {
+			match = contains(values, field(obj, name))
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+// field returns an attribute as a string, "" if missing, null or not a scalar
+func field(obj object, key string) string {
+	v, ok := obj[key]
+	if !ok {
+		if strings.HasPrefix(key, "_") {
+			return ""
+		}
+		if v, ok = obj["_"+key]; !ok {
+			return ""
+		}
+	}
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return fmt.Sprintf("%t", val)
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
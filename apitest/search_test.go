@@ -0,0 +1,140 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+	terms := parseSearch(`(active:1)(type:"httptrap") (tags:a,b:c)foo "bar baz"`)
+	expect := []searchTerm{
+		{key: "active", value: "1"},
+		{key: "type", value: "httptrap"},
+		{key: "tags", value: "a,b:c"},
+		{value: "foo"},
+		{value: "bar baz"},
+	}
+	if !reflect.DeepEqual(terms, expect) {
+		t.Fatalf("Expected %+v, got %+v", expect, terms)
+	}
+
+	if terms := parseSearch(""); len(terms) != 0 {
+		t.Fatalf("Expected no terms, got %+v", terms)
+	}
+}
+
+func TestMatchSearch(t *testing.T) {
+	obj := object{
+		"_cid":         "/check_bundle/1",
+		"display_name": "Test Check",
+		"status":       "active",
+		"tags":         []interface{}{"a", "b:c"},
+		"target":       "host1",
+		"type":         "httptrap",
+		"period":       float64(60),
+	}
+
+	tests := []struct {
+		search string
+		match  bool
+	}{
+		{"", true},
+		{"(active:1)", true},
+		{"(active:0)", false},
+		{`(type:"httptrap")`, true},
+		{"(type:json)", false},
+		{`(host:"host1")`, true},
+		{"(host:host2)", false},
+		{"(tags:a,b:c)", true},
+		{"(tags:a,d)", false},
+		{"(name:test)", true},
+		{"(period:60)", true},
+		{"(cid:/check_bundle/1)", true},
+		{"check", true},
+		{"missing", false},
+		{`(active:1)(type:"httptrap")(host:"host1")(tags:a)`, true},
+	}
+	for _, test := range tests {
+		if m := matchSearch(obj, test.search); m != test.match {
+			t.Fatalf("Expected %v for '%s', got %v", test.match, test.search, m)
+		}
+	}
+
+	t.Log("_active")
+	{
+		check := object{"_active": false}
+		if matchSearch(check, "(active:1)") {
+			t.Fatal("Expected no match")
+		}
+	}
+}
+
+func TestMatchFilters(t *testing.T) {
+	obj := object{
+		"_tags":       []interface{}{"dc:a", "loc:b"},
+		"_check_uuid": "abc",
+		"notes":       "cgm_instanceid|foo",
+	}
+
+	tests := []struct {
+		query string
+		match bool
+	}{
+		{"", true},
+		{"search=x&size=10", true},
+		{"f__check_uuid=abc", true},
+		{"f__check_uuid=xyz", false},
+		{"f__check_uuid=xyz&f__check_uuid=abc", true},
+		{"f__tags_has=dc:a", true},
+		{"f__tags_has=dc:b&f__tags_has=loc:b", true},
+		{"f__tags_has=dc:b", false},
+		{"f_notes=cgm_instanceid|foo&f__tags_has=dc:a", true},
+		{"f_notes=cgm_instanceid|foo&f__tags_has=dc:b", false},
+		{"f_missing=x", false},
+	}
+	for _, test := range tests {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if m := matchFilters(obj, q); m != test.match {
+			t.Fatalf("Expected %v for '%s', got %v", test.match, test.query, m)
+		}
+	}
+}
+
+func TestSearchEndpoint(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	for _, b := range []map[string]interface{}{
+		{"_name": "a", "_tags": []string{"dc:a"}},
+		{"_name": "b", "_tags": []string{"dc:b"}},
+	} {
+		if _, err := s.Add("/broker", b); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	status, body := request(t, s, "GET", "/broker?f__tags_has=dc%3Ab", s.Token(), "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	var brokers []map[string]interface{}
+	if err := json.Unmarshal(body, &brokers); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(brokers) != 1 || brokers[0]["_name"] != "b" {
+		t.Fatalf("Expected broker b, got %v", brokers)
+	}
+}
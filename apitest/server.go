@@ -0,0 +1,307 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package apitest provides a fake, stateful, in-memory Circonus API (v2) for
+// testing code built on the api package or on checkmgr.
+//
+// Every endpoint wrapped by the api package is served (GET, POST, PUT and
+// DELETE where the API supports them), objects are stored as json. CIDs are
+// generated and validated against the config CID regexes, GET on a collection
+// supports search= and f_<field>[_has]= filters, the auth token (and app name)
+// is checked and faults (e.g. 429, 5xx, slow responses) can be injected.
+//
+// Creating a check bundle also creates its checks, check uuids and (for
+// httptrap) the submission_url on the broker, updating its brokers replaces
+// them (keeping the secret). AddBroker adds a broker backed by
+// a brokertest.Broker, so checkmgr can search, create and submit end to end:
+//
+//	trap, _ := brokertest.New(&brokertest.Config{TLS: true})
+//	srv, _ := apitest.New(&apitest.Config{})
+//	srv.AddBroker("test", trap)
+//	cfg.CheckManager.API.TokenKey = srv.Token()
+//	cfg.CheckManager.API.URL = srv.URL()
+package apitest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultToken = "apitest"
+	pathPrefix   = "/v2"
+)
+
+// Config options for the server
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// Token required in X-Circonus-Auth-Token (default: apitest)
+	Token string
+	// App required in X-Circonus-App-Name (default: any app name is accepted)
+	App string
+	// CACert returned (as {"contents":"..."}) by /pki/ca.crt, AddBroker sets
+	// it to the CA of a TLS broker
+	CACert []byte
+}
+
+// Fault changes how requests are handled
+type Fault struct {
+	// StatusCode responds with the status (e.g. 429, 500, 503) instead of handling the request
+	StatusCode int
+	// Delay before responding (ends early if the client gives up)
+	Delay time.Duration
+	// Method the fault applies to (default: all)
+	Method string
+	// Path prefix the fault applies to, e.g. /check_bundle (default: all)
+	Path string
+	// Count of requests the fault applies to (0: until cleared)
+	Count int
+}
+
+// Request is a request received by the server
+type Request struct {
+	Method string
+	Path   string // without the /v2 prefix
+	Query  url.Values
+	Body   []byte
+}
+
+// Server is a fake Circonus API
+type Server struct {
+	Log   *log.Logger
+	Debug bool
+
+	server *httptest.Server
+	token  string
+	app    string
+
+	mu          sync.Mutex
+	caCert      []byte
+	fault       *Fault
+	requests    []Request
+	collections map[string]*collection
+	// submission url scheme of brokers added with AddBroker
+	brokerSchemes map[string]string
+}
+
+// New starts a new server
+func New(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+
+	s := &Server{
+		Debug:         cfg.Debug,
+		Log:           cfg.Log,
+		token:         defaultToken,
+		app:           cfg.App,
+		caCert:        cfg.CACert,
+		collections:   newCollections(),
+		brokerSchemes: make(map[string]string),
+	}
+
+	if s.Debug && s.Log == nil {
+		s.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if s.Log == nil {
+		s.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	if cfg.Token != "" {
+		s.token = cfg.Token
+	}
+
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s, nil
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// URL returns the api url (including /v2) for api.Config.URL
+func (s *Server) URL() string {
+	return s.server.URL + pathPrefix
+}
+
+// Token returns the auth token accepted by the server
+func (s *Server) Token() string {
+	return s.token
+}
+
+// SetCACert sets the certificate returned by /pki/ca.crt
+func (s *Server) SetCACert(cert []byte) {
+	s.mu.Lock()
+	s.caCert = cert
+	s.mu.Unlock()
+}
+
+// SetFault injects a fault, replacing any current fault
+func (s *Server) SetFault(f Fault) {
+	s.mu.Lock()
+	s.fault = &f
+	s.mu.Unlock()
+}
+
+// ClearFault removes the current fault
+func (s *Server) ClearFault() {
+	s.mu.Lock()
+	s.fault = nil
+	s.mu.Unlock()
+}
+
+// Requests returns the requests received, oldest first
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make([]Request, len(s.requests))
+	copy(r, s.requests)
+	return r
+}
+
+// ResetRequests discards the recorded requests
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	s.requests = nil
+	s.mu.Unlock()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Request.Invalid", err.Error())
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, pathPrefix)
+	query := r.URL.Query()
+
+	if s.Debug {
+		s.Log.Printf("[DEBUG] %s %s", r.Method, r.URL.String())
+	}
+
+	fault := s.record(Request{Method: r.Method, Path: path, Query: query, Body: body})
+
+	if fault.Delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(fault.Delay):
+		}
+	}
+	if fault.StatusCode != 0 {
+		if fault.StatusCode == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		respondError(w, fault.StatusCode, "Fault.Injected", "injected fault")
+		return
+	}
+
+	if r.Header.Get("X-Circonus-Auth-Token") != s.token {
+		respondError(w, http.StatusForbidden, "Authentication.InvalidToken", "invalid or missing auth token")
+		return
+	}
+	if s.app != "" && r.Header.Get("X-Circonus-App-Name") != s.app {
+		respondError(w, http.StatusForbidden, "Authentication.InvalidApp", "invalid or missing app name")
+		return
+	}
+
+	if path == "/pki/ca.crt" {
+		s.mu.Lock()
+		cert := s.caCert
+		s.mu.Unlock()
+		if r.Method != "GET" || cert == nil {
+			respondError(w, http.StatusNotFound, "ObjectError.NotFound", "no ca certificate")
+			return
+		}
+		respond(w, http.StatusOK, map[string]string{"contents": string(cert)})
+		return
+	}
+
+	status, result, err := s.route(r.Method, path, query, body)
+	if err != nil {
+		respondError(w, status, errorCode(status), err.Error())
+		return
+	}
+	if result == nil {
+		w.WriteHeader(status)
+		return
+	}
+	respond(w, status, result)
+}
+
+// record records a request and returns the fault to apply (if any)
+func (s *Server) record(req Request) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, req)
+
+	f := s.fault
+	if f == nil {
+		return Fault{}
+	}
+	if f.Method != "" && f.Method != req.Method {
+		return Fault{}
+	}
+	if f.Path != "" && !strings.HasPrefix(req.Path, f.Path) {
+		return Fault{}
+	}
+	applied := *f
+	if f.Count > 0 {
+		f.Count--
+		if f.Count == 0 {
+			s.fault = nil
+		}
+	}
+	return applied
+}
+
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "ObjectError.InvalidObject"
+	case http.StatusNotFound:
+		return "ObjectError.NotFound"
+	case http.StatusMethodNotAllowed:
+		return "ObjectError.InvalidMethod"
+	}
+	return "Server.Error"
+}
+
+func respond(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Server.Error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func respondError(w http.ResponseWriter, status int, code, msg string) {
+	data, _ := json.Marshal(map[string]string{
+		"code":      code,
+		"message":   msg,
+		"reference": "apitest",
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
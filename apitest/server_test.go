@@ -0,0 +1,242 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func request(t *testing.T, s *Server, method, path, token, body string) (int, []byte) {
+	req, err := http.NewRequest(method, s.URL()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Circonus-Auth-Token", token)
+	}
+	req.Header.Set("X-Circonus-App-Name", "apitest")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return resp.StatusCode, data
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config (nil)")
+	{
+		if _, err := New(nil); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("defaults")
+	{
+		s, err := New(&Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer s.Close()
+		if !strings.HasPrefix(s.URL(), "http://127.0.0.1:") || !strings.HasSuffix(s.URL(), "/v2") {
+			t.Fatalf("Expected api url, got '%s'", s.URL())
+		}
+		if s.Token() != defaultToken {
+			t.Fatalf("Expected '%s', got '%s'", defaultToken, s.Token())
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s, err := New(&Config{Token: "abc", App: "apitest"})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	t.Log("missing token")
+	{
+		if status, _ := request(t, s, "GET", "/check_bundle", "", ""); status != http.StatusForbidden {
+			t.Fatalf("Expected 403, got %d", status)
+		}
+	}
+
+	t.Log("invalid token")
+	{
+		if status, _ := request(t, s, "GET", "/check_bundle", "xyz", ""); status != http.StatusForbidden {
+			t.Fatalf("Expected 403, got %d", status)
+		}
+	}
+
+	t.Log("invalid app")
+	{
+		req, _ := http.NewRequest("GET", s.URL()+"/check_bundle", nil)
+		req.Header.Set("X-Circonus-Auth-Token", "abc")
+		req.Header.Set("X-Circonus-App-Name", "other")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected 403, got %d", resp.StatusCode)
+		}
+	}
+
+	t.Log("valid")
+	{
+		status, body := request(t, s, "GET", "/check_bundle", "abc", "")
+		if status != http.StatusOK || string(body) != "[]" {
+			t.Fatalf("Expected 200 [], got %d %s", status, body)
+		}
+	}
+
+	t.Log("api client")
+	{
+		client, err := api.New(&api.Config{TokenKey: "xyz", TokenApp: "apitest", URL: s.URL()})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := client.FetchCheckBundles(); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("Expected 403 error, got '%v'", err)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	t.Log("status, count")
+	{
+		s.SetFault(Fault{StatusCode: http.StatusServiceUnavailable, Count: 2})
+		for i := 0; i < 2; i++ {
+			if status, _ := request(t, s, "GET", "/broker", s.Token(), ""); status != http.StatusServiceUnavailable {
+				t.Fatalf("Expected 503, got %d", status)
+			}
+		}
+		if status, _ := request(t, s, "GET", "/broker", s.Token(), ""); status != http.StatusOK {
+			t.Fatalf("Expected 200 (fault expired), got %d", status)
+		}
+	}
+
+	t.Log("method, path")
+	{
+		s.SetFault(Fault{StatusCode: http.StatusTooManyRequests, Method: "POST", Path: "/check_bundle"})
+		if status, _ := request(t, s, "GET", "/check_bundle", s.Token(), ""); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if status, _ := request(t, s, "POST", "/contact_group", s.Token(), `{"name":"foo"}`); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if status, _ := request(t, s, "POST", "/check_bundle", s.Token(), `{}`); status != http.StatusTooManyRequests {
+			t.Fatalf("Expected 429, got %d", status)
+		}
+		s.ClearFault()
+	}
+
+	t.Log("api client retries")
+	{
+		client, err := api.New(&api.Config{TokenKey: s.Token(), TokenApp: "apitest", URL: s.URL()})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		s.ResetRequests()
+		s.SetFault(Fault{StatusCode: http.StatusTooManyRequests, Count: 1})
+		if _, err := client.FetchBrokers(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if n := len(s.Requests()); n != 2 {
+			t.Fatalf("Expected 2 requests, got %d", n)
+		}
+	}
+
+	t.Log("delay")
+	{
+		s.SetFault(Fault{Delay: 200 * time.Millisecond})
+		start := time.Now()
+		if status, _ := request(t, s, "GET", "/broker", s.Token(), ""); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if d := time.Since(start); d < 200*time.Millisecond {
+			t.Fatalf("Expected delay >= 200ms, got %s", d)
+		}
+		s.ClearFault()
+	}
+}
+
+func TestRequests(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	request(t, s, "GET", "/check_bundle?search=foo&f_notes=bar", s.Token(), "")
+	request(t, s, "POST", "/contact_group", s.Token(), `{"name":"foo"}`)
+
+	reqs := s.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(reqs))
+	}
+	if reqs[0].Method != "GET" || reqs[0].Path != "/check_bundle" || reqs[0].Query.Get("f_notes") != "bar" {
+		t.Fatalf("Expected GET /check_bundle, got %+v", reqs[0])
+	}
+	if reqs[1].Method != "POST" || string(reqs[1].Body) != `{"name":"foo"}` {
+		t.Fatalf("Expected POST body, got %+v", reqs[1])
+	}
+
+	s.ResetRequests()
+	if n := len(s.Requests()); n != 0 {
+		t.Fatalf("Expected 0 requests, got %d", n)
+	}
+}
+
+func TestCACert(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	t.Log("not set")
+	{
+		if status, _ := request(t, s, "GET", "/pki/ca.crt", s.Token(), ""); status != http.StatusNotFound {
+			t.Fatalf("Expected 404, got %d", status)
+		}
+	}
+
+	t.Log("set")
+	{
+		s.SetCACert([]byte("cert"))
+		status, body := request(t, s, "GET", "/pki/ca.crt", s.Token(), "")
+		if status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		var cacert struct {
+			Contents string `json:"contents"`
+		}
+		if err := json.Unmarshal(body, &cacert); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cacert.Contents != "cert" {
+			t.Fatalf("Expected 'cert', got '%s'", cacert.Contents)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+	"github.com/pkg/errors"
+)
+
+var checkBundleMetricsCIDRx = regexp.MustCompile(config.CheckBundleMetricsCIDRegex)
+
+// object is an api object as stored (and returned) by the server
+type object map[string]interface{}
+
+// collection holds the objects of one endpoint, e.g. /check_bundle
+type collection struct {
+	prefix string
+	cidRx  *regexp.Regexp
+	// create is false for objects which cannot be created through the api
+	create  bool
+	next    int
+	order   []string
+	objects map[string]object
+}
+
+func newCollections() map[string]*collection {
+	c := make(map[string]*collection)
+	for _, ep := range []struct {
+		prefix string
+		rx     string
+		create bool
+	}{
+		{config.AccountPrefix, config.AccountCIDRegex, false},
+		{config.AcknowledgementPrefix, config.AcknowledgementCIDRegex, true},
+		{config.AlertPrefix, config.AlertCIDRegex, false},
+		{config.AnnotationPrefix, config.AnnotationCIDRegex, true},
+		{config.BrokerPrefix, config.BrokerCIDRegex, false},
+		{config.CheckBundlePrefix, config.CheckBundleCIDRegex, true},
+		{config.CheckPrefix, config.CheckCIDRegex, false},
+		{config.ContactGroupPrefix, config.ContactGroupCIDRegex, true},
+		{config.DashboardPrefix, config.DashboardCIDRegex, true},
+		{config.GraphPrefix, config.GraphCIDRegex, true},
+		{config.MaintenancePrefix, config.MaintenanceCIDRegex, true},
+		{config.MetricClusterPrefix, config.MetricClusterCIDRegex, true},
+		{config.MetricPrefix, config.MetricCIDRegex, false},
+		{config.OutlierReportPrefix, config.OutlierReportCIDRegex, true},
+		{config.ProvisionBrokerPrefix, config.ProvisionBrokerCIDRegex, true},
+		{config.RuleSetGroupPrefix, config.RuleSetGroupCIDRegex, true},
+		{config.RuleSetPrefix, config.RuleSetCIDRegex, true},
+		{config.UserPrefix, config.UserCIDRegex, false},
+		{config.WorksheetPrefix, config.WorksheetCIDRegex, true},
+	} {
+		c[ep.prefix] = &collection{
+			prefix:  ep.prefix,
+			cidRx:   regexp.MustCompile(ep.rx),
+			create:  ep.create,
+			next:    1,
+			objects: make(map[string]object),
+		}
+	}
+	return c
+}
+
+// newCID generates a cid for a new object
+func (c *collection) newCID(obj object) (string, error) {
+	switch c.prefix {
+	case config.GraphPrefix, config.WorksheetPrefix:
+		return c.prefix + "/" + newUUID(), nil
+	case config.ProvisionBrokerPrefix:
+		return c.prefix + "/" + randomHex(4) + "-" + randomHex(4), nil
+	case config.RuleSetPrefix:
+		check, _ := obj["check"].(string)
+		name, _ := obj["metric_name"].(string)
+		if !strings.HasPrefix(check, config.CheckPrefix+"/") || name == "" {
+			return "", errors.New("rule set requires check and metric_name")
+		}
+		return c.prefix + "/" + strings.TrimPrefix(check, config.CheckPrefix+"/") + "_" + name, nil
+	case config.MetricPrefix:
+		return "", errors.New("metric cid cannot be generated")
+	}
+	for {
+		cid := c.prefix + "/" + strconv.Itoa(c.next)
+		c.next++
+		if _, exists := c.objects[cid]; !exists {
+			return cid, nil
+		}
+	}
+}
+
+func (c *collection) put(cid string, obj object) {
+	if _, exists := c.objects[cid]; !exists {
+		c.order = append(c.order, cid)
+	}
+	obj["_cid"] = cid
+	c.objects[cid] = obj
+}
+
+func (c *collection) get(cid string) (object, bool) {
+	if strings.HasSuffix(cid, "/current") && len(c.order) > 0 {
+		cid = c.order[0]
+	}
+	obj, ok := c.objects[cid]
+	return obj, ok
+}
+
+func (c *collection) remove(cid string) {
+	delete(c.objects, cid)
+	for i, id := range c.order {
+		if id == cid {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *collection) list() []object {
+	objs := make([]object, 0, len(c.order))
+	for _, cid := range c.order {
+		objs = append(objs, c.objects[cid])
+	}
+	return objs
+}
+
+// Add stores an object (any value encoding to a json object, e.g. an
+// api.ContactGroup), as is, in the collection for prefix (e.g. /contact_group)
+// and returns its cid. If the object has no _cid one is generated.
+func (s *Server) Add(prefix string, obj interface{}) (string, error) {
+	o, err := toObject(obj)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.collections[prefix]
+	if !ok {
+		return "", errors.Errorf("unknown endpoint (%s)", prefix)
+	}
+
+	cid, _ := o["_cid"].(string)
+	if cid == "" {
+		if cid, err = c.newCID(o); err != nil {
+			return "", err
+		}
+	}
+	if !c.cidRx.MatchString(cid) {
+		return "", errors.Errorf("invalid cid (%s) for %s", cid, prefix)
+	}
+	c.put(cid, o)
+
+	return cid, nil
+}
+
+// AddBroker adds an active, enterprise, httptrap broker instance for the
+// fake broker. The broker cn, ip and port are those of the fake broker and,
+// with TLS, the /pki/ca.crt response is set to its CA certificate.
+func (s *Server) AddBroker(name string, b *brokertest.Broker) (string, error) {
+	u, err := url.Parse(b.URL())
+	if err != nil {
+		return "", errors.Wrap(err, "parsing broker url")
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return "", errors.Wrap(err, "parsing broker port")
+	}
+
+	cid, err := s.Add(config.BrokerPrefix, object{
+		"_name": name,
+		"_type": "enterprise",
+		"_tags": []string{},
+		"_details": []object{{
+			"cn":            b.CN(),
+			"external_host": nil,
+			"external_port": 0,
+			"ipaddress":     u.Hostname(),
+			"minimize":      "0",
+			"modules":       []string{"httptrap", "json"},
+			"port":          port,
+			"skew":          nil,
+			"status":        "active",
+			"version":       nil,
+		}},
+		"_latitude":  nil,
+		"_longitude": nil,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.brokerSchemes[cid] = u.Scheme
+	if ca := b.CACert(); ca != nil {
+		s.caCert = ca
+	}
+	s.mu.Unlock()
+
+	return cid, nil
+}
+
+// Get returns a copy of an object
+func (s *Server) Get(cid string) (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.collectionFor(cid)
+	if c == nil {
+		return nil, false
+	}
+	obj, ok := c.get(cid)
+	if !ok {
+		return nil, false
+	}
+	return copyObject(obj), true
+}
+
+// List returns copies of the objects for prefix (e.g. /check_bundle)
+func (s *Server) List(prefix string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.collections[prefix]
+	if !ok {
+		return nil
+	}
+	objs := []map[string]interface{}{}
+	for _, obj := range c.list() {
+		objs = append(objs, copyObject(obj))
+	}
+	return objs
+}
+
+// Delete removes an object
+func (s *Server) Delete(cid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.collectionFor(cid)
+	if c == nil {
+		return false
+	}
+	if _, ok := c.objects[cid]; !ok {
+		return false
+	}
+	c.remove(cid)
+	return true
+}
+
+// collectionFor returns the collection for a cid or path, e.g. /check_bundle/123
+func (s *Server) collectionFor(cid string) *collection {
+	parts := strings.SplitN(strings.TrimPrefix(cid, "/"), "/", 2)
+	return s.collections["/"+parts[0]]
+}
+
+// route handles api requests, returning the status and the object(s) to respond with
+func (s *Server) route(method, path string, query url.Values, body []byte) (int, interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, result, err := s.handleRequest(method, path, query, body)
+	if err != nil || result == nil {
+		return status, nil, err
+	}
+	// encoded while holding the lock, the stored objects may change once it is released
+	data, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, nil, errors.Wrap(err, "encoding response")
+	}
+	return status, json.RawMessage(data), nil
+}
+
+func (s *Server) handleRequest(method, path string, query url.Values, body []byte) (int, interface{}, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	prefix := "/" + parts[0]
+	id := ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	if prefix == config.CheckBundleMetricsPrefix {
+		return s.checkBundleMetrics(method, path, id, body)
+	}
+
+	c, ok := s.collections[prefix]
+	if !ok {
+		return http.StatusNotFound, nil, errors.Errorf("unknown endpoint (%s)", path)
+	}
+
+	if id == "" {
+		switch method {
+		case "GET":
+			objs := []object{}
+			for _, obj := range c.list() {
+				if matchSearch(obj, query.Get("search")) && matchFilters(obj, query) {
+					objs = append(objs, obj)
+				}
+			}
+			return http.StatusOK, objs, nil
+		case "POST":
+			if !c.create {
+				return http.StatusMethodNotAllowed, nil, errors.Errorf("%s cannot be created", prefix)
+			}
+			return s.create(c, body)
+		}
+		return http.StatusMethodNotAllowed, nil, errors.Errorf("unsupported method %s %s", method, path)
+	}
+
+	if !c.cidRx.MatchString(path) {
+		return http.StatusNotFound, nil, errors.Errorf("invalid cid (%s)", path)
+	}
+	obj, ok := c.get(path)
+	if !ok {
+		return http.StatusNotFound, nil, errors.Errorf("%s not found", path)
+	}
+
+	switch method {
+	case "GET":
+		return http.StatusOK, obj, nil
+	case "PUT":
+		return s.update(c, obj, body)
+	case "DELETE":
+		if prefix == config.CheckBundlePrefix {
+			for _, cid := range stringList(obj["_checks"]) {
+				s.collections[config.CheckPrefix].remove(cid)
+			}
+		}
+		c.remove(obj["_cid"].(string))
+		return http.StatusNoContent, nil, nil
+	}
+	return http.StatusMethodNotAllowed, nil, errors.Errorf("unsupported method %s %s", method, path)
+}
+
+// create handles POST, read-only (_ prefixed) attributes are set by the server
+func (s *Server) create(c *collection, body []byte) (int, interface{}, error) {
+	var obj object
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return http.StatusBadRequest, nil, errors.Wrap(err, "parsing object")
+	}
+	if obj == nil {
+		return http.StatusBadRequest, nil, errors.New("invalid object (null)")
+	}
+	for k := range obj {
+		if strings.HasPrefix(k, "_") {
+			delete(obj, k)
+		}
+	}
+
+	if c.prefix == config.CheckBundlePrefix {
+		if err := s.validateCheckBundle(obj); err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+	}
+
+	cid, err := c.newCID(obj)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	now := time.Now().Unix()
+	obj["_created"] = now
+	obj["_last_modified"] = now
+	c.put(cid, obj)
+
+	if c.prefix == config.CheckBundlePrefix {
+		s.createChecks(obj)
+	}
+
+	return http.StatusOK, obj, nil
+}
+
+// update handles PUT, read-only (_ prefixed) attributes are preserved
+func (s *Server) update(c *collection, current object, body []byte) (int, interface{}, error) {
+	var obj object
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return http.StatusBadRequest, nil, errors.Wrap(err, "parsing object")
+	}
+	if obj == nil {
+		return http.StatusBadRequest, nil, errors.New("invalid object (null)")
+	}
+	for k, v := range current {
+		if strings.HasPrefix(k, "_") {
+			obj[k] = v
+		}
+	}
+
+	if c.prefix == config.CheckBundlePrefix {
+		if err := s.validateCheckBundle(obj); err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		// reserved config options cannot be changed
+		cfg, _ := obj["config"].(map[string]interface{})
+		if cfg == nil {
+			cfg = make(map[string]interface{})
+			obj["config"] = cfg
+		}
+		curCfg, _ := current["config"].(map[string]interface{})
+		if strings.Join(stringList(obj["brokers"]), ",") != strings.Join(stringList(current["brokers"]), ",") {
+			// moving the bundle to other brokers replaces its checks, keeping the secret
+			for _, cid := range stringList(current["_checks"]) {
+				s.collections[config.CheckPrefix].remove(cid)
+			}
+			if secret, _ := cfg[string(config.Secret)].(string); secret == "" {
+				if su, _ := curCfg[string(config.SubmissionURL)].(string); su != "" {
+					cfg[string(config.Secret)] = path.Base(su)
+				}
+			}
+			delete(cfg, string(config.SubmissionURL))
+			delete(cfg, string(config.ReverseSecretKey))
+			s.createChecks(obj)
+		} else {
+			for _, k := range []config.Key{config.SubmissionURL, config.ReverseSecretKey} {
+				if v, ok := curCfg[string(k)]; ok {
+					cfg[string(k)] = v
+				} else {
+					delete(cfg, string(k))
+				}
+			}
+		}
+	}
+
+	obj["_last_modified"] = time.Now().Unix()
+	c.put(current["_cid"].(string), obj)
+
+	return http.StatusOK, obj, nil
+}
+
+func (s *Server) validateCheckBundle(obj object) error {
+	if t, _ := obj["type"].(string); t == "" {
+		return errors.New("check bundle requires type")
+	}
+	if _, ok := obj["metrics"].([]interface{}); !ok {
+		return errors.New("check bundle requires metrics")
+	}
+	brokers := stringList(obj["brokers"])
+	if len(brokers) == 0 {
+		return errors.New("check bundle requires at least one broker")
+	}
+	for _, cid := range brokers {
+		if !s.collections[config.BrokerPrefix].cidRx.MatchString(cid) {
+			return errors.Errorf("invalid broker cid (%s)", cid)
+		}
+		if _, ok := s.collections[config.BrokerPrefix].get(cid); !ok {
+			return errors.Errorf("broker %s not found", cid)
+		}
+	}
+	return nil
+}
+
+// createChecks creates a check per broker for a new check bundle and sets the
+// submission url (httptrap) or reverse secret in the bundle config
+func (s *Server) createChecks(bundle object) {
+	checks := s.collections[config.CheckPrefix]
+	bundleCID := bundle["_cid"].(string)
+	active := true
+	if status, _ := bundle["status"].(string); status != "" && status != "active" {
+		active = false
+	}
+
+	cfg, _ := bundle["config"].(map[string]interface{})
+	if cfg == nil {
+		cfg = make(map[string]interface{})
+		bundle["config"] = cfg
+	}
+	secret, _ := cfg["secret"].(string)
+	if secret == "" {
+		secret = randomHex(8)
+	}
+
+	checkCIDs := []string{}
+	uuids := []string{}
+	reverseURLs := []string{}
+	for i, brokerCID := range stringList(bundle["brokers"]) {
+		uuid := newUUID()
+		cid, _ := checks.newCID(nil)
+		host, port := s.brokerAddress(brokerCID)
+
+		details := object{}
+		if i == 0 {
+			if bundle["type"] == "httptrap" {
+				scheme := s.brokerSchemes[brokerCID]
+				if scheme == "" {
+					scheme = "https"
+				}
+				cfg[string(config.SubmissionURL)] = fmt.Sprintf("%s://%s:%d/module/httptrap/%s/%s", scheme, host, port, uuid, secret)
+				details[string(config.SubmissionURL)] = cfg[string(config.SubmissionURL)]
+			} else {
+				cfg[string(config.ReverseSecretKey)] = randomHex(8)
+			}
+		}
+
+		checks.put(cid, object{
+			"_active":       active,
+			"_broker":       brokerCID,
+			"_check_bundle": bundleCID,
+			"_check_uuid":   uuid,
+			"_details":      details,
+		})
+		checkCIDs = append(checkCIDs, cid)
+		uuids = append(uuids, uuid)
+		reverseURLs = append(reverseURLs, fmt.Sprintf("mtev_reverse://%s:%d/check/%s", host, port, uuid))
+	}
+
+	bundle["_checks"] = checkCIDs
+	bundle["_check_uuids"] = uuids
+	bundle["_reverse_connection_urls"] = reverseURLs
+}
+
+// brokerAddress returns the host and port of the first instance of a broker
+func (s *Server) brokerAddress(cid string) (string, int) {
+	host := "127.0.0.1"
+	port := 43191
+	broker, ok := s.collections[config.BrokerPrefix].get(cid)
+	if !ok {
+		return host, port
+	}
+	details, _ := broker["_details"].([]interface{})
+	if len(details) == 0 {
+		return host, port
+	}
+	detail, _ := details[0].(map[string]interface{})
+	if h, _ := detail["external_host"].(string); h != "" {
+		host = h
+	} else if h, _ := detail["ipaddress"].(string); h != "" {
+		host = h
+	}
+	if p, _ := detail["external_port"].(float64); p != 0 {
+		port = int(p)
+	} else if p, _ := detail["port"].(float64); p != 0 {
+		port = int(p)
+	}
+	return host, port
+}
+
+// checkBundleMetrics handles /check_bundle_metrics, a view of the metrics of a check bundle
+func (s *Server) checkBundleMetrics(method, path, id string, body []byte) (int, interface{}, error) {
+	if !checkBundleMetricsCIDRx.MatchString(path) {
+		return http.StatusNotFound, nil, errors.Errorf("invalid cid (%s)", path)
+	}
+	bundle, ok := s.collections[config.CheckBundlePrefix].get(config.CheckBundlePrefix + "/" + id)
+	if !ok {
+		return http.StatusNotFound, nil, errors.Errorf("%s not found", path)
+	}
+
+	switch method {
+	case "GET":
+	case "PUT":
+		var update struct {
+			Metrics []map[string]interface{} `json:"metrics"`
+		}
+		if err := json.Unmarshal(body, &update); err != nil {
+			return http.StatusBadRequest, nil, errors.Wrap(err, "parsing object")
+		}
+		metrics, _ := bundle["metrics"].([]interface{})
+		for _, m := range update.Metrics {
+			name, _ := m["name"].(string)
+			if name == "" {
+				return http.StatusBadRequest, nil, errors.New("metric requires name")
+			}
+			found := false
+			for _, cur := range metrics {
+				cm, _ := cur.(map[string]interface{})
+				if cm["name"] == name {
+					for k, v := range m {
+						cm[k] = v
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				metrics = append(metrics, m)
+			}
+		}
+		bundle["metrics"] = metrics
+		bundle["_last_modified"] = time.Now().Unix()
+	default:
+		return http.StatusMethodNotAllowed, nil, errors.Errorf("unsupported method %s %s", method, path)
+	}
+
+	return http.StatusOK, object{"_cid": path, "metrics": bundle["metrics"]}, nil
+}
+
+// toObject converts a value to its generic json representation
+func toObject(v interface{}) (object, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding object")
+	}
+	var obj object
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, errors.Wrap(err, "decoding object")
+	}
+	if obj == nil {
+		return nil, errors.New("invalid object (null)")
+	}
+	return obj, nil
+}
+
+func copyObject(obj object) map[string]interface{} {
+	c, _ := toObject(obj)
+	return c
+}
+
+func stringList(v interface{}) []string {
+	var l []string
+	switch items := v.(type) {
+	case []string:
+		l = append(l, items...)
+	case []interface{}:
+		for _, item := range items {
+			if s, ok := item.(string); ok {
+				l = append(l, s)
+			}
+		}
+	}
+	return l
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,461 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apitest
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+	"github.com/circonus-labs/circonus-gometrics/checkmgr"
+)
+
+func newClient(t *testing.T, s *Server) *api.API {
+	client, err := api.New(&api.Config{TokenKey: s.Token(), TokenApp: "apitest", URL: s.URL()})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return client
+}
+
+func waitReady(t *testing.T, cm *checkmgr.CheckManager) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cm.WaitReady(ctx); err != nil {
+		t.Fatalf("Expected check manager to be ready, got '%v'", err)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	t.Log("generated cid")
+	{
+		cid, err := s.Add(config.ContactGroupPrefix, api.ContactGroup{Name: "foo"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cid != "/contact_group/1" {
+			t.Fatalf("Expected /contact_group/1, got '%s'", cid)
+		}
+		obj, ok := s.Get(cid)
+		if !ok {
+			t.Fatal("Expected object")
+		}
+		if obj["name"] != "foo" || obj["_cid"] != cid {
+			t.Fatalf("Expected contact group, got %v", obj)
+		}
+	}
+
+	t.Log("generated uuid cid")
+	{
+		cid, err := s.Add(config.GraphPrefix, api.Graph{Title: "foo"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if !regexp.MustCompile(config.GraphCIDRegex).MatchString(cid) {
+			t.Fatalf("Expected graph cid, got '%s'", cid)
+		}
+	}
+
+	t.Log("supplied cid")
+	{
+		cid, err := s.Add(config.MetricPrefix, map[string]interface{}{"_cid": "/metric/123_foo`bar", "_metric_name": "foo`bar"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cid != "/metric/123_foo`bar" {
+			t.Fatalf("Expected /metric/123_foo`bar, got '%s'", cid)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		if _, err := s.Add(config.BrokerPrefix, map[string]interface{}{"_cid": "/broker/abc"}); err == nil {
+			t.Fatal("Expected error, invalid cid")
+		}
+		if _, err := s.Add(config.MetricPrefix, map[string]interface{}{}); err == nil {
+			t.Fatal("Expected error, metric cid cannot be generated")
+		}
+		if _, err := s.Add("/foo", map[string]interface{}{}); err == nil {
+			t.Fatal("Expected error, unknown endpoint")
+		}
+		if _, err := s.Add(config.AlertPrefix, nil); err == nil {
+			t.Fatal("Expected error, null object")
+		}
+	}
+
+	t.Log("list, delete")
+	{
+		if n := len(s.List(config.ContactGroupPrefix)); n != 1 {
+			t.Fatalf("Expected 1 contact group, got %d", n)
+		}
+		if !s.Delete("/contact_group/1") {
+			t.Fatal("Expected deleted")
+		}
+		if s.Delete("/contact_group/1") {
+			t.Fatal("Expected not found")
+		}
+		if n := len(s.List(config.ContactGroupPrefix)); n != 0 {
+			t.Fatalf("Expected 0 contact groups, got %d", n)
+		}
+		if s.List("/foo") != nil {
+			t.Fatal("Expected nil, unknown endpoint")
+		}
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	client := newClient(t, s)
+
+	t.Log("create")
+	var cg *api.ContactGroup
+	{
+		cg, err = client.CreateContactGroup(&api.ContactGroup{Name: "foo", Tags: []string{"a:b"}})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cg.CID != "/contact_group/1" || cg.Name != "foo" {
+			t.Fatalf("Expected contact group, got %+v", cg)
+		}
+	}
+
+	t.Log("read only attributes ignored")
+	{
+		status, body := request(t, s, "POST", "/contact_group", s.Token(), `{"_cid":"/contact_group/99","name":"bar"}`)
+		if status != http.StatusOK || !strings.Contains(string(body), `"_cid":"/contact_group/2"`) {
+			t.Fatalf("Expected /contact_group/2, got %d %s", status, body)
+		}
+	}
+
+	t.Log("update")
+	{
+		cg.Name = "baz"
+		updated, err := client.UpdateContactGroup(cg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if updated.Name != "baz" || updated.CID != cg.CID {
+			t.Fatalf("Expected updated contact group, got %+v", updated)
+		}
+	}
+
+	t.Log("fetch")
+	{
+		fetched, err := client.FetchContactGroup(api.CIDType(&cg.CID))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if fetched.Name != "baz" {
+			t.Fatalf("Expected baz, got '%s'", fetched.Name)
+		}
+	}
+
+	t.Log("delete")
+	{
+		if _, err := client.DeleteContactGroupByCID(api.CIDType(&cg.CID)); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := client.FetchContactGroup(api.CIDType(&cg.CID)); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Fatalf("Expected 404 error, got '%v'", err)
+		}
+	}
+
+	t.Log("invalid requests")
+	{
+		for _, r := range []struct {
+			method, path, body string
+			status             int
+		}{
+			{"GET", "/foo", "", http.StatusNotFound},
+			{"GET", "/contact_group/abc", "", http.StatusNotFound},
+			{"POST", "/contact_group", "{bad", http.StatusBadRequest},
+			{"POST", "/contact_group", "null", http.StatusBadRequest},
+			{"POST", "/broker", "{}", http.StatusMethodNotAllowed},
+			{"PATCH", "/contact_group", "", http.StatusMethodNotAllowed},
+		} {
+			if status, _ := request(t, s, r.method, r.path, s.Token(), r.body); status != r.status {
+				t.Fatalf("Expected %d for %s %s, got %d", r.status, r.method, r.path, status)
+			}
+		}
+	}
+
+	t.Log("current")
+	{
+		if status, _ := request(t, s, "GET", "/account/current", s.Token(), ""); status != http.StatusNotFound {
+			t.Fatalf("Expected 404, got %d", status)
+		}
+		if _, err := s.Add(config.AccountPrefix, api.Account{Name: "test"}); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		account, err := client.FetchAccount(nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if account.CID != "/account/1" || account.Name != "test" {
+			t.Fatalf("Expected /account/1, got %+v", account)
+		}
+	}
+
+	t.Log("rule set cid")
+	{
+		rs, err := client.CreateRuleSet(&api.RuleSet{CheckCID: "/check/123", MetricName: "foo", MetricType: "numeric"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if rs.CID != "/rule_set/123_foo" {
+			t.Fatalf("Expected /rule_set/123_foo, got '%s'", rs.CID)
+		}
+	}
+}
+
+func TestCheckBundle(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+
+	brokerCID, err := s.AddBroker("test", trap)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	client := newClient(t, s)
+
+	t.Log("invalid broker")
+	{
+		_, err := client.CreateCheckBundle(&api.CheckBundle{
+			Brokers: []string{"/broker/999"},
+			Metrics: []api.CheckBundleMetric{},
+			Type:    "httptrap",
+		})
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Fatalf("Expected 400 error, got '%v'", err)
+		}
+	}
+
+	t.Log("create")
+	var bundle *api.CheckBundle
+	{
+		bundle, err = client.CreateCheckBundle(&api.CheckBundle{
+			Brokers:     []string{brokerCID},
+			Config:      api.CheckBundleConfig{config.Secret: "xyz"},
+			DisplayName: "test",
+			Metrics:     []api.CheckBundleMetric{{Name: "foo", Type: "numeric", Status: "active"}},
+			Status:      "active",
+			Target:      "host",
+			Type:        "httptrap",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if bundle.CID != "/check_bundle/1" || len(bundle.Checks) != 1 || len(bundle.CheckUUIDs) != 1 {
+			t.Fatalf("Expected check bundle with a check, got %+v", bundle)
+		}
+		expect := trap.SubmissionURL(bundle.CheckUUIDs[0], "xyz")
+		if u := bundle.Config[config.SubmissionURL]; u != expect {
+			t.Fatalf("Expected '%s', got '%s'", expect, u)
+		}
+	}
+
+	t.Log("check")
+	{
+		check, err := client.FetchCheck(api.CIDType(&bundle.Checks[0]))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if !check.Active || check.BrokerCID != brokerCID || check.CheckBundleCID != bundle.CID || check.CheckUUID != bundle.CheckUUIDs[0] {
+			t.Fatalf("Expected check, got %+v", check)
+		}
+
+		checks, err := client.SearchChecks(nil, &api.SearchFilterType{"f__check_uuid": []string{check.CheckUUID}})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(*checks) != 1 || (*checks)[0].CID != check.CID {
+			t.Fatalf("Expected 1 check, got %+v", checks)
+		}
+	}
+
+	t.Log("update preserves reserved config")
+	{
+		submissionURL := bundle.Config[config.SubmissionURL]
+		bundle.Config = api.CheckBundleConfig{config.SubmissionURL: "http://example.com"}
+		bundle.Notes = &submissionURL
+		updated, err := client.UpdateCheckBundle(bundle)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if updated.Config[config.SubmissionURL] != submissionURL {
+			t.Fatalf("Expected '%s', got '%s'", submissionURL, updated.Config[config.SubmissionURL])
+		}
+		if updated.Notes == nil || *updated.Notes != submissionURL || len(updated.Checks) != 1 {
+			t.Fatalf("Expected updated check bundle, got %+v", updated)
+		}
+	}
+
+	t.Log("update moving brokers replaces checks")
+	{
+		other, err := brokertest.New(&brokertest.Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer other.Close()
+		otherCID, err := s.AddBroker("other", other)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		oldCheck := bundle.Checks[0]
+		bundle.Brokers = []string{otherCID}
+		moved, err := client.UpdateCheckBundle(bundle)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(moved.Checks) != 1 || moved.Checks[0] == oldCheck {
+			t.Fatalf("Expected a new check, got %+v", moved.Checks)
+		}
+		if _, ok := s.Get(oldCheck); ok {
+			t.Fatalf("Expected %s removed", oldCheck)
+		}
+		expect := other.SubmissionURL(moved.CheckUUIDs[0], "xyz")
+		if u := moved.Config[config.SubmissionURL]; u != expect {
+			t.Fatalf("Expected '%s', got '%s'", expect, u)
+		}
+		bundle = moved
+	}
+
+	t.Log("check bundle metrics")
+	{
+		cid := "/check_bundle_metrics/1"
+		metrics, err := client.FetchCheckBundleMetrics(api.CIDType(&cid))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(metrics.Metrics) != 1 || metrics.Metrics[0].Name != "foo" {
+			t.Fatalf("Expected metric foo, got %+v", metrics)
+		}
+		metrics.Metrics = []api.CheckBundleMetric{
+			{Name: "foo", Type: "numeric", Status: "available"},
+			{Name: "bar", Type: "text", Status: "active"},
+		}
+		if _, err := client.UpdateCheckBundleMetrics(metrics); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		updated, err := client.FetchCheckBundle(api.CIDType(&bundle.CID))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(updated.Metrics) != 2 || updated.Metrics[0].Status != "available" || updated.Metrics[1].Name != "bar" {
+			t.Fatalf("Expected updated metrics, got %+v", updated.Metrics)
+		}
+	}
+
+	t.Log("delete removes checks")
+	{
+		if _, err := client.DeleteCheckBundle(bundle); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if n := len(s.List(config.CheckPrefix)); n != 0 {
+			t.Fatalf("Expected 0 checks, got %d", n)
+		}
+	}
+}
+
+func TestCheckManager(t *testing.T) {
+	s, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{TLS: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+
+	if _, err := s.AddBroker("test", trap); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cfg := &checkmgr.Config{}
+	cfg.API.TokenKey = s.Token()
+	cfg.API.URL = s.URL()
+	cfg.Check.InstanceID = "apitest:test"
+	cfg.Check.SearchTag = "service:apitest"
+
+	t.Log("create check")
+	var submissionURL string
+	{
+		cm, err := checkmgr.New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		waitReady(t, cm)
+		trapURL, err := cm.GetSubmissionURL()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		submissionURL = trapURL.URL.String()
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: trapURL.TLS}}
+		resp, err := client.Post(submissionURL, "application/json", strings.NewReader(`{"foo":{"_type":"L","_value":1}}`))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		resp.Body.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := trap.WaitForSubmissions(ctx, 1); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("find existing check")
+	{
+		cm, err := checkmgr.New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		waitReady(t, cm)
+		trapURL, err := cm.GetSubmissionURL()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if trapURL.URL.String() != submissionURL {
+			t.Fatalf("Expected '%s', got '%s'", submissionURL, trapURL.URL.String())
+		}
+		if n := len(s.List(config.CheckBundlePrefix)); n != 1 {
+			t.Fatalf("Expected 1 check bundle, got %d", n)
+		}
+	}
+}
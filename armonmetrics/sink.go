@@ -0,0 +1,140 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package armonmetrics provides an armon/go-metrics MetricSink which records
+// to circonus-gometrics, so libraries instrumented with go-metrics (e.g.
+// Consul or Vault style code) report through the same check.
+//
+//	IncrCounter[WithLabels]    Add (counters are integers, fractions are carried forward)
+//	SetGauge[WithLabels]       SetGauge
+//	EmitKey                    SetGauge
+//	AddSample[WithLabels]      RecordValue
+//
+// Key parts are joined with the separator (default: "`") and labels are
+// added to the metric name as stream tags.
+//
+//	sink, err := armonmetrics.New(&armonmetrics.Config{Metrics: metrics})
+//	...
+//	gometrics.NewGlobal(gometrics.DefaultConfig("myapp"), sink)
+package armonmetrics
+
+import (
+	"math"
+	"strings"
+	"sync"
+
+	gometrics "github.com/armon/go-metrics"
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSeparator = "`"
+)
+
+// Config options for the sink
+type Config struct {
+	// Metrics the sink records to
+	Metrics *cgm.CirconusMetrics
+	// Separator used to join the parts of a key (default: "`")
+	Separator string
+}
+
+// Sink implements the go-metrics MetricSink interface
+type Sink struct {
+	metrics   *cgm.CirconusMetrics
+	separator string
+
+	mu sync.Mutex
+	// fractional remainders of counters, carried to the next increment
+	remainders map[string]float64
+}
+
+// New returns a new sink
+func New(cfg *Config) (*Sink, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+	if cfg.Metrics == nil {
+		return nil, errors.New("invalid configuration, no metrics (nil)")
+	}
+
+	s := &Sink{
+		metrics:    cfg.Metrics,
+		separator:  defaultSeparator,
+		remainders: make(map[string]float64),
+	}
+
+	if cfg.Separator != "" {
+		s.separator = cfg.Separator
+	}
+
+	return s, nil
+}
+
+// SetGauge sets a gauge
+func (s *Sink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+// SetGaugeWithLabels sets a gauge, labels are stream tags
+func (s *Sink) SetGaugeWithLabels(key []string, val float32, labels []gometrics.Label) {
+	s.metrics.SetGauge(s.metricName(key, labels), float64(val))
+}
+
+// EmitKey sets a gauge
+func (s *Sink) EmitKey(key []string, val float32) {
+	s.metrics.SetGauge(s.metricName(key, nil), float64(val))
+}
+
+// IncrCounter increments a counter
+func (s *Sink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+// IncrCounterWithLabels increments a counter, labels are stream tags.
+// Negative values are ignored, counters cannot be decremented.
+func (s *Sink) IncrCounterWithLabels(key []string, val float32, labels []gometrics.Label) {
+	if val <= 0 {
+		return
+	}
+
+	name := s.metricName(key, labels)
+
+	s.mu.Lock()
+	v := float64(val) + s.remainders[name]
+	whole := math.Floor(v)
+	if rem := v - whole; rem > 0 {
+		s.remainders[name] = rem
+	} else {
+		delete(s.remainders, name)
+	}
+	s.mu.Unlock()
+
+	if whole > 0 {
+		s.metrics.Add(name, uint64(whole))
+	}
+}
+
+// AddSample adds a value to a histogram
+func (s *Sink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+// AddSampleWithLabels adds a value to a histogram, labels are stream tags
+func (s *Sink) AddSampleWithLabels(key []string, val float32, labels []gometrics.Label) {
+	s.metrics.RecordValue(s.metricName(key, labels), float64(val))
+}
+
+func (s *Sink) metricName(key []string, labels []gometrics.Label) string {
+	name := strings.Join(key, s.separator)
+	if len(labels) == 0 {
+		return name
+	}
+	tags := make(cgm.Tags, 0, len(labels))
+	for _, l := range labels {
+		tags = append(tags, cgm.Tag{Category: l.Name, Value: l.Value})
+	}
+	return cgm.MetricNameWithStreamTags(name, tags)
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package armonmetrics
+
+import (
+	"testing"
+
+	gometrics "github.com/armon/go-metrics"
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+var _ gometrics.MetricSink = &Sink{}
+
+func testSink(t *testing.T, cfg *Config) (*Sink, *cgm.CirconusMetrics) {
+	mcfg := &cgm.Config{}
+	mcfg.CheckManager.Check.SubmissionURL = "none"
+	mcfg.Interval = "0"
+
+	m, err := cgm.New(mcfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cfg.Metrics = m
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return s, m
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config")
+	{
+		if _, err := New(nil); err == nil {
+			t.Fatal("Expected error")
+		}
+		expectedError := "invalid configuration, no metrics (nil)"
+		if _, err := New(&Config{}); err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected '%s', got '%v'", expectedError, err)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	s, m := testSink(t, &Config{})
+
+	t.Log("increment, fractions carried")
+	{
+		s.IncrCounter([]string{"consul", "rpc", "request"}, 1)
+		s.IncrCounter([]string{"consul", "rpc", "request"}, 0.5)
+		s.IncrCounter([]string{"consul", "rpc", "request"}, 0.5)
+		s.IncrCounter([]string{"consul", "rpc", "request"}, -1)
+
+		val, err := m.GetCounterTest("consul`rpc`request")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 2 {
+			t.Fatalf("Expected 2, got %d", val)
+		}
+	}
+
+	t.Log("labels")
+	{
+		s.IncrCounterWithLabels([]string{"requests"}, 3, []gometrics.Label{{Name: "method", Value: "GET"}})
+
+		val, err := m.GetCounterTest("requests|ST[method:GET]")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 3 {
+			t.Fatalf("Expected 3, got %d", val)
+		}
+	}
+}
+
+func TestGauge(t *testing.T) {
+	s, m := testSink(t, &Config{Separator: "."})
+
+	t.Log("set gauge")
+	{
+		s.SetGauge([]string{"runtime", "heap"}, 1.5)
+
+		val, err := m.GetGaugeTest("runtime.heap")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val.(float64) != 1.5 {
+			t.Fatalf("Expected 1.5, got %v", val)
+		}
+	}
+
+	t.Log("emit key, labels")
+	{
+		s.EmitKey([]string{"leader"}, 1)
+		s.SetGaugeWithLabels([]string{"peers"}, 3, []gometrics.Label{{Name: "dc", Value: "dc1"}})
+
+		if _, err := m.GetGaugeTest("leader"); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := m.GetGaugeTest("peers|ST[dc:dc1]"); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	t.Log("samples")
+
+	s, m := testSink(t, &Config{})
+
+	s.AddSample([]string{"raft", "commit"}, 12)
+	s.AddSampleWithLabels([]string{"raft", "commit"}, 12, []gometrics.Label{{Name: "peer", Value: "a"}})
+
+	hist, err := m.GetHistogramTest("raft`commit")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(hist) != 1 || hist[0] != "H[1.2e+01]=1" {
+		t.Fatalf("Expected H[1.2e+01]=1, got %v", hist)
+	}
+	if _, err := m.GetHistogramTest("raft`commit|ST[peer:a]"); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package brokertest provides a fake httptrap broker for integration tests
+// and development.
+//
+// The broker accepts submissions (PUT or POST) on /module/httptrap/<uuid>/<secret>
+// and responds like a broker, {"stats":N}, or like circonus-agent, 204 No
+// Content. Submissions are recorded and histograms (H[...]=n bins) can be
+// decoded for assertions. Faults (error responses, slow responses) can be
+// injected at any time.
+//
+// With TLS enabled, the server certificate is signed by a generated CA, the CA
+// is available as PEM (e.g. for Broker.TLSConfig or the API /pki/ca.crt
+// response, which the broker also serves) and the certificate is valid for the
+// CN, localhost, 127.0.0.1 and ::1.
+//
+//	broker, err := brokertest.New(&brokertest.Config{TLS: true})
+//	...
+//	defer broker.Close()
+//	cfg.CheckManager.Check.SubmissionURL = broker.SubmissionURL("uuid", "secret")
+//	cfg.CheckManager.Broker.TLSConfig = broker.TLSConfig()
+package brokertest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAddr = "127.0.0.1:0"
+	defaultCN   = "brokertest"
+	trapPrefix  = "/module/httptrap/"
+)
+
+// Config options for the broker
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// Addr to listen on (default: 127.0.0.1:0, a random port)
+	Addr string
+	// TLS serves https with a certificate signed by a generated CA
+	TLS bool
+	// CN common name of the server certificate (default: brokertest)
+	CN string
+	// Secret required in submission urls (default: any secret is accepted)
+	Secret string
+	// NoContent responds 204 No Content, like circonus-agent, instead of {"stats":N}
+	NoContent bool
+	// MaxSubmissions number of submissions kept, the oldest are dropped (default: 0, all)
+	MaxSubmissions int
+}
+
+// Fault changes how submissions are handled
+type Fault struct {
+	// StatusCode responds with the status (e.g. 500, 503) instead of accepting the submission
+	StatusCode int
+	// Delay before responding (ends early if the client gives up)
+	Delay time.Duration
+	// NoContent responds 204 No Content
+	NoContent bool
+	// Count of submissions the fault applies to (0: until cleared)
+	Count int
+}
+
+// Metric is a submitted metric
+type Metric struct {
+	Type  string      `json:"_type"`
+	Value interface{} `json:"_value"`
+}
+
+// Submission is an accepted submission
+type Submission struct {
+	Time    time.Time
+	UUID    string
+	Secret  string
+	Payload []byte
+	Metrics map[string]Metric
+}
+
+// Broker is a fake httptrap broker
+type Broker struct {
+	Log   *log.Logger
+	Debug bool
+
+	server    *httptest.Server
+	certs     *certs
+	cn        string
+	secret    string
+	noContent bool
+	maxKept   int
+
+	mu          sync.Mutex
+	fault       *Fault
+	attempts    int
+	accepted    int
+	submissions []Submission
+}
+
+// New starts a new broker
+func New(cfg *Config) (*Broker, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+
+	b := &Broker{
+		Debug:     cfg.Debug,
+		Log:       cfg.Log,
+		cn:        defaultCN,
+		secret:    cfg.Secret,
+		noContent: cfg.NoContent,
+		maxKept:   cfg.MaxSubmissions,
+	}
+
+	if b.Debug && b.Log == nil {
+		b.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if b.Log == nil {
+		b.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	if cfg.CN != "" {
+		b.cn = cfg.CN
+	}
+
+	addr := defaultAddr
+	if cfg.Addr != "" {
+		addr = cfg.Addr
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "listening")
+	}
+
+	b.server = httptest.NewUnstartedServer(http.HandlerFunc(b.handle))
+	b.server.Listener.Close()
+	b.server.Listener = ln
+
+	if cfg.TLS {
+		c, err := generateCerts(b.cn)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		b.certs = c
+		b.server.TLS = &tls.Config{Certificates: []tls.Certificate{c.server}}
+		b.server.StartTLS()
+	} else {
+		b.server.Start()
+	}
+
+	return b, nil
+}
+
+// Close stops the broker
+func (b *Broker) Close() {
+	b.server.Close()
+}
+
+// URL returns the base url of the broker, e.g. https://127.0.0.1:43210
+func (b *Broker) URL() string {
+	return b.server.URL
+}
+
+// SubmissionURL returns the httptrap submission url for a check
+func (b *Broker) SubmissionURL(uuid, secret string) string {
+	return b.server.URL + trapPrefix + uuid + "/" + secret
+}
+
+// CN returns the common name of the server certificate
+func (b *Broker) CN() string {
+	return b.cn
+}
+
+// CACert returns the CA certificate (PEM), nil without TLS
+func (b *Broker) CACert() []byte {
+	if b.certs == nil {
+		return nil
+	}
+	return b.certs.caPEM
+}
+
+// TLSConfig returns a client tls configuration trusting the CA, nil without TLS
+func (b *Broker) TLSConfig() *tls.Config {
+	if b.certs == nil {
+		return nil
+	}
+	return &tls.Config{
+		RootCAs:    b.certs.pool,
+		ServerName: b.cn,
+	}
+}
+
+// SetFault injects a fault, replacing any current fault
+func (b *Broker) SetFault(f Fault) {
+	b.mu.Lock()
+	b.fault = &f
+	b.mu.Unlock()
+}
+
+// ClearFault removes the current fault
+func (b *Broker) ClearFault() {
+	b.mu.Lock()
+	b.fault = nil
+	b.mu.Unlock()
+}
+
+// Attempts returns the number of submission requests received, including rejected ones
+func (b *Broker) Attempts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempts
+}
+
+// Accepted returns the number of submissions accepted, including those no
+// longer kept (Config.MaxSubmissions)
+func (b *Broker) Accepted() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.accepted
+}
+
+// Submissions returns the accepted submissions kept, oldest first
+func (b *Broker) Submissions() []Submission {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := make([]Submission, len(b.submissions))
+	copy(s, b.submissions)
+	return s
+}
+
+// SubmissionsSince returns the kept submissions accepted after the first n,
+// oldest first, and the number accepted so far (pass it to the next call)
+func (b *Broker) SubmissionsSince(n int) ([]Submission, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kept := b.accepted - n
+	if kept > len(b.submissions) {
+		kept = len(b.submissions)
+	}
+	if kept < 0 {
+		kept = 0
+	}
+	s := make([]Submission, kept)
+	copy(s, b.submissions[len(b.submissions)-kept:])
+	return s, b.accepted
+}
+
+// Last returns the most recent accepted submission
+func (b *Broker) Last() (Submission, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.submissions) == 0 {
+		return Submission{}, false
+	}
+	return b.submissions[len(b.submissions)-1], true
+}
+
+// WaitForSubmissions waits until at least n submissions have been accepted
+func (b *Broker) WaitForSubmissions(ctx context.Context, n int) error {
+	for {
+		have := b.Accepted()
+		if have >= n {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("waiting for %d submissions, have %d: %s", n, have, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Reset discards the recorded submissions and the attempts and accepted counts
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	b.attempts = 0
+	b.accepted = 0
+	b.submissions = nil
+	b.mu.Unlock()
+}
+
+func (b *Broker) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/pki/ca.crt" && r.Method == "GET" && b.certs != nil {
+		b.respond(w, http.StatusOK, map[string]string{"contents": string(b.certs.caPEM)})
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, trapPrefix) {
+		b.respond(w, http.StatusNotFound, map[string]string{"error": "not found " + r.URL.Path})
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, trapPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		b.respond(w, http.StatusNotFound, map[string]string{"error": "invalid submission url " + r.URL.Path})
+		return
+	}
+	if r.Method != "PUT" && r.Method != "POST" {
+		b.respond(w, http.StatusMethodNotAllowed, map[string]string{"error": "unsupported method " + r.Method})
+		return
+	}
+
+	fault := b.attempt()
+
+	if fault.Delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(fault.Delay):
+		}
+	}
+
+	if fault.StatusCode != 0 {
+		if b.Debug {
+			b.Log.Printf("[DEBUG] fault, responding %d", fault.StatusCode)
+		}
+		b.respond(w, fault.StatusCode, map[string]string{"error": "injected fault"})
+		return
+	}
+
+	if b.secret != "" && parts[1] != b.secret {
+		b.respond(w, http.StatusForbidden, map[string]string{"error": "invalid secret"})
+		return
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		b.respond(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var metrics map[string]Metric
+	if err := json.Unmarshal(payload, &metrics); err != nil {
+		b.respond(w, http.StatusBadRequest, map[string]string{"error": "parsing payload: " + err.Error()})
+		return
+	}
+
+	b.mu.Lock()
+	b.submissions = append(b.submissions, Submission{
+		Time:    time.Now(),
+		UUID:    parts[0],
+		Secret:  parts[1],
+		Payload: payload,
+		Metrics: metrics,
+	})
+	b.accepted++
+	if b.maxKept > 0 && len(b.submissions) > b.maxKept {
+		b.submissions = append([]Submission(nil), b.submissions[len(b.submissions)-b.maxKept:]...)
+	}
+	b.mu.Unlock()
+
+	if b.Debug {
+		b.Log.Printf("[DEBUG] accepted %d metrics for %s", len(metrics), parts[0])
+	}
+
+	if b.noContent || fault.NoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b.respond(w, http.StatusOK, map[string]int{"stats": len(metrics)})
+}
+
+// attempt counts a submission attempt and returns the fault to apply (if any)
+func (b *Broker) attempt() Fault {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attempts++
+
+	if b.fault == nil {
+		return Fault{}
+	}
+	f := *b.fault
+	if b.fault.Count > 0 {
+		b.fault.Count--
+		if b.fault.Count == 0 {
+			b.fault = nil
+		}
+	}
+	return f
+}
+
+func (b *Broker) respond(w http.ResponseWriter, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package brokertest
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func submit(t *testing.T, client *http.Client, url, payload string) (int, string) {
+	req, err := http.NewRequest("PUT", url, strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config (nil)")
+	{
+		if _, err := New(nil); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("invalid addr")
+	{
+		if _, err := New(&Config{Addr: "127.0.0.1:abc"}); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("http")
+	{
+		b, err := New(&Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer b.Close()
+		if !strings.HasPrefix(b.URL(), "http://127.0.0.1:") {
+			t.Fatalf("Expected http url, got '%s'", b.URL())
+		}
+		if b.CACert() != nil || b.TLSConfig() != nil {
+			t.Fatal("Expected no ca cert or tls config")
+		}
+		if u := b.SubmissionURL("abc", "xyz"); u != b.URL()+"/module/httptrap/abc/xyz" {
+			t.Fatalf("Expected submission url, got '%s'", u)
+		}
+	}
+}
+
+func TestSubmission(t *testing.T) {
+	b, err := New(&Config{Secret: "xyz"})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer b.Close()
+
+	payload := `{"foo":{"_type":"L","_value":3},"bar":{"_type":"n","_value":["H[1.0e+00]=2","H[2.5e+01]=1"]},"baz":{"_type":"s","_value":"x"}}`
+
+	t.Log("accepted")
+	{
+		status, body := submit(t, http.DefaultClient, b.SubmissionURL("abc", "xyz"), payload)
+		if status != http.StatusOK || body != `{"stats":3}` {
+			t.Fatalf("Expected 200 {\"stats\":3}, got %d %s", status, body)
+		}
+
+		s, ok := b.Last()
+		if !ok {
+			t.Fatal("Expected a submission")
+		}
+		if s.UUID != "abc" || s.Secret != "xyz" || string(s.Payload) != payload {
+			t.Fatalf("Expected submission, got %+v", s)
+		}
+		if v, err := s.Number("foo"); err != nil || v != 3 {
+			t.Fatalf("Expected 3, got %v (%v)", v, err)
+		}
+		if _, err := s.Number("baz"); err == nil {
+			t.Fatal("Expected error, text metric")
+		}
+		if _, err := s.Number("bar"); err == nil {
+			t.Fatal("Expected error, histogram metric")
+		}
+		bins, err := s.Histogram("bar")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(bins) != 2 || bins[0] != (Bin{Value: 1, Count: 2}) || bins[1] != (Bin{Value: 25, Count: 1}) {
+			t.Fatalf("Expected [{1 2} {25 1}], got %v", bins)
+		}
+		if _, err := s.Histogram("foo"); err == nil {
+			t.Fatal("Expected error, not a histogram")
+		}
+		if _, err := s.Histogram("missing"); err == nil {
+			t.Fatal("Expected error, not found")
+		}
+	}
+
+	t.Log("rejected")
+	{
+		for url, expect := range map[string]int{
+			b.SubmissionURL("abc", "bad"):    http.StatusForbidden,
+			b.URL() + "/module/httptrap/abc": http.StatusNotFound,
+			b.URL() + "/other":               http.StatusNotFound,
+		} {
+			if status, _ := submit(t, http.DefaultClient, url, payload); status != expect {
+				t.Fatalf("Expected %d for %s, got %d", expect, url, status)
+			}
+		}
+		if status, _ := submit(t, http.DefaultClient, b.SubmissionURL("abc", "xyz"), "{bad"); status != http.StatusBadRequest {
+			t.Fatalf("Expected 400, got %d", status)
+		}
+		resp, err := http.Get(b.SubmissionURL("abc", "xyz"))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected 405, got %d", resp.StatusCode)
+		}
+
+		if n := len(b.Submissions()); n != 1 {
+			t.Fatalf("Expected 1 submission, got %d", n)
+		}
+		if n := b.Attempts(); n != 3 {
+			t.Fatalf("Expected 3 attempts, got %d", n)
+		}
+	}
+
+	t.Log("reset")
+	{
+		b.Reset()
+		if _, ok := b.Last(); ok {
+			t.Fatal("Expected no submissions")
+		}
+		if b.Attempts() != 0 || b.Accepted() != 0 {
+			t.Fatal("Expected no attempts")
+		}
+	}
+}
+
+func TestMaxSubmissions(t *testing.T) {
+	b, err := New(&Config{MaxSubmissions: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer b.Close()
+
+	for i := 1; i <= 3; i++ {
+		submit(t, http.DefaultClient, b.SubmissionURL("abc", "xyz"), fmt.Sprintf(`{"foo":{"_type":"L","_value":%d}}`, i))
+	}
+
+	t.Log("oldest dropped")
+	{
+		if n := b.Accepted(); n != 3 {
+			t.Fatalf("Expected 3 accepted, got %d", n)
+		}
+		submissions := b.Submissions()
+		if len(submissions) != 2 {
+			t.Fatalf("Expected 2 submissions, got %d", len(submissions))
+		}
+		if v, _ := submissions[0].Number("foo"); v != 2 {
+			t.Fatalf("Expected 2, got %v", v)
+		}
+		if err := b.WaitForSubmissions(context.Background(), 3); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("since")
+	{
+		submissions, n := b.SubmissionsSince(2)
+		if n != 3 || len(submissions) != 1 {
+			t.Fatalf("Expected 1 of 3, got %d of %d", len(submissions), n)
+		}
+		if v, _ := submissions[0].Number("foo"); v != 3 {
+			t.Fatalf("Expected 3, got %v", v)
+		}
+		if submissions, _ = b.SubmissionsSince(0); len(submissions) != 2 {
+			t.Fatalf("Expected 2 submissions kept, got %d", len(submissions))
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	b, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer b.Close()
+
+	url := b.SubmissionURL("abc", "xyz")
+	payload := `{"foo":{"_type":"L","_value":1}}`
+
+	t.Log("status, count")
+	{
+		b.SetFault(Fault{StatusCode: http.StatusServiceUnavailable, Count: 2})
+		for i := 0; i < 2; i++ {
+			if status, _ := submit(t, http.DefaultClient, url, payload); status != http.StatusServiceUnavailable {
+				t.Fatalf("Expected 503, got %d", status)
+			}
+		}
+		if status, _ := submit(t, http.DefaultClient, url, payload); status != http.StatusOK {
+			t.Fatalf("Expected 200 (fault expired), got %d", status)
+		}
+		if n := len(b.Submissions()); n != 1 {
+			t.Fatalf("Expected 1 submission, got %d", n)
+		}
+	}
+
+	t.Log("no content")
+	{
+		b.SetFault(Fault{NoContent: true})
+		if status, body := submit(t, http.DefaultClient, url, payload); status != http.StatusNoContent || body != "" {
+			t.Fatalf("Expected 204, got %d %s", status, body)
+		}
+		b.ClearFault()
+		if status, _ := submit(t, http.DefaultClient, url, payload); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+	}
+
+	t.Log("delay")
+	{
+		b.SetFault(Fault{Delay: 200 * time.Millisecond})
+		client := &http.Client{Timeout: 50 * time.Millisecond}
+		req, _ := http.NewRequest("PUT", url, strings.NewReader(payload))
+		if _, err := client.Do(req); err == nil {
+			t.Fatal("Expected timeout error")
+		}
+
+		start := time.Now()
+		if status, _ := submit(t, http.DefaultClient, url, payload); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		if d := time.Since(start); d < 200*time.Millisecond {
+			t.Fatalf("Expected delay >= 200ms, got %s", d)
+		}
+		b.ClearFault()
+	}
+
+	t.Log("wait for submissions")
+	{
+		b.Reset()
+		go func() {
+			resp, err := http.Post(url, "application/json", strings.NewReader(payload))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.WaitForSubmissions(ctx, 1); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := b.WaitForSubmissions(ctx, 2); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	b, err := New(&Config{TLS: true, NoContent: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer b.Close()
+
+	t.Log("ca cert")
+	{
+		if !strings.HasPrefix(b.URL(), "https://") {
+			t.Fatalf("Expected https url, got '%s'", b.URL())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b.CACert()) {
+			t.Fatal("Expected valid ca cert pem")
+		}
+
+		// served like the api, {"contents":"..."}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: b.TLSConfig()}}
+		resp, err := client.Get(b.URL() + "/pki/ca.crt")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer resp.Body.Close()
+		var cacert struct {
+			Contents string `json:"contents"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&cacert); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cacert.Contents != string(b.CACert()) {
+			t.Fatalf("Expected ca cert, got '%s'", cacert.Contents)
+		}
+	}
+
+	t.Log("submission, broker cn")
+	{
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: b.TLSConfig()}}
+		if status, _ := submit(t, client, b.SubmissionURL("abc", "xyz"), `{}`); status != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", status)
+		}
+	}
+
+	t.Log("untrusted")
+	{
+		req, _ := http.NewRequest("PUT", b.SubmissionURL("abc", "xyz"), strings.NewReader(`{}`))
+		if _, err := http.DefaultClient.Do(req); err == nil {
+			t.Fatal("Expected certificate error")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package brokertest
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Bin is a histogram bin, Count samples with a value in the bin starting at Value
+type Bin struct {
+	Value float64
+	Count int64
+}
+
+// Number returns the value of a numeric (non histogram) metric
+func (s Submission) Number(name string) (float64, error) {
+	metric, ok := s.Metrics[name]
+	if !ok {
+		return 0, errors.Errorf("metric '%s' not found", name)
+	}
+	switch v := metric.Value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		// 64bit integers may be submitted as strings
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || metric.Type == "s" {
+			return 0, errors.Errorf("metric '%s' is not numeric (%s)", name, metric.Type)
+		}
+		return f, nil
+	}
+	return 0, errors.Errorf("metric '%s' is not numeric (%T)", name, metric.Value)
+}
+
+// Histogram returns the bins of a histogram metric
+func (s Submission) Histogram(name string) ([]Bin, error) {
+	metric, ok := s.Metrics[name]
+	if !ok {
+		return nil, errors.Errorf("metric '%s' not found", name)
+	}
+	values, ok := metric.Value.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("metric '%s' is not a histogram (%T)", name, metric.Value)
+	}
+	bins := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.Errorf("metric '%s' invalid bin (%v)", name, v)
+		}
+		bins = append(bins, s)
+	}
+	return ParseHistogram(bins)
+}
+
+// ParseHistogram parses histogram bins as submitted, e.g.
+// []string{"H[1.2e+01]=3", "H[2.5e+01]=1"}
+func ParseHistogram(bins []string) ([]Bin, error) {
+	parsed := make([]Bin, 0, len(bins))
+	for _, s := range bins {
+		if !strings.HasPrefix(s, "H[") {
+			return nil, errors.Errorf("invalid bin (%s)", s)
+		}
+		end := strings.Index(s, "]=")
+		if end < 0 {
+			return nil, errors.Errorf("invalid bin (%s)", s)
+		}
+		v, err := strconv.ParseFloat(s[2:end], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing bin value (%s)", s)
+		}
+		n, err := strconv.ParseInt(s[end+2:], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing bin count (%s)", s)
+		}
+		parsed = append(parsed, Bin{Value: v, Count: n})
+	}
+	return parsed, nil
+}
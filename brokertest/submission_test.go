@@ -0,0 +1,59 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package brokertest
+
+import (
+	"testing"
+)
+
+func TestParseHistogram(t *testing.T) {
+	t.Log("valid")
+	{
+		bins, err := ParseHistogram([]string{"H[1.0e+00]=2", "H[-3.0e-01]=1"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(bins) != 2 || bins[0] != (Bin{Value: 1, Count: 2}) || bins[1] != (Bin{Value: -0.3, Count: 1}) {
+			t.Fatalf("Expected [{1 2} {-0.3 1}], got %v", bins)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, s := range []string{"", "1.0=1", "H[1.0e+00", "H[abc]=1", "H[1]=x"} {
+			if _, err := ParseHistogram([]string{s}); err == nil {
+				t.Fatalf("Expected error for '%s'", s)
+			}
+		}
+	}
+}
+
+func TestNumber(t *testing.T) {
+	s := Submission{Metrics: map[string]Metric{
+		"a": {Type: "n", Value: 1.5},
+		"b": {Type: "L", Value: "18446744073709551615"},
+	}}
+
+	t.Log("float")
+	{
+		if v, err := s.Number("a"); err != nil || v != 1.5 {
+			t.Fatalf("Expected 1.5, got %v (%v)", v, err)
+		}
+	}
+
+	t.Log("string encoded")
+	{
+		if v, err := s.Number("b"); err != nil || v != 18446744073709551615 {
+			t.Fatalf("Expected 18446744073709551615, got %v (%v)", v, err)
+		}
+	}
+
+	t.Log("missing")
+	{
+		if _, err := s.Number("c"); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
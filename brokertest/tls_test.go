@@ -0,0 +1,50 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package brokertest
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestGenerateCerts(t *testing.T) {
+	t.Log("name cn")
+	{
+		c, err := generateCerts("broker.example.com")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cert, err := x509.ParseCertificate(c.server.Certificate[0])
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cert.Subject.CommonName != "broker.example.com" {
+			t.Fatalf("Expected broker.example.com, got '%s'", cert.Subject.CommonName)
+		}
+		for _, name := range []string{"broker.example.com", "localhost", "127.0.0.1", "::1"} {
+			if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: c.pool}); err != nil {
+				t.Fatalf("Expected %s to verify, got '%v'", name, err)
+			}
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: "other.example.com", Roots: c.pool}); err == nil {
+			t.Fatal("Expected other.example.com not to verify")
+		}
+	}
+
+	t.Log("ip cn")
+	{
+		c, err := generateCerts("10.1.2.3")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cert, err := x509.ParseCertificate(c.server.Certificate[0])
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: "10.1.2.3", Roots: c.pool}); err != nil {
+			t.Fatalf("Expected 10.1.2.3 to verify, got '%v'", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cgmtest provides utilities for testing code instrumented with
+// circonus-gometrics.
+//
+// New returns a CirconusMetrics instance which needs no API token or trap
+// URL, submissions go to an in-process trap which accepts everything. A
+// Recorder, registered as a sink, captures the metrics of each flush (including
+// func metrics and collectors), and provides assertions on them.
+//
+//	func TestHandler(t *testing.T) {
+//		m, err := cgmtest.New(nil)
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		defer m.Close()
+//
+//		handler := newHandler(m.CirconusMetrics)
+//		...
+//		m.Flush()
+//
+//		m.Recorder.AssertCounter(t, "requests", 3)
+//		m.Recorder.AssertHistogramSample(t, "latency", 0, 0.5)
+//		m.Recorder.AssertStreamTags(t, "requests", cgm.Tags{{Category: "code", Value: "200"}})
+//	}
+package cgmtest
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/pkg/errors"
+)
+
+// RecorderName is the name the Recorder of New is registered (as a sink) with
+const RecorderName = "cgmtest"
+
+// Metrics is a CirconusMetrics instance for tests
+type Metrics struct {
+	*cgm.CirconusMetrics
+
+	// Recorder captures the metrics of each flush
+	Recorder *Recorder
+
+	trap *httptest.Server
+}
+
+// New returns a new CirconusMetrics instance for tests. The configuration is
+// optional, the submission url is always replaced with the in-process trap
+// and the API token is cleared. When no Interval is set, automatic flushing
+// is disabled ("0"), call Flush to capture the metrics.
+func New(cfg *cgm.Config) (*Metrics, error) {
+	c := cgm.Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+
+	trap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	c.CheckManager.API.TokenKey = ""
+	c.CheckManager.Check.SubmissionURL = trap.URL + "/module/httptrap/cgmtest/secret"
+	if c.Interval == "" {
+		c.Interval = "0"
+	}
+
+	metrics, err := cgm.New(&c)
+	if err != nil {
+		trap.Close()
+		return nil, errors.Wrap(err, "creating metrics")
+	}
+
+	rec := NewRecorder()
+	metrics.RegisterSink(RecorderName, rec)
+
+	return &Metrics{
+		CirconusMetrics: metrics,
+		Recorder:        rec,
+		trap:            trap,
+	}, nil
+}
+
+// Flush submits the metrics and waits for the Recorder (and any other sink)
+// to capture them
+func (m *Metrics) Flush() {
+	m.CirconusMetrics.Flush()
+	m.WaitSinks()
+}
+
+// Close stops the in-process trap
+func (m *Metrics) Close() {
+	m.trap.Close()
+}
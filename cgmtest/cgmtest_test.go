@@ -0,0 +1,73 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cgmtest
+
+import (
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+func TestNew(t *testing.T) {
+	t.Log("no config")
+	{
+		m, err := New(nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer m.Close()
+
+		if !m.Ready() {
+			t.Fatal("Expected check to be ready")
+		}
+
+		m.Increment("requests")
+		m.SetGaugeFunc("goroutines", func() int64 { return 5 })
+		m.Flush()
+
+		if n := len(m.Recorder.Flushes()); n != 1 {
+			t.Fatalf("Expected 1 flush, got %d", n)
+		}
+		m.Recorder.AssertCounter(t, "requests", 1)
+		m.Recorder.AssertGauge(t, "goroutines", 5)
+	}
+
+	t.Log("config, api token ignored")
+	{
+		cfg := &cgm.Config{}
+		cfg.CheckManager.API.TokenKey = "abc"
+		cfg.CheckManager.Check.SubmissionURL = "https://example.com/not/used"
+		cfg.ResetCounters = "false"
+		m, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer m.Close()
+
+		if cfg.CheckManager.API.TokenKey != "abc" {
+			t.Fatal("Expected config to be unchanged")
+		}
+
+		m.Increment("requests")
+		m.Flush()
+		m.Increment("requests")
+		m.Flush()
+
+		if v, err := m.GetCounterTest("requests"); err != nil || v != 2 {
+			t.Fatalf("Expected 2 (not reset), got %d (%v)", v, err)
+		}
+		if v, ok := m.Recorder.Last()["requests"]; !ok || v.Value != uint64(2) {
+			t.Fatalf("Expected 2, got %v", v)
+		}
+	}
+
+	t.Log("invalid config")
+	{
+		cfg := &cgm.Config{Interval: "abc"}
+		if _, err := New(cfg); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cgmtest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/pkg/errors"
+)
+
+// Flush is the metrics packaged at one flush
+type Flush struct {
+	Timestamp time.Time
+	Metrics   cgm.Metrics
+}
+
+// Bin is a histogram bin, Count samples with a value in the bin starting at Value
+type Bin struct {
+	Value float64
+	Count int64
+}
+
+// Recorder captures the metrics of each flush, it implements circonusgometrics.Sink
+type Recorder struct {
+	mu      sync.Mutex
+	flushes []Flush
+}
+
+// NewRecorder returns a new recorder, register it as a sink to capture flushes
+// (sinks are written in the background, see CirconusMetrics.WaitSinks)
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Write records the metrics of a flush
+func (r *Recorder) Write(ts time.Time, metrics cgm.Metrics) error {
+	m := make(cgm.Metrics, len(metrics))
+	for name, metric := range metrics {
+		m[name] = metric
+	}
+
+	r.mu.Lock()
+	r.flushes = append(r.flushes, Flush{Timestamp: ts, Metrics: m})
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Flushes returns the recorded flushes, oldest first
+func (r *Recorder) Flushes() []Flush {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	flushes := make([]Flush, len(r.flushes))
+	copy(flushes, r.flushes)
+	return flushes
+}
+
+// Last returns the metrics of the most recent flush (nil if none)
+func (r *Recorder) Last() cgm.Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.flushes) == 0 {
+		return nil
+	}
+	return r.flushes[len(r.flushes)-1].Metrics
+}
+
+// Reset discards the recorded flushes
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.flushes = nil
+	r.mu.Unlock()
+}
+
+// Counter returns the sum of a counter over all recorded flushes, which is
+// the total increment when counters are reset at each flush (the default)
+func (r *Recorder) Counter(name string) (uint64, bool) {
+	var total uint64
+	found := false
+	for _, f := range r.Flushes() {
+		metric, ok := f.Metrics[name]
+		if !ok || metric.Type != "L" {
+			continue
+		}
+		if v, ok := metric.Value.(uint64); ok {
+			total += v
+			found = true
+		}
+	}
+	return total, found
+}
+
+// Gauge returns the most recently recorded value of a gauge (or any other numeric metric)
+func (r *Recorder) Gauge(name string) (interface{}, bool) {
+	flushes := r.Flushes()
+	for i := len(flushes) - 1; i >= 0; i-- {
+		metric, ok := flushes[i].Metrics[name]
+		if !ok || metric.Type == "s" || isHistogram(metric) {
+			continue
+		}
+		return metric.Value, true
+	}
+	return nil, false
+}
+
+// Histogram returns the bins of a histogram merged over all recorded flushes, sorted by value
+func (r *Recorder) Histogram(name string) ([]Bin, bool) {
+	counts := make(map[float64]int64)
+	found := false
+	for _, f := range r.Flushes() {
+		metric, ok := f.Metrics[name]
+		if !ok || !isHistogram(metric) {
+			continue
+		}
+		found = true
+		for _, s := range metric.Value.([]string) {
+			v, n, err := parseBin(s)
+			if err != nil {
+				continue
+			}
+			counts[v] += n
+		}
+	}
+
+	bins := make([]Bin, 0, len(counts))
+	for v, n := range counts {
+		bins = append(bins, Bin{Value: v, Count: n})
+	}
+	sort.Slice(bins, func(i, j int) bool { return bins[i].Value < bins[j].Value })
+
+	return bins, found
+}
+
+// Names returns the names of all recorded metrics whose base name (without
+// stream tags) is name, sorted
+func (r *Recorder) Names(name string) []string {
+	seen := make(map[string]bool)
+	for _, f := range r.Flushes() {
+		for n := range f.Metrics {
+			if baseName(n) == name {
+				seen[n] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AssertCounter fails the test unless counter name was incremented by n
+// (the sum over all recorded flushes)
+func (r *Recorder) AssertCounter(t testing.TB, name string, n uint64) {
+	t.Helper()
+	v, ok := r.Counter(name)
+	if !ok {
+		t.Fatalf("Expected counter '%s', not found", name)
+	}
+	if v != n {
+		t.Fatalf("Expected counter '%s' incremented by %d, got %d", name, n, v)
+	}
+}
+
+// AssertGauge fails the test unless the last value of gauge name is val,
+// numeric values are compared as float64
+func (r *Recorder) AssertGauge(t testing.TB, name string, val interface{}) {
+	t.Helper()
+	v, ok := r.Gauge(name)
+	if !ok {
+		t.Fatalf("Expected gauge '%s', not found", name)
+	}
+	want, wantOK := toFloat(val)
+	got, gotOK := toFloat(v)
+	if wantOK && gotOK {
+		if want != got {
+			t.Fatalf("Expected gauge '%s' %v, got %v", name, val, v)
+		}
+		return
+	}
+	if fmt.Sprintf("%v", v) != fmt.Sprintf("%v", val) {
+		t.Fatalf("Expected gauge '%s' %v, got %v", name, val, v)
+	}
+}
+
+// AssertHistogramSample fails the test unless histogram name has at least
+// one sample in a bin with a value within [lo, hi]
+func (r *Recorder) AssertHistogramSample(t testing.TB, name string, lo, hi float64) {
+	t.Helper()
+	bins, ok := r.Histogram(name)
+	if !ok {
+		t.Fatalf("Expected histogram '%s', not found", name)
+	}
+	for _, bin := range bins {
+		if bin.Count > 0 && bin.Value >= lo && bin.Value <= hi {
+			return
+		}
+	}
+	t.Fatalf("Expected histogram '%s' to have a sample within [%v, %v], got %v", name, lo, hi, bins)
+}
+
+// AssertStreamTags fails the test unless a metric named name was recorded
+// with (at least) the stream tags
+func (r *Recorder) AssertStreamTags(t testing.TB, name string, tags cgm.Tags) {
+	t.Helper()
+	names := r.Names(name)
+	if len(names) == 0 {
+		t.Fatalf("Expected metric '%s', not found", name)
+	}
+	for _, n := range names {
+		if hasStreamTags(n, tags) {
+			return
+		}
+	}
+	t.Fatalf("Expected metric '%s' with stream tags %v, got %v", name, tags, names)
+}
+
+// AssertNoMetric fails the test if a metric named name (with any stream tags) was recorded
+func (r *Recorder) AssertNoMetric(t testing.TB, name string) {
+	t.Helper()
+	if names := r.Names(name); len(names) > 0 {
+		t.Fatalf("Expected no metric '%s', got %v", name, names)
+	}
+}
+
+// isHistogram reports whether the metric is a histogram (bins as strings)
+func isHistogram(metric cgm.Metric) bool {
+	_, ok := metric.Value.([]string)
+	return metric.Type == "n" && ok
+}
+
+// parseBin parses a histogram bin, H[1.2e+01]=3
+func parseBin(s string) (float64, int64, error) {
+	if !strings.HasPrefix(s, "H[") {
+		return 0, 0, errors.Errorf("invalid bin (%s)", s)
+	}
+	end := strings.Index(s, "]=")
+	if end < 0 {
+		return 0, 0, errors.Errorf("invalid bin (%s)", s)
+	}
+	v, err := strconv.ParseFloat(s[2:end], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := strconv.ParseInt(s[end+2:], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return v, n, nil
+}
+
+// baseName returns the metric name without stream tags
+func baseName(name string) string {
+	if i := strings.Index(name, "|ST["); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// hasStreamTags reports whether the stream tags of name include all tags
+func hasStreamTags(name string, tags cgm.Tags) bool {
+	i := strings.Index(name, "|ST[")
+	if i < 0 {
+		return len(tags) == 0
+	}
+	have := make(map[string]bool)
+	for _, st := range strings.Split(strings.TrimSuffix(name[i+4:], "]"), ",") {
+		have[st] = true
+	}
+	for _, tag := range tags {
+		// encode the tag the same way it is encoded in metric names
+		st := strings.TrimSuffix(strings.TrimPrefix(cgm.MetricNameWithStreamTags("", cgm.Tags{tag}), "|ST["), "]")
+		if st != "" && !have[st] {
+			return false
+		}
+	}
+	return true
+}
+
+// toFloat converts a numeric gauge value to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cgmtest
+
+import (
+	"testing"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+func testRecorder() *Recorder {
+	r := NewRecorder()
+	r.Write(time.Now(), cgm.Metrics{
+		"requests":                     {Type: "L", Value: uint64(2)},
+		"requests|ST[code:200]":        {Type: "L", Value: uint64(1)},
+		"temp":                         {Type: "n", Value: 21.5},
+		"latency":                      {Type: "n", Value: []string{"H[1.0e-01]=2", "H[2.0e+00]=1"}},
+		"version":                      {Type: "s", Value: "1.0"},
+		`path|ST[b"L2EgYg==":x,env:a]`: {Type: "i", Value: 3},
+	})
+	r.Write(time.Now(), cgm.Metrics{
+		"requests": {Type: "L", Value: uint64(3)},
+		"temp":     {Type: "n", Value: 22.0},
+		"latency":  {Type: "n", Value: []string{"H[1.0e-01]=1"}},
+	})
+	return r
+}
+
+func TestRecorder(t *testing.T) {
+	t.Log("flushes")
+	{
+		r := testRecorder()
+		if n := len(r.Flushes()); n != 2 {
+			t.Fatalf("Expected 2 flushes, got %d", n)
+		}
+		if n := len(r.Last()); n != 3 {
+			t.Fatalf("Expected 3 metrics, got %d", n)
+		}
+		r.Reset()
+		if r.Last() != nil {
+			t.Fatal("Expected no flushes")
+		}
+	}
+
+	t.Log("counter")
+	{
+		r := testRecorder()
+		if v, ok := r.Counter("requests"); !ok || v != 5 {
+			t.Fatalf("Expected 5, got %d", v)
+		}
+		if _, ok := r.Counter("temp"); ok {
+			t.Fatal("Expected temp not to be a counter")
+		}
+		r.AssertCounter(t, "requests", 5)
+	}
+
+	t.Log("gauge")
+	{
+		r := testRecorder()
+		if v, ok := r.Gauge("temp"); !ok || v != 22.0 {
+			t.Fatalf("Expected 22, got %v", v)
+		}
+		if _, ok := r.Gauge("latency"); ok {
+			t.Fatal("Expected latency not to be a gauge")
+		}
+		if _, ok := r.Gauge("version"); ok {
+			t.Fatal("Expected version not to be a gauge")
+		}
+		r.AssertGauge(t, "temp", 22)
+		r.AssertGauge(t, `path|ST[b"L2EgYg==":x,env:a]`, int64(3))
+	}
+
+	t.Log("histogram")
+	{
+		r := testRecorder()
+		bins, ok := r.Histogram("latency")
+		if !ok {
+			t.Fatal("Expected histogram")
+		}
+		if len(bins) != 2 || bins[0] != (Bin{Value: 0.1, Count: 3}) || bins[1] != (Bin{Value: 2, Count: 1}) {
+			t.Fatalf("Expected [{0.1 3} {2 1}], got %v", bins)
+		}
+		r.AssertHistogramSample(t, "latency", 1, 5)
+		r.AssertHistogramSample(t, "latency", 0, 0.1)
+	}
+
+	t.Log("stream tags")
+	{
+		r := testRecorder()
+		if names := r.Names("requests"); len(names) != 2 {
+			t.Fatalf("Expected 2 names, got %v", names)
+		}
+		r.AssertStreamTags(t, "requests", cgm.Tags{{Category: "code", Value: "200"}})
+		r.AssertStreamTags(t, "path", cgm.Tags{{Category: "/a b", Value: "x"}})
+		r.AssertStreamTags(t, "path", cgm.Tags{{Category: "env", Value: "a"}, {Category: "/a b", Value: "x"}})
+		r.AssertNoMetric(t, "missing")
+
+		if hasStreamTags("path|ST[env:a]", cgm.Tags{{Category: "env", Value: "b"}}) {
+			t.Fatal("Expected env:b not to match")
+		}
+		if hasStreamTags("path", cgm.Tags{{Category: "env", Value: "a"}}) {
+			t.Fatal("Expected no stream tags not to match")
+		}
+	}
+}
+
+func TestParseBin(t *testing.T) {
+	t.Log("valid")
+	{
+		v, n, err := parseBin("H[-1.5e+02]=7")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if v != -150 || n != 7 {
+			t.Fatalf("Expected -150 7, got %v %d", v, n)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, s := range []string{"", "1.0=1", "H[1.0e+00", "H[abc]=1", "H[1]=x"} {
+			if _, _, err := parseBin(s); err == nil {
+				t.Fatalf("Expected error for '%s'", s)
+			}
+		}
+	}
+}
@@ -5,11 +5,12 @@
 package checkmgr
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/url"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -39,6 +40,9 @@ func (cm *CheckManager) getBroker() (*api.Broker, error) {
 	}
 	broker, err := cm.selectBroker()
 	if err != nil {
+		if IsPermanent(err) {
+			return nil, permanent(fmt.Errorf("[ERROR] Unable to fetch suitable broker %s", err))
+		}
 		return nil, fmt.Errorf("[ERROR] Unable to fetch suitable broker %s", err)
 	}
 	return broker, nil
@@ -78,6 +82,14 @@ func (cm *CheckManager) getBrokerCN(broker *api.Broker, submissionURL api.URLTyp
 // Select a broker for use when creating a check, if a specific broker
 // was not specified.
 func (cm *CheckManager) selectBroker() (*api.Broker, error) {
+	ctx, cancel := cm.shutdownContext()
+	defer cancel()
+	return cm.selectBrokerExcluding(ctx, nil)
+}
+
+// selectBrokerExcluding selects a broker other than the excluded brokers (by
+// cid), probing stops when ctx is done
+func (cm *CheckManager) selectBrokerExcluding(ctx context.Context, exclude map[string]bool) (*api.Broker, error) {
 	var brokerList *[]api.Broker
 	var err error
 	enterpriseType := "enterprise"
@@ -98,16 +110,29 @@ func (cm *CheckManager) selectBroker() (*api.Broker, error) {
 	}
 
 	if len(*brokerList) == 0 {
-		return nil, fmt.Errorf("zero brokers found")
+		return nil, permanent(fmt.Errorf("zero brokers found"))
 	}
 
-	validBrokers := make(map[string]api.Broker)
+	validBrokers := make(map[string]BrokerCandidate)
 	haveEnterprise := false
 
+	if len(exclude) > 0 {
+		brokers := make([]api.Broker, 0, len(*brokerList))
+		for _, broker := range *brokerList {
+			if !exclude[broker.CID] {
+				brokers = append(brokers, broker)
+			}
+		}
+		if len(brokers) == 0 {
+			return nil, fmt.Errorf("found %d broker(s), zero are not excluded", len(*brokerList))
+		}
+		brokerList = &brokers
+	}
+
+	rtts := cm.probeBrokers(ctx, *brokerList)
 	for _, broker := range *brokerList {
-		broker := broker
-		if cm.isValidBroker(&broker) {
-			validBrokers[broker.CID] = broker
+		if rtt, ok := rtts[broker.CID]; ok {
+			validBrokers[broker.CID] = BrokerCandidate{Broker: broker, RTT: rtt}
 			if broker.Type == enterpriseType {
 				haveEnterprise = true
 			}
@@ -116,7 +141,7 @@ func (cm *CheckManager) selectBroker() (*api.Broker, error) {
 
 	if haveEnterprise { // eliminate non-enterprise brokers from valid brokers
 		for k, v := range validBrokers {
-			if v.Type != enterpriseType {
+			if v.Broker.Type != enterpriseType {
 				delete(validBrokers, k)
 			}
 		}
@@ -126,11 +151,24 @@ func (cm *CheckManager) selectBroker() (*api.Broker, error) {
 		return nil, fmt.Errorf("found %d broker(s), zero are valid", len(*brokerList))
 	}
 
-	validBrokerKeys := reflect.ValueOf(validBrokers).MapKeys()
-	selectedBroker := validBrokers[validBrokerKeys[rand.Intn(len(validBrokerKeys))].String()]
+	candidates := make([]BrokerCandidate, 0, len(validBrokers))
+	for _, c := range validBrokers {
+		candidates = append(candidates, c)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Broker.CID < candidates[j].Broker.CID })
+
+	selector := cm.brokerSelector
+	if selector == nil {
+		selector = selectRandom
+	}
+	idx, reason := selector(candidates)
+	if idx < 0 || idx >= len(candidates) {
+		return nil, fmt.Errorf("broker selector returned invalid index %d for %d broker(s)", idx, len(candidates))
+	}
+	selectedBroker := candidates[idx].Broker
 
 	if cm.Debug {
-		cm.Log.Printf("[DEBUG] Selected broker '%s'\n", selectedBroker.Name)
+		cm.Log.Printf("[DEBUG] Selected broker '%s' (%s)\n", selectedBroker.Name, reason)
 	}
 
 	return &selectedBroker, nil
@@ -139,6 +177,12 @@ func (cm *CheckManager) selectBroker() (*api.Broker, error) {
 
 // Verify broker supports the check type to be used
 func (cm *CheckManager) brokerSupportsCheckType(checkType CheckTypeType, details *api.BrokerDetail) bool {
+	return supportsCheckType(checkType, details)
+}
+
+// supportsCheckType reports whether a broker instance has the module for the
+// check type (or its base type, e.g. json for json:nad) loaded
+func supportsCheckType(checkType CheckTypeType, details *api.BrokerDetail) bool {
 
 	baseType := string(checkType)
 
@@ -162,81 +206,39 @@ func (cm *CheckManager) brokerSupportsCheckType(checkType CheckTypeType, details
 
 }
 
-// Is the broker valid (active, supports check type, and reachable)
-func (cm *CheckManager) isValidBroker(broker *api.Broker) bool {
+// brokerAddress returns the host and port to connect to for a broker instance,
+// host is blank if the instance has no ip or external host
+func brokerAddress(detail *api.BrokerDetail) (string, string) {
 	var brokerHost string
 	var brokerPort string
 
-	if broker.Type != "circonus" && broker.Type != "enterprise" {
-		return false
-	}
-
-	valid := false
-
-	for _, detail := range broker.Details {
-		detail := detail
-
-		// broker must be active
-		if detail.Status != statusActive {
-			if cm.Debug {
-				cm.Log.Printf("[DEBUG] Broker '%s' is not active.\n", broker.Name)
-			}
-			continue
-		}
-
-		// broker must have module loaded for the check type to be used
-		if !cm.brokerSupportsCheckType(cm.checkType, &detail) {
-			if cm.Debug {
-				cm.Log.Printf("[DEBUG] Broker '%s' does not support '%s' checks.\n", broker.Name, cm.checkType)
-			}
-			continue
-		}
-
-		if detail.ExternalPort != 0 {
-			brokerPort = strconv.Itoa(int(detail.ExternalPort))
+	if detail.ExternalPort != 0 {
+		brokerPort = strconv.Itoa(int(detail.ExternalPort))
+	} else {
+		if detail.Port != nil && *detail.Port != 0 {
+			brokerPort = strconv.Itoa(int(*detail.Port))
 		} else {
-			if detail.Port != nil && *detail.Port != 0 {
-				brokerPort = strconv.Itoa(int(*detail.Port))
-			} else {
-				brokerPort = "43191"
-			}
-		}
-
-		if detail.ExternalHost != nil && *detail.ExternalHost != "" {
-			brokerHost = *detail.ExternalHost
-		} else if detail.IP != nil && *detail.IP != "" {
-			brokerHost = *detail.IP
-		}
-
-		if brokerHost == "" {
-			cm.Log.Printf("[WARN] Broker '%s' instance %s has no IP or external host set", broker.Name, detail.CN)
-			continue
+			brokerPort = "43191"
 		}
+	}
 
-		if brokerHost == "trap.noit.circonus.net" && brokerPort != "443" {
-			brokerPort = "443"
-		}
+	if detail.ExternalHost != nil && *detail.ExternalHost != "" {
+		brokerHost = *detail.ExternalHost
+	} else if detail.IP != nil && *detail.IP != "" {
+		brokerHost = *detail.IP
+	}
 
-		retries := 5
-		for attempt := 1; attempt <= retries; attempt++ {
-			// broker must be reachable and respond within designated time
-			conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%s", brokerHost, brokerPort), cm.brokerMaxResponseTime)
-			if err == nil {
-				conn.Close()
-				valid = true
-				break
-			}
+	if brokerHost == "trap.noit.circonus.net" && brokerPort != "443" {
+		brokerPort = "443"
+	}
 
-			cm.Log.Printf("[WARN] Broker '%s' unable to connect, %v. Retrying in 2 seconds, attempt %d of %d.", broker.Name, err, attempt, retries)
-			time.Sleep(2 * time.Second)
-		}
+	return brokerHost, brokerPort
+}
 
-		if valid {
-			if cm.Debug {
-				cm.Log.Printf("[DEBUG] Broker '%s' is valid\n", broker.Name)
-			}
-			break
-		}
-	}
+// Is the broker valid (active, supports check type, and reachable)
+func (cm *CheckManager) isValidBroker(broker *api.Broker) bool {
+	ctx, cancel := cm.shutdownContext()
+	defer cancel()
+	_, valid := cm.probeBrokers(ctx, []api.Broker{*broker})[broker.CID]
 	return valid
 }
@@ -41,14 +41,13 @@ type CACert struct {
 	Contents string `json:"contents"`
 }
 
-// loadCACert loads the CA cert for the broker designated by the submission url
+// loadCACert loads the CA cert for the broker designated by the submission url,
+// trapmu must be held
 func (cm *CheckManager) loadCACert() error {
 	if cm.certPool != nil {
 		return nil
 	}
 
-	cm.certPool = x509.NewCertPool()
-
 	var cert []byte
 	var err error
 
@@ -65,7 +64,9 @@ func (cm *CheckManager) loadCACert() error {
 		cert = circonusCA
 	}
 
+	cm.certPool = x509.NewCertPool()
 	cm.certPool.AppendCertsFromPEM(cert)
+	cm.caPEM = cert
 
 	return nil
 }
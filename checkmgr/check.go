@@ -19,7 +19,11 @@ import (
 	"github.com/circonus-labs/circonus-gometrics/api/config"
 )
 
-// UpdateCheck determines if the check needs to be updated (new metrics, tags, etc.)
+// UpdateCheck queues check metric changes (new metrics to activate, metric
+// tags) and sends them, batched, through the check bundle metrics endpoint.
+// Updates are at most CheckConfig.MetricUpdateBatch metrics and at least
+// CheckConfig.MetricUpdateInterval apart, changes made in between are sent
+// with the next update.
 func (cm *CheckManager) UpdateCheck(newMetrics map[string]*api.CheckBundleMetric) {
 	// only if check manager is enabled
 	if !cm.enabled {
@@ -27,61 +31,60 @@ func (cm *CheckManager) UpdateCheck(newMetrics map[string]*api.CheckBundleMetric
 	}
 
 	// only if checkBundle has been populated
-	if cm.checkBundle == nil {
+	cm.cbmu.Lock()
+	haveBundle := cm.checkBundle != nil
+	cm.cbmu.Unlock()
+	if !haveBundle {
 		return
 	}
 
+	cm.queueMetricUpdates(newMetrics)
+
+	cm.metricupdmu.Lock()
+	defer cm.metricupdmu.Unlock()
+
 	// only if there is *something* to update
-	if !cm.forceCheckUpdate && len(newMetrics) == 0 && len(cm.metricTags) == 0 {
+	if len(cm.pendingMetrics) == 0 {
 		return
 	}
 
-	// refresh check bundle (in case there were changes made by other apps or in UI)
-	cid := cm.checkBundle.CID
-	checkBundle, err := cm.apih.FetchCheckBundle(api.CIDType(&cid))
-	if err != nil {
-		cm.Log.Printf("[ERROR] unable to fetch up-to-date check bundle %v", err)
-		return
+	if !cm.lastMetricUpdate.IsZero() && time.Since(cm.lastMetricUpdate) < cm.metricUpdateInterval {
+		return // debounce, sent with a later update
 	}
-	cm.cbmu.Lock()
-	cm.checkBundle = checkBundle
-	cm.cbmu.Unlock()
 
-	// check metric_limit and see if it’s 0, if so, don't even bother to try to update the check.
-
-	cm.addNewMetrics(newMetrics)
+	cm.sendMetricUpdates()
+}
 
-	if len(cm.metricTags) > 0 {
-		// note: if a tag has been added (queued) for a metric which never gets sent
-		//       the tags will be discarded. (setting tags does not *create* metrics.)
-		for metricName, metricTags := range cm.metricTags {
-			for metricIdx, metric := range cm.checkBundle.Metrics {
-				if metric.Name == metricName {
-					cm.checkBundle.Metrics[metricIdx].Tags = metricTags
-					break
-				}
+// bundleSubmissionURL returns the url metrics for a check bundle are PUT to,
+// the submission_url of an httptrap check or, for other check types, one
+// built out of the mtev_reverse url
+func (cm *CheckManager) bundleSubmissionURL(checkBundle *api.CheckBundle) (api.URLType, error) {
+	if checkBundle.Type == "httptrap" {
+		turl, found := checkBundle.Config[config.SubmissionURL]
+		if !found {
+			if cm.Debug {
+				cm.Log.Printf("Missing config.%s %+v", config.SubmissionURL, checkBundle)
 			}
-			cm.mtmu.Lock()
-			delete(cm.metricTags, metricName)
-			cm.mtmu.Unlock()
+			return "", permanent(fmt.Errorf("[ERROR] Unable to use check, no %s in config", config.SubmissionURL))
 		}
-		cm.forceCheckUpdate = true
+		return api.URLType(turl), nil
 	}
 
-	if cm.forceCheckUpdate {
-		newCheckBundle, err := cm.apih.UpdateCheckBundle(cm.checkBundle)
-		if err != nil {
-			cm.Log.Printf("[ERROR] updating check bundle %v", err)
-			return
+	// build a submission_url for non-httptrap checks out of mtev_reverse url
+	if len(checkBundle.ReverseConnectURLs) == 0 {
+		return "", permanent(fmt.Errorf("%s is not an HTTPTRAP check and no reverse connection urls found", checkBundle.Checks[0]))
+	}
+	mtevURL := checkBundle.ReverseConnectURLs[0]
+	mtevURL = strings.Replace(mtevURL, "mtev_reverse", "https", 1)
+	mtevURL = strings.Replace(mtevURL, "check", "module/httptrap", 1)
+	rs, found := checkBundle.Config[config.ReverseSecretKey]
+	if !found {
+		if cm.Debug {
+			cm.Log.Printf("Missing config.%s %+v", config.ReverseSecretKey, checkBundle)
 		}
-
-		cm.forceCheckUpdate = false
-		cm.cbmu.Lock()
-		cm.checkBundle = newCheckBundle
-		cm.cbmu.Unlock()
-		cm.inventoryMetrics()
+		return "", permanent(fmt.Errorf("[ERROR] Unable to use check, no %s in config", config.ReverseSecretKey))
 	}
-
+	return api.URLType(fmt.Sprintf("%s/%s", mtevURL, rs)), nil
 }
 
 // Initialize CirconusMetrics instance. Attempt to find a check otherwise create one.
@@ -92,13 +95,13 @@ func (cm *CheckManager) UpdateCheck(newMetrics map[string]*api.CheckBundleMetric
 // check [bundle] by search
 // create check [bundle]
 func (cm *CheckManager) initializeTrapURL() error {
+	cm.trapmu.Lock()
+	defer cm.trapmu.Unlock()
+
 	if cm.trapURL != "" {
 		return nil
 	}
 
-	cm.trapmu.Lock()
-	defer cm.trapmu.Unlock()
-
 	// special case short-circuit: just send to a url, no check management
 	// up to user to ensure that if url is https that it will work (e.g. not self-signed)
 	if cm.checkSubmissionURL != "" {
@@ -110,7 +113,7 @@ func (cm *CheckManager) initializeTrapURL() error {
 	}
 
 	if !cm.enabled {
-		return errors.New("unable to initialize trap, check manager is disabled")
+		return permanent(errors.New("unable to initialize trap, check manager is disabled"))
 	}
 
 	var err error
@@ -124,7 +127,7 @@ func (cm *CheckManager) initializeTrapURL() error {
 			return err
 		}
 		if !check.Active {
-			return fmt.Errorf("[ERROR] Check ID %v is not active", check.CID)
+			return permanent(fmt.Errorf("[ERROR] Check ID %v is not active", check.CID))
 		}
 		// extract check id from check object returned from looking up using submission url
 		// set m.CheckId to the id
@@ -149,7 +152,7 @@ func (cm *CheckManager) initializeTrapURL() error {
 			return err
 		}
 		if !check.Active {
-			return fmt.Errorf("[ERROR] Check ID %v is not active", check.CID)
+			return permanent(fmt.Errorf("[ERROR] Check ID %v is not active", check.CID))
 		}
 	} else {
 		if checkBundle == nil {
@@ -191,7 +194,7 @@ func (cm *CheckManager) initializeTrapURL() error {
 				return err
 			}
 		} else {
-			return fmt.Errorf("[ERROR] Unable to retrieve, find, or create check")
+			return permanent(fmt.Errorf("[ERROR] Unable to retrieve, find, or create check"))
 		}
 	}
 
@@ -204,36 +207,18 @@ func (cm *CheckManager) initializeTrapURL() error {
 	}
 
 	// retain to facilitate metric management (adding new metrics specifically)
+	cm.cbmu.Lock()
 	cm.checkBundle = checkBundle
+	cm.cbmu.Unlock()
+	cm.broker = broker
 	cm.inventoryMetrics()
 
 	// determine the trap url to which metrics should be PUT
-	if checkBundle.Type == "httptrap" {
-		if turl, found := checkBundle.Config[config.SubmissionURL]; found {
-			cm.trapURL = api.URLType(turl)
-		} else {
-			if cm.Debug {
-				cm.Log.Printf("Missing config.%s %+v", config.SubmissionURL, checkBundle)
-			}
-			return fmt.Errorf("[ERROR] Unable to use check, no %s in config", config.SubmissionURL)
-		}
-	} else {
-		// build a submission_url for non-httptrap checks out of mtev_reverse url
-		if len(checkBundle.ReverseConnectURLs) == 0 {
-			return fmt.Errorf("%s is not an HTTPTRAP check and no reverse connection urls found", checkBundle.Checks[0])
-		}
-		mtevURL := checkBundle.ReverseConnectURLs[0]
-		mtevURL = strings.Replace(mtevURL, "mtev_reverse", "https", 1)
-		mtevURL = strings.Replace(mtevURL, "check", "module/httptrap", 1)
-		if rs, found := checkBundle.Config[config.ReverseSecretKey]; found {
-			cm.trapURL = api.URLType(fmt.Sprintf("%s/%s", mtevURL, rs))
-		} else {
-			if cm.Debug {
-				cm.Log.Printf("Missing config.%s %+v", config.ReverseSecretKey, checkBundle)
-			}
-			return fmt.Errorf("[ERROR] Unable to use check, no %s in config", config.ReverseSecretKey)
-		}
+	turl, err := cm.bundleSubmissionURL(checkBundle)
+	if err != nil {
+		return err
 	}
+	cm.trapURL = turl
 
 	// used when sending as "ServerName" get around certs not having IP SANS
 	// (cert created with server name as CN but IP used in trap url)
@@ -283,7 +268,7 @@ func (cm *CheckManager) checkBundleSearch(criteria string, filter map[string][]s
 	}
 
 	if numActive > 1 {
-		return nil, fmt.Errorf("[ERROR] multiple check bundles match criteria %s", criteria)
+		return nil, permanent(fmt.Errorf("[ERROR] multiple check bundles match criteria %s", criteria))
 	}
 
 	bundle := (*checkBundles)[checkID]
@@ -307,6 +292,11 @@ func (cm *CheckManager) createNewCheck() (*api.CheckBundle, *api.Broker, error)
 		return nil, nil, err
 	}
 
+	tags := append(append([]string{}, cm.checkSearchTag...), cm.checkTags...)
+	if cm.ephemeral {
+		tags = append(tags, cm.ephemeralTags()...)
+	}
+
 	chkcfg := &api.CheckBundle{
 		Brokers:     []string{broker.CID},
 		Config:      make(map[config.Key]string),
@@ -316,7 +306,7 @@ func (cm *CheckManager) createNewCheck() (*api.CheckBundle, *api.Broker, error)
 		Notes:       cm.getNotes(),
 		Period:      60,
 		Status:      statusActive,
-		Tags:        append(cm.checkSearchTag, cm.checkTags...),
+		Tags:        tags,
 		Target:      string(cm.checkTarget),
 		Timeout:     10,
 		Type:        string(cm.checkType),
@@ -344,6 +334,10 @@ func (cm *CheckManager) createNewCheck() (*api.CheckBundle, *api.Broker, error)
 		return nil, nil, err
 	}
 
+	cm.cbmu.Lock()
+	cm.createdBundleCID = checkBundle.CID
+	cm.cbmu.Unlock()
+
 	return checkBundle, broker, nil
 }
 
@@ -366,7 +360,7 @@ func (cm *CheckManager) getNotes() *string {
 // FetchCheckBySubmissionURL fetch a check configuration by submission_url
 func (cm *CheckManager) fetchCheckBySubmissionURL(submissionURL api.URLType) (*api.Check, error) {
 	if string(submissionURL) == "" {
-		return nil, errors.New("[ERROR] Invalid submission URL (blank)")
+		return nil, permanent(errors.New("[ERROR] Invalid submission URL (blank)"))
 	}
 
 	u, err := url.Parse(string(submissionURL))
@@ -378,13 +372,13 @@ func (cm *CheckManager) fetchCheckBySubmissionURL(submissionURL api.URLType) (*a
 
 	// does it smell like a valid trap url path
 	if !strings.Contains(u.Path, "/module/httptrap/") {
-		return nil, fmt.Errorf("[ERROR] Invalid submission URL '%s', unrecognized path", submissionURL)
+		return nil, permanent(fmt.Errorf("[ERROR] Invalid submission URL '%s', unrecognized path", submissionURL))
 	}
 
 	// extract uuid
 	pathParts := strings.Split(strings.Replace(u.Path, "/module/httptrap/", "", 1), "/")
 	if len(pathParts) != 2 {
-		return nil, fmt.Errorf("[ERROR] Invalid submission URL '%s', UUID not where expected", submissionURL)
+		return nil, permanent(fmt.Errorf("[ERROR] Invalid submission URL '%s', UUID not where expected", submissionURL))
 	}
 	uuid := pathParts[0]
 
@@ -396,7 +390,7 @@ func (cm *CheckManager) fetchCheckBySubmissionURL(submissionURL api.URLType) (*a
 	}
 
 	if len(*checks) == 0 {
-		return nil, fmt.Errorf("[ERROR] No checks found with UUID %s", uuid)
+		return nil, permanent(fmt.Errorf("[ERROR] No checks found with UUID %s", uuid))
 	}
 
 	numActive := 0
@@ -410,7 +404,7 @@ func (cm *CheckManager) fetchCheckBySubmissionURL(submissionURL api.URLType) (*a
 	}
 
 	if numActive > 1 {
-		return nil, fmt.Errorf("[ERROR] Multiple checks with same UUID %s", uuid)
+		return nil, permanent(fmt.Errorf("[ERROR] Multiple checks with same UUID %s", uuid))
 	}
 
 	check := (*checks)[checkID]
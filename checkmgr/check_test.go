@@ -111,6 +111,29 @@ func testCheckServer() *httptest.Server {
 				w.WriteHeader(500)
 				fmt.Fprintln(w, "unsupported method")
 			}
+		case "/check_bundle_metrics/1234":
+			switch r.Method {
+			case "GET":
+				ret, err := json.Marshal(api.CheckBundleMetrics{CID: "/check_bundle_metrics/1234", Metrics: testCheckBundle.Metrics})
+				if err != nil {
+					panic(err)
+				}
+				w.WriteHeader(200)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintln(w, string(ret))
+			case "PUT": // update
+				defer r.Body.Close()
+				b, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					panic(err)
+				}
+				w.WriteHeader(200)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintln(w, string(b))
+			default:
+				w.WriteHeader(500)
+				fmt.Fprintln(w, "unsupported method")
+			}
 		case "/check_bundle":
 			switch r.Method {
 			case "GET": // search
@@ -233,6 +256,7 @@ func TestUpdateCheck(t *testing.T) {
 
 	cm := &CheckManager{
 		enabled: true,
+		Log:     log.New(ioutil.Discard, "", log.LstdFlags),
 	}
 	ac := &api.Config{
 		TokenApp: "abcd",
@@ -244,6 +268,10 @@ func TestUpdateCheck(t *testing.T) {
 		t.Errorf("Expected no error, got '%v'", err)
 	}
 	cm.apih = apih
+	cm.availableMetrics = make(map[string]bool)
+
+	bundle := testCheckBundle
+	bundle.Metrics = append([]api.CheckBundleMetric{}, testCheckBundle.Metrics...)
 
 	newMetrics := make(map[string]*api.CheckBundleMetric)
 
@@ -260,12 +288,14 @@ func TestUpdateCheck(t *testing.T) {
 		cm.UpdateCheck(newMetrics)
 	}
 
-	t.Log("nothing to update (!force metrics, 0 metrics, 0 tags)")
+	t.Log("nothing to update (0 metrics, 0 tags)")
 	{
 		cm.enabled = true
-		cm.checkBundle = &testCheckBundle
-		cm.forceCheckUpdate = false
+		cm.checkBundle = &bundle
 		cm.UpdateCheck(newMetrics)
+		if !cm.lastMetricUpdate.IsZero() {
+			t.Fatal("Expected no update")
+		}
 	}
 
 	newMetrics["test`metric"] = &api.CheckBundleMetric{
@@ -277,9 +307,11 @@ func TestUpdateCheck(t *testing.T) {
 	t.Log("new metric")
 	{
 		cm.enabled = true
-		cm.checkBundle = &testCheckBundle
-		cm.forceCheckUpdate = false
+		cm.checkBundle = &bundle
 		cm.UpdateCheck(newMetrics)
+		if len(cm.pendingMetrics) != 0 || !cm.IsMetricActive("test`metric") {
+			t.Fatalf("Expected test`metric active, got pending %v", cm.pendingMetrics)
+		}
 	}
 
 	cm.metricTags = make(map[string][]string)
@@ -288,9 +320,15 @@ func TestUpdateCheck(t *testing.T) {
 	t.Log("metric tag")
 	{
 		cm.enabled = true
-		cm.checkBundle = &testCheckBundle
-		cm.forceCheckUpdate = false
-		cm.UpdateCheck(newMetrics)
+		cm.checkBundle = &bundle
+		cm.lastMetricUpdate = time.Time{}
+		cm.UpdateCheck(nil)
+		if len(cm.pendingMetrics) != 0 || len(cm.metricTags) != 0 {
+			t.Fatalf("Expected tags sent, got pending %v", cm.pendingMetrics)
+		}
+		if bundle.Metrics[0].Name != "elmo" || len(bundle.Metrics[0].Tags) != 1 {
+			t.Fatalf("Expected elmo tagged, got %+v", bundle.Metrics)
+		}
 	}
 
 }
@@ -47,7 +47,16 @@ const (
 	defaultCheckType             = "httptrap"
 	defaultTrapMaxURLAge         = "60s"   // 60 seconds
 	defaultBrokerMaxResponseTime = "500ms" // 500 milliseconds
+	defaultBrokerProbeTimeout    = "15s"
+	defaultBrokerProbeWorkers    = 8
+	defaultFailoverAfter         = "0"
 	defaultForceMetricActivation = "false"
+	defaultMetricUpdateInterval  = "10s"
+	defaultMetricUpdateBatch     = 500
+	defaultEphemeralTTL          = "24h"
+	defaultInitMinDelay          = "2s"
+	defaultInitMaxDelay          = "60s"
+	defaultInitJitter            = "0.5"
 	statusActive                 = "active"
 )
 
@@ -91,6 +100,35 @@ type CheckConfig struct {
 	Type string
 	// Custom check config fields (default: none)
 	CustomConfigFields map[string]string
+	// minimum time between check metric updates (activating new metrics,
+	// setting metric tags), changes in between are batched into the next
+	// update e.g. 30s, 1m, default 10s
+	MetricUpdateInterval string
+	// maximum metrics in a check metric update, default "500"
+	MetricUpdateBatch string
+	// ephemeral mode for short lived jobs, a created check is tagged with
+	// an expiry and removed on Shutdown "(true|false)", default "false"
+	// **only relevant when check management is enabled**
+	Ephemeral string
+	// how long an ephemeral check is kept before CleanupEphemeralChecks
+	// considers it orphaned e.g. 2h, 24h, default 24h
+	EphemeralTTL string
+	// what Shutdown does with an ephemeral check: delete (default) or
+	// deactivate
+	EphemeralShutdown string
+	// ordered allow/deny rules for metrics, one per line (patterns may
+	// contain ";"), each "allow|deny <name pattern> [<stream tag pattern>]". The first
+	// matching rule decides, a metric matching no rule is allowed. Patterns
+	// are regular expressions, or globs when prefixed with "glob:", a tag
+	// pattern matches one of the metric's stream tags (cat:val). Rejected
+	// metrics are neither activated nor submitted. e.g.
+	// "deny glob:debug_*\nallow ^http_ env:prod\ndeny ^http_" (default: none)
+	MetricFilters string
+	// file caching the resolved check (check bundle cid, submission url,
+	// broker cn and ca cert) so a restart submits metrics immediately,
+	// revalidating against the API in the background (default: none)
+	// **only relevant when check management is enabled**
+	StateFile string
 }
 
 // BrokerConfig options for broker
@@ -105,6 +143,63 @@ type BrokerConfig struct {
 	MaxResponseTime string
 	// TLS configuration to use when communicating within broker
 	TLSConfig *tls.Config
+	// PEM CA certificate(s) for the broker, used instead of the broker CA
+	// certificate from the API, reloaded when the file changes
+	CAFile string
+	// client certificate and key for brokers requiring mutual TLS, PEM
+	// files (reloaded when they change) or PEM contents
+	ClientCertFile string
+	ClientKeyFile  string
+	ClientCert     string
+	ClientKey      string
+	// pinned broker public keys, comma separated base64 sha256 hashes of
+	// the certificate SubjectPublicKeyInfo (optionally prefixed sha256/),
+	// a certificate of the broker's verified chain (the broker's certificate
+	// with InsecureSkipVerify) must match one of them
+	PinSPKI string
+	// strategy used to select a broker from the valid brokers when creating
+	// a check: random (default), latency (lowest connect time), nearest (to
+	// Location), skew (lowest clock skew) or tag_order (first of PreferTags)
+	SelectStrategy string
+	// "latitude,longitude" for the nearest strategy e.g. "40.71,-74.01"
+	Location string
+	// tags in order of preference for the tag_order strategy
+	// e.g. dc:east,dc:west
+	PreferTags string
+	// custom selection func, overrides SelectStrategy
+	Selector BrokerSelector
+	// overall deadline for validating brokers (connecting to all the
+	// usable broker instances concurrently) e.g. 5s, 1m, default 15s
+	ProbeTimeout string
+	// maximum concurrent broker connection attempts, default "8"
+	ProbeConcurrency string
+	// consecutive failed submissions (each after retries) before failing
+	// over to another instance of the check's brokers, default "0" (failover
+	// disabled) **only relevant when check management is enabled**
+	FailoverAfter string
+	// move the check to another valid broker when none of the instances
+	// of its brokers are healthy "(true|false)", default "false"
+	FailoverMoveCheck string
+}
+
+// InitConfig options for retrying check initialization (obtaining the
+// submission url) after a failed attempt **only relevant when check
+// management is enabled**
+type InitConfig struct {
+	// delay before the first retry, doubled after each failed attempt
+	// up to MaxDelay e.g. 500ms, 5s, default 2s
+	MinDelay string
+	// maximum delay between attempts e.g. 30s, 5m, default 60s
+	MaxDelay string
+	// fraction of the delay randomized (reduced by up to delay*jitter) so
+	// many instances don't retry in lockstep, "0" to "1", default "0.5"
+	Jitter string
+	// give up after this many attempts, default "0" (no limit)
+	MaxAttempts string
+	// also retry errors classified as permanent (e.g. invalid API token,
+	// inactive check, no valid brokers), which otherwise stop initialization
+	// "(true|false)", default "false"
+	RetryPermanent string
 }
 
 // Config options
@@ -118,6 +213,8 @@ type Config struct {
 	Check CheckConfig
 	// Broker specific configuration options
 	Broker BrokerConfig
+	// Initialization retry options
+	Init InitConfig
 }
 
 // CheckTypeType check type
@@ -147,6 +244,7 @@ type CheckManager struct {
 	Log     *log.Logger
 	Debug   bool
 	apih    *api.API
+	apiURL  string
 
 	initialized   bool
 	initializedmu sync.RWMutex
@@ -163,21 +261,64 @@ type CheckManager struct {
 	checkSubmissionURL    api.URLType
 	checkDisplayName      CheckDisplayNameType
 	forceMetricActivation bool
-	forceCheckUpdate      bool
 
 	// metric tags
 	metricTags map[string][]string
 	mtmu       sync.Mutex
 
+	// check metric updates
+	metricUpdateInterval time.Duration
+	metricUpdateBatch    int
+	pendingMetrics       map[string]api.CheckBundleMetric
+	lastMetricUpdate     time.Time
+	metricupdmu          sync.Mutex
+
+	// ephemeral checks
+	ephemeral        bool
+	ephemeralTTL     time.Duration
+	ephemeralDisable bool
+	createdBundleCID string
+
+	// metric filters
+	metricFilters []metricFilter
+	filterResults map[string]bool
+	numFiltered   int
+	filtermu      sync.Mutex
+
 	// broker
 	brokerID              api.IDType
 	brokerSelectTag       api.TagType
 	brokerMaxResponseTime time.Duration
 	brokerTLS             *tls.Config
+	brokerCerts           *brokerCerts
+	brokerSelector        BrokerSelector
+	brokerProbeTimeout    time.Duration
+	brokerProbeWorkers    int
+	probeCache            map[string]probeResult
+	probemu               sync.Mutex
+
+	// submission failover
+	failoverAfter int
+	failoverMove  bool
+	targets       []*submitTarget
+	targetsBuilt  bool // alternate targets added
+	failoverBusy  bool // a failover job is pending or running
+	moveTried     bool // since the last successful submission
+	failovermu    sync.Mutex
+	failoverjobmu sync.Mutex
+	failoverwg    sync.WaitGroup
+
+	// initialization retries
+	initMinDelay       time.Duration
+	initMaxDelay       time.Duration
+	initJitter         float64
+	initMaxAttempts    int
+	initRetryPermanent bool
 
 	// state
 	checkBundle        *api.CheckBundle
 	cbmu               sync.Mutex
+	broker             *api.Broker
 	availableMetrics   map[string]bool
 	availableMetricsmu sync.Mutex
 	trapURL            api.URLType
@@ -186,7 +327,27 @@ type CheckManager struct {
 	trapMaxURLAge      time.Duration
 	trapmu             sync.Mutex
 	certPool           *x509.CertPool
+	caPEM              []byte
 	sockRx             *regexp.Regexp
+
+	// state file
+	stateFile   string
+	stateKey    string
+	stateCached *cachedState
+	statemu     sync.Mutex
+
+	// status
+	status      Status
+	subscribers map[int]chan Status
+	nextSubID   int
+	supervising bool
+	statusmu    sync.Mutex
+
+	// shutdown, done is closed by Shutdown, initmu is held by an
+	// initialization attempt so Shutdown can wait for it
+	done         chan struct{}
+	shutdownOnce sync.Once
+	initmu       sync.Mutex
 }
 
 // Trap config
@@ -209,7 +370,7 @@ func New(cfg *Config) (*CheckManager, error) {
 		return nil, errors.New("invalid Check Manager configuration (nil)")
 	}
 
-	cm := &CheckManager{enabled: true, initialized: false}
+	cm := &CheckManager{enabled: true, initialized: false, done: make(chan struct{})}
 
 	// Setup logging for check manager
 	cm.Debug = cfg.Debug
@@ -221,13 +382,7 @@ func New(cfg *Config) (*CheckManager, error) {
 		cm.Log = log.New(ioutil.Discard, "", log.LstdFlags)
 	}
 
-	{
-		rx, err := regexp.Compile(`^http\+unix://(?P<sockfile>.+)/write/(?P<id>.+)$`)
-		if err != nil {
-			return nil, errors.Wrap(err, "compiling socket regex")
-		}
-		cm.sockRx = rx
-	}
+	cm.sockRx = sockURLRx
 
 	if cfg.Check.SubmissionURL != "" {
 		cm.checkSubmissionURL = api.URLType(cfg.Check.SubmissionURL)
@@ -251,6 +406,7 @@ func New(cfg *Config) (*CheckManager, error) {
 			return nil, errors.Wrap(err, "initializing api client")
 		}
 		cm.apih = apih
+		cm.apiURL = cfg.API.URL
 	}
 
 	// initialize check related data
@@ -274,6 +430,7 @@ func New(cfg *Config) (*CheckManager, error) {
 	cm.checkTarget = CheckTargetType(cfg.Check.TargetHost)
 	cm.checkDisplayName = CheckDisplayNameType(cfg.Check.DisplayName)
 	cm.checkSecret = CheckSecretType(cfg.Check.Secret)
+	cm.stateFile = cfg.Check.StateFile
 
 	fma := defaultForceMetricActivation
 	if cfg.Check.ForceMetricActivation != "" {
@@ -327,6 +484,60 @@ func New(cfg *Config) (*CheckManager, error) {
 	}
 	cm.trapMaxURLAge = maxDur
 
+	dur = cfg.Check.MetricUpdateInterval
+	if dur == "" {
+		dur = defaultMetricUpdateInterval
+	}
+	maxDur, err = time.ParseDuration(dur)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing metric update interval")
+	}
+	cm.metricUpdateInterval = maxDur
+
+	cm.metricUpdateBatch = defaultMetricUpdateBatch
+	if cfg.Check.MetricUpdateBatch != "" {
+		n, err := strconv.Atoi(cfg.Check.MetricUpdateBatch)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing metric update batch")
+		}
+		if n <= 0 {
+			return nil, errors.Errorf("invalid metric update batch (%d)", n)
+		}
+		cm.metricUpdateBatch = n
+	}
+
+	if cfg.Check.Ephemeral != "" {
+		ephemeral, err := strconv.ParseBool(cfg.Check.Ephemeral)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing ephemeral")
+		}
+		cm.ephemeral = ephemeral
+	}
+
+	dur = cfg.Check.EphemeralTTL
+	if dur == "" {
+		dur = defaultEphemeralTTL
+	}
+	maxDur, err = time.ParseDuration(dur)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ephemeral ttl")
+	}
+	cm.ephemeralTTL = maxDur
+
+	switch cfg.Check.EphemeralShutdown {
+	case "", ephemeralShutdownDelete:
+	case ephemeralShutdownDisable:
+		cm.ephemeralDisable = true
+	default:
+		return nil, errors.Errorf("invalid ephemeral shutdown (%s), expected delete or deactivate", cfg.Check.EphemeralShutdown)
+	}
+
+	filters, err := parseMetricFilters(cfg.Check.MetricFilters)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing metric filters")
+	}
+	cm.metricFilters = filters
+
 	// setup broker
 	idSetting = "0"
 	if cfg.Broker.ID != "" {
@@ -355,10 +566,75 @@ func New(cfg *Config) (*CheckManager, error) {
 	// add user specified tls config for broker if provided
 	cm.brokerTLS = cfg.Broker.TLSConfig
 
+	bc, err := newBrokerCerts(&cfg.Broker, cm.Log)
+	if err != nil {
+		return nil, errors.Wrap(err, "broker tls")
+	}
+	cm.brokerCerts = bc
+
+	dur = cfg.Broker.ProbeTimeout
+	if dur == "" {
+		dur = defaultBrokerProbeTimeout
+	}
+	maxDur, err = time.ParseDuration(dur)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing broker probe timeout")
+	}
+	cm.brokerProbeTimeout = maxDur
+
+	cm.brokerProbeWorkers = defaultBrokerProbeWorkers
+	if cfg.Broker.ProbeConcurrency != "" {
+		n, err := strconv.Atoi(cfg.Broker.ProbeConcurrency)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing broker probe concurrency")
+		}
+		if n <= 0 {
+			return nil, errors.Errorf("invalid broker probe concurrency (%d)", n)
+		}
+		cm.brokerProbeWorkers = n
+	}
+
+	fa := defaultFailoverAfter
+	if cfg.Broker.FailoverAfter != "" {
+		fa = cfg.Broker.FailoverAfter
+	}
+	n, err := strconv.Atoi(fa)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing broker failover after")
+	}
+	if n < 0 {
+		return nil, errors.Errorf("invalid broker failover after (%d)", n)
+	}
+	cm.failoverAfter = n
+
+	if cfg.Broker.FailoverMoveCheck != "" {
+		fm, err := strconv.ParseBool(cfg.Broker.FailoverMoveCheck)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing broker failover move check")
+		}
+		cm.failoverMove = fm
+	}
+
+	cm.brokerSelector = cfg.Broker.Selector
+	if cm.brokerSelector == nil {
+		selector, err := newBrokerSelector(cfg.Broker.SelectStrategy, cfg.Broker.Location, cfg.Broker.PreferTags)
+		if err != nil {
+			return nil, err
+		}
+		cm.brokerSelector = selector
+	}
+
+	// initialization retries
+	if err := cm.configureInit(&cfg.Init); err != nil {
+		return nil, err
+	}
+
 	// metrics
 	cm.availableMetrics = make(map[string]bool)
 	cm.metricTags = make(map[string][]string)
 
+	cm.stateKey = cm.computeStateKey()
+
 	return cm, nil
 }
 
@@ -367,34 +643,61 @@ func (cm *CheckManager) Initialize() {
 
 	// if not managing the check, quicker initialization
 	if !cm.enabled {
-		err := cm.initializeTrapURL()
-		if err == nil {
-			cm.initializedmu.Lock()
-			cm.initialized = true
-			cm.initializedmu.Unlock()
-		} else {
+		if err := cm.initTrap(); err != nil {
 			cm.Log.Printf("[WARN] error initializing trap %s", err.Error())
+			cm.setState(StateFailed, err)
 		}
 		return
 	}
 
-	// background initialization when we have to reach out to the api
+	// start with the check from the state file, if there is one, and
+	// verify it is still valid in the background
+	if cm.loadState() {
+		go cm.revalidateState()
+		return
+	}
+
+	// background initialization when we have to reach out to the api,
+	// retried (see InitConfig) until it succeeds or the error is permanent
 	go func() {
-		cm.apih.EnableExponentialBackoff()
-		err := cm.initializeTrapURL()
-		if err == nil {
-			cm.initializedmu.Lock()
-			cm.initialized = true
-			cm.initializedmu.Unlock()
-		} else {
-			cm.Log.Printf("[WARN] error initializing trap %s", err.Error())
+		if err := cm.initTrap(); err != nil {
+			cm.superviseInit(StateInitializing, err)
 		}
-		cm.apih.DisableExponentialBackoff()
 	}()
 }
 
-// IsReady reflects if the check has been initialied and metrics can be sent to Circonus
+// initTrap runs an initialization attempt, recording success in the status
+func (cm *CheckManager) initTrap() error {
+	cm.initmu.Lock()
+	defer cm.initmu.Unlock()
+	if cm.isShutdown() {
+		return errShutdown
+	}
+
+	cm.attempt()
+	if err := cm.initializeTrapURL(); err != nil {
+		return err
+	}
+	cm.initializedmu.Lock()
+	cm.initialized = true
+	cm.initializedmu.Unlock()
+	cm.setState(StateReady, nil)
+	if cm.enabled {
+		cm.extendEphemeral()
+		cm.syncMetricFilters()
+		if err := cm.saveState(); err != nil {
+			cm.Log.Printf("[WARN] %s", err)
+		}
+	}
+	return nil
+}
+
+// IsReady reflects if the check has been initialied and metrics can be sent to Circonus,
+// false once shut down
 func (cm *CheckManager) IsReady() bool {
+	if cm.isShutdown() {
+		return false
+	}
 	cm.initializedmu.RLock()
 	defer cm.initializedmu.RUnlock()
 	return cm.initialized
@@ -402,13 +705,18 @@ func (cm *CheckManager) IsReady() bool {
 
 // GetSubmissionURL returns submission url for circonus
 func (cm *CheckManager) GetSubmissionURL() (*Trap, error) {
-	if cm.trapURL == "" {
+	// the submission url changes on failover and reset, in the background
+	cm.trapmu.Lock()
+	trapURL, trapCN := cm.trapURL, cm.trapCN
+	cm.trapmu.Unlock()
+
+	if trapURL == "" {
 		return nil, errors.Errorf("get submission url - submission url unavailable")
 	}
 
 	trap := &Trap{}
 
-	u, err := url.Parse(string(cm.trapURL))
+	u, err := url.Parse(string(trapURL))
 	if err != nil {
 		return nil, errors.Wrap(err, "get submission url")
 	}
@@ -420,7 +728,7 @@ func (cm *CheckManager) GetSubmissionURL() (*Trap, error) {
 		metricID := ""
 
 		subNames := cm.sockRx.SubexpNames()
-		matches := cm.sockRx.FindAllStringSubmatch(string(cm.trapURL), -1)
+		matches := cm.sockRx.FindAllStringSubmatch(string(trapURL), -1)
 		for _, match := range matches {
 			for idx, val := range match {
 				switch subNames[idx] {
@@ -433,7 +741,7 @@ func (cm *CheckManager) GetSubmissionURL() (*Trap, error) {
 		}
 
 		if sockPath == "" || metricID == "" {
-			return nil, errors.Errorf("get submission url - invalid socket url (%s)", cm.trapURL)
+			return nil, errors.Errorf("get submission url - invalid socket url (%s)", trapURL)
 		}
 
 		u, err = url.Parse(fmt.Sprintf("http+unix://%s/write/%s", service, metricID))
@@ -452,29 +760,9 @@ func (cm *CheckManager) GetSubmissionURL() (*Trap, error) {
 	}
 
 	if u.Scheme == "https" {
-		// preference user-supplied TLS configuration
-		if cm.brokerTLS != nil {
-			trap.TLS = cm.brokerTLS
-			return trap, nil
-		}
-
-		// api.circonus.com uses a public CA signed certificate
-		// trap.noit.circonus.net uses Circonus CA private certificate
-		// enterprise brokers use private CA certificate
-		if trap.URL.Hostname() == "api.circonus.com" {
-			return trap, nil
-		}
-
-		if cm.certPool == nil {
-			if err := cm.loadCACert(); err != nil {
-				return nil, errors.Wrap(err, "get submission url")
-			}
-		}
-		t := &tls.Config{
-			RootCAs: cm.certPool,
-		}
-		if cm.trapCN != "" {
-			t.ServerName = string(cm.trapCN)
+		t, err := cm.submissionTLS(trap.URL.Hostname(), trapCN)
+		if err != nil {
+			return nil, errors.Wrap(err, "get submission url")
 		}
 		trap.TLS = t
 	}
@@ -484,22 +772,38 @@ func (cm *CheckManager) GetSubmissionURL() (*Trap, error) {
 
 // ResetTrap URL, force request to the API for the submission URL and broker ca cert
 func (cm *CheckManager) ResetTrap() error {
-	if cm.trapURL == "" {
+	cm.trapmu.Lock()
+	if cm.trapURL == "" || cm.isShutdown() {
+		cm.trapmu.Unlock()
 		return nil
 	}
 
 	cm.trapURL = ""
 	cm.certPool = nil // force re-fetching CA cert (if custom TLS config not supplied)
-	return cm.initializeTrapURL()
+	cm.trapmu.Unlock()
+
+	err := cm.initTrap()
+	if err != nil {
+		cm.setState(StateDegraded, err)
+		// the submission url is gone, re-enter initialization
+		if cm.enabled {
+			go cm.superviseInit(StateDegraded, err)
+		}
+	}
+	return err
 }
 
 // RefreshTrap check when the last time the URL was reset, reset if needed
 func (cm *CheckManager) RefreshTrap() error {
-	if cm.trapURL == "" {
+	cm.trapmu.Lock()
+	trapURL, lastUpdate := cm.trapURL, cm.trapLastUpdate
+	cm.trapmu.Unlock()
+
+	if trapURL == "" {
 		return nil
 	}
 
-	if time.Since(cm.trapLastUpdate) >= cm.trapMaxURLAge {
+	if time.Since(lastUpdate) >= cm.trapMaxURLAge {
 		return cm.ResetTrap()
 	}
 
@@ -0,0 +1,200 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ephemeralTag marks check bundles created in ephemeral mode
+	// (CheckConfig.Ephemeral), used by CleanupEphemeralChecks to find them
+	ephemeralTag = "cgm:ephemeral"
+	// ephemeralExpiresCategory is the tag category holding the expiry of
+	// an ephemeral check bundle (unix seconds)
+	ephemeralExpiresCategory = "cgm_expires"
+	ephemeralShutdownDelete  = "delete"
+	ephemeralShutdownDisable = "deactivate"
+	statusDisabled           = "disabled"
+)
+
+// ephemeralTags returns the tags of an ephemeral check bundle expiring
+// CheckConfig.EphemeralTTL from now
+func (cm *CheckManager) ephemeralTags() []string {
+	return []string{
+		ephemeralTag,
+		fmt.Sprintf("%s:%d", ephemeralExpiresCategory, time.Now().Add(cm.ephemeralTTL).Unix()),
+	}
+}
+
+// ephemeralExpiry returns the expiry of an ephemeral check bundle, false if
+// the bundle is not ephemeral
+func ephemeralExpiry(bundle *api.CheckBundle) (time.Time, bool) {
+	isEphemeral := false
+	var expires time.Time
+	for _, tag := range bundle.Tags {
+		if tag == ephemeralTag {
+			isEphemeral = true
+			continue
+		}
+		if !strings.HasPrefix(tag, ephemeralExpiresCategory+":") {
+			continue
+		}
+		if ts, err := strconv.ParseInt(strings.TrimPrefix(tag, ephemeralExpiresCategory+":"), 10, 64); err == nil {
+			expires = time.Unix(ts, 0)
+		}
+	}
+	return expires, isEphemeral
+}
+
+// extendEphemeral refreshes the expiry of a reused ephemeral check bundle so
+// CleanupEphemeralChecks does not remove it while it is in use
+func (cm *CheckManager) extendEphemeral() {
+	if !cm.ephemeral {
+		return
+	}
+
+	cm.cbmu.Lock()
+	if cm.checkBundle == nil || cm.checkBundle.CID == cm.createdBundleCID {
+		cm.cbmu.Unlock()
+		return
+	}
+	bundle := *cm.checkBundle
+	cm.cbmu.Unlock()
+
+	if _, isEphemeral := ephemeralExpiry(&bundle); !isEphemeral {
+		return
+	}
+
+	tags := make([]string, 0, len(bundle.Tags))
+	for _, tag := range bundle.Tags {
+		if tag != ephemeralTag && !strings.HasPrefix(tag, ephemeralExpiresCategory+":") {
+			tags = append(tags, tag)
+		}
+	}
+	bundle.Tags = append(tags, cm.ephemeralTags()...)
+
+	updated, err := cm.apih.UpdateCheckBundle(&bundle)
+	if err != nil {
+		cm.Log.Printf("[WARN] extending ephemeral check bundle %s expiry: %s", bundle.CID, err)
+		return
+	}
+
+	cm.cbmu.Lock()
+	cm.checkBundle = updated
+	cm.cbmu.Unlock()
+
+	if cm.Debug {
+		cm.Log.Printf("[DEBUG] reusing ephemeral check bundle %s\n", bundle.CID)
+	}
+}
+
+// Shutdown stops initialization retries, state revalidation and failover,
+// waiting for an attempt in progress, then removes an ephemeral check
+// (CheckConfig.Ephemeral) created by this check manager, deleting or
+// deactivating the check bundle (CheckConfig.EphemeralShutdown). A reused
+// check is left as is, another instance may still be submitting to it,
+// CleanupEphemeralChecks removes it once expired. No metrics can be sent
+// afterwards.
+func (cm *CheckManager) Shutdown() error {
+	// under failovermu, no failover job is started once done is closed
+	cm.failovermu.Lock()
+	cm.shutdownOnce.Do(func() { close(cm.done) })
+	cm.failovermu.Unlock()
+
+	// an initialization attempt in progress may still create the check
+	cm.initmu.Lock()
+	cm.initmu.Unlock()
+	cm.failoverwg.Wait()
+
+	if !cm.enabled || !cm.ephemeral {
+		return nil
+	}
+
+	cm.cbmu.Lock()
+	if cm.checkBundle == nil || cm.checkBundle.CID != cm.createdBundleCID {
+		cm.cbmu.Unlock()
+		return nil
+	}
+	bundle := *cm.checkBundle
+	cm.cbmu.Unlock()
+
+	if cm.ephemeralDisable {
+		bundle.Status = statusDisabled
+		if _, err := cm.apih.UpdateCheckBundle(&bundle); err != nil {
+			return errors.Wrapf(err, "deactivating ephemeral check bundle %s", bundle.CID)
+		}
+	} else {
+		if _, err := cm.apih.DeleteCheckBundle(&bundle); err != nil {
+			return errors.Wrapf(err, "deleting ephemeral check bundle %s", bundle.CID)
+		}
+	}
+
+	cm.removeState()
+
+	cm.cbmu.Lock()
+	cm.checkBundle = nil
+	cm.createdBundleCID = ""
+	cm.cbmu.Unlock()
+
+	cm.initializedmu.Lock()
+	cm.initialized = false
+	cm.initializedmu.Unlock()
+
+	if cm.Debug {
+		cm.Log.Printf("[DEBUG] removed ephemeral check bundle %s\n", bundle.CID)
+	}
+
+	return nil
+}
+
+// CleanupEphemeralChecks deletes orphaned ephemeral check bundles (see
+// CheckConfig.Ephemeral), those which expired or, if maxAge > 0, were
+// created more than maxAge ago. Returns the cids of the deleted check
+// bundles and the first error encountered.
+func CleanupEphemeralChecks(apih *api.API, maxAge time.Duration) ([]string, error) {
+	if apih == nil {
+		return nil, errors.New("invalid api handle (nil)")
+	}
+
+	search := api.SearchQueryType(fmt.Sprintf("(tags:%s)", ephemeralTag))
+	bundles, err := apih.SearchCheckBundles(&search, &map[string][]string{})
+	if err != nil {
+		return nil, errors.Wrap(err, "searching ephemeral check bundles")
+	}
+
+	now := time.Now()
+	var deleted []string
+	var firstErr error
+	for _, bundle := range *bundles {
+		bundle := bundle
+		expires, isEphemeral := ephemeralExpiry(&bundle)
+		if !isEphemeral {
+			continue
+		}
+		expired := !expires.IsZero() && now.After(expires)
+		if maxAge > 0 && bundle.Created > 0 && now.Sub(time.Unix(int64(bundle.Created), 0)) > maxAge {
+			expired = true
+		}
+		if !expired {
+			continue
+		}
+		if _, err := apih.DeleteCheckBundle(&bundle); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "deleting ephemeral check bundle %s", bundle.CID)
+			}
+			continue
+		}
+		deleted = append(deleted, bundle.CID)
+	}
+
+	return deleted, firstErr
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+)
+
+func TestEphemeral(t *testing.T) {
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+	if _, err := srv.AddBroker("test", trap); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	newCM := func(shutdown string) *CheckManager {
+		cm, err := New(&Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{InstanceID: "job", Ephemeral: "true", EphemeralTTL: "1h", EphemeralShutdown: shutdown},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		return cm
+	}
+
+	t.Log("created with expiry")
+	cm := newCM("")
+	cid := cm.Status().CheckBundleCID
+	{
+		expires, isEphemeral := ephemeralExpiry(cm.checkBundle)
+		if !isEphemeral {
+			t.Fatalf("Expected ephemeral tags, got %v", cm.checkBundle.Tags)
+		}
+		if d := time.Until(expires); d < 59*time.Minute || d > time.Hour {
+			t.Fatalf("Expected expiry in 1h, got %v", expires)
+		}
+	}
+
+	t.Log("reused, left on shutdown")
+	{
+		other := newCM("")
+		if st := other.Status(); st.CheckBundleCID != cid {
+			t.Fatalf("Expected %s reused, got %s", cid, st.CheckBundleCID)
+		}
+		if err := other.Shutdown(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, ok := srv.Get(cid); !ok {
+			t.Fatalf("Expected %s to remain", cid)
+		}
+	}
+
+	t.Log("deleted on shutdown")
+	{
+		if err := cm.Shutdown(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, ok := srv.Get(cid); ok {
+			t.Fatalf("Expected %s deleted", cid)
+		}
+		if cm.IsReady() {
+			t.Fatal("Expected not ready after shutdown")
+		}
+	}
+
+	t.Log("deactivated on shutdown")
+	{
+		cm := newCM("deactivate")
+		cid := cm.Status().CheckBundleCID
+		if err := cm.Shutdown(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		bundle, ok := srv.Get(cid)
+		if !ok || bundle["status"] != "disabled" {
+			t.Fatalf("Expected %s disabled, got %v", cid, bundle["status"])
+		}
+	}
+
+	t.Log("shutdown while initialization is retried")
+	{
+		srv.SetFault(apitest.Fault{StatusCode: 408, Count: 1})
+		srv.ResetRequests()
+		cm, err := New(&Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{InstanceID: "retried", Ephemeral: "true"},
+			Init:  InitConfig{MinDelay: "100ms", Jitter: "0"},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		waitStatus(t, cm, func(st Status) bool { return st.Attempts == 1 && st.Err != nil })
+		if err := cm.Shutdown(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if st := cm.Status(); st.Attempts != 1 || st.CheckBundleCID != "" {
+			t.Fatalf("Expected no attempt after shutdown, got %+v", st)
+		}
+		for _, req := range srv.Requests() {
+			if req.Method == "POST" {
+				t.Fatalf("Expected no check created, got %s %s", req.Method, req.Path)
+			}
+		}
+	}
+}
+
+func TestCleanupEphemeralChecks(t *testing.T) {
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+	broker, err := srv.AddBroker("test", trap)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	apih, err := api.New(&api.Config{TokenKey: srv.Token(), URL: srv.URL()})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	create := func(tags ...string) string {
+		bundle, err := apih.CreateCheckBundle(&api.CheckBundle{
+			Brokers: []string{broker},
+			Config:  api.CheckBundleConfig{},
+			Metrics: []api.CheckBundleMetric{},
+			Status:  "active",
+			Tags:    tags,
+			Target:  "host",
+			Type:    "httptrap",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		return bundle.CID
+	}
+	expires := func(d time.Duration) string {
+		return fmt.Sprintf("%s:%d", ephemeralExpiresCategory, time.Now().Add(d).Unix())
+	}
+
+	expired := create(ephemeralTag, expires(-time.Hour))
+	current := create(ephemeralTag, expires(time.Hour))
+	permanent := create("service:foo", expires(-time.Hour))
+
+	t.Log("invalid api handle")
+	{
+		if _, err := CleanupEphemeralChecks(nil, 0); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("expired")
+	{
+		deleted, err := CleanupEphemeralChecks(apih, 0)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(deleted) != 1 || deleted[0] != expired {
+			t.Fatalf("Expected [%s], got %v", expired, deleted)
+		}
+	}
+
+	t.Log("max age")
+	{
+		time.Sleep(1100 * time.Millisecond)
+		deleted, err := CleanupEphemeralChecks(apih, time.Second)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(deleted) != 1 || deleted[0] != current {
+			t.Fatalf("Expected [%s], got %v", current, deleted)
+		}
+		if _, ok := srv.Get(permanent); !ok {
+			t.Fatalf("Expected %s (not ephemeral) to remain", permanent)
+		}
+	}
+}
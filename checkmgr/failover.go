@@ -0,0 +1,410 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/pkg/errors"
+)
+
+// failoverRetryAfter is how long a failed broker instance is skipped when
+// choosing the instance to fail over to
+const failoverRetryAfter = 5 * time.Minute
+
+// InstanceHealth is the submission health of a broker instance the check
+// can submit to
+type InstanceHealth struct {
+	BrokerCID     string
+	BrokerName    string
+	CN            string
+	SubmissionURL string
+	// Active is the instance metrics are currently submitted to
+	Active bool
+	// consecutive failed submissions
+	Failures    int
+	LastError   error
+	LastFailure time.Time
+	LastSuccess time.Time
+}
+
+// submitTarget is a broker instance metrics can be submitted to
+type submitTarget struct {
+	InstanceHealth
+	broker *api.Broker
+}
+
+// ReportSubmission records the result of a metric submission (nil on
+// success, the error once all retries failed). After BrokerConfig.FailoverAfter
+// consecutive failures metrics are submitted to another healthy instance of
+// the check's brokers, without one the check is moved to another broker
+// (BrokerConfig.FailoverMoveCheck, once until a submission succeeds) or the
+// submission url is refreshed (if older than CheckConfig.MaxURLAge). Finding
+// the other instances and moving the check use the API, they are done in the
+// background. A failed submission also removes the state file
+// (CheckConfig.StateFile).
+func (cm *CheckManager) ReportSubmission(err error) {
+	if cm.enabled {
+		cm.submissionState(err)
+	}
+	if !cm.enabled || cm.failoverAfter == 0 {
+		if err != nil {
+			cm.RefreshTrap()
+		}
+		return
+	}
+
+	cm.trapmu.Lock()
+	current := string(cm.trapURL)
+	cm.trapmu.Unlock()
+	if current == "" {
+		return
+	}
+
+	cm.failovermu.Lock()
+	defer cm.failovermu.Unlock()
+
+	if t := cm.activeTarget(); t == nil || t.SubmissionURL != current {
+		// first report, or the submission url changed (e.g. reset)
+		cm.targets = []*submitTarget{cm.currentTarget(current)}
+		cm.targetsBuilt = false
+		cm.failoverJob(func() { cm.addAlternateTargets(current) })
+	}
+	t := cm.activeTarget()
+
+	if err == nil {
+		t.Failures = 0
+		t.LastSuccess = time.Now()
+		cm.moveTried = false
+		return
+	}
+
+	t.Failures++
+	t.LastError = err
+	t.LastFailure = time.Now()
+	if t.Failures < cm.failoverAfter || cm.failoverBusy {
+		return
+	}
+
+	cm.failoverBusy = true
+	cm.failoverJob(func() {
+		cm.failover(current)
+		cm.failovermu.Lock()
+		cm.failoverBusy = false
+		cm.failovermu.Unlock()
+	})
+}
+
+// failoverJob runs fn in the background, one job at a time, unless the
+// check manager was shut down. failovermu must be held, Shutdown waits for
+// the jobs started before it.
+func (cm *CheckManager) failoverJob(fn func()) {
+	if cm.isShutdown() {
+		return
+	}
+	cm.failoverwg.Add(1)
+	go func() {
+		defer cm.failoverwg.Done()
+		cm.failoverjobmu.Lock()
+		defer cm.failoverjobmu.Unlock()
+		if cm.isShutdown() {
+			return
+		}
+		fn()
+	}()
+}
+
+// failover submits to the next healthy target after the active target
+// (current) failed, without one the check is moved or the submission url
+// refreshed
+func (cm *CheckManager) failover(current string) {
+	cm.addAlternateTargets(current)
+
+	cm.failovermu.Lock()
+	t := cm.activeTarget()
+	if t == nil || t.SubmissionURL != current || t.Failures < cm.failoverAfter {
+		// a submission succeeded or the submission url changed meanwhile
+		cm.failovermu.Unlock()
+		return
+	}
+
+	next := cm.nextTarget()
+	if next == nil {
+		move := cm.failoverMove && !cm.moveTried
+		cm.moveTried = true
+		failures := t.Failures
+		cm.failovermu.Unlock()
+
+		if cm.failoverMove && !move {
+			// already tried, until a submission succeeds
+			return
+		}
+		cm.Log.Printf("[WARN] submission to %s failed %d times, no healthy broker instance to fail over to", current, failures)
+		if move {
+			if err := cm.moveCheck(); err != nil {
+				cm.Log.Printf("[ERROR] moving check to another broker: %s", err)
+			}
+			return
+		}
+		cm.RefreshTrap()
+		return
+	}
+
+	t.Active = false
+	next.Active = true
+	next.Failures = 0
+	failures, lastErr := t.Failures, t.LastError
+	cm.failovermu.Unlock()
+
+	cm.Log.Printf("[WARN] submission to %s failed %d times (%s), failing over to %s (broker '%s')",
+		current, failures, lastErr, next.SubmissionURL, next.BrokerName)
+
+	cm.trapmu.Lock()
+	cm.trapURL = api.URLType(next.SubmissionURL)
+	cm.trapCN = BrokerCNType(next.CN)
+	cm.broker = next.broker
+	cm.trapmu.Unlock()
+
+	cm.setState(StateReady, nil)
+}
+
+// Health returns the submission health of the broker instances the check
+// can submit to, empty until a submission has been reported
+func (cm *CheckManager) Health() []InstanceHealth {
+	cm.failovermu.Lock()
+	defer cm.failovermu.Unlock()
+
+	health := make([]InstanceHealth, 0, len(cm.targets))
+	for _, t := range cm.targets {
+		health = append(health, t.InstanceHealth)
+	}
+	return health
+}
+
+// activeTarget returns the target metrics are submitted to, nil if the
+// targets have not been built
+func (cm *CheckManager) activeTarget() *submitTarget {
+	for _, t := range cm.targets {
+		if t.Active {
+			return t
+		}
+	}
+	return nil
+}
+
+// nextTarget returns the first healthy target after the active one, a target
+// which failed is eligible again after failoverRetryAfter
+func (cm *CheckManager) nextTarget() *submitTarget {
+	active := 0
+	for i, t := range cm.targets {
+		if t.Active {
+			active = i
+			break
+		}
+	}
+	for i := 1; i < len(cm.targets); i++ {
+		t := cm.targets[(active+i)%len(cm.targets)]
+		if t.Failures == 0 || time.Since(t.LastFailure) >= failoverRetryAfter {
+			return t
+		}
+	}
+	return nil
+}
+
+// currentTarget returns the target of the current submission url (active)
+func (cm *CheckManager) currentTarget(current string) *submitTarget {
+	cm.trapmu.Lock()
+	cn := string(cm.trapCN)
+	broker := cm.broker
+	cm.trapmu.Unlock()
+
+	active := &submitTarget{
+		InstanceHealth: InstanceHealth{
+			CN:            cn,
+			SubmissionURL: current,
+			Active:        true,
+		},
+		broker: broker,
+	}
+	if broker != nil {
+		active.BrokerCID = broker.CID
+		active.BrokerName = broker.Name
+	}
+	return active
+}
+
+// addAlternateTargets adds the alternate targets of the current submission
+// url after the active target, unless already added or the submission url
+// changed
+func (cm *CheckManager) addAlternateTargets(current string) {
+	cm.failovermu.Lock()
+	t := cm.activeTarget()
+	done := cm.targetsBuilt || t == nil || t.SubmissionURL != current
+	var broker *api.Broker
+	if t != nil {
+		broker = t.broker
+	}
+	cm.failovermu.Unlock()
+	if done {
+		return
+	}
+
+	alternates := cm.alternateTargets(current, broker)
+
+	cm.failovermu.Lock()
+	defer cm.failovermu.Unlock()
+	if t := cm.activeTarget(); cm.targetsBuilt || t == nil || t.SubmissionURL != current {
+		return
+	}
+	cm.targets = append(cm.targets[:1:1], alternates...)
+	cm.targetsBuilt = true
+}
+
+// alternateTargets returns the broker instances the check can submit to
+// other than the current submission url, the other instances of the same
+// broker first, then the instances of the check bundle's other brokers. Only
+// httptrap checks have alternate submission urls (same secret, the uuid of
+// the check on each broker).
+func (cm *CheckManager) alternateTargets(current string, broker *api.Broker) []*submitTarget {
+	var targets []*submitTarget
+
+	cm.cbmu.Lock()
+	bundle := cm.checkBundle
+	cm.cbmu.Unlock()
+
+	if bundle == nil || bundle.Type != "httptrap" {
+		return nil
+	}
+
+	u, err := url.Parse(current)
+	if err != nil {
+		return nil
+	}
+	secret := path.Base(u.Path)
+
+	var others []*submitTarget
+	for i, cid := range bundle.Brokers {
+		if i >= len(bundle.CheckUUIDs) {
+			break
+		}
+		b := broker
+		if b == nil || b.CID != cid {
+			cid := cid
+			if b, err = cm.apih.FetchBroker(api.CIDType(&cid)); err != nil {
+				cm.Log.Printf("[WARN] fetching broker %s for failover: %s", cid, err)
+				continue
+			}
+		}
+		for _, detail := range b.Details {
+			detail := detail
+			if detail.Status != statusActive || !cm.brokerSupportsCheckType(cm.checkType, &detail) {
+				continue
+			}
+			host, port := brokerAddress(&detail)
+			if host == "" {
+				continue
+			}
+			turl := fmt.Sprintf("%s://%s/module/httptrap/%s/%s", u.Scheme, net.JoinHostPort(host, port), bundle.CheckUUIDs[i], secret)
+			if turl == current {
+				continue
+			}
+			tcn, err := cm.getBrokerCN(b, api.URLType(turl))
+			if err != nil {
+				tcn = detail.CN
+			}
+			t := &submitTarget{
+				InstanceHealth: InstanceHealth{
+					BrokerCID:     b.CID,
+					BrokerName:    b.Name,
+					CN:            tcn,
+					SubmissionURL: turl,
+				},
+				broker: b,
+			}
+			if broker != nil && b.CID == broker.CID {
+				targets = append(targets, t)
+			} else {
+				others = append(others, t)
+			}
+		}
+	}
+
+	return append(targets, others...)
+}
+
+// moveCheck moves the check bundle to a valid broker other than its current
+// brokers and submits to the new submission url
+func (cm *CheckManager) moveCheck() error {
+	cm.cbmu.Lock()
+	if cm.checkBundle == nil {
+		cm.cbmu.Unlock()
+		return errors.New("no check bundle")
+	}
+	bundle := *cm.checkBundle
+	cm.cbmu.Unlock()
+
+	if bundle.Type != "httptrap" {
+		return cm.ResetTrap()
+	}
+
+	exclude := make(map[string]bool)
+	for _, cid := range bundle.Brokers {
+		exclude[cid] = true
+	}
+	ctx, cancel := cm.shutdownContext()
+	defer cancel()
+	broker, err := cm.selectBrokerExcluding(ctx, exclude)
+	if err != nil {
+		return errors.Wrap(err, "selecting broker")
+	}
+
+	bundle.Brokers = []string{broker.CID}
+	updated, err := cm.apih.UpdateCheckBundle(&bundle)
+	if err != nil {
+		return errors.Wrap(err, "updating check bundle")
+	}
+
+	turl, found := updated.Config[config.SubmissionURL]
+	if !found {
+		return errors.Errorf("no %s in moved check bundle %s", config.SubmissionURL, updated.CID)
+	}
+	cn, err := cm.getBrokerCN(broker, api.URLType(turl))
+	if err != nil {
+		return err
+	}
+
+	cm.cbmu.Lock()
+	cm.checkBundle = updated
+	cm.cbmu.Unlock()
+
+	cm.trapmu.Lock()
+	cm.trapURL = api.URLType(turl)
+	cm.trapCN = BrokerCNType(cn)
+	cm.broker = broker
+	cm.trapLastUpdate = time.Now()
+	// the checks were replaced, a check id would no longer be found on reset
+	if cm.checkID > 0 && len(updated.Checks) > 0 {
+		if id, err := strconv.Atoi(strings.TrimPrefix(updated.Checks[0], config.CheckPrefix+"/")); err == nil {
+			cm.checkID = api.IDType(id)
+		}
+	}
+	cm.trapmu.Unlock()
+
+	cm.Log.Printf("[WARN] moved check bundle %s to broker '%s'", updated.CID, broker.Name)
+	cm.setState(StateReady, nil)
+	if err := cm.saveState(); err != nil {
+		cm.Log.Printf("[WARN] %s", err)
+	}
+
+	return nil
+}
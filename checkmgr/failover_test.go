@@ -0,0 +1,340 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+	"github.com/pkg/errors"
+)
+
+// failoverSetup starts an api server with brokers a and b and creates a
+// check bundle (secret "s") on the brokers given by index
+func failoverSetup(t *testing.T, brokers ...int) (*apitest.Server, []*brokertest.Broker, *api.CheckBundle, func()) {
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	var traps []*brokertest.Broker
+	var cids []string
+	for _, name := range []string{"a", "b"} {
+		trap, err := brokertest.New(&brokertest.Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cid, err := srv.AddBroker(name, trap)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		traps = append(traps, trap)
+		cids = append(cids, cid)
+	}
+
+	client, err := api.New(&api.Config{TokenKey: srv.Token(), URL: srv.URL()})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	bundle := &api.CheckBundle{
+		Config:  api.CheckBundleConfig{config.Secret: "s"},
+		Metrics: []api.CheckBundleMetric{},
+		Status:  "active",
+		Target:  "host",
+		Type:    "httptrap",
+	}
+	for _, i := range brokers {
+		bundle.Brokers = append(bundle.Brokers, cids[i])
+	}
+	bundle, err = client.CreateCheckBundle(bundle)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	return srv, traps, bundle, func() {
+		for _, trap := range traps {
+			trap.Close()
+		}
+		srv.Close()
+	}
+}
+
+func failoverManager(t *testing.T, srv *apitest.Server, bundle *api.CheckBundle, broker BrokerConfig) *CheckManager {
+	cm, err := New(&Config{
+		API:    api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+		Check:  CheckConfig{ID: strings.TrimPrefix(bundle.Checks[0], "/check/")},
+		Broker: broker,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	cm.Initialize()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cm.WaitReady(ctx); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return cm
+}
+
+// reportSubmission reports a submission result and waits for the failover
+// jobs it started
+func reportSubmission(cm *CheckManager, err error) {
+	cm.ReportSubmission(err)
+	cm.failoverwg.Wait()
+}
+
+func submissionURL(t *testing.T, cm *CheckManager) string {
+	trap, err := cm.GetSubmissionURL()
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return trap.URL.String()
+}
+
+func TestReportSubmission(t *testing.T) {
+	srv, traps, bundle, cleanup := failoverSetup(t, 0, 1)
+	defer cleanup()
+
+	cm := failoverManager(t, srv, bundle, BrokerConfig{FailoverAfter: "2"})
+	primary := traps[0].SubmissionURL(bundle.CheckUUIDs[0], "s")
+	alternate := traps[1].SubmissionURL(bundle.CheckUUIDs[1], "s")
+	if u := submissionURL(t, cm); u != primary {
+		t.Fatalf("Expected '%s', got '%s'", primary, u)
+	}
+
+	t.Log("success")
+	{
+		reportSubmission(cm, nil)
+		health := cm.Health()
+		if len(health) != 2 {
+			t.Fatalf("Expected 2 instances, got %+v", health)
+		}
+		if !health[0].Active || health[0].SubmissionURL != primary || health[0].LastSuccess.IsZero() || health[0].BrokerName != "a" {
+			t.Fatalf("Expected active primary, got %+v", health[0])
+		}
+		if health[1].Active || health[1].SubmissionURL != alternate || health[1].BrokerName != "b" || health[1].CN != traps[1].CN() {
+			t.Fatalf("Expected alternate, got %+v", health[1])
+		}
+	}
+
+	t.Log("failures below threshold")
+	{
+		reportSubmission(cm, errors.New("broker down"))
+		if u := submissionURL(t, cm); u != primary {
+			t.Fatalf("Expected '%s', got '%s'", primary, u)
+		}
+		reportSubmission(cm, nil)
+		reportSubmission(cm, errors.New("broker down"))
+		if u := submissionURL(t, cm); u != primary {
+			t.Fatalf("Expected '%s' (failures reset by success), got '%s'", primary, u)
+		}
+	}
+
+	t.Log("failover")
+	{
+		reportSubmission(cm, errors.New("broker down"))
+		if u := submissionURL(t, cm); u != alternate {
+			t.Fatalf("Expected '%s', got '%s'", alternate, u)
+		}
+		st := cm.Status()
+		if st.State != StateReady || st.BrokerName != "b" || st.SubmissionURL != alternate {
+			t.Fatalf("Expected ready on b, got %+v", st)
+		}
+		health := cm.Health()
+		if health[0].Active || health[0].Failures != 2 || health[0].LastError == nil || !health[1].Active {
+			t.Fatalf("Expected failed primary and active alternate, got %+v", health)
+		}
+	}
+
+	t.Log("no healthy instance")
+	{
+		reportSubmission(cm, errors.New("broker down"))
+		reportSubmission(cm, errors.New("broker down"))
+		if u := submissionURL(t, cm); u != alternate {
+			t.Fatalf("Expected '%s' (primary failed recently), got '%s'", alternate, u)
+		}
+	}
+}
+
+func TestReportSubmissionBackground(t *testing.T) {
+	srv, _, bundle, cleanup := failoverSetup(t, 0, 1)
+	defer cleanup()
+
+	cm := failoverManager(t, srv, bundle, BrokerConfig{FailoverAfter: "1"})
+	srv.SetFault(apitest.Fault{Delay: time.Second, Path: "/broker", Count: 1})
+
+	start := time.Now()
+	cm.ReportSubmission(errors.New("broker down"))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected api calls in the background, took %v", elapsed)
+	}
+	cm.failoverwg.Wait()
+	if st := cm.Status(); st.BrokerName != "b" {
+		t.Fatalf("Expected failover to b, got %+v", st)
+	}
+}
+
+func TestReportSubmissionWhileSubmitting(t *testing.T) {
+	srv, traps, bundle, cleanup := failoverSetup(t, 0, 1)
+	defer cleanup()
+
+	cm := failoverManager(t, srv, bundle, BrokerConfig{FailoverAfter: "1"})
+	urls := map[string]bool{
+		traps[0].SubmissionURL(bundle.CheckUUIDs[0], "s"): true,
+		traps[1].SubmissionURL(bundle.CheckUUIDs[1], "s"): true,
+	}
+
+	done := make(chan struct{})
+	var unexpected string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// unavailable while the submission url is reset
+			if trap, err := cm.GetSubmissionURL(); err == nil && !urls[trap.URL.String()] {
+				unexpected = trap.URL.String()
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		reportSubmission(cm, errors.New("broker down"))
+		if i%5 == 4 {
+			if err := cm.ResetTrap(); err != nil {
+				t.Fatalf("Expected no error, got '%v'", err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if unexpected != "" {
+		t.Fatalf("Expected a broker submission url, got '%s'", unexpected)
+	}
+	if st := cm.Status(); st.State != StateReady {
+		t.Fatalf("Expected ready, got %+v", st)
+	}
+}
+
+func TestReportSubmissionShutdown(t *testing.T) {
+	srv, _, bundle, cleanup := failoverSetup(t, 0, 1)
+	defer cleanup()
+
+	cm := failoverManager(t, srv, bundle, BrokerConfig{FailoverAfter: "1"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				cm.ReportSubmission(errors.New("broker down"))
+			}
+		}()
+	}
+	if err := cm.Shutdown(); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	wg.Wait()
+	cm.failoverwg.Wait()
+
+	t.Log("no failover after shutdown")
+	{
+		before := submissionURL(t, cm)
+		for i := 0; i < 3; i++ {
+			reportSubmission(cm, errors.New("broker down"))
+		}
+		if u := submissionURL(t, cm); u != before {
+			t.Fatalf("Expected '%s', got '%s'", before, u)
+		}
+	}
+}
+
+func TestReportSubmissionDisabled(t *testing.T) {
+	srv, _, bundle, cleanup := failoverSetup(t, 0, 1)
+	defer cleanup()
+
+	cm := failoverManager(t, srv, bundle, BrokerConfig{})
+	before := submissionURL(t, cm)
+	for i := 0; i < 5; i++ {
+		reportSubmission(cm, errors.New("broker down"))
+	}
+	if u := submissionURL(t, cm); u != before {
+		t.Fatalf("Expected '%s', got '%s'", before, u)
+	}
+	if health := cm.Health(); len(health) != 0 {
+		t.Fatalf("Expected no health, got %+v", health)
+	}
+}
+
+func TestMoveCheck(t *testing.T) {
+	srv, traps, bundle, cleanup := failoverSetup(t, 0)
+	defer cleanup()
+
+	cm := failoverManager(t, srv, bundle, BrokerConfig{FailoverAfter: "1", FailoverMoveCheck: "true"})
+	if u := submissionURL(t, cm); u != traps[0].SubmissionURL(bundle.CheckUUIDs[0], "s") {
+		t.Fatalf("Expected broker a, got '%s'", u)
+	}
+
+	reportSubmission(cm, errors.New("broker down"))
+
+	moved, ok := srv.Get(bundle.CID)
+	if !ok {
+		t.Fatalf("Expected %s", bundle.CID)
+	}
+	st := cm.Status()
+	if st.BrokerName != "b" || st.CheckCID == bundle.Checks[0] {
+		t.Fatalf("Expected moved to b with a new check, got %+v", st)
+	}
+	uuids, _ := moved["_check_uuids"].([]interface{})
+	if len(uuids) != 1 {
+		t.Fatalf("Expected 1 check uuid, got %+v", moved)
+	}
+	if u, expect := submissionURL(t, cm), traps[1].SubmissionURL(uuids[0].(string), "s"); u != expect {
+		t.Fatalf("Expected '%s', got '%s'", expect, u)
+	}
+
+	t.Log("reset after move")
+	{
+		if err := cm.ResetTrap(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if st := cm.Status(); st.State != StateReady || st.BrokerName != "b" {
+			t.Fatalf("Expected ready on b, got %+v", st)
+		}
+	}
+
+	t.Log("moved once until a submission succeeds")
+	{
+		reportSubmission(cm, errors.New("broker down"))
+		if st := cm.Status(); st.BrokerName != "b" {
+			t.Fatalf("Expected still on b, got %+v", st)
+		}
+	}
+
+	t.Log("move again")
+	{
+		reportSubmission(cm, nil)
+		reportSubmission(cm, errors.New("broker down"))
+		if st := cm.Status(); st.BrokerName != "a" {
+			t.Fatalf("Expected moved back to a, got %+v", st)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"encoding/base64"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	filterAllow = "allow"
+	filterDeny  = "deny"
+	// globPrefix marks a glob (* and ?) pattern, otherwise a pattern is a
+	// regular expression
+	globPrefix = "glob:"
+	// filterComment identifies the check bundle metric filters set from
+	// CheckConfig.MetricFilters
+	filterComment = "circonus-gometrics"
+)
+
+// metricFilter is an allow/deny rule (see CheckConfig.MetricFilters)
+type metricFilter struct {
+	action string
+	name   *regexp.Regexp
+	// tags matches one of the metric's stream tags (cat:val), nil if the
+	// rule does not look at stream tags
+	tags *regexp.Regexp
+}
+
+// parseMetricFilters parses ordered allow/deny rules, one per line, each
+// "allow|deny <name pattern> [<stream tag pattern>]" (patterns may contain
+// ";", so only newlines separate rules)
+func parseMetricFilters(rules string) ([]metricFilter, error) {
+	var filters []metricFilter
+	for _, rule := range strings.Split(rules, "\n") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		n := len(filters) + 1
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, errors.Errorf("invalid metric filter %d (%s), expected allow|deny <name pattern> [<tag pattern>]", n, strings.TrimSpace(rule))
+		}
+
+		f := metricFilter{action: strings.ToLower(fields[0])}
+		if f.action != filterAllow && f.action != filterDeny {
+			return nil, errors.Errorf("invalid metric filter %d action (%s), expected allow or deny", n, fields[0])
+		}
+		rx, err := compileFilterPattern(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "metric filter %d name pattern", n)
+		}
+		f.name = rx
+		if len(fields) == 3 {
+			rx, err := compileFilterPattern(fields[2])
+			if err != nil {
+				return nil, errors.Wrapf(err, "metric filter %d tag pattern", n)
+			}
+			f.tags = rx
+		}
+
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+// compileFilterPattern compiles a regular expression, or a glob when
+// prefixed with "glob:" (matching the whole name e.g. glob:http_* )
+func compileFilterPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, globPrefix) {
+		glob := regexp.QuoteMeta(strings.TrimPrefix(pattern, globPrefix))
+		glob = strings.Replace(glob, `\*`, ".*", -1)
+		glob = strings.Replace(glob, `\?`, ".", -1)
+		pattern = "^" + glob + "$"
+	}
+	return regexp.Compile(pattern)
+}
+
+// maxFilterResults is the number of metric names the metric filter results are
+// cached for, the cache is cleared when full (stream tags make the set of
+// names unbounded)
+const maxFilterResults = 10000
+
+// allowMetric applies the metric filters, the first matching rule decides,
+// a metric matching no rule is allowed. Results are cached by metric name.
+func (cm *CheckManager) allowMetric(name string) bool {
+	if len(cm.metricFilters) == 0 {
+		return true
+	}
+
+	cm.filtermu.Lock()
+	defer cm.filtermu.Unlock()
+
+	if allowed, seen := cm.filterResults[name]; seen {
+		return allowed
+	}
+
+	allowed := matchMetricFilters(cm.metricFilters, name)
+	if cm.filterResults == nil || len(cm.filterResults) >= maxFilterResults {
+		cm.filterResults = make(map[string]bool)
+	}
+	cm.filterResults[name] = allowed
+	if !allowed {
+		cm.numFiltered++
+		if cm.Debug {
+			cm.Log.Printf("[DEBUG] metric %s rejected by metric filters\n", name)
+		}
+	}
+
+	return allowed
+}
+
+// FilteredMetrics returns the number of distinct metrics rejected by the
+// metric filters (CheckConfig.MetricFilters), a metric rejected again after
+// the cached results were cleared is counted again
+func (cm *CheckManager) FilteredMetrics() int {
+	cm.filtermu.Lock()
+	defer cm.filtermu.Unlock()
+	return cm.numFiltered
+}
+
+func matchMetricFilters(filters []metricFilter, metric string) bool {
+	name, tags := splitStreamTags(metric)
+	for _, f := range filters {
+		if !f.name.MatchString(name) {
+			continue
+		}
+		if f.tags != nil {
+			matched := false
+			for _, tag := range tags {
+				if f.tags.MatchString(tag) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		return f.action == filterAllow
+	}
+	return true
+}
+
+// splitStreamTags splits a metric name of the form name|ST[cat:val,...]
+// into the name and its tags, base64 encoded (b"...") categories and values
+// are decoded
+func splitStreamTags(metric string) (string, []string) {
+	idx := strings.Index(metric, "|ST[")
+	if idx < 0 || !strings.HasSuffix(metric, "]") {
+		return metric, nil
+	}
+
+	var tags []string
+	for _, st := range strings.Split(metric[idx+4:len(metric)-1], ",") {
+		if st == "" {
+			continue
+		}
+		parts := strings.SplitN(st, ":", 2)
+		for i, part := range parts {
+			parts[i] = decodeStreamTag(part)
+		}
+		tags = append(tags, strings.Join(parts, ":"))
+	}
+
+	return metric[:idx], tags
+}
+
+func decodeStreamTag(s string) string {
+	if len(s) < 3 || !strings.HasPrefix(s, `b"`) || !strings.HasSuffix(s, `"`) {
+		return s
+	}
+	data, err := base64.StdEncoding.DecodeString(s[2 : len(s)-1])
+	if err != nil {
+		return s
+	}
+	return string(data)
+}
+
+// bundleMetricFilters returns the rules as check bundle metric filters,
+// ending with an allow all (a metric matching no rule is allowed). False
+// if the rules cannot be expressed as check bundle metric filters (rules
+// on stream tags are only applied locally).
+func (cm *CheckManager) bundleMetricFilters() ([][]string, bool) {
+	filters := make([][]string, 0, len(cm.metricFilters)+1)
+	for _, f := range cm.metricFilters {
+		if f.tags != nil {
+			return nil, false
+		}
+		filters = append(filters, []string{f.action, f.name.String(), filterComment})
+	}
+	return append(filters, []string{filterAllow, "^.+$", filterComment}), true
+}
+
+// mergeMetricFilters replaces the filters set from the rules (identified by
+// filterComment) in the check bundle metric filters, other filters (e.g.
+// set in the UI) are kept as is. The rules take the place of the first
+// replaced filter, or come first. The allow all ending the rules is dropped
+// when other filters follow them, which then decide.
+func mergeMetricFilters(current, rules [][]string) [][]string {
+	var others [][]string
+	at := -1
+	for _, f := range current {
+		if len(f) > 2 && f[2] == filterComment {
+			if at < 0 {
+				at = len(others)
+			}
+			continue
+		}
+		others = append(others, f)
+	}
+	if at < 0 {
+		at = 0
+	}
+	if at < len(others) {
+		rules = rules[:len(rules)-1]
+	}
+
+	merged := make([][]string, 0, len(others)+len(rules))
+	merged = append(merged, others[:at]...)
+	merged = append(merged, rules...)
+	return append(merged, others[at:]...)
+}
+
+// syncMetricFilters sets the configured rules in the check bundle metric
+// filters, so metrics are also filtered by the broker. Only if the account
+// supports metric filters (the check bundle has them). The check bundle is
+// fetched again first, to keep changes made since it was retrieved.
+func (cm *CheckManager) syncMetricFilters() {
+	if !cm.enabled || len(cm.metricFilters) == 0 {
+		return
+	}
+
+	cm.cbmu.Lock()
+	if cm.checkBundle == nil {
+		cm.cbmu.Unlock()
+		return
+	}
+	cid := cm.checkBundle.CID
+	cm.cbmu.Unlock()
+
+	rules, ok := cm.bundleMetricFilters()
+	if !ok {
+		if cm.Debug {
+			cm.Log.Printf("[DEBUG] metric filters on stream tags, metric filters only applied locally\n")
+		}
+		return
+	}
+
+	bundle, err := cm.apih.FetchCheckBundle(api.CIDType(&cid))
+	if err != nil {
+		cm.Log.Printf("[WARN] fetching check bundle %s metric filters: %s", cid, err)
+		return
+	}
+
+	if bundle.MetricFilters == nil {
+		if cm.Debug {
+			cm.Log.Printf("[DEBUG] check bundle %s has no metric filters, metric filters only applied locally\n", bundle.CID)
+		}
+		return
+	}
+
+	filters := mergeMetricFilters(bundle.MetricFilters, rules)
+	if reflect.DeepEqual(bundle.MetricFilters, filters) {
+		return
+	}
+
+	bundle.MetricFilters = filters
+	updated, err := cm.apih.UpdateCheckBundle(bundle)
+	if err != nil {
+		cm.Log.Printf("[WARN] updating check bundle %s metric filters: %s", bundle.CID, err)
+		return
+	}
+
+	cm.cbmu.Lock()
+	cm.checkBundle = updated
+	cm.cbmu.Unlock()
+
+	if cm.Debug {
+		cm.Log.Printf("[DEBUG] updated check bundle %s metric filters", bundle.CID)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func TestParseMetricFilters(t *testing.T) {
+	t.Log("empty")
+	{
+		filters, err := parseMetricFilters(" \n\n")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(filters) != 0 {
+			t.Fatalf("Expected 0 filters, got %d", len(filters))
+		}
+	}
+
+	t.Log("valid")
+	{
+		filters, err := parseMetricFilters("deny glob:debug_*\nALLOW ^http_ env:prod\ndeny ^a;b$")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(filters) != 3 {
+			t.Fatalf("Expected 3 filters, got %d", len(filters))
+		}
+		if filters[0].action != "deny" || filters[0].name.String() != "^debug_.*$" || filters[0].tags != nil {
+			t.Fatalf("Expected deny ^debug_.*$, got %+v", filters[0])
+		}
+		if filters[1].action != "allow" || filters[1].tags == nil || filters[1].tags.String() != "env:prod" {
+			t.Fatalf("Expected allow with tag pattern, got %+v", filters[1])
+		}
+		if filters[2].name.String() != "^a;b$" {
+			t.Fatalf("Expected ^a;b$, got %+v", filters[2])
+		}
+	}
+
+	tests := []struct {
+		rules  string
+		expect string
+	}{
+		{"deny", "invalid metric filter 1 (deny)"},
+		{"allow a b c", "invalid metric filter 1 (allow a b c)"},
+		{"allow ^a\nkeep ^b", "invalid metric filter 2 action (keep)"},
+		{"deny (", "metric filter 1 name pattern"},
+		{"deny ^a [", "metric filter 1 tag pattern"},
+	}
+	for _, test := range tests {
+		t.Logf("invalid %q", test.rules)
+		_, err := parseMetricFilters(test.rules)
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+		if !strings.HasPrefix(err.Error(), test.expect) {
+			t.Fatalf("Expected '%s', got '%v'", test.expect, err)
+		}
+	}
+}
+
+func TestAllowMetric(t *testing.T) {
+	filters, err := parseMetricFilters("deny glob:debug_*\nallow ^http_ glob:env:prod\ndeny ^http_\nallow glob:ver?")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	cm := &CheckManager{metricFilters: filters}
+	cm.availableMetrics = map[string]bool{"debug_foo": true}
+
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{"debug_foo", false},
+		{"http_requests|ST[env:prod,host:a]", true},
+		{`http_requests|ST[b"ZW52":b"cHJvZA=="]`, true},
+		{"http_requests|ST[env:dev]", false},
+		{"http_requests", false},
+		{"ver1", true},
+		{"foo", true},
+	}
+	for _, test := range tests {
+		t.Logf("metric %s", test.name)
+		if allowed := cm.allowMetric(test.name); allowed != test.allowed {
+			t.Fatalf("Expected %v, got %v", test.allowed, allowed)
+		}
+	}
+
+	t.Log("rejected metrics are neither active nor activated")
+	{
+		if cm.IsMetricActive("debug_foo") {
+			t.Fatal("Expected debug_foo not active")
+		}
+		if cm.ActivateMetric("debug_bar") {
+			t.Fatal("Expected debug_bar not activated")
+		}
+		if !cm.ActivateMetric("foo") {
+			t.Fatal("Expected foo activated")
+		}
+	}
+
+	t.Log("filtered count")
+	{
+		if n := cm.FilteredMetrics(); n != 4 {
+			t.Fatalf("Expected 4, got %d", n)
+		}
+	}
+
+	t.Log("bounded cache")
+	{
+		for i := 0; i <= maxFilterResults; i++ {
+			cm.allowMetric(fmt.Sprintf("foo|ST[host:%d]", i))
+		}
+		if n := len(cm.filterResults); n > maxFilterResults {
+			t.Fatalf("Expected at most %d cached results, got %d", maxFilterResults, n)
+		}
+		if cm.allowMetric("debug_foo") {
+			t.Fatal("Expected debug_foo rejected after the cache was cleared")
+		}
+		if n := cm.FilteredMetrics(); n != 5 {
+			t.Fatalf("Expected 5, got %d", n)
+		}
+	}
+}
+
+func TestMergeMetricFilters(t *testing.T) {
+	rules := [][]string{{"deny", "^a$", filterComment}, {"allow", "^.+$", filterComment}}
+	ui := []string{"deny", "^b$", ""}
+
+	tests := []struct {
+		name    string
+		current [][]string
+		expect  [][]string
+	}{
+		{"none", [][]string{}, rules},
+		{"replaced", [][]string{{"deny", "^old$", filterComment}, {"allow", "^.+$", filterComment}}, rules},
+		{"others follow", [][]string{ui}, [][]string{rules[0], ui}},
+		{"in place", [][]string{ui, {"deny", "^old$", filterComment}, {"allow", "^.+$", filterComment}}, [][]string{ui, rules[0], rules[1]}},
+	}
+	for _, test := range tests {
+		t.Log(test.name)
+		if merged := mergeMetricFilters(test.current, rules); !reflect.DeepEqual(merged, test.expect) {
+			t.Fatalf("Expected %v, got %v", test.expect, merged)
+		}
+	}
+}
+
+func TestSyncMetricFilters(t *testing.T) {
+	srv, _, bundle, cleanup := failoverSetup(t, 0)
+	defer cleanup()
+
+	newCM := func(rules string) *CheckManager {
+		cm, err := New(&Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{ID: strings.TrimPrefix(bundle.Checks[0], "/check/"), MetricFilters: rules},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if err := cm.initTrap(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		return cm
+	}
+	filters := func() interface{} {
+		stored, _ := srv.Get(bundle.CID)
+		return stored["metric_filters"]
+	}
+
+	t.Log("not supported")
+	{
+		newCM("deny glob:debug_*")
+		if f := filters(); f != nil {
+			t.Fatalf("Expected no metric filters, got %v", f)
+		}
+	}
+
+	client, err := api.New(&api.Config{TokenKey: srv.Token(), URL: srv.URL()})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	bundle.MetricFilters = [][]string{{"allow", "^.+$", ""}}
+	if _, err := client.UpdateCheckBundle(bundle); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("stream tag rules")
+	{
+		newCM("allow ^http_ env:prod\ndeny ^http_")
+		if f := filters(); !reflect.DeepEqual(f, []interface{}{[]interface{}{"allow", "^.+$", ""}}) {
+			t.Fatalf("Expected filters unchanged, got %v", f)
+		}
+	}
+
+	t.Log("synced, other filters kept")
+	{
+		cm := newCM("deny glob:debug_*")
+		expect := [][]string{{"deny", "^debug_.*$", filterComment}, {"allow", "^.+$", ""}}
+		if !reflect.DeepEqual(cm.checkBundle.MetricFilters, expect) {
+			t.Fatalf("Expected %v, got %v", expect, cm.checkBundle.MetricFilters)
+		}
+		if f, _ := filters().([]interface{}); len(f) != 2 {
+			t.Fatalf("Expected 2 filters, got %v", f)
+		}
+
+		srv.ResetRequests()
+		newCM("deny glob:debug_*")
+		for _, req := range srv.Requests() {
+			if req.Method == "PUT" {
+				t.Fatalf("Expected no update when unchanged, got %s %s", req.Method, req.Path)
+			}
+		}
+	}
+}
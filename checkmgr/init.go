@@ -0,0 +1,227 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var apiResponseCodeRx = regexp.MustCompile(`API response code (\d{3})`)
+
+// errShutdown is returned by an initialization attempt after Shutdown
+var errShutdown = errors.New("check manager shut down")
+
+// permanentError is an initialization error retrying will not fix without
+// a change to the configuration, the account or the check (in the UI)
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent marks an initialization error as permanent
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if an initialization error will not go away by
+// retrying: errors marked as such (e.g. inactive check, no valid brokers,
+// multiple matching check bundles) and API client errors (4xx other than
+// 408 and 429, e.g. 403 invalid token or 404 unknown check). Network
+// errors, timeouts and API server errors are transient.
+func IsPermanent(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := errors.Cause(err).(*permanentError); ok {
+		return true
+	}
+	m := apiResponseCodeRx.FindStringSubmatch(err.Error())
+	if m == nil {
+		return false
+	}
+	code, _ := strconv.Atoi(m[1])
+	return code >= 400 && code < 500 && code != 408 && code != 429
+}
+
+// configureInit parses the initialization retry options
+func (cm *CheckManager) configureInit(cfg *InitConfig) error {
+	for _, d := range []struct {
+		name string
+		v    string
+		def  string
+		dst  *time.Duration
+	}{
+		{"init min delay", cfg.MinDelay, defaultInitMinDelay, &cm.initMinDelay},
+		{"init max delay", cfg.MaxDelay, defaultInitMaxDelay, &cm.initMaxDelay},
+	} {
+		v := d.v
+		if v == "" {
+			v = d.def
+		}
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.Wrapf(err, "parsing %s", d.name)
+		}
+		if dur <= 0 {
+			return errors.Errorf("invalid %s (%s)", d.name, v)
+		}
+		*d.dst = dur
+	}
+	if cm.initMaxDelay < cm.initMinDelay {
+		cm.initMaxDelay = cm.initMinDelay
+	}
+
+	jitter := defaultInitJitter
+	if cfg.Jitter != "" {
+		jitter = cfg.Jitter
+	}
+	j, err := strconv.ParseFloat(jitter, 64)
+	if err != nil {
+		return errors.Wrap(err, "parsing init jitter")
+	}
+	if j < 0 || j > 1 {
+		return errors.Errorf("invalid init jitter (%s), must be 0-1", jitter)
+	}
+	cm.initJitter = j
+
+	if cfg.MaxAttempts != "" {
+		n, err := strconv.Atoi(cfg.MaxAttempts)
+		if err != nil {
+			return errors.Wrap(err, "parsing init max attempts")
+		}
+		if n < 0 {
+			return errors.Errorf("invalid init max attempts (%d)", n)
+		}
+		cm.initMaxAttempts = n
+	}
+
+	if cfg.RetryPermanent != "" {
+		rp, err := strconv.ParseBool(cfg.RetryPermanent)
+		if err != nil {
+			return errors.Wrap(err, "parsing init retry permanent")
+		}
+		cm.initRetryPermanent = rp
+	}
+
+	return nil
+}
+
+// superviseInit retries initialization after a failed attempt (err) until
+// it succeeds, the error is permanent, the maximum attempts are reached
+// (then the state is failed) or the check manager is shut down. While retrying the status keeps state (e.g.
+// initializing or degraded) with the last error.
+func (cm *CheckManager) superviseInit(state State, err error) {
+	cm.statusmu.Lock()
+	if cm.supervising {
+		cm.statusmu.Unlock()
+		return
+	}
+	cm.supervising = true
+	cm.statusmu.Unlock()
+
+	defer func() {
+		cm.statusmu.Lock()
+		cm.supervising = false
+		cm.statusmu.Unlock()
+	}()
+
+	// attempts are counted here rather than using the status, which
+	// counts every attempt since the check manager was created
+	attempts := 1
+	delay := cm.initMinDelay
+	for {
+		if cm.isShutdown() {
+			return
+		}
+		if IsPermanent(err) && !cm.initRetryPermanent {
+			cm.giveUp(errors.Wrap(err, "permanent error"))
+			return
+		}
+		if cm.initMaxAttempts > 0 && attempts >= cm.initMaxAttempts {
+			cm.giveUp(errors.Wrapf(err, "%d attempts", cm.initMaxAttempts))
+			return
+		}
+
+		cm.setState(state, err)
+
+		wait := cm.initWait(delay)
+		cm.Log.Printf("[WARN] error initializing trap %s, retrying in %s", err.Error(), wait)
+		if !cm.sleep(wait) {
+			return
+		}
+
+		if delay *= 2; delay > cm.initMaxDelay {
+			delay = cm.initMaxDelay
+		}
+
+		attempts++
+		if err = cm.initTrap(); err == nil {
+			return
+		}
+	}
+}
+
+// giveUp stops initialization, metrics cannot be sent
+func (cm *CheckManager) giveUp(err error) {
+	cm.Log.Printf("[ERROR] unable to initialize trap, giving up: %s", err.Error())
+	cm.initializedmu.Lock()
+	cm.initialized = false
+	cm.initializedmu.Unlock()
+	cm.setState(StateFailed, err)
+}
+
+// initWait returns the delay with jitter applied
+func (cm *CheckManager) initWait(delay time.Duration) time.Duration {
+	if cm.initJitter == 0 {
+		return delay
+	}
+	return delay - time.Duration(rand.Float64()*cm.initJitter*float64(delay))
+}
+
+// sleep waits for d, false if the check manager was shut down meanwhile
+func (cm *CheckManager) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-cm.done:
+		return false
+	}
+}
+
+// isShutdown reports whether Shutdown was called
+func (cm *CheckManager) isShutdown() bool {
+	select {
+	case <-cm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownContext returns a context canceled when the check manager is shut
+// down, call cancel once done with it
+func (cm *CheckManager) shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-cm.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+	"github.com/pkg/errors"
+)
+
+func TestIsPermanent(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{errors.New("[ERROR] https://api.circonus.com/v2/check_bundle: dial tcp: connection refused"), false},
+		{errors.New("- response: 503 unavailable"), false},
+		{errors.New("[ERROR] API response code 500: oops"), false},
+		{errors.New("[ERROR] API response code 429: slow down"), false},
+		{errors.New("[ERROR] API response code 408: timeout"), false},
+		{errors.New("[ERROR] API response code 403: forbidden"), true},
+		{errors.New("[ERROR] API response code 404: not found"), true},
+		{fmt.Errorf("[ERROR] Unable to fetch suitable broker %s", errors.New("[ERROR] API response code 403: x")), true},
+		{permanent(errors.New("[ERROR] Check ID /check/1 is not active")), true},
+		{errors.Wrap(permanent(errors.New("zero brokers found")), "wrapped"), true},
+	} {
+		if IsPermanent(test.err) != test.expect {
+			t.Fatalf("Expected %v for '%v'", test.expect, test.err)
+		}
+	}
+
+	if permanent(nil) != nil {
+		t.Fatal("Expected nil")
+	}
+	if err := permanent(errors.New("foo")); err.Error() != "foo" {
+		t.Fatalf("Expected 'foo', got '%v'", err)
+	}
+}
+
+func TestConfigureInit(t *testing.T) {
+	t.Log("defaults")
+	{
+		cm := &CheckManager{}
+		if err := cm.configureInit(&InitConfig{}); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cm.initMinDelay != 2*time.Second || cm.initMaxDelay != 60*time.Second || cm.initJitter != 0.5 {
+			t.Fatalf("Expected defaults, got %v %v %v", cm.initMinDelay, cm.initMaxDelay, cm.initJitter)
+		}
+		if cm.initMaxAttempts != 0 || cm.initRetryPermanent {
+			t.Fatalf("Expected no limit and no permanent retries, got %d %v", cm.initMaxAttempts, cm.initRetryPermanent)
+		}
+	}
+
+	t.Log("settings")
+	{
+		cm := &CheckManager{}
+		if err := cm.configureInit(&InitConfig{MinDelay: "10s", MaxDelay: "1s", Jitter: "0", MaxAttempts: "5", RetryPermanent: "true"}); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cm.initMinDelay != 10*time.Second || cm.initMaxDelay != 10*time.Second {
+			t.Fatalf("Expected max delay raised to min delay, got %v %v", cm.initMinDelay, cm.initMaxDelay)
+		}
+		if cm.initJitter != 0 || cm.initMaxAttempts != 5 || !cm.initRetryPermanent {
+			t.Fatalf("Expected settings, got %+v", cm)
+		}
+		if wait := cm.initWait(time.Second); wait != time.Second {
+			t.Fatalf("Expected 1s without jitter, got %v", wait)
+		}
+		cm.initJitter = 0.5
+		for i := 0; i < 100; i++ {
+			if wait := cm.initWait(time.Second); wait < 500*time.Millisecond || wait > time.Second {
+				t.Fatalf("Expected 500ms-1s, got %v", wait)
+			}
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, cfg := range []InitConfig{
+			{MinDelay: "1"},
+			{MaxDelay: "0s"},
+			{Jitter: "x"},
+			{Jitter: "1.5"},
+			{MaxAttempts: "x"},
+			{MaxAttempts: "-1"},
+			{RetryPermanent: "maybe"},
+		} {
+			cfg := cfg
+			if err := (&CheckManager{}).configureInit(&cfg); err == nil {
+				t.Fatalf("Expected error for %+v", cfg)
+			}
+			if _, err := New(&Config{Check: CheckConfig{SubmissionURL: "http://127.0.0.1/write/foo"}, Init: cfg}); err == nil {
+				t.Fatalf("Expected error for %+v", cfg)
+			}
+		}
+	}
+}
+
+// waitState waits for the check manager to reach a state
+func waitState(t *testing.T, cm *CheckManager, state State) Status {
+	ch, unsubscribe := cm.Subscribe()
+	defer unsubscribe()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case st := <-ch:
+			if st.State == state {
+				return st
+			}
+		case <-timeout:
+			t.Fatalf("Expected %s, got %+v", state, cm.Status())
+		}
+	}
+}
+
+func TestSuperviseInit(t *testing.T) {
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+
+	if _, err := srv.AddBroker("test", trap); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	newCM := func(init InitConfig) *CheckManager {
+		cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}, Init: init}
+		cfg.Check.InstanceID = "init:test"
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		return cm
+	}
+
+	t.Log("permanent error, no retry")
+	{
+		srv.SetFault(apitest.Fault{StatusCode: 403, Count: 1})
+		cm := newCM(InitConfig{MinDelay: "1ms"})
+		cm.Initialize()
+		st := waitState(t, cm, StateFailed)
+		if st.Attempts != 1 || !strings.Contains(st.Err.Error(), "permanent error") {
+			t.Fatalf("Expected permanent error after 1 attempt, got %+v", st)
+		}
+		if cm.IsReady() {
+			t.Fatal("Expected not ready")
+		}
+	}
+
+	t.Log("retry permanent error")
+	{
+		srv.SetFault(apitest.Fault{StatusCode: 403, Count: 1})
+		cm := newCM(InitConfig{MinDelay: "1ms", RetryPermanent: "true"})
+		cm.Initialize()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if st := cm.Status(); st.Attempts != 2 || st.Err != nil {
+			t.Fatalf("Expected ready after 2 attempts, got %+v", st)
+		}
+
+		t.Log("re-enter initialization when the submission url is lost")
+		{
+			srv.SetFault(apitest.Fault{StatusCode: 403, Count: 1})
+			if err := cm.ResetTrap(); err == nil {
+				t.Fatal("Expected error")
+			}
+			st := waitState(t, cm, StateReady)
+			if st.Attempts != 4 || st.SubmissionURL == "" {
+				t.Fatalf("Expected ready after 4 attempts, got %+v", st)
+			}
+		}
+	}
+
+	t.Log("max attempts counted per initialization")
+	{
+		cm := newCM(InitConfig{MinDelay: "1ms", MaxAttempts: "2", RetryPermanent: "true"})
+		cm.Initialize()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		srv.SetFault(apitest.Fault{StatusCode: 403, Count: 1})
+		if err := cm.ResetTrap(); err == nil {
+			t.Fatal("Expected error")
+		}
+		if st := waitState(t, cm, StateReady); st.Attempts != 3 {
+			t.Fatalf("Expected ready after 3 attempts, got %+v", st)
+		}
+	}
+
+	t.Log("max attempts")
+	{
+		srv.SetFault(apitest.Fault{StatusCode: 403})
+		defer srv.ClearFault()
+		cm := newCM(InitConfig{MinDelay: "1ms", MaxDelay: "2ms", MaxAttempts: "3", RetryPermanent: "true"})
+		cm.Initialize()
+		st := waitState(t, cm, StateFailed)
+		if st.Attempts != 3 || !strings.Contains(st.Err.Error(), "3 attempts") {
+			t.Fatalf("Expected failure after 3 attempts, got %+v", st)
+		}
+	}
+}
@@ -5,11 +5,21 @@
 package checkmgr
 
 import (
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
 )
 
-// IsMetricActive checks whether a given metric name is currently active(enabled)
+// IsMetricActive checks whether a given metric name is currently active(enabled),
+// a metric rejected by the metric filters is never active
 func (cm *CheckManager) IsMetricActive(name string) bool {
+	if !cm.allowMetric(name) {
+		return false
+	}
+
 	cm.availableMetricsmu.Lock()
 	defer cm.availableMetricsmu.Unlock()
 
@@ -18,6 +28,10 @@ func (cm *CheckManager) IsMetricActive(name string) bool {
 
 // ActivateMetric determines if a given metric should be activated
 func (cm *CheckManager) ActivateMetric(name string) bool {
+	if !cm.allowMetric(name) {
+		return false
+	}
+
 	cm.availableMetricsmu.Lock()
 	defer cm.availableMetricsmu.Unlock()
 
@@ -95,48 +109,184 @@ func (cm *CheckManager) AddMetricTags(metricName string, tags []string, appendTa
 	return tagsUpdated
 }
 
-// addNewMetrics updates a check bundle with new metrics
-func (cm *CheckManager) addNewMetrics(newMetrics map[string]*api.CheckBundleMetric) bool {
-	updatedCheckBundle := false
+// queueMetricUpdates adds new metrics and queued metric tags to the pending
+// metric updates. Tags for a metric which is neither in the check bundle nor
+// new are discarded (setting tags does not *create* metrics).
+func (cm *CheckManager) queueMetricUpdates(newMetrics map[string]*api.CheckBundleMetric) {
+	cm.metricupdmu.Lock()
+	defer cm.metricupdmu.Unlock()
+
+	if cm.pendingMetrics == nil {
+		cm.pendingMetrics = make(map[string]api.CheckBundleMetric)
+	}
+
+	for name, metric := range newMetrics {
+		if _, queued := cm.pendingMetrics[name]; !queued {
+			cm.pendingMetrics[name] = *metric
+		}
+	}
 
-	if cm.checkBundle == nil || len(newMetrics) == 0 {
-		return updatedCheckBundle
+	cm.mtmu.Lock()
+	defer cm.mtmu.Unlock()
+	if len(cm.metricTags) == 0 {
+		return
 	}
 
 	cm.cbmu.Lock()
 	defer cm.cbmu.Unlock()
+	for name, tags := range cm.metricTags {
+		metric, queued := cm.pendingMetrics[name]
+		if !queued && cm.checkBundle != nil {
+			for _, m := range cm.checkBundle.Metrics {
+				if m.Name == name {
+					metric, queued = m, true
+					break
+				}
+			}
+		}
+		if queued {
+			metric.Tags = tags
+			cm.pendingMetrics[name] = metric
+		}
+		delete(cm.metricTags, name)
+	}
+}
+
+// sendMetricUpdates sends a batch of pending metric updates. The check bundle
+// metrics are fetched first (in case there were changes made by other apps
+// or in UI), activations which would exceed the check bundle metric limit are
+// not attempted (the metrics are marked inactive, so they are not queued
+// again). The caller holds metricupdmu.
+func (cm *CheckManager) sendMetricUpdates() {
+	cm.lastMetricUpdate = time.Now()
+
+	cm.cbmu.Lock()
+	bundleCID := cm.checkBundle.CID
+	limit := cm.checkBundle.MetricLimit
+	cm.cbmu.Unlock()
+
+	cid := config.CheckBundleMetricsPrefix + strings.TrimPrefix(bundleCID, config.CheckBundlePrefix)
+	current, err := cm.apih.FetchCheckBundleMetrics(api.CIDType(&cid))
+	if err != nil {
+		// pending updates are retried with the next update
+		cm.Log.Printf("[ERROR] unable to fetch up-to-date check bundle metrics %v", err)
+		return
+	}
+
+	existing := make(map[string]api.CheckBundleMetric, len(current.Metrics))
+	numActive := 0
+	for _, m := range current.Metrics {
+		existing[m.Name] = m
+		if m.Status == "active" {
+			numActive++
+		}
+	}
+
+	names := make([]string, 0, len(cm.pendingMetrics))
+	for name := range cm.pendingMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	batchSize := cm.metricUpdateBatch
+	if batchSize <= 0 {
+		batchSize = defaultMetricUpdateBatch
+	}
+
+	var batch []api.CheckBundleMetric
+	var dropped []string
+	for _, name := range names {
+		if len(batch) >= batchSize {
+			break
+		}
+		metric := cm.pendingMetrics[name]
+		cur, found := existing[name]
+		if found && metric.Tags != nil {
+			// tag update, keep the current state of the metric
+			cur.Tags = metric.Tags
+			metric = cur
+		}
+		if metric.Status == "active" && cur.Status != "active" {
+			// limit <= 0 is unlimited
+			if limit > 0 && numActive >= limit {
+				dropped = append(dropped, name)
+				delete(cm.pendingMetrics, name)
+				continue
+			}
+			numActive++
+		}
+		batch = append(batch, metric)
+	}
 
-	numCurrMetrics := len(cm.checkBundle.Metrics)
-	numNewMetrics := len(newMetrics)
+	if len(dropped) > 0 {
+		cm.Log.Printf("[WARN] check bundle %s metric limit (%d) reached, not activating %d metric(s): %s",
+			bundleCID, limit, len(dropped), strings.Join(dropped, ", "))
+		cm.availableMetricsmu.Lock()
+		for _, name := range dropped {
+			cm.availableMetrics[name] = false
+		}
+		cm.availableMetricsmu.Unlock()
+	}
 
-	if numCurrMetrics+numNewMetrics >= cap(cm.checkBundle.Metrics) {
-		nm := make([]api.CheckBundleMetric, numCurrMetrics+numNewMetrics)
-		copy(nm, cm.checkBundle.Metrics)
-		cm.checkBundle.Metrics = nm
+	if len(batch) == 0 {
+		return
 	}
 
-	cm.checkBundle.Metrics = cm.checkBundle.Metrics[0 : numCurrMetrics+numNewMetrics]
+	metrics := &api.CheckBundleMetrics{
+		CID:     cid,
+		Metrics: batch,
+	}
+	updated, err := cm.apih.UpdateCheckBundleMetrics(metrics)
+	if err != nil {
+		// pending updates are retried with the next update
+		cm.Log.Printf("[ERROR] updating check bundle metrics %v", err)
+		return
+	}
 
-	i := 0
-	for _, metric := range newMetrics {
-		cm.checkBundle.Metrics[numCurrMetrics+i] = *metric
-		i++
-		updatedCheckBundle = true
+	for _, metric := range batch {
+		delete(cm.pendingMetrics, metric.Name)
 	}
 
-	if updatedCheckBundle {
-		cm.forceCheckUpdate = true
+	if cm.Debug {
+		cm.Log.Printf("[DEBUG] updated %d check bundle metric(s), %d pending\n", len(batch), len(cm.pendingMetrics))
 	}
 
-	return updatedCheckBundle
+	cm.cbmu.Lock()
+	for _, metric := range append(append(current.Metrics, batch...), updated.Metrics...) {
+		found := false
+		for i, m := range cm.checkBundle.Metrics {
+			if m.Name == metric.Name {
+				cm.checkBundle.Metrics[i] = metric
+				found = true
+				break
+			}
+		}
+		if !found {
+			cm.checkBundle.Metrics = append(cm.checkBundle.Metrics, metric)
+		}
+	}
+	cm.cbmu.Unlock()
+
+	cm.availableMetricsmu.Lock()
+	for _, metric := range batch {
+		cm.availableMetrics[metric.Name] = metric.Status == "active"
+	}
+	for _, metric := range updated.Metrics {
+		cm.availableMetrics[metric.Name] = metric.Status == "active"
+	}
+	cm.availableMetricsmu.Unlock()
 }
 
 // inventoryMetrics creates list of active metrics in check bundle
 func (cm *CheckManager) inventoryMetrics() {
 	availableMetrics := make(map[string]bool)
-	for _, metric := range cm.checkBundle.Metrics {
-		availableMetrics[metric.Name] = metric.Status == "active"
+	cm.cbmu.Lock()
+	if cm.checkBundle != nil {
+		for _, metric := range cm.checkBundle.Metrics {
+			availableMetrics[metric.Name] = metric.Status == "active"
+		}
 	}
+	cm.cbmu.Unlock()
 	cm.availableMetricsmu.Lock()
 	cm.availableMetrics = availableMetrics
 	cm.availableMetricsmu.Unlock()
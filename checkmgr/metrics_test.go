@@ -5,8 +5,11 @@
 package checkmgr
 
 import (
+	"context"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/circonus-labs/circonus-gometrics/api"
 )
@@ -314,32 +317,155 @@ func TestAddMetricTags(t *testing.T) {
 	}
 }
 
-func TestAddNewMetrics(t *testing.T) {
+func TestQueueMetricUpdates(t *testing.T) {
 	cm := &CheckManager{}
+	cm.checkBundle = &api.CheckBundle{
+		Metrics: []api.CheckBundleMetric{{Name: "foo", Type: "numeric", Status: "active"}},
+	}
+	cm.metricTags = map[string][]string{
+		"foo": {"cat:foo"},
+		"bar": {"cat:bar"},
+		"baz": {"cat:baz"},
+	}
 
-	newMetrics := make(map[string]*api.CheckBundleMetric)
+	cm.queueMetricUpdates(map[string]*api.CheckBundleMetric{
+		"bar": {Name: "bar", Type: "numeric", Status: "active"},
+	})
 
-	newMetrics["foo"] = &api.CheckBundleMetric{
-		Name:   "foo",
-		Type:   "numeric",
-		Status: "active",
+	if len(cm.pendingMetrics) != 2 {
+		t.Fatalf("Expected 2 pending, got %+v", cm.pendingMetrics)
+	}
+	if m := cm.pendingMetrics["foo"]; m.Status != "active" || !reflect.DeepEqual(m.Tags, []string{"cat:foo"}) {
+		t.Fatalf("Expected foo with tags, got %+v", m)
+	}
+	if m := cm.pendingMetrics["bar"]; !reflect.DeepEqual(m.Tags, []string{"cat:bar"}) {
+		t.Fatalf("Expected bar with tags, got %+v", m)
+	}
+	if len(cm.metricTags) != 0 {
+		t.Fatalf("Expected queued tags consumed (baz discarded), got %v", cm.metricTags)
 	}
 
-	t.Log("no check bundle")
+	t.Log("already queued")
 	{
-		if cm.addNewMetrics(newMetrics) {
-			t.Fatalf("Expected false")
+		cm.queueMetricUpdates(map[string]*api.CheckBundleMetric{
+			"bar": {Name: "bar", Type: "text", Status: "active"},
+		})
+		if m := cm.pendingMetrics["bar"]; m.Type != "numeric" || len(m.Tags) != 1 {
+			t.Fatalf("Expected queued bar unchanged, got %+v", m)
 		}
 	}
+}
 
-	cm.checkBundle = &api.CheckBundle{}
-	t.Log("no check bundle metrics")
+func TestMetricUpdates(t *testing.T) {
+	srv, _, bundle, cleanup := failoverSetup(t, 0)
+	defer cleanup()
+
+	cm, err := New(&Config{
+		API: api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+		Check: CheckConfig{
+			ID:                   strings.TrimPrefix(bundle.Checks[0], "/check/"),
+			MetricUpdateInterval: "1h",
+			MetricUpdateBatch:    "2",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	cm.Initialize()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cm.WaitReady(ctx); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	metricsPath := "/check_bundle_metrics/" + strings.TrimPrefix(bundle.CID, "/check_bundle/")
+	puts := func() int {
+		n := 0
+		for _, req := range srv.Requests() {
+			if req.Method != "PUT" {
+				continue
+			}
+			if req.Path != metricsPath {
+				t.Fatalf("Expected only check bundle metrics updates, got %s %s", req.Method, req.Path)
+			}
+			n++
+		}
+		return n
+	}
+
+	t.Log("batch")
 	{
-		if !cm.addNewMetrics(newMetrics) {
-			t.Fatalf("Expected true")
+		srv.ResetRequests()
+		cm.UpdateCheck(map[string]*api.CheckBundleMetric{
+			"a": {Name: "a", Type: "numeric", Status: "active"},
+			"b": {Name: "b", Type: "numeric", Status: "active"},
+			"c": {Name: "c", Type: "numeric", Status: "active"},
+		})
+		if n := puts(); n != 1 {
+			t.Fatalf("Expected 1 update, got %d", n)
+		}
+		if !cm.IsMetricActive("a") || !cm.IsMetricActive("b") || cm.IsMetricActive("c") {
+			t.Fatalf("Expected a and b active, got %v", cm.availableMetrics)
+		}
+		if _, pending := cm.pendingMetrics["c"]; !pending {
+			t.Fatalf("Expected c pending, got %v", cm.pendingMetrics)
+		}
+	}
+
+	t.Log("debounce")
+	{
+		srv.ResetRequests()
+		cm.AddMetricTags("a", []string{"cat:a"}, false)
+		cm.UpdateCheck(nil)
+		if len(srv.Requests()) != 0 {
+			t.Fatalf("Expected no requests, got %+v", srv.Requests())
+		}
+		if len(cm.pendingMetrics) != 2 {
+			t.Fatalf("Expected a and c pending, got %v", cm.pendingMetrics)
 		}
-		if !cm.forceCheckUpdate {
-			t.Fatal("Expected forceCheckUpdate to be true")
+	}
+
+	t.Log("metric limit")
+	{
+		srv.ResetRequests()
+		cm.checkBundle.MetricLimit = 2
+		cm.lastMetricUpdate = time.Now().Add(-time.Hour)
+		cm.UpdateCheck(nil)
+		if n := puts(); n != 1 {
+			t.Fatalf("Expected 1 update, got %d", n)
+		}
+		if len(cm.pendingMetrics) != 0 {
+			t.Fatalf("Expected nothing pending, got %v", cm.pendingMetrics)
+		}
+		if cm.IsMetricActive("c") || !cm.IsMetricActive("a") {
+			t.Fatalf("Expected c not activated, got %v", cm.availableMetrics)
+		}
+
+		stored, _ := srv.Get(bundle.CID)
+		metrics, _ := stored["metrics"].([]interface{})
+		if len(metrics) != 2 {
+			t.Fatalf("Expected 2 metrics, got %+v", metrics)
+		}
+		for _, m := range metrics {
+			m := m.(map[string]interface{})
+			if m["name"] != "a" {
+				continue
+			}
+			if tags, _ := m["tags"].([]interface{}); len(tags) != 1 || tags[0] != "cat:a" {
+				t.Fatalf("Expected a tagged, got %+v", m)
+			}
+		}
+	}
+
+	t.Log("limit reached, nothing sent")
+	{
+		srv.ResetRequests()
+		cm.lastMetricUpdate = time.Time{}
+		cm.UpdateCheck(map[string]*api.CheckBundleMetric{
+			"d": {Name: "d", Type: "numeric", Status: "active"},
+		})
+		if n := puts(); n != 0 {
+			t.Fatalf("Expected no update, got %d", n)
 		}
 	}
 }
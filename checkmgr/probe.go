@@ -0,0 +1,196 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+const (
+	brokerProbeRetries   = 5
+	brokerProbeRetryWait = 2 * time.Second
+	brokerProbeCacheTTL  = time.Minute
+)
+
+// probeResult is the outcome of connecting to a broker instance
+type probeResult struct {
+	rtt time.Duration
+	ok  bool
+	at  time.Time
+}
+
+// probeJob is a broker instance to connect to
+type probeJob struct {
+	broker string // cid
+	name   string
+	addr   string
+}
+
+// probeBrokers validates brokers (active, supports check type, and
+// reachable), connecting to all usable instances concurrently with at most
+// brokerProbeWorkers connection attempts in flight and an overall deadline of
+// brokerProbeTimeout (or ctx, if done first). Returns the connect time of the
+// fastest reachable instance of each valid broker by cid. Successful
+// connections are cached for brokerProbeCacheTTL, failures are not (an
+// instance may be back by the next selection), instances not probed before
+// the deadline are unreachable.
+func (cm *CheckManager) probeBrokers(ctx context.Context, brokers []api.Broker) map[string]time.Duration {
+	var jobs []probeJob
+
+	for _, broker := range brokers {
+		if broker.Type != "circonus" && broker.Type != "enterprise" {
+			continue
+		}
+
+		for _, detail := range broker.Details {
+			detail := detail
+
+			// broker must be active
+			if detail.Status != statusActive {
+				if cm.Debug {
+					cm.Log.Printf("[DEBUG] Broker '%s' is not active.\n", broker.Name)
+				}
+				continue
+			}
+
+			// broker must have module loaded for the check type to be used
+			if !cm.brokerSupportsCheckType(cm.checkType, &detail) {
+				if cm.Debug {
+					cm.Log.Printf("[DEBUG] Broker '%s' does not support '%s' checks.\n", broker.Name, cm.checkType)
+				}
+				continue
+			}
+
+			brokerHost, brokerPort := brokerAddress(&detail)
+			if brokerHost == "" {
+				cm.Log.Printf("[WARN] Broker '%s' instance %s has no IP or external host set", broker.Name, detail.CN)
+				continue
+			}
+
+			jobs = append(jobs, probeJob{broker: broker.CID, name: broker.Name, addr: net.JoinHostPort(brokerHost, brokerPort)})
+		}
+	}
+
+	valid := make(map[string]time.Duration)
+	if len(jobs) == 0 {
+		return valid
+	}
+
+	timeout := cm.brokerProbeTimeout
+	if timeout <= 0 {
+		timeout, _ = time.ParseDuration(defaultBrokerProbeTimeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	workers := cm.brokerProbeWorkers
+	if workers <= 0 {
+		workers = defaultBrokerProbeWorkers
+	}
+
+	// connection attempts are bounded, waiting to retry is not (so
+	// unreachable instances don't hold up the others)
+	sem := make(chan struct{}, workers)
+	results := make([]probeResult, len(jobs))
+	var wg sync.WaitGroup
+	for i := range jobs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cm.probeInstance(ctx, sem, jobs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, job := range jobs {
+		r := results[i]
+		if !r.ok {
+			continue
+		}
+		if rtt, found := valid[job.broker]; !found || r.rtt < rtt {
+			valid[job.broker] = r.rtt
+		}
+	}
+
+	if cm.Debug {
+		for _, broker := range brokers {
+			if _, ok := valid[broker.CID]; ok {
+				cm.Log.Printf("[DEBUG] Broker '%s' is valid\n", broker.Name)
+			}
+		}
+	}
+
+	return valid
+}
+
+// probeInstance connects to a broker instance, retrying until it responds
+// within the broker max response time or the context is done, each
+// connection attempt holds a slot in sem
+func (cm *CheckManager) probeInstance(ctx context.Context, sem chan struct{}, job probeJob) probeResult {
+	cm.probemu.Lock()
+	cached, found := cm.probeCache[job.addr]
+	if found && time.Since(cached.at) >= brokerProbeCacheTTL {
+		delete(cm.probeCache, job.addr)
+		found = false
+	}
+	cm.probemu.Unlock()
+	if found {
+		return cached
+	}
+
+	var r probeResult
+	dialer := &net.Dialer{Timeout: cm.brokerMaxResponseTime}
+	for attempt := 1; attempt <= brokerProbeRetries; attempt++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return probeResult{}
+		}
+		// broker must be reachable and respond within designated time
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", job.addr)
+		<-sem
+		if err == nil {
+			conn.Close()
+			r = probeResult{rtt: time.Since(start), ok: true}
+			break
+		}
+		if ctx.Err() != nil {
+			cm.Log.Printf("[WARN] Broker '%s' unable to connect, %v.", job.name, err)
+			return probeResult{}
+		}
+
+		if attempt == brokerProbeRetries {
+			cm.Log.Printf("[WARN] Broker '%s' unable to connect, %v. Giving up after %d attempts.", job.name, err, attempt)
+			break
+		}
+
+		cm.Log.Printf("[WARN] Broker '%s' unable to connect, %v. Retrying in %s, attempt %d of %d.", job.name, err, brokerProbeRetryWait, attempt, brokerProbeRetries)
+		select {
+		case <-time.After(brokerProbeRetryWait):
+		case <-ctx.Done():
+			return probeResult{}
+		}
+	}
+
+	if !r.ok {
+		return r
+	}
+
+	r.at = time.Now()
+	cm.probemu.Lock()
+	if cm.probeCache == nil {
+		cm.probeCache = make(map[string]probeResult)
+	}
+	cm.probeCache[job.addr] = r
+	cm.probemu.Unlock()
+
+	return r
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+)
+
+func testProbeBroker(cid, addr string) api.Broker {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return api.Broker{
+		CID:  cid,
+		Name: cid,
+		Type: "enterprise",
+		Details: []api.BrokerDetail{
+			{
+				CN:           cid,
+				ExternalPort: uint16(p),
+				IP:           &host,
+				Modules:      []string{"httptrap"},
+				Status:       statusActive,
+			},
+		},
+	}
+}
+
+func TestProbeBrokers(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer up.Close()
+
+	var down []string
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		down = append(down, l.Addr().String())
+		l.Close()
+	}
+
+	cm := &CheckManager{
+		Log:                   log.New(ioutil.Discard, "", log.LstdFlags),
+		checkType:             "httptrap",
+		brokerMaxResponseTime: 100 * time.Millisecond,
+		brokerProbeTimeout:    500 * time.Millisecond,
+		brokerProbeWorkers:    4,
+	}
+
+	t.Log("concurrent, bounded by deadline")
+	{
+		var brokers []api.Broker
+		for i, addr := range down {
+			brokers = append(brokers, testProbeBroker("/broker/"+strconv.Itoa(i+10), addr))
+		}
+		// second instance of the last broker is reachable
+		brokers = append(brokers, testProbeBroker("/broker/1", up.Addr().String()))
+		last := &brokers[len(down)-1]
+		last.Details = append(last.Details, brokers[len(down)].Details[0])
+
+		start := time.Now()
+		valid := cm.probeBrokers(context.Background(), brokers)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("Expected probing within the deadline, took %v", elapsed)
+		}
+		if len(valid) != 2 {
+			t.Fatalf("Expected 2 valid brokers, got %v", valid)
+		}
+		if _, ok := valid["/broker/1"]; !ok {
+			t.Fatalf("Expected /broker/1 valid, got %v", valid)
+		}
+		if _, ok := valid[last.CID]; !ok {
+			t.Fatalf("Expected %s valid (second instance), got %v", last.CID, valid)
+		}
+	}
+
+	t.Log("cached results")
+	{
+		up.Close()
+		if !cm.isValidBroker(&[]api.Broker{testProbeBroker("/broker/1", up.Addr().String())}[0]) {
+			t.Fatal("Expected valid broker (cached)")
+		}
+
+		cm.probemu.Lock()
+		for addr, r := range cm.probeCache {
+			r.at = time.Now().Add(-brokerProbeCacheTTL)
+			cm.probeCache[addr] = r
+		}
+		cm.probemu.Unlock()
+
+		if cm.isValidBroker(&[]api.Broker{testProbeBroker("/broker/1", up.Addr().String())}[0]) {
+			t.Fatal("Expected invalid broker (cache expired)")
+		}
+
+		cm.probemu.Lock()
+		_, cached := cm.probeCache[down[0]]
+		cm.probemu.Unlock()
+		if cached {
+			t.Fatal("Expected failed probe not cached")
+		}
+	}
+
+	t.Log("caller context")
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		if valid := cm.probeBrokers(ctx, []api.Broker{testProbeBroker("/broker/6", down[0])}); len(valid) != 0 {
+			t.Fatalf("Expected no valid brokers, got %v", valid)
+		}
+		if elapsed := time.Since(start); elapsed > brokerProbeRetryWait {
+			t.Fatalf("Expected probing to stop with the context, took %v", elapsed)
+		}
+	}
+
+	t.Log("not probed")
+	{
+		b := testProbeBroker("/broker/2", "127.0.0.1:1")
+		b.Type = "other"
+		inactive := testProbeBroker("/broker/3", "127.0.0.1:1")
+		inactive.Details[0].Status = "unprovisioned"
+		noModule := testProbeBroker("/broker/4", "127.0.0.1:1")
+		noModule.Details[0].Modules = []string{"json"}
+		noHost := testProbeBroker("/broker/5", "127.0.0.1:1")
+		noHost.Details[0].IP = nil
+
+		if valid := cm.probeBrokers(context.Background(), []api.Broker{b, inactive, noModule, noHost}); len(valid) != 0 {
+			t.Fatalf("Expected no valid brokers, got %v", valid)
+		}
+		cm.probemu.Lock()
+		_, probed := cm.probeCache["127.0.0.1:1"]
+		cm.probemu.Unlock()
+		if probed {
+			t.Fatal("Expected no connection attempts")
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/pkg/errors"
+)
+
+// Broker selection strategies (BrokerConfig.SelectStrategy), used when
+// creating a check without a specific broker id
+const (
+	// SelectRandom any valid broker, uniformly at random (default)
+	SelectRandom = "random"
+	// SelectLatency the broker with the lowest connect time
+	SelectLatency = "latency"
+	// SelectNearest the broker nearest to BrokerConfig.Location
+	SelectNearest = "nearest"
+	// SelectSkew the broker with the lowest clock skew
+	SelectSkew = "skew"
+	// SelectTagOrder the broker with the first of BrokerConfig.PreferTags
+	SelectTagOrder = "tag_order"
+)
+
+// BrokerCandidate is a valid broker (active, supports the check type and
+// reachable) a new check could be created on
+type BrokerCandidate struct {
+	Broker api.Broker
+	// connect time of the fastest reachable broker instance
+	RTT time.Duration
+}
+
+// BrokerSelector chooses the broker for a new check among the candidates
+// (at least one, ordered by cid), returning the index of the chosen
+// candidate and the reason for the choice, which is logged
+type BrokerSelector func(candidates []BrokerCandidate) (int, string)
+
+// newBrokerSelector returns the selector for a strategy
+func newBrokerSelector(strategy, location, preferTags string) (BrokerSelector, error) {
+	switch strategy {
+	case "", SelectRandom:
+		return selectRandom, nil
+	case SelectLatency:
+		return selectLatency, nil
+	case SelectNearest:
+		lat, lon, err := parseLocation(location)
+		if err != nil {
+			return nil, err
+		}
+		return selectNearest(lat, lon), nil
+	case SelectSkew:
+		return selectSkew, nil
+	case SelectTagOrder:
+		if preferTags == "" {
+			return nil, errors.Errorf("broker select strategy %s requires prefer tags", strategy)
+		}
+		return selectTagOrder(strings.Split(strings.Replace(preferTags, " ", "", -1), ",")), nil
+	}
+	return nil, errors.Errorf("invalid broker select strategy (%s)", strategy)
+}
+
+// parseLocation parses a "latitude,longitude" location
+func parseLocation(location string) (float64, float64, error) {
+	parts := strings.Split(location, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid broker location (%s), expected latitude,longitude", location)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, errors.Errorf("invalid broker location latitude (%s)", parts[0])
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, errors.Errorf("invalid broker location longitude (%s)", parts[1])
+	}
+	return lat, lon, nil
+}
+
+func selectRandom(candidates []BrokerCandidate) (int, string) {
+	return rand.Intn(len(candidates)), fmt.Sprintf("random choice of %d valid broker(s)", len(candidates))
+}
+
+func selectLatency(candidates []BrokerCandidate) (int, string) {
+	best := 0
+	for i, c := range candidates {
+		if c.RTT < candidates[best].RTT {
+			best = i
+		}
+	}
+	return best, fmt.Sprintf("lowest connect time %s of %d valid broker(s)", candidates[best].RTT, len(candidates))
+}
+
+func selectNearest(lat, lon float64) BrokerSelector {
+	return func(candidates []BrokerCandidate) (int, string) {
+		best := -1
+		bestDist := math.Inf(1)
+		for i, c := range candidates {
+			if c.Broker.Latitude == nil || c.Broker.Longitude == nil {
+				continue
+			}
+			blat, err := strconv.ParseFloat(*c.Broker.Latitude, 64)
+			if err != nil {
+				continue
+			}
+			blon, err := strconv.ParseFloat(*c.Broker.Longitude, 64)
+			if err != nil {
+				continue
+			}
+			if d := distance(lat, lon, blat, blon); d < bestDist {
+				best, bestDist = i, d
+			}
+		}
+		if best < 0 {
+			i, reason := selectLatency(candidates)
+			return i, "no broker location, " + reason
+		}
+		return best, fmt.Sprintf("nearest (%.0fkm) of %d valid broker(s)", bestDist, len(candidates))
+	}
+}
+
+// distance in km between two points (haversine)
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371 // km
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func selectSkew(candidates []BrokerCandidate) (int, string) {
+	best := -1
+	bestSkew := math.Inf(1)
+	for i, c := range candidates {
+		for _, detail := range c.Broker.Details {
+			if detail.Status != statusActive || detail.Skew == nil {
+				continue
+			}
+			skew, err := strconv.ParseFloat(*detail.Skew, 64)
+			if err != nil {
+				continue
+			}
+			if skew = math.Abs(skew); skew < bestSkew {
+				best, bestSkew = i, skew
+			}
+		}
+	}
+	if best < 0 {
+		i, reason := selectRandom(candidates)
+		return i, "no broker skew, " + reason
+	}
+	return best, fmt.Sprintf("lowest skew %g of %d valid broker(s)", bestSkew, len(candidates))
+}
+
+func selectTagOrder(tags []string) BrokerSelector {
+	return func(candidates []BrokerCandidate) (int, string) {
+		for _, tag := range tags {
+			var tagged []BrokerCandidate
+			var idx []int
+			for i, c := range candidates {
+				for _, t := range c.Broker.Tags {
+					if t == tag {
+						tagged = append(tagged, c)
+						idx = append(idx, i)
+						break
+					}
+				}
+			}
+			if len(tagged) > 0 {
+				i, reason := selectLatency(tagged)
+				return idx[i], fmt.Sprintf("preferred tag %s, %s", tag, reason)
+			}
+		}
+		i, reason := selectRandom(candidates)
+		return i, "no preferred tag, " + reason
+	}
+}
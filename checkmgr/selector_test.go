@@ -0,0 +1,212 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func testCandidates() []BrokerCandidate {
+	return []BrokerCandidate{
+		{
+			Broker: api.Broker{
+				CID:       "/broker/1",
+				Name:      "nyc",
+				Latitude:  strPtr("40.71"),
+				Longitude: strPtr("-74.01"),
+				Tags:      []string{"dc:east"},
+				Details:   []api.BrokerDetail{{Status: statusActive, Skew: strPtr("-0.5")}},
+			},
+			RTT: 30 * time.Millisecond,
+		},
+		{
+			Broker: api.Broker{
+				CID:       "/broker/2",
+				Name:      "sfo",
+				Latitude:  strPtr("37.77"),
+				Longitude: strPtr("-122.42"),
+				Tags:      []string{"dc:west"},
+				Details:   []api.BrokerDetail{{Status: statusActive, Skew: strPtr("0.1")}},
+			},
+			RTT: 10 * time.Millisecond,
+		},
+		{
+			Broker: api.Broker{
+				CID:     "/broker/3",
+				Name:    "lon",
+				Tags:    []string{"dc:west"},
+				Details: []api.BrokerDetail{{Status: statusActive}},
+			},
+			RTT: 20 * time.Millisecond,
+		},
+	}
+}
+
+func TestBrokerSelectors(t *testing.T) {
+	candidates := testCandidates()
+
+	for _, test := range []struct {
+		strategy   string
+		location   string
+		preferTags string
+		expect     string
+		reason     string
+	}{
+		{SelectLatency, "", "", "sfo", "lowest connect time 10ms"},
+		{SelectNearest, "40.0,-75.0", "", "nyc", "nearest"},
+		{SelectNearest, "38,-120", "", "sfo", "nearest"},
+		{SelectSkew, "", "", "sfo", "lowest skew 0.1"},
+		{SelectTagOrder, "", "dc:west, dc:east", "sfo", "preferred tag dc:west"},
+		{SelectTagOrder, "", "dc:north,dc:east", "nyc", "preferred tag dc:east"},
+	} {
+		selector, err := newBrokerSelector(test.strategy, test.location, test.preferTags)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		idx, reason := selector(candidates)
+		if candidates[idx].Broker.Name != test.expect {
+			t.Fatalf("Expected %s for %s, got %s (%s)", test.expect, test.strategy, candidates[idx].Broker.Name, reason)
+		}
+		if !strings.Contains(reason, test.reason) {
+			t.Fatalf("Expected reason '%s', got '%s'", test.reason, reason)
+		}
+	}
+
+	t.Log("random")
+	{
+		for _, strategy := range []string{"", SelectRandom} {
+			selector, err := newBrokerSelector(strategy, "", "")
+			if err != nil {
+				t.Fatalf("Expected no error, got '%v'", err)
+			}
+			seen := make(map[int]bool)
+			for i := 0; i < 100; i++ {
+				idx, _ := selector(candidates)
+				seen[idx] = true
+			}
+			if len(seen) != len(candidates) {
+				t.Fatalf("Expected all candidates chosen, got %v", seen)
+			}
+		}
+	}
+
+	t.Log("fallbacks")
+	{
+		lon := candidates[2:]
+		if _, reason := selectNearest(0, 0)(lon); !strings.HasPrefix(reason, "no broker location, lowest connect time") {
+			t.Fatalf("Expected latency fallback, got '%s'", reason)
+		}
+		if _, reason := selectSkew(lon); !strings.HasPrefix(reason, "no broker skew, random") {
+			t.Fatalf("Expected random fallback, got '%s'", reason)
+		}
+		if _, reason := selectTagOrder([]string{"dc:north"})(lon); !strings.HasPrefix(reason, "no preferred tag, random") {
+			t.Fatalf("Expected random fallback, got '%s'", reason)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, test := range []struct{ strategy, location, preferTags string }{
+			{"fastest", "", ""},
+			{SelectNearest, "", ""},
+			{SelectNearest, "40.7", ""},
+			{SelectNearest, "x,-74", ""},
+			{SelectNearest, "91,0", ""},
+			{SelectNearest, "0,181", ""},
+			{SelectTagOrder, "", ""},
+		} {
+			if _, err := newBrokerSelector(test.strategy, test.location, test.preferTags); err == nil {
+				t.Fatalf("Expected error for %+v", test)
+			}
+			cfg := &Config{API: api.Config{TokenKey: "abc"}, Broker: BrokerConfig{SelectStrategy: test.strategy, Location: test.location, PreferTags: test.preferTags}}
+			if errs := cfg.Validate(); len(errs) != 1 {
+				t.Fatalf("Expected 1 error for %+v, got %v", test, errs)
+			}
+			if _, err := New(cfg); err == nil {
+				t.Fatalf("Expected error for %+v", test)
+			}
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// new york - london, ~5570km
+	if d := distance(40.71, -74.01, 51.51, -0.13); math.Abs(d-5570) > 10 {
+		t.Fatalf("Expected ~5570km, got %f", d)
+	}
+	if d := distance(10, 10, 10, 10); d != 0 {
+		t.Fatalf("Expected 0, got %f", d)
+	}
+}
+
+func TestSelectBrokerStrategy(t *testing.T) {
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	for _, name := range []string{"a", "b", "c"} {
+		trap, err := brokertest.New(&brokertest.Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer trap.Close()
+		if _, err := srv.AddBroker(name, trap); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	var names []string
+	cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}}
+	cfg.Log = log.New(&buf, "", 0)
+	cfg.Debug = true
+	cfg.Broker.Selector = func(candidates []BrokerCandidate) (int, string) {
+		for _, c := range candidates {
+			names = append(names, c.Broker.Name)
+			if c.RTT <= 0 {
+				t.Fatalf("Expected connect time, got %v", c.RTT)
+			}
+		}
+		return 1, "custom"
+	}
+	cm, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	broker, err := cm.selectBroker()
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if broker.Name != "b" || strings.Join(names, ",") != "a,b,c" {
+		t.Fatalf("Expected b of a,b,c, got %s of %v", broker.Name, names)
+	}
+	if !strings.Contains(buf.String(), "[DEBUG] Selected broker 'b' (custom)") {
+		t.Fatalf("Expected selection logged, got '%s'", buf.String())
+	}
+
+	t.Log("invalid index")
+	{
+		cm.brokerSelector = func(candidates []BrokerCandidate) (int, string) { return len(candidates), "oops" }
+		if _, err := cm.selectBroker(); err == nil || !strings.Contains(err.Error(), "invalid index 3") {
+			t.Fatalf("Expected invalid index error, got '%v'", err)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/pkg/errors"
+)
+
+// cachedState is the resolved check, saved to CheckConfig.StateFile so the
+// next start can submit metrics without waiting on the API
+type cachedState struct {
+	// Key identifies the configuration the state was resolved with
+	Key            string    `json:"key"`
+	CheckBundleCID string    `json:"check_bundle_cid"`
+	SubmissionURL  string    `json:"submission_url"`
+	BrokerCID      string    `json:"broker_cid"`
+	BrokerName     string    `json:"broker_name"`
+	BrokerCN       string    `json:"broker_cn"`
+	CACert         string    `json:"ca_cert,omitempty"`
+	Saved          time.Time `json:"saved"`
+}
+
+// computeStateKey identifies the settings used to find (or create) the
+// check, a state saved with other settings is not used. It is computed once
+// from the configuration, initialization changes some of the settings (e.g.
+// the check id of a submission url).
+func (cm *CheckManager) computeStateKey() string {
+	h := sha256.New()
+	fmt.Fprintln(h, cm.apiURL)
+	fmt.Fprintln(h, cm.checkType, cm.checkID, cm.checkSubmissionURL)
+	fmt.Fprintln(h, cm.checkInstanceID, cm.checkTarget, strings.Join(cm.checkSearchTag, ","))
+	fmt.Fprintln(h, cm.brokerID, strings.Join(cm.brokerSelectTag, ","))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadState starts from the state file, if there is one saved with the
+// current settings. Returns true if the submission url was set.
+func (cm *CheckManager) loadState() bool {
+	if cm.stateFile == "" {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(cm.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			cm.Log.Printf("[WARN] reading state file %s", err)
+		}
+		return false
+	}
+
+	var st cachedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		cm.Log.Printf("[WARN] parsing state file %s: %s", cm.stateFile, err)
+		return false
+	}
+	if st.Key != cm.stateKey || st.CheckBundleCID == "" || st.SubmissionURL == "" {
+		if cm.Debug {
+			cm.Log.Printf("[DEBUG] state file %s does not match the configuration, ignoring", cm.stateFile)
+		}
+		return false
+	}
+
+	var certPool *x509.CertPool
+	if st.CACert != "" {
+		certPool = x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM([]byte(st.CACert)) {
+			cm.Log.Printf("[WARN] state file %s has an invalid ca cert, ignoring", cm.stateFile)
+			return false
+		}
+	}
+
+	cm.trapmu.Lock()
+	cm.trapURL = api.URLType(st.SubmissionURL)
+	cm.trapCN = BrokerCNType(st.BrokerCN)
+	cm.broker = &api.Broker{CID: st.BrokerCID, Name: st.BrokerName}
+	if certPool != nil {
+		cm.certPool = certPool
+		cm.caPEM = []byte(st.CACert)
+	}
+	cm.trapLastUpdate = time.Now()
+	cm.trapmu.Unlock()
+
+	cm.statemu.Lock()
+	cm.stateCached = &st
+	cm.statemu.Unlock()
+
+	cm.initializedmu.Lock()
+	cm.initialized = true
+	cm.initializedmu.Unlock()
+	cm.setState(StateReady, nil)
+
+	if cm.Debug {
+		cm.Log.Printf("[DEBUG] using check bundle %s from state file %s (saved %s)", st.CheckBundleCID, cm.stateFile, st.Saved.Format(time.RFC3339))
+	}
+
+	return true
+}
+
+// revalidateState verifies the state loaded from the state file against the
+// API. If the check bundle is gone, inactive or its submission url changed
+// the state file is removed and the check is resolved again. If the API
+// cannot be reached the loaded state is used meanwhile, and revalidation is
+// retried with the initialization backoff (see InitConfig) until it succeeds
+// or the check manager is shut down.
+func (cm *CheckManager) revalidateState() {
+	cm.statemu.Lock()
+	st := cm.stateCached
+	cm.statemu.Unlock()
+	if st == nil {
+		return
+	}
+
+	delay := cm.initMinDelay
+	for {
+		if cm.isShutdown() {
+			return
+		}
+		err := cm.verifyState(st)
+		if err == nil {
+			return
+		}
+
+		cm.cbmu.Lock()
+		resolved := cm.checkBundle != nil
+		cm.cbmu.Unlock()
+		if resolved {
+			// resolved meanwhile (e.g. the submission url was reset)
+			return
+		}
+
+		wait := cm.initWait(delay)
+		cm.Log.Printf("[WARN] unable to revalidate state file %s, using it as is, retrying in %s: %s", cm.stateFile, wait, err)
+		if !cm.sleep(wait) {
+			return
+		}
+
+		if delay *= 2; delay > cm.initMaxDelay {
+			delay = cm.initMaxDelay
+		}
+	}
+}
+
+// verifyState revalidates the state once, returns an error only if the API
+// could not be reached (a transient error)
+func (cm *CheckManager) verifyState(st *cachedState) error {
+	stale := func(reason string) {
+		cm.Log.Printf("[WARN] state file %s is stale (%s), resolving check", cm.stateFile, reason)
+		cm.removeState()
+		if err := cm.ResetTrap(); err != nil {
+			cm.Log.Printf("[WARN] resolving check: %s", err)
+		}
+	}
+
+	cid := st.CheckBundleCID
+	bundle, err := cm.apih.FetchCheckBundle(api.CIDType(&cid))
+	if err != nil {
+		if IsPermanent(err) {
+			stale(err.Error())
+			return nil
+		}
+		return err
+	}
+	if bundle.Status != statusActive {
+		stale("check bundle is not active")
+		return nil
+	}
+	turl, err := cm.bundleSubmissionURL(bundle)
+	if err != nil {
+		stale(err.Error())
+		return nil
+	}
+	if string(turl) != st.SubmissionURL {
+		stale("submission url changed")
+		return nil
+	}
+
+	broker := &api.Broker{CID: st.BrokerCID, Name: st.BrokerName}
+	if len(bundle.Brokers) > 0 {
+		cid := bundle.Brokers[0]
+		if b, err := cm.apih.FetchBroker(api.CIDType(&cid)); err == nil {
+			broker = b
+		} else {
+			cm.Log.Printf("[WARN] fetching broker %s: %s", cid, err)
+		}
+	}
+
+	cm.cbmu.Lock()
+	cm.checkBundle = bundle
+	cm.cbmu.Unlock()
+	cm.trapmu.Lock()
+	cm.broker = broker
+	cm.trapmu.Unlock()
+	cm.inventoryMetrics()
+	cm.setState(StateReady, nil)
+	cm.extendEphemeral()
+	cm.syncMetricFilters()
+
+	if cm.Debug {
+		cm.Log.Printf("[DEBUG] state file %s revalidated", cm.stateFile)
+	}
+
+	return nil
+}
+
+// saveState writes the current check, submission url, broker cn and ca cert
+// to the state file (readable only by the owner, the url holds the secret)
+func (cm *CheckManager) saveState() error {
+	if cm.stateFile == "" {
+		return nil
+	}
+
+	cm.cbmu.Lock()
+	bundle := cm.checkBundle
+	cm.cbmu.Unlock()
+	if bundle == nil {
+		return nil
+	}
+
+	cm.trapmu.Lock()
+	st := cachedState{
+		Key:            cm.stateKey,
+		CheckBundleCID: bundle.CID,
+		SubmissionURL:  string(cm.trapURL),
+		BrokerCN:       string(cm.trapCN),
+		CACert:         string(cm.caPEM),
+		Saved:          time.Now(),
+	}
+	if cm.broker != nil {
+		st.BrokerCID = cm.broker.CID
+		st.BrokerName = cm.broker.Name
+	}
+	cm.trapmu.Unlock()
+
+	if st.SubmissionURL == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding state")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(cm.stateFile), filepath.Base(cm.stateFile)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating state file")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "writing state file")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "writing state file")
+	}
+	if err := os.Rename(tmp.Name(), cm.stateFile); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "saving state file")
+	}
+
+	cm.statemu.Lock()
+	cm.stateCached = &st
+	cm.statemu.Unlock()
+
+	return nil
+}
+
+// removeState removes the state file (e.g. when submissions fail), the
+// next start resolves the check through the API
+func (cm *CheckManager) removeState() {
+	if cm.stateFile == "" {
+		return
+	}
+
+	cm.statemu.Lock()
+	defer cm.statemu.Unlock()
+	if cm.stateCached == nil {
+		return
+	}
+	cm.stateCached = nil
+
+	if err := os.Remove(cm.stateFile); err != nil && !os.IsNotExist(err) {
+		cm.Log.Printf("[WARN] removing state file %s", err)
+	}
+}
+
+// submissionState removes the state file when a submission fails and saves
+// it again once submissions succeed
+func (cm *CheckManager) submissionState(err error) {
+	if cm.stateFile == "" {
+		return
+	}
+	if err != nil {
+		cm.removeState()
+		return
+	}
+
+	cm.statemu.Lock()
+	saved := cm.stateCached != nil
+	cm.statemu.Unlock()
+	if !saved {
+		if err := cm.saveState(); err != nil {
+			cm.Log.Printf("[WARN] %s", err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+	"github.com/pkg/errors"
+)
+
+func readState(t *testing.T, fn string) cachedState {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	var st cachedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return st
+}
+
+func waitStatus(t *testing.T, cm *CheckManager, ok func(Status) bool) Status {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if st := cm.Status(); ok(st) {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected status, got %+v", cm.Status())
+	return Status{}
+}
+
+func TestStateFile(t *testing.T) {
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{TLS: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+	if _, err := srv.AddBroker("test", trap); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	dir, err := ioutil.TempDir("", "cgm-state")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state.json")
+
+	newCM := func() *CheckManager {
+		cm, err := New(&Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{InstanceID: "state-test", StateFile: fn},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		return cm
+	}
+
+	t.Log("saved after initialization")
+	var saved cachedState
+	{
+		cm := newCM()
+		cm.Initialize()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		info, err := os.Stat(fn)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("Expected 0600, got %v", info.Mode().Perm())
+		}
+		saved = readState(t, fn)
+		st := cm.Status()
+		if saved.Key != cm.stateKey || saved.CheckBundleCID != st.CheckBundleCID || saved.SubmissionURL != st.SubmissionURL {
+			t.Fatalf("Expected state of %+v, got %+v", st, saved)
+		}
+		if saved.BrokerCN != trap.CN() || saved.CACert != string(trap.CACert()) {
+			t.Fatalf("Expected broker cn and ca cert, got %+v", saved)
+		}
+	}
+
+	t.Log("used at startup, revalidated in the background")
+	{
+		srv.ResetRequests()
+		srv.SetFault(apitest.Fault{Delay: 500 * time.Millisecond, Count: 1})
+		cm := newCM()
+		cm.Initialize()
+		if !cm.IsReady() {
+			t.Fatal("Expected ready from state file")
+		}
+		trapCfg, err := cm.GetSubmissionURL()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if trapCfg.URL.String() != saved.SubmissionURL || trapCfg.TLS == nil || trapCfg.TLS.ServerName != trap.CN() {
+			t.Fatalf("Expected cached submission url and tls config, got %+v", trapCfg)
+		}
+		waitStatus(t, cm, func(st Status) bool { return st.CheckBundleCID == saved.CheckBundleCID })
+		for _, req := range srv.Requests() {
+			if req.Method != "GET" || (req.Path != saved.CheckBundleCID && req.Path != saved.BrokerCID) {
+				t.Fatalf("Expected only revalidation requests, got %s %s", req.Method, req.Path)
+			}
+		}
+	}
+
+	t.Log("removed on failed submission, saved again on success")
+	{
+		cm := newCM()
+		cm.Initialize()
+		waitStatus(t, cm, func(st Status) bool { return st.CheckBundleCID != "" })
+		cm.ReportSubmission(errors.New("broker down"))
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Fatalf("Expected state file removed, got '%v'", err)
+		}
+		cm.ReportSubmission(nil)
+		if st := readState(t, fn); st.SubmissionURL != saved.SubmissionURL {
+			t.Fatalf("Expected state saved again, got %+v", st)
+		}
+	}
+
+	t.Log("revalidation retried until the api is reachable")
+	{
+		srv.SetFault(apitest.Fault{StatusCode: 408, Path: "/check_bundle", Count: 2})
+		defer srv.ClearFault()
+		cm, err := New(&Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{InstanceID: "state-test", StateFile: fn},
+			Init:  InitConfig{MinDelay: "1ms"},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		if !cm.IsReady() {
+			t.Fatal("Expected ready from state file")
+		}
+		waitStatus(t, cm, func(st Status) bool { return st.CheckBundleCID == saved.CheckBundleCID })
+	}
+
+	t.Log("stale")
+	{
+		st := saved
+		st.SubmissionURL = trap.SubmissionURL("0000", "old")
+		data, _ := json.Marshal(st)
+		if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm := newCM()
+		cm.Initialize()
+		waitStatus(t, cm, func(st Status) bool { return st.SubmissionURL == saved.SubmissionURL })
+		if st := readState(t, fn); st.SubmissionURL != saved.SubmissionURL {
+			t.Fatalf("Expected state resolved again, got %+v", st)
+		}
+	}
+
+	t.Log("other settings")
+	{
+		cm, err := New(&Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{InstanceID: "other", StateFile: fn},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cm.loadState() {
+			t.Fatal("Expected state file ignored")
+		}
+	}
+
+	t.Log("submission url setting")
+	{
+		cfg := &Config{
+			API:   api.Config{TokenKey: srv.Token(), URL: srv.URL()},
+			Check: CheckConfig{SubmissionURL: saved.SubmissionURL, StateFile: fn},
+		}
+		os.Remove(fn)
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := os.Stat(fn); err != nil {
+			t.Fatalf("Expected state file saved, got '%v'", err)
+		}
+
+		cm, err = New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if !cm.loadState() {
+			t.Fatal("Expected state file used")
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// State of the check manager
+type State int
+
+// States reported in Status
+const (
+	// StateInitializing the check and submission url have not been determined yet
+	StateInitializing State = iota
+	// StateReady metrics can be sent
+	StateReady
+	// StateDegraded the check was ready but refreshing the submission url failed
+	StateDegraded
+	// StateFailed initialization gave up (permanent error or maximum
+	// attempts reached), metrics cannot be sent
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateInitializing:
+		return "initializing"
+	case StateReady:
+		return "ready"
+	case StateDegraded:
+		return "degraded"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Status of the check manager
+type Status struct {
+	State State
+	// Err from the last initialization (or submission url refresh) attempt,
+	// nil if it succeeded, set while initialization is being retried
+	Err error
+	// Attempts made to initialize (or refresh) the submission url
+	Attempts int
+	// Changed is when the status last changed
+	Changed time.Time
+
+	// check and broker in use, blank when not managing the check (submission url only)
+	CheckBundleCID string
+	CheckCID       string
+	CheckUUID      string
+	BrokerCID      string
+	BrokerName     string
+
+	SubmissionURL string
+}
+
+// Status returns the current status of the check manager
+func (cm *CheckManager) Status() Status {
+	cm.statusmu.Lock()
+	defer cm.statusmu.Unlock()
+	return cm.status
+}
+
+// Subscribe returns a channel receiving the status each time it changes,
+// starting with the current status, and a func to unsubscribe (which closes
+// the channel). The channel is buffered and only holds the latest status, a
+// slow reader misses intermediate changes but not the current state.
+func (cm *CheckManager) Subscribe() (<-chan Status, func()) {
+	ch := make(chan Status, 1)
+
+	cm.statusmu.Lock()
+	if cm.subscribers == nil {
+		cm.subscribers = make(map[int]chan Status)
+	}
+	id := cm.nextSubID
+	cm.nextSubID++
+	cm.subscribers[id] = ch
+	ch <- cm.status
+	cm.statusmu.Unlock()
+
+	unsubscribe := func() {
+		cm.statusmu.Lock()
+		defer cm.statusmu.Unlock()
+		if _, ok := cm.subscribers[id]; ok {
+			delete(cm.subscribers, id)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// WaitReady blocks until the check manager is ready (or degraded),
+// initialization gives up or the context is done. Returns nil when ready,
+// otherwise the initialization error or the context error (with the last
+// initialization error, if any).
+func (cm *CheckManager) WaitReady(ctx context.Context) error {
+	ch, unsubscribe := cm.Subscribe()
+	defer unsubscribe()
+
+	var last Status
+	for {
+		select {
+		case st := <-ch:
+			last = st
+			switch st.State {
+			case StateReady, StateDegraded:
+				return nil
+			case StateFailed:
+				return errors.Wrap(st.Err, "initializing check")
+			}
+		case <-ctx.Done():
+			if last.Err != nil {
+				return errors.Wrapf(ctx.Err(), "waiting for check (last error: %s)", last.Err)
+			}
+			return errors.Wrap(ctx.Err(), "waiting for check")
+		}
+	}
+}
+
+// attempt counts an initialization (or refresh) attempt
+func (cm *CheckManager) attempt() {
+	cm.statusmu.Lock()
+	cm.status.Attempts++
+	cm.statusmu.Unlock()
+}
+
+// setState records the result of an attempt and notifies subscribers
+func (cm *CheckManager) setState(state State, err error) {
+	cm.trapmu.Lock()
+	submissionURL := string(cm.trapURL)
+	broker := cm.broker
+	cm.trapmu.Unlock()
+
+	cm.cbmu.Lock()
+	bundle := cm.checkBundle
+	cm.cbmu.Unlock()
+
+	cm.statusmu.Lock()
+	defer cm.statusmu.Unlock()
+
+	st := cm.status
+	st.State = state
+	st.Err = err
+	st.SubmissionURL = submissionURL
+	if bundle != nil {
+		st.CheckBundleCID = bundle.CID
+		if len(bundle.Checks) > 0 {
+			st.CheckCID = bundle.Checks[0]
+		}
+		if len(bundle.CheckUUIDs) > 0 {
+			st.CheckUUID = bundle.CheckUUIDs[0]
+		}
+	}
+	if broker != nil {
+		st.BrokerCID = broker.CID
+		st.BrokerName = broker.Name
+	}
+
+	if !cm.status.Changed.IsZero() && st == cm.status {
+		return // nothing changed
+	}
+
+	st.Changed = time.Now()
+	cm.status = st
+
+	for _, ch := range cm.subscribers {
+		// keep only the latest status in the channel
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- st
+	}
+}
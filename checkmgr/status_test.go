@@ -0,0 +1,159 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+)
+
+func TestState(t *testing.T) {
+	for state, expect := range map[State]string{
+		StateInitializing: "initializing",
+		StateReady:        "ready",
+		StateDegraded:     "degraded",
+		StateFailed:       "failed",
+		State(99):         "unknown",
+	} {
+		if state.String() != expect {
+			t.Fatalf("Expected '%s', got '%s'", expect, state.String())
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	t.Log("submission url only")
+	{
+		cm, err := New(&Config{Check: CheckConfig{SubmissionURL: "http://127.0.0.1:2609/write/foo"}})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		if st := cm.Status(); st.State != StateInitializing || st.Attempts != 0 {
+			t.Fatalf("Expected initializing, got %+v", st)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+			t.Fatalf("Expected deadline exceeded, got '%v'", err)
+		}
+
+		ch, unsubscribe := cm.Subscribe()
+		if st := <-ch; st.State != StateInitializing {
+			t.Fatalf("Expected initializing, got %+v", st)
+		}
+
+		cm.Initialize()
+
+		st := <-ch
+		if st.State != StateReady || st.Err != nil || st.Attempts != 1 {
+			t.Fatalf("Expected ready after 1 attempt, got %+v", st)
+		}
+		if st.SubmissionURL != "http://127.0.0.1:2609/write/foo" || st.CheckBundleCID != "" || st.BrokerCID != "" {
+			t.Fatalf("Expected submission url only, got %+v", st)
+		}
+
+		unsubscribe()
+		if _, ok := <-ch; ok {
+			t.Fatal("Expected closed channel")
+		}
+		unsubscribe()
+
+		if err := cm.WaitReady(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	trap, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+
+	brokerCID, err := srv.AddBroker("test", trap)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("failed")
+	{
+		cm, err := New(&Config{API: api.Config{TokenKey: "bad", URL: srv.URL()}})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Fatalf("Expected 403 error, got '%v'", err)
+		}
+		if st := cm.Status(); st.State != StateFailed || st.Err == nil || st.Attempts != 1 {
+			t.Fatalf("Expected failed with error, got %+v", st)
+		}
+		if cm.IsReady() {
+			t.Fatal("Expected not ready")
+		}
+	}
+
+	t.Log("ready")
+	{
+		cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}}
+		cfg.Check.InstanceID = "status:test"
+		cfg.Init = InitConfig{MinDelay: "1h", RetryPermanent: "true"} // stay degraded
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := cm.WaitReady(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		st := cm.Status()
+		if st.State != StateReady || st.Attempts != 1 {
+			t.Fatalf("Expected ready after 1 attempt, got %+v", st)
+		}
+		if st.BrokerCID != brokerCID || st.BrokerName != "test" {
+			t.Fatalf("Expected broker %s (test), got %+v", brokerCID, st)
+		}
+		if st.CheckBundleCID == "" || st.CheckCID == "" || st.CheckUUID == "" {
+			t.Fatalf("Expected check, got %+v", st)
+		}
+		if !strings.Contains(st.SubmissionURL, st.CheckUUID) {
+			t.Fatalf("Expected submission url for check %s, got '%s'", st.CheckUUID, st.SubmissionURL)
+		}
+
+		t.Log("degraded")
+		{
+			srv.SetFault(apitest.Fault{StatusCode: 403})
+			if err := cm.ResetTrap(); err == nil {
+				t.Fatal("Expected error")
+			}
+			srv.ClearFault()
+
+			st := cm.Status()
+			if st.State != StateDegraded || st.Err == nil || st.Attempts != 2 {
+				t.Fatalf("Expected degraded after 2 attempts, got %+v", st)
+			}
+		}
+	}
+}
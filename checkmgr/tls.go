@@ -0,0 +1,297 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fileStamp identifies the version of a file loaded, it is reloaded when
+// the modification time or size changes
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// brokerCerts holds the broker CA bundle, client certificate and pinned
+// public keys (BrokerConfig.CAFile, ClientCert*, ClientKey*, PinSPKI).
+// Files are reloaded when they change, if a reload fails the certificates
+// loaded last are used.
+type brokerCerts struct {
+	log      *log.Logger
+	caFile   string
+	certFile string
+	keyFile  string
+	certPEM  []byte
+	keyPEM   []byte
+	pins     map[string]bool
+
+	mu        sync.Mutex
+	caPool    *x509.CertPool
+	caStamp   fileStamp
+	cert      *tls.Certificate
+	certStamp fileStamp
+	keyStamp  fileStamp
+}
+
+// newBrokerCerts verifies the broker certificate settings and loads the
+// certificates, nil if none are configured
+func newBrokerCerts(cfg *BrokerConfig, logger *log.Logger) (*brokerCerts, error) {
+	if cfg.CAFile == "" && cfg.ClientCertFile == "" && cfg.ClientKeyFile == "" &&
+		cfg.ClientCert == "" && cfg.ClientKey == "" && cfg.PinSPKI == "" {
+		return nil, nil
+	}
+
+	if cfg.ClientCertFile != "" && cfg.ClientCert != "" {
+		return nil, errors.New("only one of client cert file and client cert may be set")
+	}
+	if cfg.ClientKeyFile != "" && cfg.ClientKey != "" {
+		return nil, errors.New("only one of client key file and client key may be set")
+	}
+	hasCert := cfg.ClientCertFile != "" || cfg.ClientCert != ""
+	hasKey := cfg.ClientKeyFile != "" || cfg.ClientKey != ""
+	if hasCert != hasKey {
+		return nil, errors.New("client cert and client key must both be set")
+	}
+
+	bc := &brokerCerts{
+		log:      logger,
+		caFile:   cfg.CAFile,
+		certFile: cfg.ClientCertFile,
+		keyFile:  cfg.ClientKeyFile,
+		certPEM:  []byte(cfg.ClientCert),
+		keyPEM:   []byte(cfg.ClientKey),
+	}
+
+	if cfg.PinSPKI != "" {
+		bc.pins = make(map[string]bool)
+		for _, pin := range strings.Split(cfg.PinSPKI, ",") {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if pin == "" {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing pin (%s)", pin)
+			}
+			if len(sum) != sha256.Size {
+				return nil, errors.Errorf("invalid pin (%s), expected a base64 sha256 hash", pin)
+			}
+			bc.pins[pin] = true
+		}
+	}
+
+	if _, err := bc.rootCAs(); err != nil {
+		return nil, err
+	}
+	if _, err := bc.clientCertificate(); err != nil {
+		return nil, err
+	}
+
+	return bc, nil
+}
+
+// rootCAs returns the CA bundle from BrokerConfig.CAFile, nil if not set
+func (bc *brokerCerts) rootCAs() (*x509.CertPool, error) {
+	if bc.caFile == "" {
+		return nil, nil
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	stamp, err := statFile(bc.caFile)
+	if bc.caPool != nil && stamp == bc.caStamp {
+		return bc.caPool, nil
+	}
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(bc.caFile); err == nil {
+			pool := x509.NewCertPool()
+			if pool.AppendCertsFromPEM(data) {
+				bc.caPool = pool
+				bc.caStamp = stamp
+				return pool, nil
+			}
+			err = errors.Errorf("no certificates found in ca file (%s)", bc.caFile)
+		}
+	}
+	if bc.caPool == nil {
+		return nil, errors.Wrap(err, "loading broker ca file")
+	}
+
+	bc.log.Printf("[WARN] reloading broker ca file, using the certificates loaded last: %s", err)
+	bc.caStamp = stamp // not retried until the file changes again
+	return bc.caPool, nil
+}
+
+// clientCertificate returns the client certificate, nil if not set
+func (bc *brokerCerts) clientCertificate() (*tls.Certificate, error) {
+	if bc.certFile == "" && len(bc.certPEM) == 0 {
+		return nil, nil
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	var certStamp, keyStamp fileStamp
+	var err error
+	if bc.certFile != "" {
+		certStamp, err = statFile(bc.certFile)
+	}
+	if err == nil && bc.keyFile != "" {
+		keyStamp, err = statFile(bc.keyFile)
+	}
+	if bc.cert != nil && certStamp == bc.certStamp && keyStamp == bc.keyStamp {
+		return bc.cert, nil
+	}
+
+	certPEM, keyPEM := bc.certPEM, bc.keyPEM
+	if err == nil && bc.certFile != "" {
+		certPEM, err = ioutil.ReadFile(bc.certFile)
+	}
+	if err == nil && bc.keyFile != "" {
+		keyPEM, err = ioutil.ReadFile(bc.keyFile)
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err == nil {
+			bc.cert = &cert
+			bc.certStamp = certStamp
+			bc.keyStamp = keyStamp
+			return bc.cert, nil
+		}
+	}
+	if bc.cert == nil {
+		return nil, errors.Wrap(err, "loading client certificate")
+	}
+
+	// e.g. the certificate was replaced but not the key yet
+	bc.log.Printf("[WARN] reloading client certificate, using the certificate loaded last: %s", err)
+	bc.certStamp = certStamp // not retried until the files change again
+	bc.keyStamp = keyStamp
+	return bc.cert, nil
+}
+
+// verifyPins verifies one certificate of the broker's verified chain has a
+// pinned public key, or the broker's certificate if the chain is not verified
+func (bc *brokerCerts) verifyPins(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var certs []*x509.Certificate
+	for _, chain := range verifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(certs) == 0 && len(rawCerts) > 0 {
+		// not verified (InsecureSkipVerify), any other certificate presented
+		// could be added by whoever presents the chain
+		if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if bc.pins[base64.StdEncoding.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+
+	return errors.New("broker certificate does not match a pinned public key")
+}
+
+// apply adds the CA bundle, client certificate and pin verification to a
+// tls config
+func (bc *brokerCerts) apply(t *tls.Config) error {
+	pool, err := bc.rootCAs()
+	if err != nil {
+		return err
+	}
+	if pool != nil {
+		t.RootCAs = pool
+	}
+	if bc.certFile != "" || len(bc.certPEM) > 0 {
+		t.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return bc.clientCertificate()
+		}
+	}
+	if len(bc.pins) > 0 {
+		t.VerifyPeerCertificate = bc.verifyPins
+	}
+	return nil
+}
+
+// submissionTLS returns the tls config for an https submission url: the
+// user supplied BrokerConfig.TLSConfig or the broker CA certificate (from
+// BrokerConfig.CAFile, the API or the default Circonus CA) with the broker
+// CN (cn, of the submission url) as server name, plus client certificate and
+// pins if configured
+func (cm *CheckManager) submissionTLS(host string, cn BrokerCNType) (*tls.Config, error) {
+	bc := cm.brokerCerts
+
+	// preference user-supplied TLS configuration
+	if cm.brokerTLS != nil {
+		if bc == nil {
+			return cm.brokerTLS, nil
+		}
+		t := cm.brokerTLS.Clone()
+		if err := bc.apply(t); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	// api.circonus.com uses a public CA signed certificate
+	// trap.noit.circonus.net uses Circonus CA private certificate
+	// enterprise brokers use private CA certificate
+	if host == "api.circonus.com" && (bc == nil || bc.caFile == "") {
+		if bc == nil {
+			return nil, nil
+		}
+		t := &tls.Config{}
+		if err := bc.apply(t); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	t := &tls.Config{}
+	if bc == nil || bc.caFile == "" {
+		cm.trapmu.Lock()
+		err := cm.loadCACert()
+		pool := cm.certPool
+		cm.trapmu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = pool
+	}
+	if cn != "" {
+		t.ServerName = string(cn)
+	}
+	if bc != nil {
+		if err := bc.apply(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func statFile(fn string) (fileStamp, error) {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{mod: info.ModTime(), size: info.Size()}, nil
+}
@@ -0,0 +1,347 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// genCert creates a certificate signed by parent (self-signed CA if nil)
+func genCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{cn}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeCertFile writes a file with a modification time after the previous
+// version, so the change is seen even within the file system time resolution
+func writeCertFile(t *testing.T, fn string, data []byte) {
+	var mod time.Time
+	if info, err := os.Stat(fn); err == nil {
+		mod = info.ModTime()
+	}
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if !mod.IsZero() {
+		mod = mod.Add(time.Second)
+		if err := os.Chtimes(fn, mod, mod); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+}
+
+func TestNewBrokerCerts(t *testing.T) {
+	t.Log("none")
+	{
+		bc, err := newBrokerCerts(&BrokerConfig{}, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if bc != nil {
+			t.Fatalf("Expected nil, got %+v", bc)
+		}
+	}
+
+	ca := genCert(t, "ca", nil)
+	client := genCert(t, "client", ca)
+
+	t.Log("pem")
+	{
+		bc, err := newBrokerCerts(&BrokerConfig{ClientCert: string(client.certPEM), ClientKey: string(client.keyPEM), PinSPKI: "sha256/" + ca.pin()}, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cert, err := bc.clientCertificate(); err != nil || cert == nil {
+			t.Fatalf("Expected client certificate, got %v '%v'", cert, err)
+		}
+		if !bc.pins[ca.pin()] {
+			t.Fatalf("Expected pin, got %v", bc.pins)
+		}
+	}
+
+	tests := []struct {
+		cfg    BrokerConfig
+		expect string
+	}{
+		{BrokerConfig{ClientCertFile: "c.pem", ClientCert: "x", ClientKey: "y"}, "only one of client cert file and client cert"},
+		{BrokerConfig{ClientKeyFile: "k.pem", ClientKey: "y", ClientCert: "x"}, "only one of client key file and client key"},
+		{BrokerConfig{ClientCert: string(client.certPEM)}, "client cert and client key must both be set"},
+		{BrokerConfig{ClientCert: string(client.certPEM), ClientKey: "y"}, "loading client certificate"},
+		{BrokerConfig{PinSPKI: "not base64"}, "parsing pin"},
+		{BrokerConfig{PinSPKI: "YWJj"}, "invalid pin (YWJj)"},
+		{BrokerConfig{CAFile: "/missing/ca.crt"}, "loading broker ca file"},
+	}
+	for _, test := range tests {
+		t.Logf("invalid %s", test.expect)
+		_, err := newBrokerCerts(&test.cfg, nil)
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+		if !strings.Contains(err.Error(), test.expect) {
+			t.Fatalf("Expected '%s', got '%v'", test.expect, err)
+		}
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca := genCert(t, "ca", nil)
+	server := genCert(t, "server", ca)
+	other := genCert(t, "other", ca)
+
+	bc, err := newBrokerCerts(&BrokerConfig{PinSPKI: server.pin() + "," + ca.pin()}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("verified chain, pinned ca")
+	{
+		chains := [][]*x509.Certificate{{other.cert, ca.cert}}
+		if err := bc.verifyPins([][]byte{other.cert.Raw}, chains); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("not verified, pinned leaf")
+	{
+		if err := bc.verifyPins([][]byte{server.cert.Raw, other.cert.Raw}, nil); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("not verified, pinned certificate after the leaf")
+	{
+		err := bc.verifyPins([][]byte{other.cert.Raw, server.cert.Raw, ca.cert.Raw}, nil)
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+		if !strings.Contains(err.Error(), "does not match a pinned public key") {
+			t.Fatalf("Expected pin error, got '%v'", err)
+		}
+	}
+
+	t.Log("no certificates")
+	{
+		if err := bc.verifyPins(nil, nil); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
+
+func TestSubmissionTLS(t *testing.T) {
+	ca := genCert(t, "ca", nil)
+	server := genCert(t, "broker", ca)
+	clientCA := genCert(t, "client-ca", nil)
+
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.cert)
+
+	var mu sync.Mutex
+	var clientCN string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		mu.Unlock()
+		w.WriteHeader(204)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // expected handshake failures
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "cgm-tls")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	writeClient := func(cn string) {
+		c := genCert(t, cn, clientCA)
+		writeCertFile(t, certFile, c.certPEM)
+		writeCertFile(t, keyFile, c.keyPEM)
+	}
+	writeCertFile(t, caFile, ca.certPEM)
+	writeClient("client-1")
+
+	newCM := func(broker BrokerConfig) *CheckManager {
+		cm, err := New(&Config{Check: CheckConfig{SubmissionURL: srv.URL + "/module/httptrap/uuid/secret"}, Broker: broker})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		cm.Initialize()
+		// the broker certificate is only valid for its cn
+		cm.trapCN = "broker"
+		return cm
+	}
+	submit := func(cm *CheckManager) (string, error) {
+		trap, err := cm.GetSubmissionURL()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: trap.TLS, DisableKeepAlives: true}}
+		resp, err := client.Get(trap.URL.String())
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		return clientCN, nil
+	}
+
+	cfg := BrokerConfig{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile, PinSPKI: server.pin()}
+	cm := newCM(cfg)
+
+	t.Log("client certificate, pinned broker key")
+	{
+		cn, err := submit(cm)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cn != "client-1" {
+			t.Fatalf("Expected client-1, got '%s'", cn)
+		}
+	}
+
+	t.Log("client certificate reloaded")
+	{
+		writeClient("client-2")
+		cn, err := submit(cm)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cn != "client-2" {
+			t.Fatalf("Expected client-2, got '%s'", cn)
+		}
+	}
+
+	t.Log("failed reload keeps the last certificate")
+	{
+		writeCertFile(t, certFile, []byte("garbage"))
+		cn, err := submit(cm)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cn != "client-2" {
+			t.Fatalf("Expected client-2, got '%s'", cn)
+		}
+		writeClient("client-3")
+	}
+
+	t.Log("pin mismatch")
+	{
+		cfg := cfg
+		cfg.PinSPKI = genCert(t, "other", ca).pin()
+		if _, err := submit(newCM(cfg)); err == nil || !strings.Contains(err.Error(), "pinned public key") {
+			t.Fatalf("Expected pin error, got '%v'", err)
+		}
+	}
+
+	t.Log("pinned ca")
+	{
+		cfg := cfg
+		cfg.PinSPKI = "sha256/" + ca.pin()
+		if _, err := submit(newCM(cfg)); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("no client certificate")
+	{
+		if _, err := submit(newCM(BrokerConfig{CAFile: caFile})); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("user tls config")
+	{
+		cm := newCM(BrokerConfig{
+			TLSConfig:      &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "broker"},
+			CAFile:         caFile,
+			ClientCertFile: certFile,
+			ClientKeyFile:  keyFile,
+		})
+		cn, err := submit(cm)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cn != "client-3" {
+			t.Fatalf("Expected client-3, got '%s'", cn)
+		}
+	}
+}
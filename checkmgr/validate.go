@@ -0,0 +1,352 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/pkg/errors"
+)
+
+var (
+	checkTypeRx = regexp.MustCompile(`^[a-z0-9_]+(:[a-z0-9_]+)*$`)
+	sockURLRx   = regexp.MustCompile(`^http\+unix://(?P<sockfile>.+)/write/(?P<id>.+)$`)
+)
+
+// Validate checks the configuration without connecting to the API or a
+// broker, returning all the problems found (nil if there are none)
+func (cfg *Config) Validate() []error {
+	var errs []error
+
+	managed := cfg.API.TokenKey != ""
+	if !managed && cfg.Check.SubmissionURL == "" {
+		errs = append(errs, errors.New("no API token and no submission url"))
+	}
+
+	if cfg.API.URL != "" {
+		if u, err := url.Parse(cfg.API.URL); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing API url"))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, errors.Errorf("invalid API url (%s), scheme must be http or https", cfg.API.URL))
+		}
+	}
+
+	if cfg.Check.SubmissionURL != "" {
+		if err := validateSubmissionURL(cfg.Check.SubmissionURL, managed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, id := range []struct{ name, v string }{
+		{"check id", cfg.Check.ID},
+		{"broker id", cfg.Broker.ID},
+		{"broker failover after", cfg.Broker.FailoverAfter},
+	} {
+		if id.v == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(id.v); err != nil {
+			errs = append(errs, errors.Wrapf(err, "parsing %s", id.name))
+		} else if n < 0 {
+			errs = append(errs, errors.Errorf("invalid %s (%d)", id.name, n))
+		}
+	}
+
+	for _, d := range []struct{ name, v string }{
+		{"max url age", cfg.Check.MaxURLAge},
+		{"metric update interval", cfg.Check.MetricUpdateInterval},
+		{"ephemeral ttl", cfg.Check.EphemeralTTL},
+		{"broker max response time", cfg.Broker.MaxResponseTime},
+		{"broker probe timeout", cfg.Broker.ProbeTimeout},
+	} {
+		if d.v == "" {
+			continue
+		}
+		if dur, err := time.ParseDuration(d.v); err != nil {
+			errs = append(errs, errors.Wrapf(err, "parsing %s", d.name))
+		} else if dur <= 0 {
+			errs = append(errs, errors.Errorf("invalid %s (%s)", d.name, d.v))
+		}
+	}
+
+	if cfg.Check.MetricUpdateBatch != "" {
+		if n, err := strconv.Atoi(cfg.Check.MetricUpdateBatch); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing metric update batch"))
+		} else if n <= 0 {
+			errs = append(errs, errors.Errorf("invalid metric update batch (%d)", n))
+		}
+	}
+
+	if _, err := parseMetricFilters(cfg.Check.MetricFilters); err != nil {
+		errs = append(errs, errors.Wrap(err, "parsing metric filters"))
+	}
+
+	if cfg.Broker.ProbeConcurrency != "" {
+		if n, err := strconv.Atoi(cfg.Broker.ProbeConcurrency); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing broker probe concurrency"))
+		} else if n <= 0 {
+			errs = append(errs, errors.Errorf("invalid broker probe concurrency (%d)", n))
+		}
+	}
+
+	if cfg.Check.ForceMetricActivation != "" {
+		if _, err := strconv.ParseBool(cfg.Check.ForceMetricActivation); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing force metric activation"))
+		}
+	}
+
+	if cfg.Check.Ephemeral != "" {
+		if _, err := strconv.ParseBool(cfg.Check.Ephemeral); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing ephemeral"))
+		}
+	}
+
+	switch cfg.Check.EphemeralShutdown {
+	case "", ephemeralShutdownDelete, ephemeralShutdownDisable:
+	default:
+		errs = append(errs, errors.Errorf("invalid ephemeral shutdown (%s), expected delete or deactivate", cfg.Check.EphemeralShutdown))
+	}
+
+	if cfg.Broker.FailoverMoveCheck != "" {
+		if _, err := strconv.ParseBool(cfg.Broker.FailoverMoveCheck); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing broker failover move check"))
+		}
+	}
+
+	if _, err := newBrokerCerts(&cfg.Broker, log.New(ioutil.Discard, "", 0)); err != nil {
+		errs = append(errs, errors.Wrap(err, "broker tls"))
+	}
+
+	if cfg.Check.Type != "" && !checkTypeRx.MatchString(cfg.Check.Type) {
+		errs = append(errs, errors.Errorf("invalid check type (%s), expected type[:subtype] e.g. httptrap or json:nad", cfg.Check.Type))
+	}
+
+	if cfg.Broker.Selector == nil {
+		if _, err := newBrokerSelector(cfg.Broker.SelectStrategy, cfg.Broker.Location, cfg.Broker.PreferTags); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := (&CheckManager{}).configureInit(&cfg.Init); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errs
+}
+
+// validateSubmissionURL verifies the format of a submission url, a url used
+// to look up the check (managed) must be a broker httptrap url
+func validateSubmissionURL(submissionURL string, managed bool) error {
+	u, err := url.Parse(submissionURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing submission url")
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+	case "http+unix":
+		if managed {
+			return errors.Errorf("invalid submission url (%s), a socket cannot be used with an API token", submissionURL)
+		}
+		if !sockURLRx.MatchString(submissionURL) {
+			return errors.Errorf("invalid submission url (%s), expected http+unix://<socket>/write/<id>", submissionURL)
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid submission url (%s), scheme must be http, https or http+unix", submissionURL)
+	}
+
+	if u.Host == "" {
+		return errors.Errorf("invalid submission url (%s), no host", submissionURL)
+	}
+
+	if managed {
+		parts := strings.Split(strings.TrimPrefix(u.Path, "/module/httptrap/"), "/")
+		if !strings.HasPrefix(u.Path, "/module/httptrap/") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.Errorf("invalid submission url (%s), expected a broker httptrap url (/module/httptrap/<uuid>/<secret>) when using an API token", submissionURL)
+		}
+	}
+
+	return nil
+}
+
+// Preflight runs Validate and, if there are no problems, verifies the
+// configuration online: the submission url is reachable, the API token is
+// accepted, an existing check (by submission url or id) is active or, when a
+// check would be searched for or created, at least one broker supporting the
+// check type is active and reachable. Returns all the problems found (nil if
+// there are none).
+func (cfg *Config) Preflight() []error {
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return errs
+	}
+
+	var errs []error
+
+	timeout, _ := time.ParseDuration(defaultBrokerMaxResponseTime)
+	if cfg.Broker.MaxResponseTime != "" {
+		timeout, _ = time.ParseDuration(cfg.Broker.MaxResponseTime)
+	}
+
+	if cfg.Check.SubmissionURL != "" {
+		if err := dialSubmissionURL(cfg.Check.SubmissionURL, timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if cfg.API.TokenKey == "" {
+		return errs
+	}
+
+	apiCfg := cfg.API
+	apih, err := api.New(&apiCfg)
+	if err != nil {
+		return append(errs, errors.Wrap(err, "initializing api client"))
+	}
+
+	switch {
+	case cfg.Check.SubmissionURL != "":
+		u, _ := url.Parse(cfg.Check.SubmissionURL)
+		uuid := strings.Split(strings.TrimPrefix(u.Path, "/module/httptrap/"), "/")[0]
+		checks, err := apih.SearchChecks(nil, &api.SearchFilterType{"f__check_uuid": []string{uuid}})
+		if err != nil {
+			return append(errs, errors.Wrap(err, "searching for check by submission url"))
+		}
+		if !anyActive(*checks) {
+			errs = append(errs, errors.Errorf("no active check found with uuid %s", uuid))
+		}
+	case cfg.Check.ID != "" && cfg.Check.ID != "0":
+		cid := "/check/" + cfg.Check.ID
+		check, err := apih.FetchCheck(api.CIDType(&cid))
+		if err != nil {
+			return append(errs, errors.Wrap(err, "fetching check"))
+		}
+		if !check.Active {
+			errs = append(errs, errors.Errorf("check %s is not active", cid))
+		}
+	default:
+		if err := cfg.preflightBrokers(apih, timeout); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// preflightBrokers verifies at least one broker usable to create a check is reachable
+func (cfg *Config) preflightBrokers(apih *api.API, timeout time.Duration) error {
+	var brokers []api.Broker
+	switch {
+	case cfg.Broker.ID != "" && cfg.Broker.ID != "0":
+		cid := "/broker/" + cfg.Broker.ID
+		broker, err := apih.FetchBroker(api.CIDType(&cid))
+		if err != nil {
+			return errors.Wrap(err, "fetching broker")
+		}
+		brokers = append(brokers, *broker)
+	case cfg.Broker.SelectTag != "":
+		filter := api.SearchFilterType{"f__tags_has": strings.Split(strings.Replace(cfg.Broker.SelectTag, " ", "", -1), ",")}
+		list, err := apih.SearchBrokers(nil, &filter)
+		if err != nil {
+			return errors.Wrap(err, "searching brokers")
+		}
+		brokers = *list
+	default:
+		list, err := apih.FetchBrokers()
+		if err != nil {
+			return errors.Wrap(err, "fetching brokers")
+		}
+		brokers = *list
+	}
+
+	checkType := CheckTypeType(defaultCheckType)
+	if cfg.Check.Type != "" {
+		checkType = CheckTypeType(cfg.Check.Type)
+	}
+
+	var problems []string
+	for _, broker := range brokers {
+		if broker.Type != "circonus" && broker.Type != "enterprise" {
+			problems = append(problems, fmt.Sprintf("%s: unsupported type %s", broker.Name, broker.Type))
+			continue
+		}
+		for _, detail := range broker.Details {
+			detail := detail
+			if detail.Status != statusActive {
+				problems = append(problems, fmt.Sprintf("%s/%s: not active", broker.Name, detail.CN))
+				continue
+			}
+			if !supportsCheckType(checkType, &detail) {
+				problems = append(problems, fmt.Sprintf("%s/%s: no %s module", broker.Name, detail.CN, checkType))
+				continue
+			}
+			host, port := brokerAddress(&detail)
+			if host == "" {
+				problems = append(problems, fmt.Sprintf("%s/%s: no ip or external host", broker.Name, detail.CN))
+				continue
+			}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s/%s: %s", broker.Name, detail.CN, err))
+				continue
+			}
+			conn.Close()
+			return nil
+		}
+	}
+
+	if len(problems) == 0 {
+		return errors.New("no brokers found")
+	}
+	return errors.Errorf("no usable broker for %s checks (%s)", checkType, strings.Join(problems, "; "))
+}
+
+// dialSubmissionURL verifies the submission url host (or socket) accepts connections
+func dialSubmissionURL(submissionURL string, timeout time.Duration) error {
+	network := "tcp"
+	var addr string
+	if m := sockURLRx.FindStringSubmatch(submissionURL); m != nil {
+		network = "unix"
+		addr = m[1]
+	} else {
+		u, err := url.Parse(submissionURL)
+		if err != nil {
+			return errors.Wrap(err, "parsing submission url")
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return errors.Wrap(err, "connecting to submission url")
+	}
+	conn.Close()
+	return nil
+}
+
+func anyActive(checks []api.Check) bool {
+	for _, check := range checks {
+		if check.Active {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checkmgr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/api/config"
+	"github.com/circonus-labs/circonus-gometrics/apitest"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+)
+
+func TestValidate(t *testing.T) {
+	t.Log("valid")
+	{
+		for _, cfg := range []*Config{
+			{Check: CheckConfig{SubmissionURL: "http://127.0.0.1:2609/write/foo"}},
+			{Check: CheckConfig{SubmissionURL: "http+unix:///tmp/agent.sock/write/foo"}},
+			{API: api.Config{TokenKey: "abc"}},
+			{
+				API:    api.Config{TokenKey: "abc", URL: "https://api.example.com/v2"},
+				Check:  CheckConfig{SubmissionURL: "https://127.0.0.1:43191/module/httptrap/abc/xyz", ID: "123", MaxURLAge: "5m", ForceMetricActivation: "true", Type: "json:nad"},
+				Broker: BrokerConfig{ID: "1", MaxResponseTime: "1s"},
+			},
+		} {
+			if errs := cfg.Validate(); len(errs) != 0 {
+				t.Fatalf("Expected no errors for %+v, got %v", cfg, errs)
+			}
+		}
+	}
+
+	t.Log("all problems")
+	{
+		cfg := &Config{
+			API:    api.Config{URL: "ftp://api.example.com"},
+			Check:  CheckConfig{ID: "abc", MaxURLAge: "5", ForceMetricActivation: "maybe", Type: "Http Trap", MetricUpdateBatch: "0", MetricFilters: "keep ^a", Ephemeral: "maybe", EphemeralTTL: "-1h", EphemeralShutdown: "keep"},
+			Broker: BrokerConfig{ID: "-1", MaxResponseTime: "0s", ProbeTimeout: "x", ProbeConcurrency: "0", FailoverAfter: "-2", FailoverMoveCheck: "maybe", PinSPKI: "x"},
+			Init:   InitConfig{Jitter: "2"},
+		}
+		errs := cfg.Validate()
+		expect := []string{
+			"no API token and no submission url",
+			"invalid API url",
+			"parsing check id",
+			"invalid broker id",
+			"invalid broker failover after",
+			"parsing max url age",
+			"invalid ephemeral ttl",
+			"invalid broker max response time",
+			"parsing broker probe timeout",
+			"invalid metric update batch",
+			"parsing metric filters",
+			"invalid broker probe concurrency",
+			"parsing force metric activation",
+			"parsing ephemeral",
+			"invalid ephemeral shutdown",
+			"parsing broker failover move check",
+			"broker tls",
+			"invalid check type",
+			"invalid init jitter",
+		}
+		if len(errs) != len(expect) {
+			t.Fatalf("Expected %d errors, got %d %v", len(expect), len(errs), errs)
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), expect[i]) {
+				t.Fatalf("Expected '%s', got '%v'", expect[i], err)
+			}
+		}
+	}
+
+	t.Log("submission url")
+	{
+		for _, test := range []struct {
+			url   string
+			token string
+		}{
+			{"://bad", ""},
+			{"ftp://127.0.0.1/write/foo", ""},
+			{"http:///write/foo", ""},
+			{"http+unix:///tmp/agent.sock", ""},
+			{"http+unix:///tmp/agent.sock/write/foo", "abc"},
+			{"http://127.0.0.1:2609/write/foo", "abc"},
+			{"https://127.0.0.1:43191/module/httptrap/abc", "abc"},
+		} {
+			cfg := &Config{API: api.Config{TokenKey: test.token}, Check: CheckConfig{SubmissionURL: test.url}}
+			if errs := cfg.Validate(); len(errs) != 1 {
+				t.Fatalf("Expected 1 error for '%s' (token '%s'), got %v", test.url, test.token, errs)
+			}
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	trap, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer trap.Close()
+
+	closed, err := brokertest.New(&brokertest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	closed.Close()
+
+	srv, err := apitest.New(&apitest.Config{})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer srv.Close()
+
+	t.Log("invalid configuration")
+	{
+		cfg := &Config{}
+		if errs := cfg.Preflight(); len(errs) != 1 {
+			t.Fatalf("Expected 1 error, got %v", errs)
+		}
+	}
+
+	t.Log("submission url, no token")
+	{
+		cfg := &Config{Check: CheckConfig{SubmissionURL: trap.SubmissionURL("abc", "xyz")}}
+		if errs := cfg.Preflight(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+
+		cfg.Check.SubmissionURL = closed.SubmissionURL("abc", "xyz")
+		if errs := cfg.Preflight(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "connecting to submission url") {
+			t.Fatalf("Expected connection error, got %v", errs)
+		}
+	}
+
+	t.Log("invalid token")
+	{
+		cfg := &Config{API: api.Config{TokenKey: "bad", URL: srv.URL()}}
+		if errs := cfg.Preflight(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "403") {
+			t.Fatalf("Expected 403 error, got %v", errs)
+		}
+	}
+
+	t.Log("no brokers")
+	{
+		cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}}
+		if errs := cfg.Preflight(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "no brokers found") {
+			t.Fatalf("Expected no brokers error, got %v", errs)
+		}
+	}
+
+	brokerCID, err := srv.AddBroker("test", trap)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if _, err := srv.AddBroker("closed", closed); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("usable broker")
+	{
+		cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}}
+		if errs := cfg.Preflight(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+
+		cfg.Broker.ID = strings.TrimPrefix(brokerCID, "/broker/")
+		if errs := cfg.Preflight(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+	}
+
+	t.Log("unusable brokers")
+	{
+		cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}}
+		cfg.Check.Type = "snmp"
+		errs := cfg.Preflight()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "no snmp module") {
+			t.Fatalf("Expected unsupported check type error, got %v", errs)
+		}
+
+		cfg.Check.Type = ""
+		cfg.Broker.ID = "2"
+		errs = cfg.Preflight()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "no usable broker") {
+			t.Fatalf("Expected unreachable broker error, got %v", errs)
+		}
+
+		cfg.Broker.ID = "999"
+		if errs := cfg.Preflight(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "404") {
+			t.Fatalf("Expected 404 error, got %v", errs)
+		}
+	}
+
+	client, err := api.New(&api.Config{TokenKey: srv.Token(), URL: srv.URL()})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	bundle, err := client.CreateCheckBundle(&api.CheckBundle{
+		Brokers: []string{brokerCID},
+		Metrics: []api.CheckBundleMetric{},
+		Type:    "httptrap",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("existing check")
+	{
+		cfg := &Config{API: api.Config{TokenKey: srv.Token(), URL: srv.URL()}}
+		cfg.Check.SubmissionURL = bundle.Config[config.SubmissionURL]
+		if errs := cfg.Preflight(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+
+		cfg.Check.SubmissionURL = trap.SubmissionURL("abc", "xyz")
+		if errs := cfg.Preflight(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "no active check") {
+			t.Fatalf("Expected no active check error, got %v", errs)
+		}
+
+		cfg.Check.SubmissionURL = ""
+		cfg.Check.ID = strings.TrimPrefix(bundle.Checks[0], "/check/")
+		if errs := cfg.Preflight(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+
+		cfg.Check.ID = "999"
+		if errs := cfg.Preflight(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "fetching check") {
+			t.Fatalf("Expected fetch error, got %v", errs)
+		}
+	}
+}
@@ -32,6 +32,7 @@ package circonusgometrics
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -74,6 +75,16 @@ type Config struct {
 	// how frequenly to submit metrics to Circonus, default 10 seconds.
 	// Set to 0 to disable automatic flushes and call Flush manually.
 	Interval string
+
+	// how long to wait for each registered collector during a flush, default 5 seconds.
+	CollectorTimeout string
+
+	// StrictValidation validates the whole configuration in New (see Validate), returning
+	// all the problems found as ConfigErrors instead of stopping at the first
+	StrictValidation bool
+	// StrictPreflight, in addition to StrictValidation, verifies the
+	// configuration online in New (see Preflight), before any metrics are sent
+	StrictPreflight bool
 }
 
 type prevMetrics struct {
@@ -87,16 +98,20 @@ type CirconusMetrics struct {
 	Log   *log.Logger
 	Debug bool
 
-	resetCounters   bool
-	resetGauges     bool
-	resetHistograms bool
-	resetText       bool
-	flushInterval   time.Duration
-	flushing        bool
-	flushmu         sync.Mutex
-	packagingmu     sync.Mutex
-	check           *checkmgr.CheckManager
-	lastMetrics     *prevMetrics
+	resetCounters    bool
+	resetGauges      bool
+	resetHistograms  bool
+	resetText        bool
+	flushInterval    time.Duration
+	collectorTimeout time.Duration
+	flushing         bool
+	flushDone        chan struct{}
+	flushmu          sync.Mutex
+	packagingmu      sync.Mutex
+	check            *checkmgr.CheckManager
+	lastMetrics      *prevMetrics
+	shutdown         chan struct{}
+	shutdownOnce     sync.Once
 
 	counters map[string]uint64
 	cm       sync.Mutex
@@ -118,6 +133,17 @@ type CirconusMetrics struct {
 
 	textFuncs map[string]func() string
 	tfm       sync.Mutex
+
+	collectors map[string]Collector
+	clm        sync.Mutex
+
+	sinks     map[string]Sink
+	sinksBusy map[string]bool
+	sinksIdle *sync.Cond // signaled (on sm) when a sink write is done
+	sm        sync.Mutex
+
+	inFlight map[string]*int64
+	ifm      sync.Mutex
 }
 
 // NewCirconusMetrics returns a CirconusMetrics instance
@@ -132,6 +158,16 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 		return nil, errors.New("invalid configuration (nil)")
 	}
 
+	if cfg.StrictPreflight {
+		if errs := cfg.Preflight(); len(errs) > 0 {
+			return nil, ConfigErrors(errs)
+		}
+	} else if cfg.StrictValidation {
+		if errs := cfg.Validate(); len(errs) > 0 {
+			return nil, ConfigErrors(errs)
+		}
+	}
+
 	cm := &CirconusMetrics{
 		counters:     make(map[string]uint64),
 		counterFuncs: make(map[string]func() uint64),
@@ -140,7 +176,11 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 		histograms:   make(map[string]*Histogram),
 		text:         make(map[string]string),
 		textFuncs:    make(map[string]func() string),
+		collectors:   make(map[string]Collector),
+		sinks:        make(map[string]Sink),
+		inFlight:     make(map[string]*int64),
 		lastMetrics:  &prevMetrics{},
+		shutdown:     make(chan struct{}),
 	}
 
 	// Logging
@@ -170,6 +210,23 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 		cm.flushInterval = dur
 	}
 
+	// Collector Timeout
+	{
+		ct := defaultCollectorTimeout
+		if cfg.CollectorTimeout != "" {
+			ct = cfg.CollectorTimeout
+		}
+
+		dur, err := time.ParseDuration(ct)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing collector timeout")
+		}
+		if dur <= time.Duration(0) {
+			return nil, errors.Errorf("invalid collector timeout (%s)", ct)
+		}
+		cm.collectorTimeout = dur
+	}
+
 	// metric resets
 
 	cm.resetCounters = true
@@ -227,8 +284,15 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 	// NOTE: submit will jettison metrics until initialization has completed.
 	if cm.flushInterval > time.Duration(0) {
 		go func() {
-			for range time.NewTicker(cm.flushInterval).C {
-				cm.Flush()
+			ticker := time.NewTicker(cm.flushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					cm.Flush()
+				case <-cm.shutdown:
+					return
+				}
 			}
 		}()
 	}
@@ -241,11 +305,55 @@ func (m *CirconusMetrics) Start() {
 	// nop
 }
 
+// Shutdown stops the automatic flush, flushes the remaining metrics (after a
+// flush in progress), waits for the sinks and removes an ephemeral check (see checkmgr.Shutdown).
+// Metrics are not submitted afterwards.
+func (m *CirconusMetrics) Shutdown() error {
+	var err error
+	m.shutdownOnce.Do(func() {
+		close(m.shutdown)
+		m.flush(true)
+		m.WaitSinks()
+		err = m.check.Shutdown()
+	})
+	return err
+}
+
 // Ready returns true or false indicating if the check is ready to accept metrics
 func (m *CirconusMetrics) Ready() bool {
 	return m.check.IsReady()
 }
 
+// WaitReady blocks until the check is ready to accept metrics, check
+// initialization fails or the context is done (see checkmgr.WaitReady)
+func (m *CirconusMetrics) WaitReady(ctx context.Context) error {
+	return m.check.WaitReady(ctx)
+}
+
+// Status returns the check manager status: state, last initialization error,
+// attempts, and the check and broker in use
+func (m *CirconusMetrics) Status() checkmgr.Status {
+	return m.check.Status()
+}
+
+// Subscribe returns a channel receiving the check manager status each time it
+// changes and a func to unsubscribe (see checkmgr.Subscribe)
+func (m *CirconusMetrics) Subscribe() (<-chan checkmgr.Status, func()) {
+	return m.check.Subscribe()
+}
+
+// SubmissionHealth returns the submission health of the broker instances the
+// check can submit to (see checkmgr.Health)
+func (m *CirconusMetrics) SubmissionHealth() []checkmgr.InstanceHealth {
+	return m.check.Health()
+}
+
+// FilteredMetrics returns the number of distinct metrics rejected by the
+// check manager metric filters (see checkmgr.CheckConfig.MetricFilters)
+func (m *CirconusMetrics) FilteredMetrics() int {
+	return m.check.FilteredMetrics()
+}
+
 func (m *CirconusMetrics) packageMetrics() (map[string]*api.CheckBundleMetric, Metrics) {
 
 	m.packagingmu.Lock()
@@ -368,32 +476,40 @@ func (m *CirconusMetrics) FlushMetrics() *Metrics {
 		return &Metrics{}
 	}
 
-	m.flushing = true
-	m.flushmu.Unlock()
+	m.startFlush()
 
 	_, output := m.packageMetrics()
 
-	m.flushmu.Lock()
-	m.flushing = false
-	m.flushmu.Unlock()
+	m.endFlush()
 
 	return &output
 }
 
 // Flush metrics kicks off the process of sending metrics to Circonus
 func (m *CirconusMetrics) Flush() {
+	m.flush(false)
+}
+
+// flush sends the metrics, when a flush is in progress it is skipped or, with
+// wait, done after the flush in progress
+func (m *CirconusMetrics) flush(wait bool) {
 	m.flushmu.Lock()
-	if m.flushing {
+	for m.flushing {
+		if !wait {
+			m.flushmu.Unlock()
+			return
+		}
+		done := m.flushDone
 		m.flushmu.Unlock()
-		return
+		<-done
+		m.flushmu.Lock()
 	}
-
-	m.flushing = true
-	m.flushmu.Unlock()
+	m.startFlush()
 
 	newMetrics, output := m.packageMetrics()
 
 	if len(output) > 0 {
+		m.writeSinks(time.Now(), output)
 		m.submit(output, newMetrics)
 	} else {
 		if m.Debug {
@@ -401,7 +517,20 @@ func (m *CirconusMetrics) Flush() {
 		}
 	}
 
+	m.endFlush()
+}
+
+// startFlush marks a flush in progress, flushmu must be held (and is released)
+func (m *CirconusMetrics) startFlush() {
+	m.flushing = true
+	m.flushDone = make(chan struct{})
+	m.flushmu.Unlock()
+}
+
+// endFlush marks the flush in progress done
+func (m *CirconusMetrics) endFlush() {
 	m.flushmu.Lock()
 	m.flushing = false
+	close(m.flushDone)
 	m.flushmu.Unlock()
 }
@@ -5,6 +5,7 @@
 package circonusgometrics
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
 )
 
 func testServer() *httptest.Server {
@@ -145,6 +148,35 @@ func TestNew(t *testing.T) {
 		}
 	}
 
+	t.Log("collector timeout [good]")
+	{
+		cfg := &Config{
+			CollectorTimeout: "1s",
+		}
+		cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cm.collectorTimeout != time.Second {
+			t.Fatalf("Expected 1s, got %s", cm.collectorTimeout)
+		}
+	}
+	t.Log("collector timeout [bad]")
+	{
+		cfg := &Config{
+			CollectorTimeout: "0s",
+		}
+		expectedError := errors.New("invalid collector timeout (0s)")
+		_, err := New(cfg)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if err.Error() != expectedError.Error() {
+			t.Fatalf("Expected %v got '%v'", expectedError, err)
+		}
+	}
+
 	t.Log("reset counters [good(true)]")
 	{
 		cfg := &Config{
@@ -294,6 +326,35 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestWaitReady(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	cfg := &Config{Interval: "0"}
+	cfg.CheckManager.Check.SubmissionURL = server.URL + "/metrics_endpoint"
+	cm, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cm.WaitReady(ctx); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	st := cm.Status()
+	if st.State.String() != "ready" || st.Attempts != 1 || st.SubmissionURL != cfg.CheckManager.Check.SubmissionURL {
+		t.Fatalf("Expected ready, got %+v", st)
+	}
+
+	ch, unsubscribe := cm.Subscribe()
+	defer unsubscribe()
+	if st := <-ch; st.State.String() != "ready" {
+		t.Fatalf("Expected ready, got %+v", st)
+	}
+}
+
 func TestFlush(t *testing.T) {
 	server := testServer()
 	defer server.Close()
@@ -382,6 +443,102 @@ func TestFlush(t *testing.T) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	server := testServer()
+	defer server.Close()
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = server.URL + "/metrics_endpoint"
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cm.Set("foo", 30)
+
+	if err := cm.Shutdown(); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if _, err := cm.GetCounterTest("foo"); err == nil {
+		t.Fatal("Expected foo flushed")
+	}
+
+	t.Log("again")
+	{
+		if err := cm.Shutdown(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("flush in progress")
+	{
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.Set("foo", 30)
+		cm.flushmu.Lock()
+		cm.startFlush()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- cm.Shutdown()
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("Expected shutdown to wait for the flush, got '%v'", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		cm.endFlush()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Expected no error, got '%v'", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected shutdown to finish")
+		}
+		if _, err := cm.GetCounterTest("foo"); err == nil {
+			t.Fatal("Expected foo flushed")
+		}
+	}
+
+	t.Log("no submission after shutdown")
+	{
+		broker, err := brokertest.New(&brokertest.Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer broker.Close()
+
+		cfg := &Config{}
+		cfg.CheckManager.Check.SubmissionURL = broker.SubmissionURL("uuid", "secret")
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.Set("foo", 30)
+		if err := cm.Shutdown(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if n := broker.Accepted(); n != 1 {
+			t.Fatalf("Expected 1 submission on shutdown, got %d", n)
+		}
+		if cm.Ready() {
+			t.Fatal("Expected not ready after shutdown")
+		}
+
+		cm.Set("foo", 31)
+		cm.Flush()
+		if n := broker.Accepted(); n != 1 {
+			t.Fatalf("Expected no submission after shutdown, got %d", n)
+		}
+	}
+}
+
 func TestPackageMetrics(t *testing.T) {
 	cfg := &Config{}
 	cfg.CheckManager.Check.SubmissionURL = "none"
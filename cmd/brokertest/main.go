@@ -0,0 +1,109 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command brokertest runs a fake httptrap broker for development.
+//
+//	brokertest -addr 127.0.0.1:43191 -tls -ca-file /tmp/broker-ca.pem -v
+//
+// Submit to http(s)://<addr>/module/httptrap/<uuid>/<secret>, each accepted
+// submission is logged (with -v its payload). Use -status, -delay and
+// -no-content to imitate an unhealthy broker or circonus-agent.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+	"github.com/pkg/errors"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:43191", "address to listen on")
+	useTLS := flag.Bool("tls", false, "serve https with a certificate signed by a generated CA")
+	cn := flag.String("cn", "", "common name of the server certificate (default: brokertest)")
+	caFile := flag.String("ca-file", "", "write the CA certificate (PEM) to this file")
+	secret := flag.String("secret", "", "require this secret in submission urls")
+	status := flag.Int("status", 0, "respond with this status code instead of accepting submissions")
+	delay := flag.Duration("delay", 0, "delay before responding")
+	noContent := flag.Bool("no-content", false, "respond 204 No Content (circonus-agent style)")
+	keep := flag.Int("keep", 100, "number of submissions kept in memory")
+	verbose := flag.Bool("v", false, "log submission payloads")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	if *caFile != "" && !*useTLS {
+		logger.Fatalf("[FATAL] -ca-file requires -tls")
+	}
+	if *keep < 1 {
+		logger.Fatalf("[FATAL] invalid -keep (%d)", *keep)
+	}
+
+	b, err := brokertest.New(&brokertest.Config{
+		Log:            logger,
+		Debug:          *verbose,
+		Addr:           *addr,
+		TLS:            *useTLS,
+		CN:             *cn,
+		Secret:         *secret,
+		NoContent:      *noContent,
+		MaxSubmissions: *keep,
+	})
+	if err != nil {
+		logger.Fatalf("[FATAL] starting broker: %v", err)
+	}
+
+	if err := run(b, logger, *caFile, *status, *delay, *verbose); err != nil {
+		b.Close()
+		logger.Fatalf("[FATAL] %v", err)
+	}
+	b.Close()
+}
+
+// run serves submissions until interrupted, logging each one accepted
+func run(b *brokertest.Broker, logger *log.Logger, caFile string, status int, delay time.Duration, verbose bool) error {
+	if status != 0 || delay > 0 {
+		b.SetFault(brokertest.Fault{StatusCode: status, Delay: delay})
+	}
+
+	if caFile != "" {
+		if err := ioutil.WriteFile(caFile, b.CACert(), 0644); err != nil {
+			return errors.Wrap(err, "writing ca file")
+		}
+		logger.Printf("CA certificate written to %s", caFile)
+	}
+
+	logger.Printf("listening, submission url %s", b.SubmissionURL("<uuid>", "<secret>"))
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	seen := 0
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sig:
+			return nil
+		case <-ticker.C:
+			submissions, accepted := b.SubmissionsSince(seen)
+			if dropped := accepted - seen - len(submissions); dropped > 0 {
+				logger.Printf("[WARN] %d submissions not kept (-keep)", dropped)
+			}
+			for _, s := range submissions {
+				logger.Printf("%s %d metrics", s.UUID, len(s.Metrics))
+				if verbose {
+					logger.Printf("[DEBUG] %s", s.Payload)
+				}
+			}
+			seen = accepted
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/circonus-labs/circonusllhist"
+)
+
+const (
+	defaultCollectorTimeout = "5s"
+)
+
+// Emitter receives the metrics produced by a Collector
+type Emitter interface {
+	// Set a counter to a specific value
+	Set(metric string, val uint64)
+	// Add updates counter by supplied value
+	Add(metric string, val uint64)
+	// SetGauge sets a gauge to a value
+	SetGauge(metric string, val interface{})
+	// RecordValue adds a value to a histogram
+	RecordValue(metric string, val float64)
+	// RecordCountForValue adds count n for value to a histogram
+	RecordCountForValue(metric string, val float64, n int64)
+	// SetText sets a text metric
+	SetText(metric string, val string)
+}
+
+// Collector is called at each flush to emit metrics. A Collector produces a
+// variable set of metrics (e.g. one metric per connection pool or per
+// table). Collectors are called concurrently, each bounded by the collector
+// timeout.
+type Collector interface {
+	Collect(ctx context.Context, e Emitter) error
+}
+
+// CollectorFunc is an adapter allowing an ordinary function to be used as a Collector
+type CollectorFunc func(ctx context.Context, e Emitter) error
+
+// Collect calls f(ctx, e)
+func (f CollectorFunc) Collect(ctx context.Context, e Emitter) error {
+	return f(ctx, e)
+}
+
+// RegisterCollector adds a named collector [called at flush interval]. The
+// duration of each collection and the number of failed (or timed out)
+// collections are tracked in cgm`collector`<name>`duration (histogram, in
+// seconds) and cgm`collector`<name>`errors.
+func (m *CirconusMetrics) RegisterCollector(name string, c Collector) {
+	m.clm.Lock()
+	defer m.clm.Unlock()
+	m.collectors[name] = c
+}
+
+// RemoveCollector removes a named collector
+func (m *CirconusMetrics) RemoveCollector(name string) {
+	m.clm.Lock()
+	defer m.clm.Unlock()
+	delete(m.collectors, name)
+}
+
+// collectorEmitter accumulates the metrics emitted by one collector for one flush
+type collectorEmitter struct {
+	mu         sync.Mutex
+	closed     bool
+	counters   map[string]uint64
+	gauges     map[string]interface{}
+	histograms map[string]*circonusllhist.Histogram
+	text       map[string]string
+}
+
+func newCollectorEmitter() *collectorEmitter {
+	return &collectorEmitter{
+		counters:   make(map[string]uint64),
+		gauges:     make(map[string]interface{}),
+		histograms: make(map[string]*circonusllhist.Histogram),
+		text:       make(map[string]string),
+	}
+}
+
+// close discards anything emitted afterwards (e.g. by a timed out collector)
+func (e *collectorEmitter) close() {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+}
+
+func (e *collectorEmitter) Set(metric string, val uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.counters[metric] = val
+	}
+}
+
+func (e *collectorEmitter) Add(metric string, val uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.counters[metric] += val
+	}
+}
+
+func (e *collectorEmitter) SetGauge(metric string, val interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.gauges[metric] = val
+	}
+}
+
+func (e *collectorEmitter) RecordValue(metric string, val float64) {
+	e.RecordCountForValue(metric, val, 1)
+}
+
+func (e *collectorEmitter) RecordCountForValue(metric string, val float64, n int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	hist, ok := e.histograms[metric]
+	if !ok {
+		hist = circonusllhist.New()
+		e.histograms[metric] = hist
+	}
+	hist.RecordValues(val, n)
+}
+
+func (e *collectorEmitter) SetText(metric string, val string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.text[metric] = val
+	}
+}
+
+// snapCollectors calls all registered collectors concurrently and returns
+// the combined output of those which completed successfully. Collector
+// self-metrics are recorded so they are included in the current snapshot.
+func (m *CirconusMetrics) snapCollectors() *collectorEmitter {
+	m.clm.Lock()
+	collectors := make(map[string]Collector, len(m.collectors))
+	for n, c := range m.collectors {
+		collectors[n] = c
+	}
+	m.clm.Unlock()
+
+	output := newCollectorEmitter()
+	if len(collectors) == 0 {
+		return output
+	}
+
+	var wg sync.WaitGroup
+	var outmu sync.Mutex
+
+	for name, collector := range collectors {
+		wg.Add(1)
+		go func(name string, collector Collector) {
+			defer wg.Done()
+
+			e := newCollectorEmitter()
+			start := time.Now()
+			err := m.runCollector(collector, e)
+			elapsed := time.Since(start)
+			e.close()
+
+			m.RecordValue("cgm`collector`"+name+"`duration", elapsed.Seconds())
+			if err != nil {
+				m.Add("cgm`collector`"+name+"`errors", 1)
+				m.Log.Printf("[WARN] collector %s, %v", name, err)
+				return
+			}
+
+			outmu.Lock()
+			output.merge(e)
+			outmu.Unlock()
+		}(name, collector)
+	}
+
+	wg.Wait()
+
+	return output
+}
+
+// runCollector calls a collector, giving up on it after the collector timeout
+func (m *CirconusMetrics) runCollector(collector Collector, e Emitter) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.collectorTimeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- collector.Collect(ctx, e)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// merge adds the metrics of another (closed) emitter, for a given name the
+// last merged value wins
+func (e *collectorEmitter) merge(o *collectorEmitter) {
+	for n, v := range o.counters {
+		e.counters[n] = v
+	}
+	for n, v := range o.gauges {
+		e.gauges[n] = v
+	}
+	for n, v := range o.histograms {
+		e.histograms[n] = v
+	}
+	for n, v := range o.text {
+		e.text[n] = v
+	}
+}
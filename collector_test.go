@@ -0,0 +1,132 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisterCollector(t *testing.T) {
+	t.Log("Testing collector.RegisterCollector")
+
+	cm := &CirconusMetrics{}
+	cm.collectors = make(map[string]Collector)
+
+	cm.RegisterCollector("foo", CollectorFunc(func(ctx context.Context, e Emitter) error {
+		return nil
+	}))
+
+	if len(cm.collectors) != 1 {
+		t.Fatalf("Expected 1, found %d", len(cm.collectors))
+	}
+
+	cm.RemoveCollector("foo")
+
+	if len(cm.collectors) != 0 {
+		t.Fatalf("Expected 0, found %d", len(cm.collectors))
+	}
+}
+
+func TestSnapCollectors(t *testing.T) {
+	t.Log("Testing collector.snapCollectors")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cfg.CollectorTimeout = "100ms"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cm.RegisterCollector("pools", CollectorFunc(func(ctx context.Context, e Emitter) error {
+		for _, pool := range []string{"a", "b"} {
+			e.Add("pool`"+pool+"`conns", 2)
+			e.SetGauge("pool`"+pool+"`idle", 1.5)
+			e.RecordValue("pool`"+pool+"`wait", 1)
+			e.SetText("pool`"+pool+"`state", "ok")
+		}
+		return nil
+	}))
+	cm.RegisterCollector("broken", CollectorFunc(func(ctx context.Context, e Emitter) error {
+		e.Add("broken`partial", 1)
+		return errors.New("broken")
+	}))
+	cm.RegisterCollector("slow", CollectorFunc(func(ctx context.Context, e Emitter) error {
+		time.Sleep(500 * time.Millisecond)
+		e.Add("slow`late", 1)
+		return nil
+	}))
+
+	c, g, h, txt := cm.snapshot()
+
+	for _, pool := range []string{"a", "b"} {
+		if v, ok := c["pool`"+pool+"`conns"]; !ok || v != 2 {
+			t.Fatalf("Expected 2, found %v (%v)", v, ok)
+		}
+		if v, ok := g["pool`"+pool+"`idle"]; !ok || v.(float64) != 1.5 {
+			t.Fatalf("Expected 1.5, found %v (%v)", v, ok)
+		}
+		if _, ok := h["pool`"+pool+"`wait"]; !ok {
+			t.Fatal("Expected histogram")
+		}
+		if v, ok := txt["pool`"+pool+"`state"]; !ok || v != "ok" {
+			t.Fatalf("Expected ok, found %v (%v)", v, ok)
+		}
+	}
+
+	if _, ok := c["broken`partial"]; ok {
+		t.Fatal("Expected output of failed collector to be discarded")
+	}
+	if _, ok := c["slow`late"]; ok {
+		t.Fatal("Expected output of timed out collector to be discarded")
+	}
+
+	for _, name := range []string{"pools", "broken", "slow"} {
+		if _, ok := h["cgm`collector`"+name+"`duration"]; !ok {
+			t.Fatalf("Expected duration for %s", name)
+		}
+	}
+	if v := c["cgm`collector`broken`errors"]; v != 1 {
+		t.Fatalf("Expected 1, found %d", v)
+	}
+	if v := c["cgm`collector`slow`errors"]; v != 1 {
+		t.Fatalf("Expected 1, found %d", v)
+	}
+	if _, ok := c["cgm`collector`pools`errors"]; ok {
+		t.Fatal("Expected no errors for pools")
+	}
+}
+
+func TestPackageMetricsCollector(t *testing.T) {
+	t.Log("Testing collector output is packaged")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cm.RegisterCollector("tables", CollectorFunc(func(ctx context.Context, e Emitter) error {
+		e.SetGauge("table`foo`rows", int64(10))
+		return nil
+	}))
+
+	newMetrics, output := cm.packageMetrics()
+
+	if _, ok := newMetrics["table`foo`rows"]; !ok {
+		t.Fatal("Expected table`foo`rows to be activated")
+	}
+	if m, ok := output["table`foo`rows"]; !ok || m.Type != "l" {
+		t.Fatalf("Expected table`foo`rows of type l, found %v (%v)", m, ok)
+	}
+}
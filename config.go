@@ -0,0 +1,448 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Environment variables read by ConfigFromEnv and LoadConfig. Settings marked
+// (file) may also be read from a file named by the variable with a _FILE
+// suffix, e.g. CIRCONUS_API_TOKEN_FILE=/run/secrets/circonus_token.
+const (
+	EnvConfigFile                = "CIRCONUS_CONFIG_FILE" // config file loaded by ConfigFromEnv
+	EnvDebug                     = "CIRCONUS_DEBUG"
+	EnvInterval                  = "CIRCONUS_INTERVAL"
+	EnvCollectorTimeout          = "CIRCONUS_COLLECTOR_TIMEOUT"
+	EnvResetCounters             = "CIRCONUS_RESET_COUNTERS"
+	EnvResetGauges               = "CIRCONUS_RESET_GAUGES"
+	EnvResetHistograms           = "CIRCONUS_RESET_HISTOGRAMS"
+	EnvResetText                 = "CIRCONUS_RESET_TEXT"
+	EnvAPIToken                  = "CIRCONUS_API_TOKEN" // (file)
+	EnvAPIApp                    = "CIRCONUS_API_APP"
+	EnvAPIURL                    = "CIRCONUS_API_URL"
+	EnvAPIAccountID              = "CIRCONUS_API_ACCOUNT_ID"
+	EnvAPICAFile                 = "CIRCONUS_API_CA_FILE" // PEM CA certificate(s) for the API
+	EnvSubmissionURL             = "CIRCONUS_SUBMISSION_URL"
+	EnvCheckID                   = "CIRCONUS_CHECK_ID"
+	EnvCheckInstanceID           = "CIRCONUS_CHECK_INSTANCE_ID"
+	EnvCheckTargetHost           = "CIRCONUS_CHECK_TARGET_HOST"
+	EnvCheckDisplayName          = "CIRCONUS_CHECK_DISPLAY_NAME"
+	EnvCheckSearchTag            = "CIRCONUS_CHECK_SEARCH_TAG"
+	EnvCheckSecret               = "CIRCONUS_CHECK_SECRET" // (file)
+	EnvCheckTags                 = "CIRCONUS_CHECK_TAGS"
+	EnvCheckMaxURLAge            = "CIRCONUS_CHECK_MAX_URL_AGE"
+	EnvCheckForceActivation      = "CIRCONUS_CHECK_FORCE_METRIC_ACTIVATION"
+	EnvCheckType                 = "CIRCONUS_CHECK_TYPE"
+	EnvCheckStateFile            = "CIRCONUS_CHECK_STATE_FILE" // cache of the resolved check
+	EnvCheckMetricUpdateInterval = "CIRCONUS_CHECK_METRIC_UPDATE_INTERVAL"
+	EnvCheckMetricUpdateBatch    = "CIRCONUS_CHECK_METRIC_UPDATE_BATCH"
+	EnvCheckMetricFilters        = "CIRCONUS_CHECK_METRIC_FILTERS" // allow/deny rules, one per line
+	EnvCheckEphemeral            = "CIRCONUS_CHECK_EPHEMERAL"
+	EnvCheckEphemeralTTL         = "CIRCONUS_CHECK_EPHEMERAL_TTL"
+	EnvCheckEphemeralShutdown    = "CIRCONUS_CHECK_EPHEMERAL_SHUTDOWN"
+	EnvBrokerID                  = "CIRCONUS_BROKER_ID"
+	EnvBrokerSelectTag           = "CIRCONUS_BROKER_SELECT_TAG"
+	EnvBrokerMaxResponseTime     = "CIRCONUS_BROKER_MAX_RESPONSE_TIME"
+	EnvBrokerCAFile              = "CIRCONUS_BROKER_CA_FILE"          // PEM CA certificate(s) for the broker, reloaded when changed
+	EnvBrokerClientCertFile      = "CIRCONUS_BROKER_CLIENT_CERT_FILE" // PEM client certificate, reloaded when changed
+	EnvBrokerClientKeyFile       = "CIRCONUS_BROKER_CLIENT_KEY_FILE"
+	EnvBrokerClientCert          = "CIRCONUS_BROKER_CLIENT_CERT" // PEM client certificate contents
+	EnvBrokerClientKey           = "CIRCONUS_BROKER_CLIENT_KEY"
+	EnvBrokerPinSPKI             = "CIRCONUS_BROKER_PIN_SPKI"
+	EnvBrokerSelectStrategy      = "CIRCONUS_BROKER_SELECT_STRATEGY"
+	EnvBrokerLocation            = "CIRCONUS_BROKER_LOCATION"
+	EnvBrokerPreferTags          = "CIRCONUS_BROKER_PREFER_TAGS"
+	EnvBrokerProbeTimeout        = "CIRCONUS_BROKER_PROBE_TIMEOUT"
+	EnvBrokerProbeConcurrency    = "CIRCONUS_BROKER_PROBE_CONCURRENCY"
+	EnvBrokerFailoverAfter       = "CIRCONUS_BROKER_FAILOVER_AFTER"
+	EnvBrokerFailoverMoveCheck   = "CIRCONUS_BROKER_FAILOVER_MOVE_CHECK"
+	EnvInitMinDelay              = "CIRCONUS_INIT_MIN_DELAY"
+	EnvInitMaxDelay              = "CIRCONUS_INIT_MAX_DELAY"
+	EnvInitJitter                = "CIRCONUS_INIT_JITTER"
+	EnvInitMaxAttempts           = "CIRCONUS_INIT_MAX_ATTEMPTS"
+	EnvInitRetryPermanent        = "CIRCONUS_INIT_RETRY_PERMANENT"
+)
+
+// customFieldsKey is the config file table of check custom config fields
+const customFieldsKey = "check.custom_config_fields"
+
+// setting maps an environment variable and a config file key onto Config
+type setting struct {
+	env  string
+	key  string
+	file bool // value may be read from a file (<env>_FILE, <key>_file)
+	set  func(cfg *Config, v string) error
+}
+
+var settings = []setting{
+	{EnvDebug, "debug", false, func(cfg *Config, v string) error {
+		debug, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Wrap(err, "parsing debug")
+		}
+		cfg.Debug = debug
+		return nil
+	}},
+	{EnvInterval, "interval", false, func(cfg *Config, v string) error { cfg.Interval = v; return nil }},
+	{EnvCollectorTimeout, "collector_timeout", false, func(cfg *Config, v string) error { cfg.CollectorTimeout = v; return nil }},
+	{EnvResetCounters, "reset_counters", false, func(cfg *Config, v string) error { cfg.ResetCounters = v; return nil }},
+	{EnvResetGauges, "reset_gauges", false, func(cfg *Config, v string) error { cfg.ResetGauges = v; return nil }},
+	{EnvResetHistograms, "reset_histograms", false, func(cfg *Config, v string) error { cfg.ResetHistograms = v; return nil }},
+	{EnvResetText, "reset_text", false, func(cfg *Config, v string) error { cfg.ResetText = v; return nil }},
+	{EnvAPIToken, "api.token", true, func(cfg *Config, v string) error { cfg.CheckManager.API.TokenKey = v; return nil }},
+	{EnvAPIApp, "api.app", false, func(cfg *Config, v string) error { cfg.CheckManager.API.TokenApp = v; return nil }},
+	{EnvAPIURL, "api.url", false, func(cfg *Config, v string) error { cfg.CheckManager.API.URL = v; return nil }},
+	{EnvAPIAccountID, "api.account_id", false, func(cfg *Config, v string) error { cfg.CheckManager.API.TokenAccountID = v; return nil }},
+	{EnvAPICAFile, "api.ca_file", false, func(cfg *Config, v string) error {
+		t, err := loadCAFile(v)
+		if err != nil {
+			return err
+		}
+		cfg.CheckManager.API.TLSConfig = t
+		return nil
+	}},
+	{EnvSubmissionURL, "check.submission_url", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.SubmissionURL = v; return nil }},
+	{EnvCheckID, "check.id", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.ID = v; return nil }},
+	{EnvCheckInstanceID, "check.instance_id", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.InstanceID = v; return nil }},
+	{EnvCheckTargetHost, "check.target_host", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.TargetHost = v; return nil }},
+	{EnvCheckDisplayName, "check.display_name", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.DisplayName = v; return nil }},
+	{EnvCheckSearchTag, "check.search_tag", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.SearchTag = v; return nil }},
+	{EnvCheckSecret, "check.secret", true, func(cfg *Config, v string) error { cfg.CheckManager.Check.Secret = v; return nil }},
+	{EnvCheckTags, "check.tags", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.Tags = v; return nil }},
+	{EnvCheckMaxURLAge, "check.max_url_age", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.MaxURLAge = v; return nil }},
+	{EnvCheckForceActivation, "check.force_metric_activation", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Check.ForceMetricActivation = v
+		return nil
+	}},
+	{EnvCheckType, "check.type", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.Type = v; return nil }},
+	{EnvCheckStateFile, "check.state_file", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Check.StateFile = v
+		return nil
+	}},
+	{EnvCheckMetricUpdateInterval, "check.metric_update_interval", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Check.MetricUpdateInterval = v
+		return nil
+	}},
+	{EnvCheckMetricUpdateBatch, "check.metric_update_batch", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Check.MetricUpdateBatch = v
+		return nil
+	}},
+	{EnvCheckMetricFilters, "check.metric_filters", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Check.MetricFilters = v
+		return nil
+	}},
+	{EnvCheckEphemeral, "check.ephemeral", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.Ephemeral = v; return nil }},
+	{EnvCheckEphemeralTTL, "check.ephemeral_ttl", false, func(cfg *Config, v string) error { cfg.CheckManager.Check.EphemeralTTL = v; return nil }},
+	{EnvCheckEphemeralShutdown, "check.ephemeral_shutdown", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Check.EphemeralShutdown = v
+		return nil
+	}},
+	{EnvBrokerID, "broker.id", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.ID = v; return nil }},
+	{EnvBrokerSelectTag, "broker.select_tag", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.SelectTag = v; return nil }},
+	{EnvBrokerMaxResponseTime, "broker.max_response_time", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.MaxResponseTime = v
+		return nil
+	}},
+	{EnvBrokerCAFile, "broker.ca_file", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.CAFile = v; return nil }},
+	{EnvBrokerClientCertFile, "broker.client_cert_file", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.ClientCertFile = v
+		return nil
+	}},
+	{EnvBrokerClientKeyFile, "broker.client_key_file", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.ClientKeyFile = v
+		return nil
+	}},
+	{EnvBrokerClientCert, "broker.client_cert", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.ClientCert = v; return nil }},
+	{EnvBrokerClientKey, "broker.client_key", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.ClientKey = v; return nil }},
+	{EnvBrokerPinSPKI, "broker.pin_spki", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.PinSPKI = v; return nil }},
+	{EnvBrokerSelectStrategy, "broker.select_strategy", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.SelectStrategy = v
+		return nil
+	}},
+	{EnvBrokerLocation, "broker.location", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.Location = v; return nil }},
+	{EnvBrokerPreferTags, "broker.prefer_tags", false, func(cfg *Config, v string) error { cfg.CheckManager.Broker.PreferTags = v; return nil }},
+	{EnvBrokerProbeTimeout, "broker.probe_timeout", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.ProbeTimeout = v
+		return nil
+	}},
+	{EnvBrokerProbeConcurrency, "broker.probe_concurrency", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.ProbeConcurrency = v
+		return nil
+	}},
+	{EnvBrokerFailoverAfter, "broker.failover_after", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.FailoverAfter = v
+		return nil
+	}},
+	{EnvBrokerFailoverMoveCheck, "broker.failover_move_check", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Broker.FailoverMoveCheck = v
+		return nil
+	}},
+	{EnvInitMinDelay, "init.min_delay", false, func(cfg *Config, v string) error { cfg.CheckManager.Init.MinDelay = v; return nil }},
+	{EnvInitMaxDelay, "init.max_delay", false, func(cfg *Config, v string) error { cfg.CheckManager.Init.MaxDelay = v; return nil }},
+	{EnvInitJitter, "init.jitter", false, func(cfg *Config, v string) error { cfg.CheckManager.Init.Jitter = v; return nil }},
+	{EnvInitMaxAttempts, "init.max_attempts", false, func(cfg *Config, v string) error { cfg.CheckManager.Init.MaxAttempts = v; return nil }},
+	{EnvInitRetryPermanent, "init.retry_permanent", false, func(cfg *Config, v string) error {
+		cfg.CheckManager.Init.RetryPermanent = v
+		return nil
+	}},
+}
+
+// ConfigFromEnv returns a configuration from the CIRCONUS_* environment
+// variables. If CIRCONUS_CONFIG_FILE is set, the file is loaded first, as
+// with LoadConfig.
+func ConfigFromEnv() (*Config, error) {
+	if path := os.Getenv(EnvConfigFile); path != "" {
+		return LoadConfig(path)
+	}
+
+	cfg := &Config{}
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return nil, ConfigErrors(errs)
+	}
+	return cfg, nil
+}
+
+// LoadConfig returns a configuration from a JSON (.json), YAML (.yaml, .yml)
+// or TOML (.toml) file, overridden by any CIRCONUS_* environment variables.
+// Precedence, highest first: environment, file, defaults.
+//
+// Keys match the environment variables, grouped by api, check, broker and
+// init, e.g.
+//
+//	interval = "10s"
+//	[api]
+//	token_file = "/run/secrets/circonus_token"
+//	[check]
+//	search_tag = "service:foo"
+//	[check.custom_config_fields]
+//	asynch_metrics = "true"
+//	[broker]
+//	select_tag = "dc:east"
+//	ca_file = "ca.crt"
+//
+// api.token and check.secret may instead be read from a file (api.token_file,
+// check.secret_file). Relative file names are relative to the config file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, errors.Errorf("unsupported config file type (%s)", path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing config file (%s)", path)
+	}
+
+	values := make(map[string]string)
+	if err := flattenConfig("", raw, values); err != nil {
+		return nil, errors.Wrapf(err, "config file (%s)", path)
+	}
+
+	cfg := &Config{}
+	if err := applyFile(cfg, values, filepath.Dir(path)); err != nil {
+		return nil, errors.Wrapf(err, "config file (%s)", path)
+	}
+	if err := applyEnv(cfg); err != nil {
+		return nil, err
+	}
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return nil, ConfigErrors(errs)
+	}
+	return cfg, nil
+}
+
+// applyEnv applies the environment variables which are set
+func applyEnv(cfg *Config) error {
+	for _, s := range settings {
+		v, ok := os.LookupEnv(s.env)
+		if s.file {
+			if fn, isSet := os.LookupEnv(s.env + "_FILE"); isSet {
+				if ok {
+					return errors.Errorf("only one of %s and %s_FILE may be set", s.env, s.env)
+				}
+				data, err := readSecret(fn)
+				if err != nil {
+					return errors.Wrapf(err, "%s_FILE", s.env)
+				}
+				v, ok = data, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := s.set(cfg, v); err != nil {
+			return errors.Wrap(err, s.env)
+		}
+	}
+	return nil
+}
+
+// applyFile applies the (flattened) config file values
+func applyFile(cfg *Config, values map[string]string, dir string) error {
+	known := make(map[string]bool)
+	for _, s := range settings {
+		known[s.key] = true
+		v, ok := values[s.key]
+		if s.file {
+			known[s.key+"_file"] = true
+			if fn, isSet := values[s.key+"_file"]; isSet {
+				if ok {
+					return errors.Errorf("only one of %s and %s_file may be set", s.key, s.key)
+				}
+				data, err := readSecret(relativeTo(dir, fn))
+				if err != nil {
+					return errors.Wrapf(err, "%s_file", s.key)
+				}
+				v, ok = data, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(s.key, "ca_file") || strings.HasSuffix(s.key, "cert_file") || strings.HasSuffix(s.key, "key_file") {
+			v = relativeTo(dir, v)
+		}
+		if err := s.set(cfg, v); err != nil {
+			return errors.Wrap(err, s.key)
+		}
+	}
+
+	var unknown []string
+	for k, v := range values {
+		if strings.HasPrefix(k, customFieldsKey+".") {
+			if cfg.CheckManager.Check.CustomConfigFields == nil {
+				cfg.CheckManager.Check.CustomConfigFields = make(map[string]string)
+			}
+			cfg.CheckManager.Check.CustomConfigFields[strings.TrimPrefix(k, customFieldsKey+".")] = v
+			continue
+		}
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.Errorf("unknown setting(s) %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// configLineLists are the settings whose lists are joined with newlines,
+// their items may contain commas (e.g. metric filter rules)
+var configLineLists = map[string]bool{
+	"check.metric_filters": true,
+}
+
+// flattenConfig flattens nested tables into dotted keys (e.g. api.token),
+// scalar values are converted to strings and lists joined with commas (or
+// newlines, configLineLists)
+func flattenConfig(prefix string, raw map[string]interface{}, values map[string]string) error {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			if err := flattenConfig(key, val, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, 0, len(val))
+			for _, item := range val {
+				s, err := configString(item)
+				if err != nil {
+					return errors.Wrap(err, key)
+				}
+				items = append(items, s)
+			}
+			sep := ","
+			if configLineLists[key] {
+				sep = "\n"
+			}
+			values[key] = strings.Join(items, sep)
+		default:
+			s, err := configString(val)
+			if err != nil {
+				return errors.Wrap(err, key)
+			}
+			values[key] = s
+		}
+	}
+	return nil
+}
+
+func configString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case int:
+		return strconv.Itoa(val), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case nil:
+		return "", nil
+	}
+	return "", errors.Errorf("unsupported value type (%T)", v)
+}
+
+// readSecret reads a value from a file, surrounding whitespace is removed
+func readSecret(fn string) (string, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// loadCAFile returns a tls configuration trusting the PEM certificate(s) in fn
+func loadCAFile(fn string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading ca file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificates found in ca file (%s)", fn)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+func relativeTo(dir, fn string) string {
+	if fn == "" || filepath.IsAbs(fn) {
+		return fn
+	}
+	return filepath.Join(dir, fn)
+}
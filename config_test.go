@@ -0,0 +1,278 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+)
+
+// setEnv sets environment variables, clearing all other CIRCONUS_* variables,
+// the returned func restores a clean environment
+func setEnv(t *testing.T, vars map[string]string) func() {
+	clear := func() {
+		os.Unsetenv(EnvConfigFile)
+		for _, s := range settings {
+			os.Unsetenv(s.env)
+			os.Unsetenv(s.env + "_FILE")
+		}
+	}
+	clear()
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+	return clear
+}
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	fn := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fn, []byte(data), 0600); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return fn
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgm-config")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Log("settings")
+	{
+		defer setEnv(t, map[string]string{
+			EnvDebug:                 "false",
+			EnvInterval:              "30s",
+			EnvResetGauges:           "false",
+			EnvAPIToken:              "abc",
+			EnvAPIApp:                "app",
+			EnvAPIURL:                "http://127.0.0.1/v2",
+			EnvCheckSearchTag:        "service:foo",
+			EnvCheckTags:             "a:b,c:d",
+			EnvBrokerSelectTag:       "dc:east",
+			EnvBrokerMaxResponseTime: "1s",
+			EnvBrokerFailoverAfter:   "2",
+			EnvInitMaxAttempts:       "5",
+		})()
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cfg.Interval != "30s" || cfg.ResetGauges != "false" || cfg.ResetCounters != "" {
+			t.Fatalf("Expected interval and reset gauges, got %+v", cfg)
+		}
+		api := cfg.CheckManager.API
+		if api.TokenKey != "abc" || api.TokenApp != "app" || api.URL != "http://127.0.0.1/v2" {
+			t.Fatalf("Expected api settings, got %+v", api)
+		}
+		check := cfg.CheckManager.Check
+		if check.SearchTag != "service:foo" || check.Tags != "a:b,c:d" {
+			t.Fatalf("Expected check settings, got %+v", check)
+		}
+		broker := cfg.CheckManager.Broker
+		if broker.SelectTag != "dc:east" || broker.MaxResponseTime != "1s" || broker.FailoverAfter != "2" {
+			t.Fatalf("Expected broker settings, got %+v", broker)
+		}
+		if cfg.CheckManager.Init.MaxAttempts != "5" {
+			t.Fatalf("Expected init max attempts, got %+v", cfg.CheckManager.Init)
+		}
+	}
+
+	t.Log("token file")
+	{
+		fn := writeFile(t, dir, "token", "abc\n")
+		defer setEnv(t, map[string]string{EnvAPIToken + "_FILE": fn})()
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cfg.CheckManager.API.TokenKey != "abc" {
+			t.Fatalf("Expected 'abc', got '%s'", cfg.CheckManager.API.TokenKey)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, vars := range []map[string]string{
+			{},
+			{EnvAPIToken: "abc", EnvAPIToken + "_FILE": filepath.Join(dir, "token")},
+			{EnvAPIToken + "_FILE": filepath.Join(dir, "missing")},
+			{EnvAPIToken: "abc", EnvInterval: "10"},
+			{EnvAPIToken: "abc", EnvResetCounters: "maybe"},
+			{EnvAPIToken: "abc", EnvCheckID: "abc"},
+			{EnvAPIToken: "abc", EnvDebug: "yes please"},
+			{EnvAPIToken: "abc", EnvBrokerCAFile: filepath.Join(dir, "token")},
+		} {
+			clear := setEnv(t, vars)
+			if _, err := ConfigFromEnv(); err == nil {
+				t.Fatalf("Expected error for %v", vars)
+			}
+			clear()
+		}
+	}
+
+	t.Log("submission url only")
+	{
+		defer setEnv(t, map[string]string{EnvSubmissionURL: "http://127.0.0.1/write/foo"})()
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cfg.CheckManager.Check.SubmissionURL != "http://127.0.0.1/write/foo" {
+			t.Fatalf("Expected submission url, got '%s'", cfg.CheckManager.Check.SubmissionURL)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgm-config")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker, err := brokertest.New(&brokertest.Config{TLS: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	broker.Close()
+
+	writeFile(t, dir, "token", "abc\n")
+	writeFile(t, dir, "ca.crt", string(broker.CACert()))
+
+	files := map[string]string{
+		"cgm.json": `{
+			"interval": "30s",
+			"reset_text": false,
+			"api": {"token_file": "token", "url": "http://127.0.0.1/v2"},
+			"check": {"id": 123, "tags": ["a:b", "c:d"], "metric_filters": ["deny ^debug,x", "allow .*"], "custom_config_fields": {"asynch_metrics": "true"}},
+			"broker": {"select_tag": "dc:east", "ca_file": "ca.crt"}
+		}`,
+		"cgm.yaml": `
+interval: 30s
+reset_text: false
+api:
+  token_file: token
+  url: http://127.0.0.1/v2
+check:
+  id: 123
+  tags: [a:b, c:d]
+  metric_filters:
+    - deny ^debug,x
+    - allow .*
+  custom_config_fields:
+    asynch_metrics: "true"
+broker:
+  select_tag: dc:east
+  ca_file: ca.crt
+`,
+		"cgm.toml": `
+interval = "30s"
+reset_text = false
+[api]
+token_file = "token"
+url = "http://127.0.0.1/v2"
+[check]
+id = 123
+tags = [
+  "a:b",
+  "c:d", # multi-line array
+]
+metric_filters = ["deny ^debug,x", "allow .*"]
+custom_config_fields = { asynch_metrics = "true" }
+[broker]
+select_tag = "dc:east"
+ca_file = "ca.crt"
+`,
+	}
+
+	for name, data := range files {
+		t.Logf("%s", name)
+		defer setEnv(t, nil)()
+		cfg, err := LoadConfig(writeFile(t, dir, name, data))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cfg.Interval != "30s" || cfg.ResetText != "false" {
+			t.Fatalf("Expected interval and reset text, got %+v", cfg)
+		}
+		if cfg.CheckManager.API.TokenKey != "abc" || cfg.CheckManager.API.URL != "http://127.0.0.1/v2" {
+			t.Fatalf("Expected api settings, got %+v", cfg.CheckManager.API)
+		}
+		check := cfg.CheckManager.Check
+		if check.ID != "123" || check.Tags != "a:b,c:d" || check.CustomConfigFields["asynch_metrics"] != "true" {
+			t.Fatalf("Expected check settings, got %+v", check)
+		}
+		if check.MetricFilters != "deny ^debug,x\nallow .*" {
+			t.Fatalf("Expected metric filters one per line, got %q", check.MetricFilters)
+		}
+		if cfg.CheckManager.Broker.SelectTag != "dc:east" {
+			t.Fatalf("Expected broker select tag, got '%s'", cfg.CheckManager.Broker.SelectTag)
+		}
+		if fn := cfg.CheckManager.Broker.CAFile; fn != filepath.Join(dir, "ca.crt") {
+			t.Fatalf("Expected broker ca file relative to the config file, got '%s'", fn)
+		}
+	}
+
+	t.Log("environment overrides file")
+	{
+		defer setEnv(t, map[string]string{EnvInterval: "5s", EnvAPIToken: "xyz"})()
+		cfg, err := LoadConfig(filepath.Join(dir, "cgm.json"))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cfg.Interval != "5s" || cfg.CheckManager.API.TokenKey != "xyz" {
+			t.Fatalf("Expected environment settings, got %+v", cfg)
+		}
+	}
+
+	t.Log("config file from environment")
+	{
+		defer setEnv(t, map[string]string{EnvConfigFile: filepath.Join(dir, "cgm.toml")})()
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if cfg.CheckManager.API.TokenKey != "abc" {
+			t.Fatalf("Expected 'abc', got '%s'", cfg.CheckManager.API.TokenKey)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		defer setEnv(t, nil)()
+		for name, data := range map[string]string{
+			"missing.json":   "",
+			"bad.ini":        "interval=10s",
+			"bad.json":       "{",
+			"unknown.json":   `{"api": {"token": "abc", "tokne": "x"}}`,
+			"both.json":      `{"api": {"token": "abc", "token_file": "token"}}`,
+			"notoken.yaml":   "interval: 10s",
+			"interval.toml":  "interval = \"10\"\n[api]\ntoken = \"abc\"",
+			"bad.toml":       "interval = \"10s\"\ninterval = \"5s\"",
+			"badvalue.json":  `{"api": {"token": {"x": [{}]}}}`,
+			"cafile.yaml":    "api:\n  token: abc\n  ca_file: missing.crt",
+			"secretdir.json": `{"api": {"token_file": "."}}`,
+		} {
+			fn := filepath.Join(dir, name)
+			if name != "missing.json" {
+				writeFile(t, dir, name, data)
+			}
+			if _, err := LoadConfig(fn); err == nil {
+				t.Fatalf("Expected error for %s", name)
+			} else if name == "unknown.json" && !strings.Contains(err.Error(), "api.tokne") {
+				t.Fatalf("Expected unknown setting api.tokne, got '%v'", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package kitmetrics provides go-kit metrics (Counter, Gauge and Histogram)
+// which record to circonus-gometrics, so go-kit services report through the
+// same check.
+//
+// Label values (With) are key/value pairs added to the metric name as stream
+// tags, a key without a value gets the value "unknown" (as in go-kit).
+//
+//	p, err := kitmetrics.New(&kitmetrics.Config{Metrics: metrics})
+//	...
+//	requests := p.NewCounter("requests")
+//	requests.With("method", "GET").Add(1)
+package kitmetrics
+
+import (
+	"math"
+	"sync"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/go-kit/kit/metrics"
+	"github.com/pkg/errors"
+)
+
+// Config options for the provider
+type Config struct {
+	// Metrics the counters, gauges and histograms record to
+	Metrics *cgm.CirconusMetrics
+	// Prefix prepended to every metric name, e.g. "myservice`" (default: none)
+	Prefix string
+}
+
+// Provider creates go-kit metrics, it implements the go-kit provider.Provider interface
+type Provider struct {
+	metrics *cgm.CirconusMetrics
+	prefix  string
+
+	mu sync.Mutex
+	// fractional remainders of counters, carried to the next increment
+	remainders map[string]float64
+	// last values of gauges, deltas are applied to them (the gauges of
+	// CirconusMetrics are cleared at each flush when reset)
+	gauges map[string]float64
+}
+
+// New returns a new provider
+func New(cfg *Config) (*Provider, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+	if cfg.Metrics == nil {
+		return nil, errors.New("invalid configuration, no metrics (nil)")
+	}
+
+	return &Provider{
+		metrics:    cfg.Metrics,
+		prefix:     cfg.Prefix,
+		remainders: make(map[string]float64),
+		gauges:     make(map[string]float64),
+	}, nil
+}
+
+// NewCounter returns a counter
+func (p *Provider) NewCounter(name string) metrics.Counter {
+	return &Counter{p: p, name: p.prefix + name}
+}
+
+// NewGauge returns a gauge
+func (p *Provider) NewGauge(name string) metrics.Gauge {
+	return &Gauge{p: p, name: p.prefix + name}
+}
+
+// NewHistogram returns a histogram, buckets is ignored (circonus histograms
+// have a fixed, log linear, set of bins)
+func (p *Provider) NewHistogram(name string, buckets int) metrics.Histogram {
+	return &Histogram{p: p, name: p.prefix + name}
+}
+
+// Stop is a nop, the metrics are submitted by CirconusMetrics
+func (p *Provider) Stop() {}
+
+// add increments a counter, carrying the fraction forward
+func (p *Provider) add(name string, delta float64) {
+	if delta <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	v := delta + p.remainders[name]
+	whole := math.Floor(v)
+	if rem := v - whole; rem > 0 {
+		p.remainders[name] = rem
+	} else {
+		delete(p.remainders, name)
+	}
+	p.mu.Unlock()
+
+	if whole > 0 {
+		p.metrics.Add(name, uint64(whole))
+	}
+}
+
+// Counter is a go-kit counter, negative deltas are ignored
+type Counter struct {
+	p    *Provider
+	name string
+	lvs  []string
+}
+
+// With returns a counter with the label values added
+func (c *Counter) With(labelValues ...string) metrics.Counter {
+	return &Counter{p: c.p, name: c.name, lvs: with(c.lvs, labelValues)}
+}
+
+// Add increments the counter by delta
+func (c *Counter) Add(delta float64) {
+	c.p.add(metricName(c.name, c.lvs), delta)
+}
+
+// setGauge sets a gauge to value, or adds value to its last value
+func (p *Provider) setGauge(name string, value float64, delta bool) {
+	p.mu.Lock()
+	if delta {
+		value += p.gauges[name]
+	}
+	p.gauges[name] = value
+	p.mu.Unlock()
+
+	p.metrics.SetGauge(name, value)
+}
+
+// Gauge is a go-kit gauge
+type Gauge struct {
+	p    *Provider
+	name string
+	lvs  []string
+}
+
+// With returns a gauge with the label values added
+func (g *Gauge) With(labelValues ...string) metrics.Gauge {
+	return &Gauge{p: g.p, name: g.name, lvs: with(g.lvs, labelValues)}
+}
+
+// Set sets the gauge to value
+func (g *Gauge) Set(value float64) {
+	g.p.setGauge(metricName(g.name, g.lvs), value, false)
+}
+
+// Add adds delta to the last value of the gauge
+func (g *Gauge) Add(delta float64) {
+	g.p.setGauge(metricName(g.name, g.lvs), delta, true)
+}
+
+// Histogram is a go-kit histogram
+type Histogram struct {
+	p    *Provider
+	name string
+	lvs  []string
+}
+
+// With returns a histogram with the label values added
+func (h *Histogram) With(labelValues ...string) metrics.Histogram {
+	return &Histogram{p: h.p, name: h.name, lvs: with(h.lvs, labelValues)}
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(value float64) {
+	h.p.metrics.RecordValue(metricName(h.name, h.lvs), value)
+}
+
+// with returns a copy of lvs with labelValues appended, an odd number of
+// label values is completed with "unknown"
+func with(lvs, labelValues []string) []string {
+	out := make([]string, 0, len(lvs)+len(labelValues)+1)
+	out = append(out, lvs...)
+	out = append(out, labelValues...)
+	if len(labelValues)%2 != 0 {
+		out = append(out, "unknown")
+	}
+	return out
+}
+
+// metricName returns the name with the label values as stream tags
+func metricName(name string, lvs []string) string {
+	if len(lvs) == 0 {
+		return name
+	}
+	tags := make(cgm.Tags, 0, len(lvs)/2)
+	for i := 0; i+1 < len(lvs); i += 2 {
+		tags = append(tags, cgm.Tag{Category: lvs[i], Value: lvs[i+1]})
+	}
+	return cgm.MetricNameWithStreamTags(name, tags)
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kitmetrics
+
+import (
+	"reflect"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+func testProvider(t *testing.T, cfg *Config) (*Provider, *cgm.CirconusMetrics) {
+	mcfg := &cgm.Config{}
+	mcfg.CheckManager.Check.SubmissionURL = "none"
+	mcfg.Interval = "0"
+
+	m, err := cgm.New(mcfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cfg.Metrics = m
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return p, m
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config")
+	{
+		if _, err := New(nil); err == nil {
+			t.Fatal("Expected error")
+		}
+		expectedError := "invalid configuration, no metrics (nil)"
+		if _, err := New(&Config{}); err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected '%s', got '%v'", expectedError, err)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	t.Log("counter with labels")
+
+	p, m := testProvider(t, &Config{Prefix: "svc`"})
+
+	c := p.NewCounter("requests")
+	c.Add(1)
+	c.With("method", "GET").Add(2.5)
+	c.With("method", "GET").Add(0.5)
+	c.With("method", "GET").Add(-1)
+
+	val, err := m.GetCounterTest("svc`requests")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val != 1 {
+		t.Fatalf("Expected 1, got %d", val)
+	}
+
+	val, err = m.GetCounterTest("svc`requests|ST[method:GET]")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val != 3 {
+		t.Fatalf("Expected 3, got %d", val)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	t.Log("gauge set and add")
+
+	p, m := testProvider(t, &Config{})
+
+	g := p.NewGauge("workers").With("pool", "a")
+	g.Set(4)
+	g.Add(-1.5)
+
+	val, err := m.GetGaugeTest("workers|ST[pool:a]")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val.(float64) != 2.5 {
+		t.Fatalf("Expected 2.5, got %v", val)
+	}
+
+	t.Log("gauge add after flush")
+	m.FlushMetrics()
+	if _, err := m.GetGaugeTest("workers|ST[pool:a]"); err == nil {
+		t.Fatal("Expected gauge reset by flush")
+	}
+	p.NewGauge("workers").With("pool", "a").Add(1)
+
+	val, err = m.GetGaugeTest("workers|ST[pool:a]")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val.(float64) != 3.5 {
+		t.Fatalf("Expected 3.5, got %v", val)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	t.Log("histogram, odd label values")
+
+	p, m := testProvider(t, &Config{})
+
+	h := p.NewHistogram("latency", 50).With("method")
+	h.Observe(0.5)
+
+	hist, err := m.GetHistogramTest("latency|ST[method:unknown]")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(hist) != 1 || hist[0] != "H[5.0e-01]=1" {
+		t.Fatalf("Expected H[5.0e-01]=1, got %v", hist)
+	}
+}
+
+func TestWith(t *testing.T) {
+	t.Log("label values are copied")
+
+	base := make([]string, 0, 10)
+	base = append(base, "a", "1")
+	lvs := with(base, []string{"b"})
+	expected := []string{"a", "1", "b", "unknown"}
+	if !reflect.DeepEqual(lvs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, lvs)
+	}
+	other := with(base, []string{"c", "2"})
+	if !reflect.DeepEqual(lvs, expected) {
+		t.Fatalf("Expected %v unchanged, got %v (%v)", expected, lvs, other)
+	}
+}
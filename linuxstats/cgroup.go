@@ -0,0 +1,239 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// v1 reports an unlimited memory limit as a very large page aligned
+// value (e.g. 9223372036854771712), anything above this is unlimited
+const cgroupV1Unlimited = int64(1) << 62
+
+// RegisterCgroup registers cpu throttling and memory limit metrics for the
+// cgroup of the configured process. Both cgroup v1 and v2 (unified) are
+// supported. Quotas and limits are reported as -1 when unlimited.
+func (c *Collector) RegisterCgroup(r Registrar) error {
+	paths, err := c.readProcCgroup()
+	if err != nil {
+		return err
+	}
+
+	var cpuRead, memRead func() (map[string]int64, error)
+
+	if _, err := os.Stat(filepath.Join(c.cgroupRoot, "cgroup.controllers")); err == nil {
+		dir := c.cgroupDir("", paths[""])
+		cpuRead = func() (map[string]int64, error) { return readCgroupV2CPU(dir) }
+		memRead = func() (map[string]int64, error) { return readCgroupV2Memory(dir) }
+	} else {
+		cpuDir := c.cgroupDir("cpu", paths["cpu"])
+		memDir := c.cgroupDir("memory", paths["memory"])
+		cpuRead = func() (map[string]int64, error) { return readCgroupV1CPU(cpuDir) }
+		memRead = func() (map[string]int64, error) { return readCgroupV1Memory(memDir) }
+	}
+
+	registered := 0
+
+	if cpu, err := newSampler("cgroup cpu", c.Log, cpuRead); err != nil {
+		c.Log.Printf("[WARN] cgroup cpu metrics unavailable, %v", err)
+	} else {
+		for _, key := range []string{"periods", "throttled_periods", "throttled_ns"} {
+			if cpu.has(key) {
+				r.SetCounterFunc(c.metricName("cgroup", "cpu", key), cpu.counter(key))
+				registered++
+			}
+		}
+		for _, key := range []string{"quota_us", "period_us"} {
+			if cpu.has(key) {
+				r.SetGaugeFunc(c.metricName("cgroup", "cpu", key), cpu.gauge(key))
+				registered++
+			}
+		}
+	}
+
+	if mem, err := newSampler("cgroup memory", c.Log, memRead); err != nil {
+		c.Log.Printf("[WARN] cgroup memory metrics unavailable, %v", err)
+	} else {
+		for _, key := range []string{"usage", "limit"} {
+			if mem.has(key) {
+				r.SetGaugeFunc(c.metricName("cgroup", "memory", key), mem.gauge(key))
+				registered++
+			}
+		}
+	}
+
+	if registered == 0 {
+		return errors.Errorf("no cgroup metrics found in %s", c.cgroupRoot)
+	}
+
+	return nil
+}
+
+// readProcCgroup reads /proc/<pid>/cgroup returning the path of the process
+// cgroup for each controller. The v2 unified hierarchy path is keyed as "".
+func (c *Collector) readProcCgroup() (map[string]string, error) {
+	data, err := ioutil.ReadFile(c.procPath(c.pid, "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, ctrl := range strings.Split(parts[1], ",") {
+			paths[ctrl] = parts[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// cgroupDir returns the directory for the process cgroup of a controller.
+// Inside a container with a cgroup namespace the path is relative to the
+// mounted root, so the root (or controller root) is used if the full path
+// does not exist.
+func (c *Collector) cgroupDir(controller, cgroupPath string) string {
+	root := filepath.Join(c.cgroupRoot, controller)
+	dir := filepath.Join(root, cgroupPath)
+	if _, err := os.Stat(dir); err == nil {
+		return dir
+	}
+	return root
+}
+
+func readCgroupV2CPU(dir string) (map[string]int64, error) {
+	stat, err := readKeyValueFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make(map[string]int64)
+	if v, ok := stat["nr_periods"]; ok {
+		vals["periods"] = v
+	}
+	if v, ok := stat["nr_throttled"]; ok {
+		vals["throttled_periods"] = v
+	}
+	if v, ok := stat["throttled_usec"]; ok {
+		vals["throttled_ns"] = v * 1000
+	}
+
+	// cpu.max is "$MAX $PERIOD", only present with the cpu controller enabled
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			quota, err := parseLimit(fields[0])
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing cpu.max quota")
+			}
+			period, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing cpu.max period")
+			}
+			vals["quota_us"] = quota
+			vals["period_us"] = period
+		}
+	}
+
+	return vals, nil
+}
+
+func readCgroupV2Memory(dir string) (map[string]int64, error) {
+	usage, err := readIntFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	vals := map[string]int64{"usage": usage}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "memory.max")); err == nil {
+		limit, err := parseLimit(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing memory.max")
+		}
+		vals["limit"] = limit
+	}
+
+	return vals, nil
+}
+
+func readCgroupV1CPU(dir string) (map[string]int64, error) {
+	stat, err := readKeyValueFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make(map[string]int64)
+	if v, ok := stat["nr_periods"]; ok {
+		vals["periods"] = v
+	}
+	if v, ok := stat["nr_throttled"]; ok {
+		vals["throttled_periods"] = v
+	}
+	if v, ok := stat["throttled_time"]; ok {
+		vals["throttled_ns"] = v
+	}
+
+	// cfs_quota_us is -1 when unlimited
+	if quota, err := readIntFile(filepath.Join(dir, "cpu.cfs_quota_us")); err == nil {
+		vals["quota_us"] = quota
+	}
+	if period, err := readIntFile(filepath.Join(dir, "cpu.cfs_period_us")); err == nil {
+		vals["period_us"] = period
+	}
+
+	return vals, nil
+}
+
+func readCgroupV1Memory(dir string) (map[string]int64, error) {
+	usage, err := readIntFile(filepath.Join(dir, "memory.usage_in_bytes"))
+	if err != nil {
+		return nil, err
+	}
+	vals := map[string]int64{"usage": usage}
+
+	if limit, err := readIntFile(filepath.Join(dir, "memory.limit_in_bytes")); err == nil {
+		if limit >= cgroupV1Unlimited {
+			limit = -1
+		}
+		vals["limit"] = limit
+	}
+
+	return vals, nil
+}
+
+// parseLimit parses a v2 limit value, "max" is unlimited (-1)
+func parseLimit(s string) (int64, error) {
+	if s == "max" {
+		return -1, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func readIntFile(file string) (int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
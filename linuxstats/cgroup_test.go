@@ -0,0 +1,80 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"testing"
+)
+
+func TestRegisterCgroup(t *testing.T) {
+	t.Log("v1")
+	{
+		r := newTestRegistrar()
+		if err := testCollector(t).RegisterCgroup(r); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		if v := r.counters["cgroup`cpu`periods"](); v != 100 {
+			t.Fatalf("Expected 100, got %d", v)
+		}
+		if v := r.counters["cgroup`cpu`throttled_periods"](); v != 5 {
+			t.Fatalf("Expected 5, got %d", v)
+		}
+		if v := r.counters["cgroup`cpu`throttled_ns"](); v != 2000000 {
+			t.Fatalf("Expected 2000000, got %d", v)
+		}
+		if v := r.gauges["cgroup`cpu`quota_us"](); v != 50000 {
+			t.Fatalf("Expected 50000, got %d", v)
+		}
+		if v := r.gauges["cgroup`cpu`period_us"](); v != 100000 {
+			t.Fatalf("Expected 100000, got %d", v)
+		}
+		if v := r.gauges["cgroup`memory`usage"](); v != 10485760 {
+			t.Fatalf("Expected 10485760, got %d", v)
+		}
+		if v := r.gauges["cgroup`memory`limit"](); v != -1 {
+			t.Fatalf("Expected -1 (unlimited), got %d", v)
+		}
+	}
+
+	t.Log("v2")
+	{
+		c, err := New(&Config{ProcRoot: "testdata/proc", CgroupRoot: "testdata/cgroup/v2"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		r := newTestRegistrar()
+		if err := c.RegisterCgroup(r); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		if v := r.counters["cgroup`cpu`periods"](); v != 200 {
+			t.Fatalf("Expected 200, got %d", v)
+		}
+		if v := r.counters["cgroup`cpu`throttled_ns"](); v != 3000000 {
+			t.Fatalf("Expected 3000000, got %d", v)
+		}
+		if v := r.gauges["cgroup`cpu`quota_us"](); v != -1 {
+			t.Fatalf("Expected -1 (unlimited), got %d", v)
+		}
+		if v := r.gauges["cgroup`memory`usage"](); v != 20971520 {
+			t.Fatalf("Expected 20971520, got %d", v)
+		}
+		if v := r.gauges["cgroup`memory`limit"](); v != 536870912 {
+			t.Fatalf("Expected 536870912, got %d", v)
+		}
+	}
+
+	t.Log("no cgroup filesystem")
+	{
+		c, err := New(&Config{ProcRoot: "testdata/proc", CgroupRoot: "testdata/missing"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if err := c.RegisterCgroup(newTestRegistrar()); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const sectorSize = 512 // diskstats sectors are always 512 bytes
+
+// RegisterHost registers load, memory, network interface and disk metrics
+// from /proc/{loadavg,meminfo,net/dev,diskstats}. Network interfaces and
+// disks are enumerated when registered.
+func (c *Collector) RegisterHost(r Registrar) error {
+	if err := c.registerLoadavg(r); err != nil {
+		return err
+	}
+	if err := c.registerMeminfo(r); err != nil {
+		return err
+	}
+	if err := c.registerNetDev(r); err != nil {
+		return err
+	}
+	return c.registerDiskstats(r)
+}
+
+// registerLoadavg registers load averages, which are reported in hundredths
+// (the precision /proc/loadavg provides) as gauge funcs are integer valued.
+func (c *Collector) registerLoadavg(r Registrar) error {
+	file := c.procPath("loadavg")
+	load, err := newSampler(file, c.Log, func() (map[string]int64, error) {
+		return readLoadavg(file)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"1m", "5m", "15m"} {
+		r.SetGaugeFunc(c.metricName("host", "loadavg", key), load.gauge(key))
+	}
+	r.SetGaugeFunc(c.metricName("host", "procs", "running"), load.gauge("running"))
+	r.SetGaugeFunc(c.metricName("host", "procs", "total"), load.gauge("total"))
+	return nil
+}
+
+func readLoadavg(file string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return nil, errors.Errorf("invalid loadavg format (%s)", strings.TrimSpace(string(data)))
+	}
+
+	vals := make(map[string]int64)
+	for idx, key := range []string{"1m", "5m", "15m"} {
+		v, err := strconv.ParseFloat(fields[idx], 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing loadavg")
+		}
+		vals[key] = int64(math.Floor(v*100 + .5))
+	}
+
+	procs := strings.Split(fields[3], "/")
+	if len(procs) != 2 {
+		return nil, errors.Errorf("invalid loadavg procs (%s)", fields[3])
+	}
+	for idx, key := range []string{"running", "total"} {
+		v, err := strconv.ParseInt(procs[idx], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing loadavg procs")
+		}
+		vals[key] = v
+	}
+
+	return vals, nil
+}
+
+func (c *Collector) registerMeminfo(r Registrar) error {
+	file := c.procPath("meminfo")
+	mem, err := newSampler(file, c.Log, func() (map[string]int64, error) {
+		return readKeyValueFile(file)
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics := []struct {
+		key  string
+		name string
+	}{
+		{"MemTotal", "total"},
+		{"MemFree", "free"},
+		{"MemAvailable", "available"}, // kernel 3.14+
+		{"Buffers", "buffers"},
+		{"Cached", "cached"},
+		{"SwapTotal", "swap_total"},
+		{"SwapFree", "swap_free"},
+	}
+	for _, metric := range metrics {
+		if !mem.has(metric.key) {
+			continue
+		}
+		r.SetGaugeFunc(c.metricName("host", "memory", metric.name), mem.gauge(metric.key))
+	}
+	return nil
+}
+
+// netDevFields are the /proc/net/dev columns, receive then transmit
+var netDevFields = []string{
+	"rx_bytes", "rx_packets", "rx_errors", "rx_dropped", "rx_fifo", "rx_frame", "rx_compressed", "rx_multicast",
+	"tx_bytes", "tx_packets", "tx_errors", "tx_dropped", "tx_fifo", "tx_collisions", "tx_carrier", "tx_compressed",
+}
+
+func (c *Collector) registerNetDev(r Registrar) error {
+	file := c.procPath("net", "dev")
+	dev, err := newSampler(file, c.Log, func() (map[string]int64, error) {
+		return readNetDev(file)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, iface := range sampledDevices(dev) {
+		for _, fld := range []string{"rx_bytes", "rx_packets", "rx_errors", "rx_dropped", "tx_bytes", "tx_packets", "tx_errors", "tx_dropped"} {
+			r.SetCounterFunc(c.metricName("host", "net", iface, fld), dev.counter(iface+"`"+fld))
+		}
+	}
+	return nil
+}
+
+// readNetDev reads /proc/net/dev, values are keyed as interface`field
+func readNetDev(file string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, ":")
+		if idx < 0 {
+			continue // header lines
+		}
+		iface := strings.TrimSpace(line[:idx])
+		fields := strings.Fields(line[idx+1:])
+		if len(fields) < len(netDevFields) {
+			return nil, errors.Errorf("invalid net/dev format for %s, %d fields", iface, len(fields))
+		}
+		for i, fld := range netDevFields {
+			v, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing net/dev %s %s", iface, fld)
+			}
+			vals[iface+"`"+fld] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+func (c *Collector) registerDiskstats(r Registrar) error {
+	file := c.procPath("diskstats")
+	disk, err := newSampler(file, c.Log, func() (map[string]int64, error) {
+		return readDiskstats(file)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dev := range sampledDevices(disk) {
+		for _, fld := range []string{"reads", "read_bytes", "read_ms", "writes", "write_bytes", "write_ms", "io_ms"} {
+			r.SetCounterFunc(c.metricName("host", "disk", dev, fld), disk.counter(dev+"`"+fld))
+		}
+		r.SetGaugeFunc(c.metricName("host", "disk", dev, "io_in_progress"), disk.gauge(dev+"`io_in_progress"))
+	}
+	return nil
+}
+
+// readDiskstats reads /proc/diskstats, values are keyed as device`field.
+// Loop and ram devices are skipped.
+func readDiskstats(file string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// field positions (after major, minor and device name), see
+	// https://www.kernel.org/doc/Documentation/iostats.txt
+	fields := []struct {
+		pos   int
+		name  string
+		scale int64
+	}{
+		{0, "reads", 1},
+		{2, "read_bytes", sectorSize},
+		{3, "read_ms", 1},
+		{4, "writes", 1},
+		{6, "write_bytes", sectorSize},
+		{7, "write_ms", 1},
+		{8, "io_in_progress", 1},
+		{9, "io_ms", 1},
+	}
+
+	vals := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) < 14 {
+			continue
+		}
+		dev := line[2]
+		if strings.HasPrefix(dev, "loop") || strings.HasPrefix(dev, "ram") {
+			continue
+		}
+		for _, fld := range fields {
+			v, err := strconv.ParseInt(line[3+fld.pos], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing diskstats %s %s", dev, fld.name)
+			}
+			vals[dev+"`"+fld.name] = v * fld.scale
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// sampledDevices returns the sorted, distinct device portion of
+// device`field keys in the last values read by a sampler
+func sampledDevices(s *sampler) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	devs := []string{}
+	for key := range s.vals {
+		idx := strings.LastIndex(key, "`")
+		if idx < 0 {
+			continue
+		}
+		dev := key[:idx]
+		if !seen[dev] {
+			seen[dev] = true
+			devs = append(devs, dev)
+		}
+	}
+	sort.Strings(devs)
+	return devs
+}
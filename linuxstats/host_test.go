@@ -0,0 +1,72 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"testing"
+)
+
+func TestRegisterHost(t *testing.T) {
+	t.Log("fixtures")
+
+	r := newTestRegistrar()
+	if err := testCollector(t).RegisterHost(r); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	gauges := map[string]int64{
+		"host`loadavg`1m":               20,
+		"host`loadavg`5m":               118,
+		"host`loadavg`15m":              1212,
+		"host`procs`running":            2,
+		"host`procs`total":              80,
+		"host`memory`total":             2048000 * 1024,
+		"host`memory`available":         1024000 * 1024,
+		"host`memory`swap_free":         0,
+		"host`disk`sda`io_in_progress":  1,
+		"host`disk`sda1`io_in_progress": 0,
+	}
+	for name, expected := range gauges {
+		fn, ok := r.gauges[name]
+		if !ok {
+			t.Fatalf("Expected gauge %s", name)
+		}
+		if v := fn(); v != expected {
+			t.Fatalf("Expected %s %d, got %d", name, expected, v)
+		}
+	}
+
+	counters := map[string]uint64{
+		"host`net`lo`rx_bytes":     2776770,
+		"host`net`eth0`rx_errors":  1,
+		"host`net`eth0`tx_dropped": 4,
+		"host`net`eth0`tx_packets": 4324,
+		"host`disk`sda`reads":      4280,
+		"host`disk`sda`read_bytes": 285698 * 512,
+		"host`disk`sda`writes":     1573,
+		"host`disk`sda`io_ms":      2772,
+	}
+	for name, expected := range counters {
+		fn, ok := r.counters[name]
+		if !ok {
+			t.Fatalf("Expected counter %s", name)
+		}
+		if v := fn(); v != expected {
+			t.Fatalf("Expected %s %d, got %d", name, expected, v)
+		}
+	}
+
+	if _, ok := r.counters["host`disk`loop0`reads"]; ok {
+		t.Fatal("Expected loop devices to be skipped")
+	}
+}
+
+func TestReadLoadavg(t *testing.T) {
+	t.Log("invalid format")
+
+	if _, err := readLoadavg("testdata/proc/meminfo"); err == nil {
+		t.Fatal("Expected error")
+	}
+}
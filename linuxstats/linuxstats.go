@@ -0,0 +1,244 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package linuxstats provides process, host and cgroup metrics for Linux.
+//
+// Values are read from the proc filesystem and the cgroup filesystem and are
+// registered with circonus-gometrics as counter and gauge functions, so they
+// are sampled at each flush. The proc and cgroup roots are configurable which
+// allows collection from a container's view of the host, or from fixtures.
+//
+// Metric names are of the form process`<group>`<name>, host`<group>`<name>
+// and cgroup`<group>`<name>, with an optional prefix.
+package linuxstats
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultProcRoot   = "/proc"
+	defaultCgroupRoot = "/sys/fs/cgroup"
+	defaultPID        = "self"
+	defaultClockTicks = 100
+
+	// all metric funcs registered for a single source file share one read
+	// of that file, as long as they are called within this amount of time
+	sampleTTL = 1 * time.Second
+)
+
+// Registrar is the subset of CirconusMetrics used to register metric functions
+type Registrar interface {
+	SetCounterFunc(metric string, fn func() uint64)
+	SetGaugeFunc(metric string, fn func() int64)
+}
+
+// Config options for the linux collectors
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// ProcRoot is the mount point of the proc filesystem (default: /proc)
+	ProcRoot string
+	// CgroupRoot is the mount point of the cgroup filesystem (default: /sys/fs/cgroup)
+	CgroupRoot string
+	// PID of the process to collect, or "self" (default: self)
+	PID string
+	// Prefix prepended to every metric name, e.g. "myapp`" (default: none)
+	Prefix string
+	// ClockTicks is the kernel USER_HZ, used to convert cpu times (default: 100)
+	ClockTicks int
+}
+
+// Collector registers linux metrics
+type Collector struct {
+	Log   *log.Logger
+	Debug bool
+
+	procRoot   string
+	cgroupRoot string
+	pid        string
+	prefix     string
+	clockTicks int
+}
+
+// New returns a new linux metric collector
+func New(cfg *Config) (*Collector, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+
+	c := &Collector{
+		Debug:      cfg.Debug,
+		Log:        cfg.Log,
+		procRoot:   defaultProcRoot,
+		cgroupRoot: defaultCgroupRoot,
+		pid:        defaultPID,
+		prefix:     cfg.Prefix,
+		clockTicks: defaultClockTicks,
+	}
+
+	if c.Debug && c.Log == nil {
+		c.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if c.Log == nil {
+		c.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	if cfg.ProcRoot != "" {
+		c.procRoot = cfg.ProcRoot
+	}
+	if cfg.CgroupRoot != "" {
+		c.cgroupRoot = cfg.CgroupRoot
+	}
+	if cfg.PID != "" {
+		if cfg.PID != defaultPID {
+			if _, err := strconv.Atoi(cfg.PID); err != nil {
+				return nil, errors.Wrap(err, "parsing pid")
+			}
+		}
+		c.pid = cfg.PID
+	}
+	if cfg.ClockTicks < 0 {
+		return nil, errors.Errorf("invalid clock ticks (%d)", cfg.ClockTicks)
+	}
+	if cfg.ClockTicks > 0 {
+		c.clockTicks = cfg.ClockTicks
+	}
+
+	return c, nil
+}
+
+// RegisterAll registers process, host and cgroup metrics. Sources which
+// are not available (e.g. no cgroup filesystem) are logged and skipped.
+func (c *Collector) RegisterAll(r Registrar) error {
+	if err := c.RegisterProcess(r); err != nil {
+		return err
+	}
+	if err := c.RegisterHost(r); err != nil {
+		return err
+	}
+	if err := c.RegisterCgroup(r); err != nil {
+		c.Log.Printf("[WARN] cgroup metrics unavailable, %v", err)
+	}
+	return nil
+}
+
+func (c *Collector) metricName(parts ...string) string {
+	return c.prefix + strings.Join(parts, "`")
+}
+
+func (c *Collector) procPath(parts ...string) string {
+	return filepath.Join(append([]string{c.procRoot}, parts...)...)
+}
+
+// sampler caches the values parsed from one source, so the individual metric
+// funcs registered for that source share a single read during a flush. If a
+// read fails the previous values are retained, a func cannot return an error.
+type sampler struct {
+	name string
+	read func() (map[string]int64, error)
+	log  *log.Logger
+	mu   sync.Mutex
+	ts   time.Time
+	vals map[string]int64
+}
+
+func newSampler(name string, logger *log.Logger, read func() (map[string]int64, error)) (*sampler, error) {
+	s := &sampler{name: name, read: read, log: logger}
+	vals, err := read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	s.vals = vals
+	s.ts = time.Now()
+	return s, nil
+}
+
+func (s *sampler) value(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.ts) >= sampleTTL {
+		vals, err := s.read()
+		if err != nil {
+			s.log.Printf("[WARN] reading %s, %v", s.name, err)
+		} else {
+			s.vals = vals
+		}
+		s.ts = time.Now()
+	}
+
+	return s.vals[key]
+}
+
+// has reports whether the last read of the source produced the key
+func (s *sampler) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.vals[key]
+	return ok
+}
+
+func (s *sampler) counter(key string) func() uint64 {
+	return func() uint64 {
+		v := s.value(key)
+		if v < 0 {
+			return 0
+		}
+		return uint64(v)
+	}
+}
+
+func (s *sampler) gauge(key string) func() int64 {
+	return func() int64 {
+		return s.value(key)
+	}
+}
+
+// parseKeyValues parses lines of the form "key value [unit]" (optionally with
+// a ':' after the key), multiplying values having a "kB" unit by 1024.
+func parseKeyValues(data []byte) (map[string]int64, error) {
+	vals := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		key := strings.TrimSuffix(fields[0], ":")
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue // non-numeric values (e.g. status "Name:") are not metrics
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		vals[key] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// readKeyValueFile reads and parses a file with parseKeyValues
+func readKeyValueFile(file string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyValues(data)
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"errors"
+	"testing"
+)
+
+type testRegistrar struct {
+	counters map[string]func() uint64
+	gauges   map[string]func() int64
+}
+
+func newTestRegistrar() *testRegistrar {
+	return &testRegistrar{
+		counters: make(map[string]func() uint64),
+		gauges:   make(map[string]func() int64),
+	}
+}
+
+func (r *testRegistrar) SetCounterFunc(metric string, fn func() uint64) {
+	r.counters[metric] = fn
+}
+
+func (r *testRegistrar) SetGaugeFunc(metric string, fn func() int64) {
+	r.gauges[metric] = fn
+}
+
+func testCollector(t *testing.T) *Collector {
+	c, err := New(&Config{
+		ProcRoot:   "testdata/proc",
+		CgroupRoot: "testdata/cgroup/v1",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return c
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config (nil)")
+	{
+		expectedError := errors.New("invalid configuration (nil)")
+		_, err := New(nil)
+		if err == nil || err.Error() != expectedError.Error() {
+			t.Fatalf("Expected an '%#v' error, got '%#v'", expectedError, err)
+		}
+	}
+
+	t.Log("defaults")
+	{
+		c, err := New(&Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if c.procRoot != defaultProcRoot {
+			t.Fatalf("Expected %s, got %s", defaultProcRoot, c.procRoot)
+		}
+		if c.cgroupRoot != defaultCgroupRoot {
+			t.Fatalf("Expected %s, got %s", defaultCgroupRoot, c.cgroupRoot)
+		}
+		if c.pid != defaultPID {
+			t.Fatalf("Expected %s, got %s", defaultPID, c.pid)
+		}
+		if c.clockTicks != defaultClockTicks {
+			t.Fatalf("Expected %d, got %d", defaultClockTicks, c.clockTicks)
+		}
+	}
+
+	t.Log("invalid pid")
+	{
+		_, err := New(&Config{PID: "foo"})
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("invalid clock ticks")
+	{
+		expectedError := errors.New("invalid clock ticks (-1)")
+		_, err := New(&Config{ClockTicks: -1})
+		if err == nil || err.Error() != expectedError.Error() {
+			t.Fatalf("Expected an '%#v' error, got '%#v'", expectedError, err)
+		}
+	}
+
+	t.Log("prefix")
+	{
+		c, err := New(&Config{Prefix: "foo`"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		expected := "foo`process`threads"
+		if name := c.metricName("process", "threads"); name != expected {
+			t.Fatalf("Expected %s, got %s", expected, name)
+		}
+	}
+}
+
+func TestRegisterAll(t *testing.T) {
+	t.Log("fixtures")
+	{
+		r := newTestRegistrar()
+		if err := testCollector(t).RegisterAll(r); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(r.counters) == 0 || len(r.gauges) == 0 {
+			t.Fatalf("Expected metrics, got %d counters %d gauges", len(r.counters), len(r.gauges))
+		}
+	}
+
+	t.Log("no cgroup")
+	{
+		c, err := New(&Config{ProcRoot: "testdata/proc", CgroupRoot: "testdata/missing"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		r := newTestRegistrar()
+		if err := c.RegisterAll(r); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, ok := r.gauges["cgroup`memory`usage"]; ok {
+			t.Fatal("Expected no cgroup metrics")
+		}
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	t.Log("units and non-numeric values")
+
+	vals, err := parseKeyValues([]byte("Name:\tfoo\nVmRSS:\t  10 kB\nbar 5\nbaz\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(vals) != 2 {
+		t.Fatalf("Expected 2 values, got %d (%v)", len(vals), vals)
+	}
+	if vals["VmRSS"] != 10240 {
+		t.Fatalf("Expected 10240, got %d", vals["VmRSS"])
+	}
+	if vals["bar"] != 5 {
+		t.Fatalf("Expected 5, got %d", vals["bar"])
+	}
+}
+
+func TestSampler(t *testing.T) {
+	t.Log("read error retains last values")
+
+	reads := 0
+	s, err := newSampler("test", testCollector(t).Log, func() (map[string]int64, error) {
+		reads++
+		if reads > 1 {
+			return nil, errors.New("read failed")
+		}
+		return map[string]int64{"foo": 1, "neg": -1}, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	s.ts = s.ts.Add(-sampleTTL)
+	if v := s.gauge("foo")(); v != 1 {
+		t.Fatalf("Expected 1, got %d", v)
+	}
+	if reads != 2 {
+		t.Fatalf("Expected 2 reads, got %d", reads)
+	}
+	if v := s.counter("neg")(); v != 0 {
+		t.Fatalf("Expected 0, got %d", v)
+	}
+	if reads != 2 {
+		t.Fatalf("Expected cached value, got %d reads", reads)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RegisterProcess registers cpu, memory, file descriptor and i/o metrics for
+// the configured process, from /proc/<pid>/{stat,status,fd,limits,io}.
+func (c *Collector) RegisterProcess(r Registrar) error {
+	stat, err := newSampler(c.procPath(c.pid, "stat"), c.Log, c.readProcStat)
+	if err != nil {
+		return err
+	}
+	r.SetCounterFunc(c.metricName("process", "cpu", "user_ms"), stat.counter("user_ms"))
+	r.SetCounterFunc(c.metricName("process", "cpu", "system_ms"), stat.counter("system_ms"))
+	r.SetCounterFunc(c.metricName("process", "faults", "minor"), stat.counter("minflt"))
+	r.SetCounterFunc(c.metricName("process", "faults", "major"), stat.counter("majflt"))
+	r.SetGaugeFunc(c.metricName("process", "threads"), stat.gauge("num_threads"))
+
+	statusFile := c.procPath(c.pid, "status")
+	status, err := newSampler(statusFile, c.Log, func() (map[string]int64, error) {
+		return readKeyValueFile(statusFile)
+	})
+	if err != nil {
+		return err
+	}
+	r.SetGaugeFunc(c.metricName("process", "memory", "rss"), status.gauge("VmRSS"))
+	r.SetGaugeFunc(c.metricName("process", "memory", "rss_peak"), status.gauge("VmHWM"))
+	r.SetGaugeFunc(c.metricName("process", "memory", "virtual"), status.gauge("VmSize"))
+	r.SetCounterFunc(c.metricName("process", "ctx_switches", "voluntary"), status.counter("voluntary_ctxt_switches"))
+	r.SetCounterFunc(c.metricName("process", "ctx_switches", "involuntary"), status.counter("nonvoluntary_ctxt_switches"))
+
+	fd, err := newSampler(c.procPath(c.pid, "fd"), c.Log, c.readProcFDs)
+	if err != nil {
+		return err
+	}
+	r.SetGaugeFunc(c.metricName("process", "fd", "open"), fd.gauge("open"))
+	if fd.has("limit") {
+		r.SetGaugeFunc(c.metricName("process", "fd", "limit"), fd.gauge("limit"))
+	}
+
+	ioFile := c.procPath(c.pid, "io")
+	io, err := newSampler(ioFile, c.Log, func() (map[string]int64, error) {
+		return readKeyValueFile(ioFile)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{"rchar", "wchar", "syscr", "syscw", "read_bytes", "write_bytes", "cancelled_write_bytes"} {
+		r.SetCounterFunc(c.metricName("process", "io", key), io.counter(key))
+	}
+
+	return nil
+}
+
+// readProcStat reads /proc/<pid>/stat, see proc(5) for field positions
+func (c *Collector) readProcStat() (map[string]int64, error) {
+	data, err := ioutil.ReadFile(c.procPath(c.pid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// the command name (field 2) is in parens and may contain spaces
+	idx := bytes.LastIndexByte(data, ')')
+	if idx < 0 {
+		return nil, errors.New("invalid stat format, no command name")
+	}
+	// fields[0] is field 3 (state) in proc(5)
+	fields := strings.Fields(string(data[idx+1:]))
+	if len(fields) < 22 {
+		return nil, errors.Errorf("invalid stat format, %d fields", len(fields)+2)
+	}
+
+	field := func(num int) (int64, error) {
+		v, err := strconv.ParseInt(fields[num-3], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing stat field %d", num)
+		}
+		return v, nil
+	}
+
+	vals := make(map[string]int64)
+	for key, num := range map[string]int{"minflt": 10, "majflt": 12, "utime": 14, "stime": 15, "num_threads": 20} {
+		v, err := field(num)
+		if err != nil {
+			return nil, err
+		}
+		vals[key] = v
+	}
+	vals["user_ms"] = vals["utime"] * 1000 / int64(c.clockTicks)
+	vals["system_ms"] = vals["stime"] * 1000 / int64(c.clockTicks)
+
+	return vals, nil
+}
+
+// readProcFDs counts the entries in /proc/<pid>/fd and reads the soft
+// limit on open files from /proc/<pid>/limits (-1 if unlimited)
+func (c *Collector) readProcFDs() (map[string]int64, error) {
+	fds, err := ioutil.ReadDir(c.procPath(c.pid, "fd"))
+	if err != nil {
+		return nil, err
+	}
+	vals := map[string]int64{"open": int64(len(fds))}
+
+	data, err := ioutil.ReadFile(c.procPath(c.pid, "limits"))
+	if err != nil {
+		// limits are informational, the open count is still useful
+		return vals, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) == 0 {
+			break
+		}
+		if fields[0] == "unlimited" {
+			vals["limit"] = -1
+		} else if v, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			vals["limit"] = v
+		}
+		break
+	}
+
+	return vals, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxstats
+
+import (
+	"testing"
+)
+
+func TestRegisterProcess(t *testing.T) {
+	t.Log("fixtures")
+	{
+		r := newTestRegistrar()
+		if err := testCollector(t).RegisterProcess(r); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		counters := map[string]uint64{
+			"process`cpu`user_ms":              2500,
+			"process`cpu`system_ms":            500,
+			"process`faults`minor":             1520,
+			"process`faults`major":             3,
+			"process`ctx_switches`voluntary":   150,
+			"process`ctx_switches`involuntary": 12,
+			"process`io`rchar":                 323934931,
+			"process`io`read_bytes":            4096,
+			"process`io`write_bytes":           8192,
+			"process`io`cancelled_write_bytes": 0,
+		}
+		for name, expected := range counters {
+			fn, ok := r.counters[name]
+			if !ok {
+				t.Fatalf("Expected counter %s", name)
+			}
+			if v := fn(); v != expected {
+				t.Fatalf("Expected %s %d, got %d", name, expected, v)
+			}
+		}
+
+		gauges := map[string]int64{
+			"process`threads":         9,
+			"process`memory`rss":      20000 * 1024,
+			"process`memory`rss_peak": 24000 * 1024,
+			"process`memory`virtual":  1288000 * 1024,
+			"process`fd`open":         3,
+			"process`fd`limit":        1024,
+		}
+		for name, expected := range gauges {
+			fn, ok := r.gauges[name]
+			if !ok {
+				t.Fatalf("Expected gauge %s", name)
+			}
+			if v := fn(); v != expected {
+				t.Fatalf("Expected %s %d, got %d", name, expected, v)
+			}
+		}
+	}
+
+	t.Log("clock ticks")
+	{
+		c, err := New(&Config{ProcRoot: "testdata/proc", ClockTicks: 250})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		r := newTestRegistrar()
+		if err := c.RegisterProcess(r); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if v := r.counters["process`cpu`user_ms"](); v != 1000 {
+			t.Fatalf("Expected 1000, got %d", v)
+		}
+	}
+
+	t.Log("missing pid")
+	{
+		c, err := New(&Config{ProcRoot: "testdata/proc", PID: "1"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if err := c.RegisterProcess(newTestRegistrar()); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHTTPMiddlewarePrefix = "go`HTTP`"
+	defaultHTTPMiddlewareName   = "all"
+)
+
+// HTTPMiddlewareOptions options for HTTPMiddleware
+type HTTPMiddlewareOptions struct {
+	// Prefix for all metric names (default: go`HTTP`)
+	Prefix string
+	// Name used as the route when RouteName is not set, or returns "" (default: all)
+	Name string
+	// RouteName returns the route name for a request, e.g. ServeMuxRoute(mux).
+	// Use names of low cardinality, a set of metrics is created for each name.
+	RouteName func(*http.Request) string
+}
+
+// HTTPMiddleware returns a middleware which wraps an http.Handler tracking, per method and route:
+//
+//	<prefix><method>`<route>`status`<class>       counter of responses by status class (e.g. 2xx)
+//	<prefix><method>`<route>`<class>`latency      histogram of latencies in seconds, by status class
+//	<prefix><method>`<route>`request_bytes        histogram of request body sizes
+//	<prefix><method>`<route>`response_bytes       histogram of response body sizes
+//
+// and <prefix>in_flight, a gauge of requests currently being handled, shared by all
+// middlewares using the same prefix.
+func (m *CirconusMetrics) HTTPMiddleware(opts *HTTPMiddlewareOptions) func(http.Handler) http.Handler {
+	prefix := defaultHTTPMiddlewarePrefix
+	name := defaultHTTPMiddlewareName
+	var routeName func(*http.Request) string
+
+	if opts != nil {
+		if opts.Prefix != "" {
+			prefix = opts.Prefix
+		}
+		if opts.Name != "" {
+			name = opts.Name
+		}
+		routeName = opts.RouteName
+	}
+
+	inFlight := m.inFlightCounter(prefix)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(inFlight, 1)
+			defer atomic.AddInt64(inFlight, -1)
+
+			route := ""
+			if routeName != nil {
+				route = routeName(r)
+			}
+			if route == "" {
+				route = name
+			}
+
+			var body *countingReader
+			if r.Body != nil {
+				body = &countingReader{ReadCloser: r.Body}
+				r.Body = body
+			}
+
+			rec := &responseRecorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(wrapResponseWriter(rec), r)
+			elapsed := time.Since(start)
+
+			reqBytes := r.ContentLength
+			if reqBytes < 0 {
+				reqBytes = 0
+				if body != nil {
+					reqBytes = body.n
+				}
+			}
+
+			class := statusClass(rec.statusCode())
+			base := prefix + r.Method + "`" + route + "`"
+			m.Increment(base + "status`" + class)
+			m.RecordValue(base+class+"`latency", elapsed.Seconds())
+			m.RecordValue(base+"request_bytes", float64(reqBytes))
+			m.RecordValue(base+"response_bytes", float64(rec.bytes))
+		})
+	}
+}
+
+// inFlightCounter returns the in flight counter for a prefix, registering its
+// gauge (<prefix>in_flight) when first used
+func (m *CirconusMetrics) inFlightCounter(prefix string) *int64 {
+	m.ifm.Lock()
+	defer m.ifm.Unlock()
+
+	if m.inFlight == nil {
+		m.inFlight = make(map[string]*int64)
+	}
+	inFlight, ok := m.inFlight[prefix]
+	if !ok {
+		inFlight = new(int64)
+		m.inFlight[prefix] = inFlight
+	}
+
+	// (re)registered, in case the gauge funcs were reset
+	m.SetGaugeFunc(prefix+"in_flight", func() int64 {
+		return atomic.LoadInt64(inFlight)
+	})
+
+	return inFlight
+}
+
+// ServeMuxRoute returns a RouteName func which names requests
+// by the pattern of the mux handler which matches the request. The method of
+// a pattern (e.g. "GET /users/{id}", Go 1.22+) is dropped, metric names
+// already include the request method.
+func ServeMuxRoute(mux *http.ServeMux) func(*http.Request) string {
+	return func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+			pattern = strings.TrimLeft(pattern[i:], " \t")
+		}
+		return pattern
+	}
+}
+
+// statusClass returns the class of a status code, e.g. 404 is 4xx
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// responseRecorder captures the status code and number of bytes written
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		if r.hijacked {
+			return http.StatusSwitchingProtocols
+		}
+		return http.StatusOK
+	}
+	return r.status
+}
+
+type recorderFlusher struct{ r *responseRecorder }
+
+func (f recorderFlusher) Flush() {
+	if f.r.status == 0 {
+		f.r.status = http.StatusOK
+	}
+	f.r.ResponseWriter.(http.Flusher).Flush()
+}
+
+type recorderHijacker struct{ r *responseRecorder }
+
+func (h recorderHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := h.r.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		h.r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+type recorderPusher struct{ r *responseRecorder }
+
+func (p recorderPusher) Push(target string, opts *http.PushOptions) error {
+	return p.r.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// wrapResponseWriter returns the recorder with the same optional interfaces
+// (http.Flusher, http.Hijacker, http.Pusher) as the wrapped ResponseWriter
+func wrapResponseWriter(r *responseRecorder) http.ResponseWriter {
+	_, isFlusher := r.ResponseWriter.(http.Flusher)
+	_, isHijacker := r.ResponseWriter.(http.Hijacker)
+	_, isPusher := r.ResponseWriter.(http.Pusher)
+
+	f := recorderFlusher{r}
+	h := recorderHijacker{r}
+	p := recorderPusher{r}
+
+	switch {
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			*responseRecorder
+			recorderFlusher
+			recorderHijacker
+			recorderPusher
+		}{r, f, h, p}
+	case isFlusher && isHijacker:
+		return struct {
+			*responseRecorder
+			recorderFlusher
+			recorderHijacker
+		}{r, f, h}
+	case isFlusher && isPusher:
+		return struct {
+			*responseRecorder
+			recorderFlusher
+			recorderPusher
+		}{r, f, p}
+	case isHijacker && isPusher:
+		return struct {
+			*responseRecorder
+			recorderHijacker
+			recorderPusher
+		}{r, h, p}
+	case isFlusher:
+		return struct {
+			*responseRecorder
+			recorderFlusher
+		}{r, f}
+	case isHijacker:
+		return struct {
+			*responseRecorder
+			recorderHijacker
+		}{r, h}
+	case isPusher:
+		return struct {
+			*responseRecorder
+			recorderPusher
+		}{r, p}
+	}
+
+	return r
+}
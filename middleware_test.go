@@ -0,0 +1,246 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPMiddleware(t *testing.T) {
+	t.Log("Testing middleware.HTTPMiddleware")
+
+	cm := &CirconusMetrics{}
+	cm.counters = make(map[string]uint64)
+	cm.gaugeFuncs = make(map[string]func() int64)
+	cm.histograms = make(map[string]*Histogram)
+
+	var inFlight int64
+	mw := cm.HTTPMiddleware(nil)
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = cm.gaugeFuncs["go`HTTP`in_flight"]()
+		b, _ := ioutil.ReadAll(r.Body)
+		if string(b) == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprint(w, "hello")
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("foo")))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("missing")))
+
+	if inFlight != 1 {
+		t.Fatalf("Expected 1 in flight, found %d", inFlight)
+	}
+	if v := cm.gaugeFuncs["go`HTTP`in_flight"](); v != 0 {
+		t.Fatalf("Expected 0 in flight, found %d", v)
+	}
+
+	for _, name := range []string{"go`HTTP`POST`all`status`2xx", "go`HTTP`POST`all`status`4xx"} {
+		val, err := cm.GetCounterTest(name)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 1 {
+			t.Fatalf("Expected 1, found %d", val)
+		}
+	}
+
+	for _, name := range []string{"go`HTTP`POST`all`2xx`latency", "go`HTTP`POST`all`4xx`latency"} {
+		if _, err := cm.GetHistogramTest(name); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	val, err := cm.GetHistogramTest("go`HTTP`POST`all`request_bytes")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(val) != 2 || val[0] != "H[3.0e+00]=1" || val[1] != "H[7.0e+00]=1" {
+		t.Fatalf("Expected request bytes 3 and 7, found %v", val)
+	}
+
+	val, err = cm.GetHistogramTest("go`HTTP`POST`all`response_bytes")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(val) != 1 || val[0] != "H[5.0e+00]=2" {
+		t.Fatalf("Expected response bytes 5, found %v", val)
+	}
+}
+
+func TestHTTPMiddlewareRoute(t *testing.T) {
+	t.Log("Testing middleware.ServeMuxRoute")
+
+	cm := &CirconusMetrics{}
+	cm.counters = make(map[string]uint64)
+	cm.gaugeFuncs = make(map[string]func() int64)
+	cm.histograms = make(map[string]*Histogram)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {})
+
+	h := cm.HTTPMiddleware(&HTTPMiddlewareOptions{
+		Prefix:    "api`",
+		Name:      "unmatched",
+		RouteName: ServeMuxRoute(mux),
+	})(mux)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/123", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/456", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nope", nil))
+
+	val, err := cm.GetCounterTest("api`GET`/users/`status`2xx")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val != 2 {
+		t.Fatalf("Expected 2, found %d", val)
+	}
+
+	if _, err := cm.GetCounterTest("api`GET`unmatched`status`4xx"); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	if _, ok := cm.gaugeFuncs["api`in_flight"]; !ok {
+		t.Fatal("Expected api`in_flight gauge")
+	}
+
+	t.Log("method pattern")
+	{
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+		h := cm.HTTPMiddleware(&HTTPMiddlewareOptions{
+			Prefix:    "api`",
+			RouteName: ServeMuxRoute(mux),
+		})(mux)
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items/1", nil))
+
+		if _, err := cm.GetCounterTest("api`GET`/items/{id}`status`2xx"); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+}
+
+func TestHTTPMiddlewareSharedInFlight(t *testing.T) {
+	t.Log("Testing middleware.HTTPMiddleware in flight gauge shared by prefix")
+
+	cm := &CirconusMetrics{}
+	cm.counters = make(map[string]uint64)
+	cm.gaugeFuncs = make(map[string]func() int64)
+	cm.histograms = make(map[string]*Histogram)
+
+	var inFlight int64
+	inner := cm.HTTPMiddleware(&HTTPMiddlewareOptions{Name: "inner"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = cm.gaugeFuncs["go`HTTP`in_flight"]()
+	}))
+	outer := cm.HTTPMiddleware(&HTTPMiddlewareOptions{Name: "outer"})(inner)
+
+	outer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if inFlight != 2 {
+		t.Fatalf("Expected 2 in flight, found %d", inFlight)
+	}
+	if v := cm.gaugeFuncs["go`HTTP`in_flight"](); v != 0 {
+		t.Fatalf("Expected 0 in flight, found %d", v)
+	}
+}
+
+func TestHTTPMiddlewareInterfaces(t *testing.T) {
+	t.Log("Testing middleware response writer interfaces")
+
+	cm := &CirconusMetrics{}
+	cm.counters = make(map[string]uint64)
+	cm.gaugeFuncs = make(map[string]func() int64)
+	cm.histograms = make(map[string]*Histogram)
+
+	var isFlusher, isHijacker, isPusher bool
+	h := cm.HTTPMiddleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher = w.(http.Flusher)
+		_, isHijacker = w.(http.Hijacker)
+		_, isPusher = w.(http.Pusher)
+		if r.URL.Path == "/hijack" {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Expected no error, got '%v'", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.(http.Flusher).Flush()
+	}))
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	resp.Body.Close()
+
+	// http/1.1 server response writers are flushers and hijackers, not pushers
+	if !isFlusher || !isHijacker || isPusher {
+		t.Fatalf("Expected flusher, hijacker, not pusher found %v %v %v", isFlusher, isHijacker, isPusher)
+	}
+
+	if _, err := http.Get(server.URL + "/hijack"); err == nil {
+		t.Fatal("Expected error from hijacked connection")
+	}
+
+	if _, err := cm.GetCounterTest("go`HTTP`GET`all`status`1xx"); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("recorder only")
+	{
+		rec := &responseRecorder{ResponseWriter: struct{ http.ResponseWriter }{httptest.NewRecorder()}}
+		w := wrapResponseWriter(rec)
+		if _, ok := w.(http.Flusher); ok {
+			t.Fatal("Expected not to be a flusher")
+		}
+		if _, ok := w.(http.Hijacker); ok {
+			t.Fatal("Expected not to be a hijacker")
+		}
+	}
+
+	t.Log("pusher")
+	{
+		rec := &responseRecorder{ResponseWriter: struct {
+			http.ResponseWriter
+			http.Pusher
+		}{httptest.NewRecorder(), nil}}
+		w := wrapResponseWriter(rec)
+		if _, ok := w.(http.Pusher); !ok {
+			t.Fatal("Expected to be a pusher")
+		}
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	t.Log("Testing middleware.statusClass")
+
+	tests := map[int]string{
+		0:   "unknown",
+		101: "1xx",
+		200: "2xx",
+		302: "3xx",
+		404: "4xx",
+		503: "5xx",
+		600: "unknown",
+	}
+	for code, expected := range tests {
+		if class := statusClass(code); class != expected {
+			t.Fatalf("Expected %s for %d, found %s", expected, code, class)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package otelexporter provides an OpenTelemetry SDK metric.Exporter which
+// records data points in circonus-gometrics and submits them to Circonus.
+//
+// Data points are converted as follows:
+//
+//	monotonic Sum                 counter (delta, a cumulative sum is converted to a delta)
+//	non-monotonic Sum, Gauge      gauge
+//	Histogram                     histogram, each bucket count recorded at the bucket midpoint
+//	ExponentialHistogram          histogram, each bucket count recorded at the bucket midpoint
+//
+// Attributes become stream tags, name|ST[key:value,...]. After each export the
+// CirconusMetrics instance is flushed, so metrics are submitted through its check
+// (check creation and metric activation work as usual). Create it with an Interval
+// of "0", the periodic reader of the OpenTelemetry SDK drives submission.
+//
+//	metrics, err := cgm.New(&cgm.Config{Interval: "0", ...})
+//	...
+//	exp, err := otelexporter.New(&otelexporter.Config{Metrics: metrics})
+//	...
+//	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp)))
+package otelexporter
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// Config options for the exporter
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// Metrics the data points are recorded in, and flushed (submitted) after each export
+	Metrics *cgm.CirconusMetrics
+	// Prefix prepended to every metric name, e.g. "otel`" (default: none)
+	Prefix string
+}
+
+// Exporter is an OpenTelemetry metric exporter, see sdkmetric.Exporter
+type Exporter struct {
+	Log   *log.Logger
+	Debug bool
+
+	metrics *cgm.CirconusMetrics
+	prefix  string
+
+	mu       sync.Mutex
+	shutdown bool
+	// last value of cumulative monotonic sums, to calculate deltas
+	last map[string]float64
+	// fractional remainders of float counters, carried to the next export
+	remainders map[string]float64
+}
+
+// New returns a new exporter
+func New(cfg *Config) (*Exporter, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+	if cfg.Metrics == nil {
+		return nil, errors.New("invalid configuration, no metrics (nil)")
+	}
+
+	e := &Exporter{
+		Debug:      cfg.Debug,
+		Log:        cfg.Log,
+		metrics:    cfg.Metrics,
+		prefix:     cfg.Prefix,
+		last:       make(map[string]float64),
+		remainders: make(map[string]float64),
+	}
+
+	if e.Debug && e.Log == nil {
+		e.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if e.Log == nil {
+		e.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	return e, nil
+}
+
+// Temporality returns delta for counters and histograms, which match the
+// (reset at each flush) counters and histograms of circonus-gometrics, and
+// cumulative for up down counters, which are recorded as gauges
+func (e *Exporter) Temporality(k sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DeltaTemporalitySelector(k)
+}
+
+// Aggregation returns the default aggregation for the instrument kind
+func (e *Exporter) Aggregation(k sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(k)
+}
+
+// Export records the data points then flushes (submits) the metrics
+func (e *Exporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	e.mu.Lock()
+	if e.shutdown {
+		e.mu.Unlock()
+		return sdkmetric.ErrExporterShutdown
+	}
+	e.record(rm)
+	e.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	e.metrics.Flush()
+
+	return nil
+}
+
+// ForceFlush is a nop, data points are not held by the exporter
+func (e *Exporter) ForceFlush(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Shutdown stops the exporter, subsequent exports return an error
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	e.shutdown = true
+	e.mu.Unlock()
+	return ctx.Err()
+}
+
+// record converts the data points into metrics, must be called with mu held
+func (e *Exporter) record(rm *metricdata.ResourceMetrics) {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			name := e.prefix + m.Name
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					e.recordSum(metricName(name, dp.Attributes), data.IsMonotonic, data.Temporality, float64(dp.Value), dp.Value)
+				}
+			case metricdata.Sum[float64]:
+				for _, dp := range data.DataPoints {
+					e.recordSum(metricName(name, dp.Attributes), data.IsMonotonic, data.Temporality, dp.Value, dp.Value)
+				}
+			case metricdata.Gauge[int64]:
+				for _, dp := range data.DataPoints {
+					e.metrics.SetGauge(metricName(name, dp.Attributes), dp.Value)
+				}
+			case metricdata.Gauge[float64]:
+				for _, dp := range data.DataPoints {
+					e.metrics.SetGauge(metricName(name, dp.Attributes), dp.Value)
+				}
+			case metricdata.Histogram[int64]:
+				if !e.isDelta(name, data.Temporality) {
+					continue
+				}
+				for _, dp := range data.DataPoints {
+					lo, loOk := dp.Min.Value()
+					hi, hiOk := dp.Max.Value()
+					e.recordHistogram(metricName(name, dp.Attributes), dp.Bounds, dp.BucketCounts, extrema(float64(lo), loOk), extrema(float64(hi), hiOk))
+				}
+			case metricdata.Histogram[float64]:
+				if !e.isDelta(name, data.Temporality) {
+					continue
+				}
+				for _, dp := range data.DataPoints {
+					lo, loOk := dp.Min.Value()
+					hi, hiOk := dp.Max.Value()
+					e.recordHistogram(metricName(name, dp.Attributes), dp.Bounds, dp.BucketCounts, extrema(lo, loOk), extrema(hi, hiOk))
+				}
+			case metricdata.ExponentialHistogram[int64]:
+				if !e.isDelta(name, data.Temporality) {
+					continue
+				}
+				for _, dp := range data.DataPoints {
+					e.recordExponentialHistogram(metricName(name, dp.Attributes), dp.Scale, dp.ZeroCount, dp.PositiveBucket, dp.NegativeBucket)
+				}
+			case metricdata.ExponentialHistogram[float64]:
+				if !e.isDelta(name, data.Temporality) {
+					continue
+				}
+				for _, dp := range data.DataPoints {
+					e.recordExponentialHistogram(metricName(name, dp.Attributes), dp.Scale, dp.ZeroCount, dp.PositiveBucket, dp.NegativeBucket)
+				}
+			default:
+				if e.Debug {
+					e.Log.Printf("[DEBUG] skipping %s, unsupported aggregation %T", m.Name, m.Data)
+				}
+			}
+		}
+	}
+}
+
+// metricName returns the name with the attributes as stream tags
+func metricName(name string, attrs attribute.Set) string {
+	if attrs.Len() == 0 {
+		return name
+	}
+	tags := make(cgm.Tags, 0, attrs.Len())
+	iter := attrs.Iter()
+	for iter.Next() {
+		kv := iter.Attribute()
+		tags = append(tags, cgm.Tag{Category: string(kv.Key), Value: kv.Value.Emit()})
+	}
+	return cgm.MetricNameWithStreamTags(name, tags)
+}
+
+// isDelta reports whether histogram data is delta, cumulative histograms
+// cannot be merged into circonus histograms and are skipped
+func (e *Exporter) isDelta(name string, t metricdata.Temporality) bool {
+	if t == metricdata.DeltaTemporality {
+		return true
+	}
+	e.Log.Printf("[WARN] skipping %s, %s histograms are not supported", name, t)
+	return false
+}
+
+// recordSum records a monotonic sum as a counter and a non-monotonic sum as
+// a gauge (the value, int64 or float64, is recorded as is)
+func (e *Exporter) recordSum(name string, monotonic bool, t metricdata.Temporality, v float64, raw interface{}) {
+	if !monotonic {
+		e.metrics.SetGauge(name, raw)
+		return
+	}
+
+	if t == metricdata.CumulativeTemporality {
+		last, ok := e.last[name]
+		e.last[name] = v
+		if ok && v >= last {
+			v -= last
+		}
+	}
+
+	// counters are integers, carry the fraction of float counters forward
+	v += e.remainders[name]
+	whole := math.Floor(v)
+	if rem := v - whole; rem > 0 {
+		e.remainders[name] = rem
+	} else {
+		delete(e.remainders, name)
+	}
+	if whole > 0 {
+		e.metrics.Add(name, uint64(whole))
+	}
+}
+
+// extremum is an optional histogram min or max
+type extremum struct {
+	value   float64
+	defined bool
+}
+
+func extrema(v float64, defined bool) extremum {
+	return extremum{value: v, defined: defined}
+}
+
+// recordHistogram records the count of each explicit bucket at the midpoint
+// of the bucket. The first and last buckets are unbounded, they are bounded
+// by the min and max when available, otherwise their finite bound is used.
+func (e *Exporter) recordHistogram(name string, bounds []float64, counts []uint64, lo, hi extremum) {
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+
+		var lower, upper float64
+		switch {
+		case len(bounds) == 0:
+			// a single bucket
+			lower, upper = lo.value, hi.value
+		case i == 0:
+			upper = bounds[0]
+			lower = upper
+			if lo.defined {
+				lower = lo.value
+			}
+		case i >= len(bounds):
+			lower = bounds[len(bounds)-1]
+			upper = lower
+			if hi.defined {
+				upper = hi.value
+			}
+		default:
+			lower, upper = bounds[i-1], bounds[i]
+		}
+
+		v := lower + (upper-lower)/2
+		if lo.defined && v < lo.value {
+			v = lo.value
+		}
+		if hi.defined && v > hi.value {
+			v = hi.value
+		}
+
+		e.metrics.RecordCountForValue(name, v, int64(n))
+	}
+}
+
+// recordExponentialHistogram records the count of each bucket at the midpoint
+// of the bucket, bucket index i covers (base^i, base^(i+1)] where
+// base = 2^(2^-scale), negative buckets mirror the positive buckets
+func (e *Exporter) recordExponentialHistogram(name string, scale int32, zeroCount uint64, positive, negative metricdata.ExponentialBucket) {
+	base := math.Exp2(math.Exp2(-float64(scale)))
+
+	if zeroCount > 0 {
+		e.metrics.RecordCountForValue(name, 0, int64(zeroCount))
+	}
+
+	for sign, buckets := range map[float64]metricdata.ExponentialBucket{1: positive, -1: negative} {
+		for i, n := range buckets.Counts {
+			if n == 0 {
+				continue
+			}
+			idx := float64(buckets.Offset) + float64(i)
+			lower := math.Pow(base, idx)
+			upper := math.Pow(base, idx+1)
+			e.metrics.RecordCountForValue(name, sign*(lower+(upper-lower)/2), int64(n))
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package otelexporter
+
+import (
+	"context"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func testMetrics(t *testing.T) *cgm.CirconusMetrics {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cfg.ResetCounters = "false"
+	cfg.ResetGauges = "false"
+	cfg.ResetHistograms = "false"
+
+	m, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return m
+}
+
+func testExporter(t *testing.T) (*Exporter, *cgm.CirconusMetrics) {
+	m := testMetrics(t)
+	e, err := New(&Config{Metrics: m})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return e, m
+}
+
+func resourceMetrics(metrics ...metricdata.Metrics) *metricdata.ResourceMetrics {
+	return &metricdata.ResourceMetrics{
+		ScopeMetrics: []metricdata.ScopeMetrics{{Metrics: metrics}},
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config")
+	{
+		if _, err := New(nil); err == nil {
+			t.Fatal("Expected error")
+		}
+		expectedError := "invalid configuration, no metrics (nil)"
+		if _, err := New(&Config{}); err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected '%s', got '%v'", expectedError, err)
+		}
+	}
+
+	t.Log("temporality")
+	{
+		e, _ := testExporter(t)
+		if tp := e.Temporality(sdkmetric.InstrumentKindCounter); tp != metricdata.DeltaTemporality {
+			t.Fatalf("Expected delta, got %v", tp)
+		}
+		if tp := e.Temporality(sdkmetric.InstrumentKindUpDownCounter); tp != metricdata.CumulativeTemporality {
+			t.Fatalf("Expected cumulative, got %v", tp)
+		}
+	}
+}
+
+func TestRecordSum(t *testing.T) {
+	e, m := testExporter(t)
+
+	t.Log("delta int counter, attributes as stream tags")
+	{
+		attrs := attribute.NewSet(attribute.String("method", "GET"), attribute.Int("code", 200))
+		rm := resourceMetrics(metricdata.Metrics{
+			Name: "requests",
+			Data: metricdata.Sum[int64]{
+				Temporality: metricdata.DeltaTemporality,
+				IsMonotonic: true,
+				DataPoints:  []metricdata.DataPoint[int64]{{Attributes: attrs, Value: 5}},
+			},
+		})
+		e.record(rm)
+		e.record(rm)
+
+		val, err := m.GetCounterTest("requests|ST[code:200,method:GET]")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 10 {
+			t.Fatalf("Expected 10, got %d", val)
+		}
+	}
+
+	t.Log("cumulative float counter")
+	{
+		for _, v := range []float64{1.5, 2.5, 4.25} {
+			e.record(resourceMetrics(metricdata.Metrics{
+				Name: "bytes",
+				Data: metricdata.Sum[float64]{
+					Temporality: metricdata.CumulativeTemporality,
+					IsMonotonic: true,
+					DataPoints:  []metricdata.DataPoint[float64]{{Value: v}},
+				},
+			}))
+		}
+
+		val, err := m.GetCounterTest("bytes")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 4 {
+			t.Fatalf("Expected 4, got %d", val)
+		}
+		if rem := e.remainders["bytes"]; rem != 0.25 {
+			t.Fatalf("Expected 0.25 remainder, got %f", rem)
+		}
+	}
+
+	t.Log("up down counter and gauge")
+	{
+		e.record(resourceMetrics(
+			metricdata.Metrics{
+				Name: "queue",
+				Data: metricdata.Sum[int64]{
+					Temporality: metricdata.CumulativeTemporality,
+					DataPoints:  []metricdata.DataPoint[int64]{{Value: -3}},
+				},
+			},
+			metricdata.Metrics{
+				Name: "temp",
+				Data: metricdata.Gauge[float64]{
+					DataPoints: []metricdata.DataPoint[float64]{{Value: 21.5}},
+				},
+			},
+		))
+
+		val, err := m.GetGaugeTest("queue")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val.(int64) != -3 {
+			t.Fatalf("Expected -3, got %v", val)
+		}
+		val, err = m.GetGaugeTest("temp")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val.(float64) != 21.5 {
+			t.Fatalf("Expected 21.5, got %v", val)
+		}
+	}
+}
+
+func TestRecordHistogram(t *testing.T) {
+	t.Log("explicit buckets")
+	{
+		e, m := testExporter(t)
+		e.record(resourceMetrics(metricdata.Metrics{
+			Name: "latency",
+			Data: metricdata.Histogram[float64]{
+				Temporality: metricdata.DeltaTemporality,
+				DataPoints: []metricdata.HistogramDataPoint[float64]{{
+					Bounds:       []float64{10, 20},
+					BucketCounts: []uint64{1, 2, 1},
+					Min:          metricdata.NewExtrema(4.0),
+					Max:          metricdata.NewExtrema(30.0),
+				}},
+			},
+		}))
+
+		expected := map[string]bool{
+			"H[7.0e+00]=1": true, // (4+10)/2
+			"H[1.5e+01]=2": true, // (10+20)/2
+			"H[2.5e+01]=1": true, // (20+30)/2
+		}
+		hist, err := m.GetHistogramTest("latency")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(hist) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, hist)
+		}
+		for _, bin := range hist {
+			if !expected[bin] {
+				t.Fatalf("Unexpected bin %s, expected %v", bin, expected)
+			}
+		}
+	}
+
+	t.Log("exponential buckets")
+	{
+		e, m := testExporter(t)
+		e.record(resourceMetrics(metricdata.Metrics{
+			Name: "size",
+			Data: metricdata.ExponentialHistogram[int64]{
+				Temporality: metricdata.DeltaTemporality,
+				DataPoints: []metricdata.ExponentialHistogramDataPoint[int64]{{
+					Scale:          0, // base 2
+					ZeroCount:      1,
+					PositiveBucket: metricdata.ExponentialBucket{Offset: 1, Counts: []uint64{2, 0, 3}},
+					NegativeBucket: metricdata.ExponentialBucket{Offset: 0, Counts: []uint64{1}},
+				}},
+			},
+		}))
+
+		expected := map[string]bool{
+			"H[0.0e+00]=1":  true,
+			"H[3.0e+00]=2":  true, // (2, 4]
+			"H[1.2e+01]=3":  true, // (8, 16]
+			"H[-1.5e+00]=1": true, // [-2, -1)
+		}
+		hist, err := m.GetHistogramTest("size")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(hist) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, hist)
+		}
+		for _, bin := range hist {
+			if !expected[bin] {
+				t.Fatalf("Unexpected bin %s, expected %v", bin, expected)
+			}
+		}
+	}
+
+	t.Log("cumulative histograms are skipped")
+	{
+		e, m := testExporter(t)
+		e.record(resourceMetrics(metricdata.Metrics{
+			Name: "latency",
+			Data: metricdata.Histogram[int64]{
+				Temporality: metricdata.CumulativeTemporality,
+				DataPoints: []metricdata.HistogramDataPoint[int64]{{
+					Bounds:       []float64{10},
+					BucketCounts: []uint64{1, 0},
+				}},
+			},
+		}))
+		if _, err := m.GetHistogramTest("latency"); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	e, m := testExporter(t)
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(e)))
+
+	t.Log("export through the sdk")
+	{
+		counter, err := provider.Meter("test").Int64Counter("jobs")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		counter.Add(context.Background(), 3)
+
+		if err := provider.ForceFlush(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		val, err := m.GetCounterTest("jobs")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 3 {
+			t.Fatalf("Expected 3, got %d", val)
+		}
+	}
+
+	t.Log("shutdown")
+	{
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if err := e.Export(context.Background(), resourceMetrics()); err != sdkmetric.ErrExporterShutdown {
+			t.Fatalf("Expected '%v', got '%v'", sdkmetric.ErrExporterShutdown, err)
+		}
+	}
+}
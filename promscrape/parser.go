@@ -0,0 +1,204 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package promscrape
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// metric family types, other types (gauge, gaugehistogram, info, ...) are gauges
+const (
+	typeCounter   = "counter"
+	typeHistogram = "histogram"
+	typeSummary   = "summary"
+	typeUntyped   = "untyped"
+)
+
+// label is a single sample label
+type label struct {
+	name  string
+	value string
+}
+
+// sample is a single parsed sample line
+type sample struct {
+	name   string // sample name, e.g. foo_bucket
+	family string // metric family name, e.g. foo
+	typ    string // type of the metric family
+	labels []label
+	value  float64
+}
+
+// suffixes of sample names belonging to a metric family
+var familySuffixes = []string{"_bucket", "_count", "_sum", "_total", "_created", "_gcount", "_gsum", "_info"}
+
+// parse reads prometheus text (0.0.4) or openmetrics text and returns the samples
+func parse(r io.Reader) ([]sample, error) {
+	types := make(map[string]string)
+	var samples []sample
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = strings.ToLower(fields[3])
+			}
+			if len(fields) == 2 && fields[1] == "EOF" {
+				break
+			}
+			continue
+		}
+
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNum)
+		}
+
+		s.family, s.typ = s.name, types[s.name]
+		if s.typ == "" {
+			for _, suffix := range familySuffixes {
+				if family := strings.TrimSuffix(s.name, suffix); family != s.name {
+					if typ, ok := types[family]; ok {
+						s.family, s.typ = family, typ
+						break
+					}
+				}
+			}
+		}
+		if s.typ == "" || s.typ == "unknown" {
+			s.typ = typeUntyped
+		}
+
+		samples = append(samples, s)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading")
+	}
+
+	return samples, nil
+}
+
+// parseSample parses a sample line, timestamps and exemplars are ignored
+//
+//	name[{label="value",...}] value [timestamp] [# exemplar]
+func parseSample(line string) (sample, error) {
+	var s sample
+
+	end := strings.IndexAny(line, "{ \t")
+	if end < 1 {
+		return s, errors.Errorf("invalid sample (%s)", line)
+	}
+	s.name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return s, err
+		}
+		s.labels = labels
+		rest = rest[n:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, errors.Errorf("invalid sample, no value (%s)", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, errors.Wrap(err, "parsing value")
+	}
+	s.value = v
+
+	return s, nil
+}
+
+// parseLabels parses {name="value",...} and returns the labels and the
+// number of bytes consumed
+func parseLabels(s string) ([]label, int, error) {
+	var labels []label
+	i := 1 // skip {
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, errors.Errorf("invalid labels, no closing brace (%s)", s)
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 1 {
+			return nil, 0, errors.Errorf("invalid label (%s)", s[i:])
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, errors.Errorf("invalid label value, not quoted (%s)", name)
+		}
+		i++
+
+		var value strings.Builder
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, 0, errors.Errorf("invalid label value, no closing quote (%s)", name)
+		}
+		i++ // skip closing quote
+
+		labels = append(labels, label{name: name, value: value.String()})
+	}
+}
+
+// labelValue returns the value of the named label
+func labelValue(labels []label, name string) (string, bool) {
+	for _, l := range labels {
+		if l.name == name {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+// parseBound parses the value of a le label
+func parseBound(le string) (float64, error) {
+	v, err := strconv.ParseFloat(le, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing bucket bound")
+	}
+	if math.IsNaN(v) {
+		return 0, errors.Errorf("invalid bucket bound (%s)", le)
+	}
+	return v, nil
+}
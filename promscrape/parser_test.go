@@ -0,0 +1,148 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package promscrape
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	t.Log("prometheus text")
+	{
+		text := `# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# TYPE temperature gauge
+temperature -3.5
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+no_type{path="C:\\dir\\",msg="say \"hi\"\n"} NaN
+`
+		samples, err := parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(samples) != 7 {
+			t.Fatalf("Expected 7 samples, got %d", len(samples))
+		}
+
+		s := samples[1]
+		if s.name != "http_requests_total" || s.family != "http_requests_total" || s.typ != typeCounter {
+			t.Fatalf("Expected http_requests_total counter, got '%+v'", s)
+		}
+		if v, _ := labelValue(s.labels, "code"); v != "400" {
+			t.Fatalf("Expected 400, got '%s'", v)
+		}
+		if s.value != 3 {
+			t.Fatalf("Expected 3, got %v", s.value)
+		}
+
+		if s := samples[2]; s.typ != "gauge" || s.value != -3.5 {
+			t.Fatalf("Expected gauge -3.5, got '%+v'", s)
+		}
+
+		if s := samples[4]; s.family != "rpc_duration_seconds" || s.typ != typeSummary {
+			t.Fatalf("Expected rpc_duration_seconds summary, got '%+v'", s)
+		}
+
+		s = samples[6]
+		if s.typ != typeUntyped {
+			t.Fatalf("Expected untyped, got '%s'", s.typ)
+		}
+		if !math.IsNaN(s.value) {
+			t.Fatalf("Expected NaN, got %v", s.value)
+		}
+		if v, _ := labelValue(s.labels, "path"); v != `C:\dir\` {
+			t.Fatalf("Expected 'C:\\dir\\', got '%s'", v)
+		}
+		if v, _ := labelValue(s.labels, "msg"); v != "say \"hi\"\n" {
+			t.Fatalf("Expected 'say \"hi\"\\n', got '%s'", v)
+		}
+	}
+
+	t.Log("openmetrics")
+	{
+		text := `# TYPE acme_http_router_request_seconds histogram
+# UNIT acme_http_router_request_seconds seconds
+acme_http_router_request_seconds_bucket{path="/api/v1",le="0.1"} 10 # {trace_id="KOO5S4vxi0o"} 0.067
+acme_http_router_request_seconds_bucket{path="/api/v1",le="+Inf"} 12
+acme_http_router_request_seconds_sum{path="/api/v1"} 4.5
+acme_http_router_request_seconds_count{path="/api/v1"} 12
+acme_http_router_request_seconds_created{path="/api/v1"} 1.5e+09
+# TYPE jobs counter
+jobs_total 5
+# EOF
+ignored 1
+`
+		samples, err := parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(samples) != 6 {
+			t.Fatalf("Expected 6 samples, got %d", len(samples))
+		}
+		for _, s := range samples[:5] {
+			if s.family != "acme_http_router_request_seconds" || s.typ != typeHistogram {
+				t.Fatalf("Expected acme_http_router_request_seconds histogram, got '%+v'", s)
+			}
+		}
+		if s := samples[0]; s.value != 10 {
+			t.Fatalf("Expected 10 (exemplar ignored), got %v", s.value)
+		}
+		if s := samples[1]; s.value != 12 {
+			t.Fatalf("Expected 12, got %v", s.value)
+		}
+		if s := samples[5]; s.family != "jobs" || s.typ != typeCounter || s.value != 5 {
+			t.Fatalf("Expected jobs counter 5, got '%+v'", s)
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, line := range []string{
+			`foo`,
+			`foo{a="b" 1`,
+			`foo{a=b} 1`,
+			`foo{a="b} 1`,
+			`foo{a="b"}`,
+			`foo bar`,
+			`{a="b"} 1`,
+		} {
+			if _, err := parse(strings.NewReader(line)); err == nil {
+				t.Fatalf("Expected error for '%s'", line)
+			}
+		}
+	}
+}
+
+func TestParseBound(t *testing.T) {
+	t.Log("valid")
+	{
+		for le, expect := range map[string]float64{"0.5": 0.5, "1e3": 1000, "+Inf": math.Inf(1)} {
+			v, err := parseBound(le)
+			if err != nil {
+				t.Fatalf("Expected no error, got '%v'", err)
+			}
+			if v != expect {
+				t.Fatalf("Expected %v, got %v", expect, v)
+			}
+		}
+	}
+
+	t.Log("invalid")
+	{
+		for _, le := range []string{"", "abc", "NaN"} {
+			if _, err := parseBound(le); err == nil {
+				t.Fatalf("Expected error for '%s'", le)
+			}
+		}
+	}
+}
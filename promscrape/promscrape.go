@@ -0,0 +1,336 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package promscrape provides a circonus-gometrics collector which scrapes a
+// Prometheus /metrics endpoint (text 0.0.4 or OpenMetrics) at each flush.
+//
+// Samples are converted as follows:
+//
+//	counter                       counter (the scraped total)
+//	gauge, untyped, info, ...     gauge
+//	summary                       quantile gauges (name|ST[quantile:0.5]), name_sum gauge, name_count counter
+//	histogram                     histogram, the new observations in each bucket (since the previous
+//	                              scrape) recorded at the bucket midpoint, name_sum gauge, name_count counter
+//
+// Labels become stream tags, name|ST[label:value,...], and every metric name
+// is prefixed with the Prefix of the target. Histogram buckets are cumulative
+// totals, the first scrape of a histogram only establishes the baseline.
+//
+//	scraper, err := promscrape.New(&promscrape.Config{URL: "http://127.0.0.1:9100/metrics", Prefix: "node`"})
+//	...
+//	metrics.RegisterCollector("node_exporter", scraper)
+//
+// Register one scraper per target, a failed scrape discards only the metrics of that target.
+package promscrape
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	acceptHeader = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+	maxBodySize  = 32 * 1024 * 1024
+)
+
+// Config options for a scrape target
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// URL of the metrics endpoint, e.g. http://127.0.0.1:9100/metrics
+	URL string
+	// Prefix prepended to every metric name, e.g. "node`" (default: none)
+	Prefix string
+	// Headers added to each scrape request (e.g. Authorization)
+	Headers map[string]string
+	// HTTPClient used to scrape (default: http.DefaultClient, the request is
+	// bounded by the collector timeout of CirconusMetrics)
+	HTTPClient *http.Client
+}
+
+// Scraper scrapes a target, it implements circonusgometrics.Collector
+type Scraper struct {
+	Log   *log.Logger
+	Debug bool
+
+	url     string
+	prefix  string
+	headers map[string]string
+	client  *http.Client
+
+	mu sync.Mutex
+	// bucket counts of each histogram at the previous scrape
+	last map[string][]uint64
+}
+
+// bucket is a histogram bucket, le is the upper bound and count the
+// (cumulative) number of observations
+type bucket struct {
+	le    float64
+	count float64
+}
+
+// histogram accumulates the bucket samples of one histogram series
+type histogram struct {
+	name    string
+	buckets []bucket
+}
+
+// New returns a new scraper
+func New(cfg *Config) (*Scraper, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("invalid url scheme (%s)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("invalid url, no host (%s)", cfg.URL)
+	}
+
+	s := &Scraper{
+		Debug:   cfg.Debug,
+		Log:     cfg.Log,
+		url:     u.String(),
+		prefix:  cfg.Prefix,
+		headers: cfg.Headers,
+		client:  cfg.HTTPClient,
+		last:    make(map[string][]uint64),
+	}
+
+	if s.Debug && s.Log == nil {
+		s.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if s.Log == nil {
+		s.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+
+	return s, nil
+}
+
+// Collect scrapes the target and emits the metrics
+func (s *Scraper) Collect(ctx context.Context, e cgm.Emitter) error {
+	samples, err := s.scrape(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.emit(samples, e)
+
+	return nil
+}
+
+// scrape fetches and parses the metrics of the target
+func (s *Scraper) scrape(ctx context.Context) ([]sample, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", acceptHeader)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "scraping "+s.url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, errors.Errorf("scraping %s: %s", s.url, resp.Status)
+	}
+
+	samples, err := parse(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing "+s.url)
+	}
+
+	if s.Debug {
+		s.Log.Printf("[DEBUG] scraped %d samples from %s", len(samples), s.url)
+	}
+
+	return samples, nil
+}
+
+// emit converts the samples into metrics, must be called with mu held
+func (s *Scraper) emit(samples []sample, e cgm.Emitter) {
+	histograms := make(map[string]*histogram)
+	var order []string
+
+	for _, smp := range samples {
+		if math.IsNaN(smp.value) {
+			continue
+		}
+
+		suffix := strings.TrimPrefix(smp.name, smp.family)
+		if suffix == "_created" {
+			continue
+		}
+
+		switch smp.typ {
+		case typeCounter:
+			s.setCounter(e, s.metricName(smp.name, smp.labels, ""), smp.value)
+		case typeSummary:
+			switch suffix {
+			case "_count":
+				s.setCounter(e, s.metricName(smp.name, smp.labels, ""), smp.value)
+			default:
+				e.SetGauge(s.metricName(smp.name, smp.labels, ""), smp.value)
+			}
+		case typeHistogram:
+			switch suffix {
+			case "_bucket":
+				le, ok := labelValue(smp.labels, "le")
+				if !ok {
+					continue
+				}
+				bound, err := parseBound(le)
+				if err != nil {
+					s.Log.Printf("[WARN] skipping %s bucket: %s", smp.family, err)
+					continue
+				}
+				name := s.metricName(smp.family, smp.labels, "le")
+				h, ok := histograms[name]
+				if !ok {
+					h = &histogram{name: name}
+					histograms[name] = h
+					order = append(order, name)
+				}
+				h.buckets = append(h.buckets, bucket{le: bound, count: smp.value})
+			case "_count":
+				s.setCounter(e, s.metricName(smp.name, smp.labels, ""), smp.value)
+			default:
+				e.SetGauge(s.metricName(smp.name, smp.labels, ""), smp.value)
+			}
+		default:
+			e.SetGauge(s.metricName(smp.name, smp.labels, ""), smp.value)
+		}
+	}
+
+	for _, name := range order {
+		s.recordHistogram(e, histograms[name])
+	}
+
+	// forget histograms which are no longer exposed by the target
+	for name := range s.last {
+		if _, ok := histograms[name]; !ok {
+			delete(s.last, name)
+		}
+	}
+}
+
+// metricName returns the prefixed name with the labels, except skip, as stream tags
+func (s *Scraper) metricName(name string, labels []label, skip string) string {
+	name = s.prefix + name
+	if len(labels) == 0 {
+		return name
+	}
+	tags := make(cgm.Tags, 0, len(labels))
+	for _, l := range labels {
+		if l.name == skip {
+			continue
+		}
+		tags = append(tags, cgm.Tag{Category: l.name, Value: l.value})
+	}
+	return cgm.MetricNameWithStreamTags(name, tags)
+}
+
+// setCounter sets a counter to the (rounded) scraped total
+func (s *Scraper) setCounter(e cgm.Emitter, name string, v float64) {
+	if v < 0 || math.IsInf(v, 0) {
+		return
+	}
+	e.Set(name, uint64(math.Round(v)))
+}
+
+// recordHistogram records the observations made since the previous scrape in
+// each bucket at the midpoint of the bucket. The lowest bucket is bounded by
+// zero (or its own bound when it is negative) and the +Inf bucket by the
+// largest finite bound. A decrease in any bucket means the target restarted,
+// the current counts are recorded as is.
+func (s *Scraper) recordHistogram(e cgm.Emitter, h *histogram) {
+	sort.Slice(h.buckets, func(i, j int) bool { return h.buckets[i].le < h.buckets[j].le })
+
+	// convert cumulative counts to per bucket counts
+	counts := make([]uint64, len(h.buckets))
+	var prev float64
+	for i, b := range h.buckets {
+		n := b.count - prev
+		if n < 0 {
+			n = 0
+		}
+		counts[i] = uint64(math.Round(n))
+		prev = b.count
+	}
+
+	last, ok := s.last[h.name]
+	s.last[h.name] = counts
+	if !ok || len(last) != len(counts) {
+		// first scrape or the buckets changed, only establish the baseline
+		return
+	}
+
+	deltas := make([]uint64, len(counts))
+	for i := range counts {
+		if counts[i] < last[i] {
+			deltas = counts
+			break
+		}
+		deltas[i] = counts[i] - last[i]
+	}
+
+	for i, n := range deltas {
+		if n == 0 {
+			continue
+		}
+
+		upper := h.buckets[i].le
+		var lower float64
+		switch {
+		case math.IsInf(upper, 1):
+			if i == 0 {
+				lower, upper = 0, 0
+			} else {
+				lower = h.buckets[i-1].le
+				upper = lower
+			}
+		case i == 0:
+			if upper < 0 {
+				lower = upper
+			}
+		default:
+			lower = h.buckets[i-1].le
+		}
+
+		e.RecordCountForValue(h.name, lower+(upper-lower)/2, int64(n))
+	}
+}
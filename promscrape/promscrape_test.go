@@ -0,0 +1,283 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package promscrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+// testEmitter records the emitted metrics
+type testEmitter struct {
+	counters   map[string]uint64
+	gauges     map[string]interface{}
+	histograms map[string]map[float64]int64
+}
+
+func newTestEmitter() *testEmitter {
+	return &testEmitter{
+		counters:   make(map[string]uint64),
+		gauges:     make(map[string]interface{}),
+		histograms: make(map[string]map[float64]int64),
+	}
+}
+
+func (e *testEmitter) Set(metric string, val uint64)           { e.counters[metric] = val }
+func (e *testEmitter) Add(metric string, val uint64)           { e.counters[metric] += val }
+func (e *testEmitter) SetGauge(metric string, val interface{}) { e.gauges[metric] = val }
+func (e *testEmitter) RecordValue(metric string, val float64)  { e.RecordCountForValue(metric, val, 1) }
+func (e *testEmitter) SetText(metric string, val string)       {}
+func (e *testEmitter) RecordCountForValue(metric string, val float64, n int64) {
+	if e.histograms[metric] == nil {
+		e.histograms[metric] = make(map[float64]int64)
+	}
+	e.histograms[metric][val] += n
+}
+
+// testTarget serves the current body as prometheus text
+type testTarget struct {
+	sync.Mutex
+	body   string
+	status int
+	accept string
+	auth   string
+}
+
+func (tt *testTarget) set(body string) {
+	tt.Lock()
+	tt.body = body
+	tt.Unlock()
+}
+
+func (tt *testTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tt.Lock()
+	defer tt.Unlock()
+	tt.accept = r.Header.Get("Accept")
+	tt.auth = r.Header.Get("Authorization")
+	if tt.status != 0 {
+		w.WriteHeader(tt.status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, tt.body)
+}
+
+const testHistogram = `# TYPE req_seconds histogram
+req_seconds_bucket{code="200",le="0.5"} %d
+req_seconds_bucket{code="200",le="1"} %d
+req_seconds_bucket{code="200",le="+Inf"} %d
+req_seconds_sum{code="200"} 12.5
+req_seconds_count{code="200"} %d
+`
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config (nil)")
+	{
+		if _, err := New(nil); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("invalid url")
+	{
+		for _, u := range []string{"", "tcp://127.0.0.1:9100", "http://", "http://%zz"} {
+			if _, err := New(&Config{URL: u}); err == nil {
+				t.Fatalf("Expected error for '%s'", u)
+			}
+		}
+	}
+
+	t.Log("valid")
+	{
+		s, err := New(&Config{URL: "http://127.0.0.1:9100/metrics"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if s.client != http.DefaultClient {
+			t.Fatal("Expected default http client")
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	tt := &testTarget{}
+	srv := httptest.NewServer(tt)
+	defer srv.Close()
+
+	s, err := New(&Config{
+		URL:     srv.URL + "/metrics",
+		Prefix:  "app`",
+		Headers: map[string]string{"Authorization": "Bearer abc"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("counters, gauges, summaries")
+	{
+		tt.set(`# TYPE http_requests_total counter
+http_requests_total{method="get",path="/a b"} 10.6
+# TYPE temp gauge
+temp 21.5
+untyped_thing 3
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.99"} 0.25
+rpc_seconds_sum 100.5
+rpc_seconds_count 400
+nan_gauge NaN
+`)
+		e := newTestEmitter()
+		if err := s.Collect(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		if tt.auth != "Bearer abc" {
+			t.Fatalf("Expected Bearer abc, got '%s'", tt.auth)
+		}
+		if tt.accept != acceptHeader {
+			t.Fatalf("Expected accept header, got '%s'", tt.accept)
+		}
+
+		name := cgm.MetricNameWithStreamTags("app`http_requests_total", cgm.Tags{{Category: "method", Value: "get"}, {Category: "path", Value: "/a b"}})
+		if v := e.counters[name]; v != 11 {
+			t.Fatalf("Expected 11, got %d (%v)", v, e.counters)
+		}
+		if v := e.gauges["app`temp"]; v != 21.5 {
+			t.Fatalf("Expected 21.5, got %v", v)
+		}
+		if v := e.gauges["app`untyped_thing"]; v != float64(3) {
+			t.Fatalf("Expected 3, got %v", v)
+		}
+		if v := e.gauges["app`rpc_seconds|ST[quantile:0.99]"]; v != 0.25 {
+			t.Fatalf("Expected 0.25, got %v (%v)", v, e.gauges)
+		}
+		if v := e.gauges["app`rpc_seconds_sum"]; v != 100.5 {
+			t.Fatalf("Expected 100.5, got %v", v)
+		}
+		if v := e.counters["app`rpc_seconds_count"]; v != 400 {
+			t.Fatalf("Expected 400, got %d", v)
+		}
+		if _, ok := e.gauges["app`nan_gauge"]; ok {
+			t.Fatal("Expected NaN to be skipped")
+		}
+	}
+
+	t.Log("histograms")
+	{
+		name := "app`req_seconds|ST[code:200]"
+
+		// first scrape establishes the baseline
+		tt.set(fmt.Sprintf(testHistogram, 5, 8, 10, 10))
+		e := newTestEmitter()
+		if err := s.Collect(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, ok := e.histograms[name]; ok {
+			t.Fatalf("Expected no histogram, got %v", e.histograms[name])
+		}
+		if v := e.counters["app`req_seconds_count|ST[code:200]"]; v != 10 {
+			t.Fatalf("Expected 10, got %d", v)
+		}
+		if v := e.gauges["app`req_seconds_sum|ST[code:200]"]; v != 12.5 {
+			t.Fatalf("Expected 12.5, got %v", v)
+		}
+
+		// 2 new in (0,0.5], 1 new in (0.5,1], 3 new above 1
+		tt.set(fmt.Sprintf(testHistogram, 7, 11, 16, 16))
+		e = newTestEmitter()
+		if err := s.Collect(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		h := e.histograms[name]
+		if h[0.25] != 2 || h[0.75] != 1 || h[1] != 3 || len(h) != 3 {
+			t.Fatalf("Expected map[0.25:2 0.75:1 1:3], got %v", h)
+		}
+
+		// unchanged, nothing recorded
+		e = newTestEmitter()
+		if err := s.Collect(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, ok := e.histograms[name]; ok {
+			t.Fatalf("Expected no histogram, got %v", e.histograms[name])
+		}
+
+		// target restarted, counts recorded as is
+		tt.set(fmt.Sprintf(testHistogram, 1, 1, 2, 2))
+		e = newTestEmitter()
+		if err := s.Collect(context.Background(), e); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		h = e.histograms[name]
+		if h[0.25] != 1 || h[1] != 1 || len(h) != 2 {
+			t.Fatalf("Expected map[0.25:1 1:1], got %v", h)
+		}
+
+		// histogram gone, baseline forgotten
+		tt.set("up 1\n")
+		if err := s.Collect(context.Background(), newTestEmitter()); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if len(s.last) != 0 {
+			t.Fatalf("Expected no baselines, got %v", s.last)
+		}
+	}
+
+	t.Log("invalid body")
+	{
+		tt.set("foo{bar 1\n")
+		if err := s.Collect(context.Background(), newTestEmitter()); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("http error")
+	{
+		tt.Lock()
+		tt.status = http.StatusServiceUnavailable
+		tt.Unlock()
+		if err := s.Collect(context.Background(), newTestEmitter()); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	t.Log("registered collector")
+
+	tt := &testTarget{}
+	tt.set("# TYPE jobs counter\njobs_total{queue=\"default\"} 42\n# TYPE depth gauge\ndepth 7\n# EOF\n")
+	srv := httptest.NewServer(tt)
+	defer srv.Close()
+
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	metrics, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	s, err := New(&Config{URL: srv.URL, Prefix: "worker`"})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	metrics.RegisterCollector("worker", s)
+
+	output := *metrics.FlushMetrics()
+
+	if m, ok := output["worker`jobs_total|ST[queue:default]"]; !ok || m.Value != uint64(42) {
+		t.Fatalf("Expected 42, got %v (%v)", m, output)
+	}
+	if m, ok := output["worker`depth"]; !ok || m.Value != float64(7) {
+		t.Fatalf("Expected 7, got %v (%v)", m, output)
+	}
+}
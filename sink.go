@@ -0,0 +1,92 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Sink is called at each flush with the packaged metrics, which are
+// shared by all sinks and must not be modified. A Sink receives a copy of
+// the metrics packaged for submission (e.g. to dual-write them to another
+// system during a migration). Sinks are called concurrently, whether or not
+// the check is ready, and never delay the submission to Circonus.
+type Sink interface {
+	Write(ts time.Time, metrics Metrics) error
+}
+
+// SinkFunc is an adapter allowing an ordinary function to be used as a Sink
+type SinkFunc func(ts time.Time, metrics Metrics) error
+
+// Write calls f(ts, metrics)
+func (f SinkFunc) Write(ts time.Time, metrics Metrics) error {
+	return f(ts, metrics)
+}
+
+// RegisterSink adds a named sink [called at flush interval]. The number of
+// failed writes is tracked in cgm`sink`<name>`errors.
+func (m *CirconusMetrics) RegisterSink(name string, s Sink) {
+	m.sm.Lock()
+	defer m.sm.Unlock()
+	m.sinks[name] = s
+}
+
+// RemoveSink removes a named sink
+func (m *CirconusMetrics) RemoveSink(name string) {
+	m.sm.Lock()
+	defer m.sm.Unlock()
+	delete(m.sinks, name)
+}
+
+// WaitSinks blocks until the sinks have written the metrics of previous
+// flushes, sinks are written in the background
+func (m *CirconusMetrics) WaitSinks() {
+	m.sm.Lock()
+	defer m.sm.Unlock()
+	for len(m.sinksBusy) > 0 {
+		m.sinkCond().Wait()
+	}
+}
+
+// sinkCond returns the condition signaled when a sink write is done, sm must
+// be held
+func (m *CirconusMetrics) sinkCond() *sync.Cond {
+	if m.sinksIdle == nil {
+		m.sinksIdle = sync.NewCond(&m.sm)
+	}
+	return m.sinksIdle
+}
+
+// writeSinks starts writing the metrics to all registered sinks,
+// concurrently and without waiting for them. A sink still writing the
+// metrics of a previous flush is skipped, counted in cgm`sink`<name>`skipped.
+func (m *CirconusMetrics) writeSinks(ts time.Time, output Metrics) {
+	m.sm.Lock()
+	defer m.sm.Unlock()
+
+	if m.sinksBusy == nil {
+		m.sinksBusy = make(map[string]bool)
+	}
+
+	for name, sink := range m.sinks {
+		if m.sinksBusy[name] {
+			m.Add("cgm`sink`"+name+"`skipped", 1)
+			m.Log.Printf("[WARN] sink %s still writing previous metrics, skipped", name)
+			continue
+		}
+		m.sinksBusy[name] = true
+		go func(name string, sink Sink) {
+			if err := sink.Write(ts, output); err != nil {
+				m.Add("cgm`sink`"+name+"`errors", 1)
+				m.Log.Printf("[WARN] sink %s, %v", name, err)
+			}
+			m.sm.Lock()
+			delete(m.sinksBusy, name)
+			m.sinkCond().Broadcast()
+			m.sm.Unlock()
+		}(name, sink)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegisterSink(t *testing.T) {
+	t.Log("Testing sink.RegisterSink")
+
+	cm := &CirconusMetrics{}
+	cm.sinks = make(map[string]Sink)
+
+	cm.RegisterSink("foo", SinkFunc(func(ts time.Time, metrics Metrics) error {
+		return nil
+	}))
+
+	if len(cm.sinks) != 1 {
+		t.Fatalf("Expected 1, found %d", len(cm.sinks))
+	}
+
+	cm.RemoveSink("foo")
+
+	if len(cm.sinks) != 0 {
+		t.Fatalf("Expected 0, found %d", len(cm.sinks))
+	}
+}
+
+func TestWriteSinks(t *testing.T) {
+	t.Log("Testing sink.writeSinks")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	var mu sync.Mutex
+	var received Metrics
+	cm.RegisterSink("good", SinkFunc(func(ts time.Time, metrics Metrics) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = metrics
+		return nil
+	}))
+	cm.RegisterSink("broken", SinkFunc(func(ts time.Time, metrics Metrics) error {
+		return errors.New("broken")
+	}))
+
+	cm.Increment("foo")
+	cm.Flush()
+	cm.WaitSinks()
+
+	mu.Lock()
+	metric, ok := received["foo"]
+	mu.Unlock()
+	if !ok {
+		t.Fatalf("Expected foo in sink output, got %v", received)
+	}
+	if metric.Value.(uint64) != 1 {
+		t.Fatalf("Expected 1, got %v", metric.Value)
+	}
+
+	val, err := cm.GetCounterTest("cgm`sink`broken`errors")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val != 1 {
+		t.Fatalf("Expected 1, got %d", val)
+	}
+
+	if _, err := cm.GetCounterTest("cgm`sink`good`errors"); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestWriteSinksSlow(t *testing.T) {
+	t.Log("Testing sink.writeSinks with a slow sink")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	release := make(chan struct{})
+	cm.RegisterSink("slow", SinkFunc(func(ts time.Time, metrics Metrics) error {
+		<-release
+		return nil
+	}))
+
+	cm.Increment("foo")
+	done := make(chan struct{})
+	go func() {
+		cm.Flush()
+		cm.Increment("foo")
+		cm.Flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected flush not to wait for the sink")
+	}
+
+	val, err := cm.GetCounterTest("cgm`sink`slow`skipped")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if val != 1 {
+		t.Fatalf("Expected 1, got %d", val)
+	}
+
+	close(release)
+	cm.WaitSinks()
+}
+
+func TestWaitSinksConcurrent(t *testing.T) {
+	t.Log("Testing sink.WaitSinks while flushing")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	var mu sync.Mutex
+	writes := 0
+	cm.RegisterSink("counting", SinkFunc(func(ts time.Time, metrics Metrics) error {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		writes++
+		mu.Unlock()
+		return nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				cm.writeSinks(time.Now(), Metrics{"foo": Metric{Type: "n", Value: 1}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				cm.WaitSinks()
+			}
+		}()
+	}
+	wg.Wait()
+	cm.WaitSinks()
+
+	cm.sm.Lock()
+	busy := len(cm.sinksBusy)
+	cm.sm.Unlock()
+	if busy != 0 {
+		t.Fatalf("Expected no sink writing after WaitSinks, got %d", busy)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if writes == 0 {
+		t.Fatal("Expected sink writes")
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sinks
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/circonus-labs/circonusllhist"
+	"github.com/pkg/errors"
+)
+
+// tag is a single stream tag, or configured tag
+type tag struct {
+	key string
+	val string
+}
+
+// point is a single flattened value. Counters and gauges produce one point,
+// histograms one point per quantile plus one for the count.
+type point struct {
+	name  string // translated metric name
+	field string // histogram quantile or count, "" for counters and gauges
+	tags  []tag
+	value float64
+}
+
+// points flattens the packaged metrics, sorted by name, tags and field. Text
+// metrics, and values which are not numeric, are skipped.
+func (s *Sink) points(metrics cgm.Metrics) []point {
+	pts := make([]point, 0, len(metrics))
+
+	for name, metric := range metrics {
+		if metric.Type == "s" {
+			continue // text metrics unsupported
+		}
+
+		base, tags := s.translate(name)
+
+		if strs, ok := metric.Value.([]string); ok {
+			hist, err := circonusllhist.NewFromStrings(strs, false)
+			if err != nil {
+				s.Log.Printf("[WARN] parsing histogram %s, %v", name, err)
+				continue
+			}
+			vals, err := hist.ApproxQuantile(s.quantiles)
+			if err != nil {
+				s.Log.Printf("[WARN] histogram %s quantiles, %v", name, err)
+				continue
+			}
+			for i, q := range s.quantiles {
+				pts = append(pts, point{name: base, field: quantileName(q), tags: tags, value: vals[i]})
+			}
+			count, err := histogramCount(strs)
+			if err != nil {
+				s.Log.Printf("[WARN] histogram %s count, %v", name, err)
+				continue
+			}
+			pts = append(pts, point{name: base, field: "count", tags: tags, value: float64(count)})
+			continue
+		}
+
+		v, err := strconv.ParseFloat(fmt.Sprintf("%v", metric.Value), 64)
+		if err != nil {
+			if s.Debug {
+				s.Log.Printf("[DEBUG] skipping %s, non-numeric value %v", name, metric.Value)
+			}
+			continue
+		}
+		pts = append(pts, point{name: base, tags: tags, value: v})
+	}
+
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i].name != pts[j].name {
+			return pts[i].name < pts[j].name
+		}
+		if ti, tj := tagsKey(pts[i].tags), tagsKey(pts[j].tags); ti != tj {
+			return ti < tj
+		}
+		return pts[i].field < pts[j].field
+	})
+
+	return pts
+}
+
+// histogramCount returns the number of samples in histogram bins as
+// submitted, e.g. []string{"H[1.2e+01]=3", "H[2.5e+01]=1"}
+func histogramCount(bins []string) (uint64, error) {
+	var count uint64
+	for _, bin := range bins {
+		i := strings.LastIndex(bin, "]=")
+		if i < 0 {
+			return 0, errors.Errorf("invalid bin (%s)", bin)
+		}
+		n, err := strconv.ParseUint(bin[i+2:], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "parsing bin count (%s)", bin)
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// translate returns the name, with backtick separators replaced, and tags
+// of a metric. Stream tags are returned as tags, folded into the name or
+// dropped depending on the configuration. Configured tags are appended.
+func (s *Sink) translate(metric string) (string, []tag) {
+	name, streamTags := parseStreamTags(metric)
+	name = strings.Replace(s.prefix+name, "`", s.separator, -1)
+
+	var tags []tag
+	switch s.streamTags {
+	case StreamTagsAsTags:
+		tags = streamTags
+	case StreamTagsInName:
+		for _, t := range streamTags {
+			name += s.separator + t.key
+			if t.val != "" {
+				name += s.separator + t.val
+			}
+		}
+	}
+
+	for _, t := range s.tags {
+		if !hasTag(tags, t.key) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].key < tags[j].key })
+
+	return name, tags
+}
+
+func tagsKey(tags []tag) string {
+	var b strings.Builder
+	for _, t := range tags {
+		b.WriteString(t.key + "\x00" + t.val + "\x00")
+	}
+	return b.String()
+}
+
+func hasTag(tags []tag, key string) bool {
+	for _, t := range tags {
+		if t.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStreamTags splits a metric name of the form name|ST[cat:val,...]
+// into the name and its tags, base64 encoded (b"...") categories and
+// values are decoded
+func parseStreamTags(metric string) (string, []tag) {
+	idx := strings.Index(metric, "|ST[")
+	if idx < 0 || !strings.HasSuffix(metric, "]") {
+		return metric, nil
+	}
+
+	name := metric[:idx]
+	var tags []tag
+	for _, st := range strings.Split(metric[idx+4:len(metric)-1], ",") {
+		if st == "" {
+			continue
+		}
+		t := tag{key: st}
+		if sep := strings.Index(st, ":"); sep >= 0 {
+			t.key = st[:sep]
+			t.val = st[sep+1:]
+		}
+		t.key = decodeTag(t.key)
+		t.val = decodeTag(t.val)
+		tags = append(tags, t)
+	}
+
+	return name, tags
+}
+
+func decodeTag(s string) string {
+	if !strings.HasPrefix(s, `b"`) || !strings.HasSuffix(s, `"`) || len(s) < 3 {
+		return s
+	}
+	dec, err := base64.StdEncoding.DecodeString(s[2 : len(s)-1])
+	if err != nil {
+		return s
+	}
+	return string(dec)
+}
+
+// quantileName returns the field name for a quantile, e.g. 0.999 is p99.9
+func quantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// encodeGraphite writes graphite plaintext, tags use the graphite 1.1 format
+//
+//	<name>[;<tag>=<val>...] <value> <timestamp>
+func (s *Sink) encodeGraphite(w io.Writer, ts time.Time, metrics cgm.Metrics) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range s.points(metrics) {
+		name := p.name
+		if p.field != "" {
+			name += s.separator + p.field
+		}
+		bw.WriteString(graphiteReplacer.Replace(name))
+		for _, t := range p.tags {
+			fmt.Fprintf(bw, ";%s=%s", graphiteTagReplacer.Replace(t.key), graphiteTagReplacer.Replace(t.val))
+		}
+		fmt.Fprintf(bw, " %s %d\n", formatValue(p.value), ts.Unix())
+	}
+	return bw.Flush()
+}
+
+var (
+	graphiteReplacer    = strings.NewReplacer(" ", "_", ";", "_")
+	graphiteTagReplacer = strings.NewReplacer(" ", "_", ";", "_", "=", "_", "~", "_")
+)
+
+// encodeInflux writes influxdb line protocol, histogram quantiles and
+// counts are fields of the measurement
+//
+//	<name>[,<tag>=<val>...] <field>=<value> <timestamp ns>
+func (s *Sink) encodeInflux(w io.Writer, ts time.Time, metrics cgm.Metrics) error {
+	bw := bufio.NewWriter(w)
+	pts := s.points(metrics)
+	for i := 0; i < len(pts); {
+		p := pts[i]
+		bw.WriteString(influxMeasurementReplacer.Replace(p.name))
+		for _, t := range p.tags {
+			if t.val == "" {
+				continue // influx does not allow empty tag values
+			}
+			fmt.Fprintf(bw, ",%s=%s", influxTagReplacer.Replace(t.key), influxTagReplacer.Replace(t.val))
+		}
+
+		// fields of consecutive points of the same metric are combined
+		sep := " "
+		for ; i < len(pts) && pts[i].name == p.name && sameTags(pts[i].tags, p.tags); i++ {
+			field := pts[i].field
+			if field == "" {
+				field = "value"
+			}
+			fmt.Fprintf(bw, "%s%s=%s", sep, influxTagReplacer.Replace(field), formatValue(pts[i].value))
+			sep = ","
+		}
+		fmt.Fprintf(bw, " %d\n", ts.UnixNano())
+	}
+	return bw.Flush()
+}
+
+var (
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagReplacer         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+func sameTags(a, b []tag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeOpenTSDB writes opentsdb telnet put commands, note opentsdb
+// requires at least one tag per metric (see Config.Tags)
+//
+//	put <name> <timestamp> <value> [<tag>=<val>...]
+func (s *Sink) encodeOpenTSDB(w io.Writer, ts time.Time, metrics cgm.Metrics) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range s.points(metrics) {
+		name := p.name
+		if p.field != "" {
+			name += s.separator + p.field
+		}
+		fmt.Fprintf(bw, "put %s %d %s", opentsdbName(name), ts.Unix(), formatValue(p.value))
+		for _, t := range p.tags {
+			if t.val == "" {
+				continue // opentsdb does not allow empty tag values
+			}
+			fmt.Fprintf(bw, " %s=%s", opentsdbName(t.key), opentsdbName(t.val))
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+type opentsdbPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// encodeOpenTSDBJSON writes the body of an opentsdb /api/put request
+func (s *Sink) encodeOpenTSDBJSON(w io.Writer, ts time.Time, metrics cgm.Metrics) error {
+	pts := s.points(metrics)
+	out := make([]opentsdbPoint, 0, len(pts))
+	for _, p := range pts {
+		name := p.name
+		if p.field != "" {
+			name += s.separator + p.field
+		}
+		op := opentsdbPoint{
+			Metric:    opentsdbName(name),
+			Timestamp: ts.Unix(),
+			Value:     p.value,
+			Tags:      make(map[string]string, len(p.tags)),
+		}
+		for _, t := range p.tags {
+			if t.val != "" {
+				op.Tags[opentsdbName(t.key)] = opentsdbName(t.val)
+			}
+		}
+		out = append(out, op)
+	}
+	return errors.Wrap(json.NewEncoder(w).Encode(out), "encoding opentsdb json")
+}
+
+// opentsdbName replaces characters opentsdb does not allow in metric names
+// and tags (a-z, A-Z, 0-9, -, _, ., / and unicode letters are allowed)
+func opentsdbName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-' || r == '_' || r == '.' || r == '/':
+			return r
+		case r > 127 && unicode.IsLetter(r):
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+var testTS = time.Unix(1500000000, 0)
+
+func testMetrics() cgm.Metrics {
+	return cgm.Metrics{
+		"requests":                    cgm.Metric{Type: "L", Value: uint64(10)},
+		"db`conns|ST[env:prod,az:1a]": cgm.Metric{Type: "i", Value: int32(3)},
+		"latency":                     cgm.Metric{Type: "n", Value: []string{"H[1.0e+00]=2", "H[2.0e+00]=2"}},
+		"version":                     cgm.Metric{Type: "s", Value: "1.0"},
+	}
+}
+
+func testSink(t *testing.T, cfg *Config) *Sink {
+	if cfg.URL == "" {
+		cfg.URL = "tcp://127.0.0.1:2003"
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return s
+}
+
+func encode(t *testing.T, s *Sink, metrics cgm.Metrics) []string {
+	var buf bytes.Buffer
+	if err := s.Encode(&buf, testTS, metrics); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func TestParseStreamTags(t *testing.T) {
+	t.Log("no tags")
+	{
+		name, tags := parseStreamTags("foo`bar")
+		if name != "foo`bar" || tags != nil {
+			t.Fatalf("Expected foo`bar, no tags, got '%s' %v", name, tags)
+		}
+	}
+
+	t.Log("tags")
+	{
+		name, tags := parseStreamTags(`foo|ST[a:1,b,b"Yzp4":b"eSx6"]`)
+		if name != "foo" {
+			t.Fatalf("Expected foo, got '%s'", name)
+		}
+		expected := []tag{{"a", "1"}, {"b", ""}, {"c:x", "y,z"}}
+		if !reflect.DeepEqual(tags, expected) {
+			t.Fatalf("Expected %v, got %v", expected, tags)
+		}
+	}
+}
+
+func TestQuantileName(t *testing.T) {
+	t.Log("quantile names")
+
+	tests := map[float64]string{
+		0.5:   "p50",
+		0.99:  "p99",
+		0.999: "p99.9",
+		1:     "p100",
+	}
+	for q, expected := range tests {
+		if name := quantileName(q); name != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, name)
+		}
+	}
+}
+
+func TestEncodeGraphite(t *testing.T) {
+	t.Log("graphite, tags")
+	{
+		s := testSink(t, &Config{Format: FormatGraphite, Quantiles: []float64{0.5}, Tags: map[string]string{"host": "a b"}})
+		lines := encode(t, s, testMetrics())
+		expected := []string{
+			"db.conns;az=1a;env=prod;host=a_b 3 1500000000",
+			"latency.count;host=a_b 4 1500000000",
+			"latency.p50;host=a_b",
+			"requests;host=a_b 10 1500000000",
+		}
+		if len(lines) != len(expected) {
+			t.Fatalf("Expected %d lines, got %v", len(expected), lines)
+		}
+		for i, line := range lines {
+			if !strings.HasPrefix(line, expected[i]) {
+				t.Fatalf("Expected '%s', got '%s'", expected[i], line)
+			}
+		}
+	}
+
+	t.Log("graphite, tags in name, prefix and separator")
+	{
+		s := testSink(t, &Config{Format: FormatGraphite, Prefix: "app`", Separator: "_", StreamTags: StreamTagsInName, Quantiles: []float64{0.5}})
+		lines := encode(t, s, cgm.Metrics{"db`conns|ST[env:prod]": cgm.Metric{Type: "L", Value: uint64(1)}})
+		expected := "app_db_conns_env_prod 1 1500000000"
+		if len(lines) != 1 || lines[0] != expected {
+			t.Fatalf("Expected '%s', got %v", expected, lines)
+		}
+	}
+
+	t.Log("graphite, drop tags")
+	{
+		s := testSink(t, &Config{Format: FormatGraphite, StreamTags: StreamTagsDrop})
+		lines := encode(t, s, cgm.Metrics{"db`conns|ST[env:prod]": cgm.Metric{Type: "L", Value: uint64(1)}})
+		expected := "db.conns 1 1500000000"
+		if len(lines) != 1 || lines[0] != expected {
+			t.Fatalf("Expected '%s', got %v", expected, lines)
+		}
+	}
+}
+
+func TestEncodeInflux(t *testing.T) {
+	t.Log("influx")
+
+	s := testSink(t, &Config{Format: FormatInflux, Quantiles: []float64{0.5, 0.99}})
+	lines := encode(t, s, testMetrics())
+	expected := []string{
+		"db.conns,az=1a,env=prod value=3 1500000000000000000",
+		"latency count=4,p50=",
+		"requests value=10 1500000000000000000",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %v", len(expected), lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Fatalf("Expected '%s', got '%s'", expected[i], line)
+		}
+	}
+	if !strings.Contains(lines[1], ",p99=") {
+		t.Fatalf("Expected p99 field, got '%s'", lines[1])
+	}
+
+	t.Log("influx, escaping")
+	{
+		lines := encode(t, s, cgm.Metrics{"a b,c|ST[k=1:v 2]": cgm.Metric{Type: "L", Value: uint64(1)}})
+		expected := `a\ b\,c,k\=1=v\ 2 value=1 1500000000000000000`
+		if len(lines) != 1 || lines[0] != expected {
+			t.Fatalf("Expected '%s', got %v", expected, lines)
+		}
+	}
+}
+
+func TestEncodeOpenTSDB(t *testing.T) {
+	t.Log("opentsdb telnet")
+	{
+		s := testSink(t, &Config{Format: FormatOpenTSDB, Quantiles: []float64{0.5}, Tags: map[string]string{"host": "web1"}})
+		lines := encode(t, s, testMetrics())
+		expected := []string{
+			"put db.conns 1500000000 3 az=1a env=prod host=web1",
+			"put latency.count 1500000000 4 host=web1",
+			"put latency.p50 1500000000 ",
+			"put requests 1500000000 10 host=web1",
+		}
+		if len(lines) != len(expected) {
+			t.Fatalf("Expected %d lines, got %v", len(expected), lines)
+		}
+		for i, line := range lines {
+			if !strings.HasPrefix(line, expected[i]) {
+				t.Fatalf("Expected '%s', got '%s'", expected[i], line)
+			}
+		}
+	}
+
+	t.Log("opentsdb json")
+	{
+		s := testSink(t, &Config{Format: FormatOpenTSDB, URL: "http://127.0.0.1:4242/api/put", Tags: map[string]string{"host": "web1"}})
+		var buf bytes.Buffer
+		if err := s.Encode(&buf, testTS, cgm.Metrics{"a b": cgm.Metric{Type: "L", Value: uint64(1)}}); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		var pts []opentsdbPoint
+		if err := json.Unmarshal(buf.Bytes(), &pts); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		expected := []opentsdbPoint{{Metric: "a_b", Timestamp: 1500000000, Value: 1, Tags: map[string]string{"host": "web1"}}}
+		if !reflect.DeepEqual(pts, expected) {
+			t.Fatalf("Expected %+v, got %+v", expected, pts)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sinks provides circonus-gometrics sinks which write the metrics
+// packaged at each flush to Graphite, InfluxDB or OpenTSDB.
+//
+// The destination URL selects the transport:
+//
+//	tcp://host:port          plaintext over a tcp connection (one per flush)
+//	udp://host:port          plaintext in datagrams (of at most MaxPacketSize bytes)
+//	http(s)://host/path      POST, e.g. http://influx:8086/write?db=app or
+//	                         http://opentsdb:4242/api/put (sent as json)
+//
+// Backtick separators in metric names are replaced (default: "."), stream
+// tags (|ST[cat:val,...]) are written as native tags, folded into the name or
+// dropped, and histograms are flattened into the configured quantiles and a count.
+// Text metrics are not written.
+//
+//	sink, err := sinks.New(&sinks.Config{Format: sinks.FormatGraphite, URL: "tcp://graphite:2003"})
+//	...
+//	metrics.RegisterSink("graphite", sink)
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+	"github.com/pkg/errors"
+)
+
+// Output formats
+const (
+	FormatGraphite = "graphite"
+	FormatInflux   = "influx"
+	FormatOpenTSDB = "opentsdb"
+)
+
+// Stream tag handling
+const (
+	StreamTagsAsTags = "tags" // write stream tags as native tags (graphite 1.1 format for graphite)
+	StreamTagsInName = "name" // fold stream tags into the metric name
+	StreamTagsDrop   = "drop" // discard stream tags
+)
+
+const (
+	defaultSeparator     = "."
+	defaultTimeout       = "10s"
+	defaultMaxPacketSize = 1432
+)
+
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Config options for a sink
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// Format of the output, graphite, influx or opentsdb
+	Format string
+	// URL of the destination, tcp://, udp://, http:// or https://
+	URL string
+	// Timeout for connecting and writing (or the http request), default 10 seconds
+	Timeout string
+	// MaxPacketSize largest udp datagram sent, in bytes (default: 1432)
+	MaxPacketSize int
+	// HTTPClient used for http(s) destinations (default: http.Client with Timeout)
+	HTTPClient *http.Client
+
+	// Prefix prepended to every metric name, e.g. "myapp`" (default: none)
+	Prefix string
+	// Separator replaces backticks in metric names (default: ".")
+	Separator string
+	// StreamTags handling, tags, name or drop (default: tags)
+	StreamTags string
+	// Tags added to every metric (e.g. host), stream tags take precedence
+	Tags map[string]string
+	// Quantiles histograms are flattened into (default: 0.5, 0.9, 0.99)
+	Quantiles []float64
+}
+
+// Sink writes metrics to a destination, it implements circonusgometrics.Sink
+type Sink struct {
+	Log   *log.Logger
+	Debug bool
+
+	format        string
+	url           *url.URL
+	timeout       time.Duration
+	maxPacketSize int
+	client        *http.Client
+	prefix        string
+	separator     string
+	streamTags    string
+	tags          []tag
+	quantiles     []float64
+	encode        func(w io.Writer, ts time.Time, metrics cgm.Metrics) error
+	contentType   string
+}
+
+// New returns a new sink
+func New(cfg *Config) (*Sink, error) {
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+
+	s := &Sink{
+		Debug:         cfg.Debug,
+		Log:           cfg.Log,
+		format:        cfg.Format,
+		maxPacketSize: defaultMaxPacketSize,
+		prefix:        cfg.Prefix,
+		separator:     defaultSeparator,
+		streamTags:    StreamTagsAsTags,
+		quantiles:     defaultQuantiles,
+		contentType:   "text/plain",
+	}
+
+	if s.Debug && s.Log == nil {
+		s.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if s.Log == nil {
+		s.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing url")
+	}
+	switch u.Scheme {
+	case "tcp", "udp":
+		if u.Host == "" {
+			return nil, errors.Errorf("invalid url, no host (%s)", cfg.URL)
+		}
+	case "http", "https":
+	default:
+		return nil, errors.Errorf("invalid url scheme (%s)", u.Scheme)
+	}
+	s.url = u
+
+	switch cfg.Format {
+	case FormatGraphite:
+		s.encode = s.encodeGraphite
+	case FormatInflux:
+		s.encode = s.encodeInflux
+	case FormatOpenTSDB:
+		s.encode = s.encodeOpenTSDB
+		if u.Scheme == "http" || u.Scheme == "https" {
+			s.encode = s.encodeOpenTSDBJSON
+			s.contentType = "application/json"
+		}
+	default:
+		return nil, errors.Errorf("invalid format (%s)", cfg.Format)
+	}
+
+	timeout := defaultTimeout
+	if cfg.Timeout != "" {
+		timeout = cfg.Timeout
+	}
+	dur, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing timeout")
+	}
+	if dur <= 0 {
+		return nil, errors.Errorf("invalid timeout (%s)", timeout)
+	}
+	s.timeout = dur
+
+	s.client = cfg.HTTPClient
+	if s.client == nil {
+		s.client = &http.Client{Timeout: s.timeout}
+	}
+
+	if cfg.MaxPacketSize < 0 {
+		return nil, errors.Errorf("invalid max packet size (%d)", cfg.MaxPacketSize)
+	}
+	if cfg.MaxPacketSize > 0 {
+		s.maxPacketSize = cfg.MaxPacketSize
+	}
+
+	if cfg.Separator != "" {
+		s.separator = cfg.Separator
+	}
+
+	switch cfg.StreamTags {
+	case "":
+	case StreamTagsAsTags, StreamTagsInName, StreamTagsDrop:
+		s.streamTags = cfg.StreamTags
+	default:
+		return nil, errors.Errorf("invalid stream tags option (%s)", cfg.StreamTags)
+	}
+
+	for k, v := range cfg.Tags {
+		s.tags = append(s.tags, tag{key: k, val: v})
+	}
+	sort.Slice(s.tags, func(i, j int) bool { return s.tags[i].key < s.tags[j].key })
+
+	if len(cfg.Quantiles) > 0 {
+		for _, q := range cfg.Quantiles {
+			if q < 0 || q > 1 {
+				return nil, errors.Errorf("invalid quantile (%v)", q)
+			}
+		}
+		s.quantiles = cfg.Quantiles
+	}
+
+	return s, nil
+}
+
+// Encode writes the metrics, in the format of the sink, to w
+func (s *Sink) Encode(w io.Writer, ts time.Time, metrics cgm.Metrics) error {
+	return s.encode(w, ts, metrics)
+}
+
+// Write sends the metrics to the destination of the sink
+func (s *Sink) Write(ts time.Time, metrics cgm.Metrics) error {
+	var buf bytes.Buffer
+	if err := s.encode(&buf, ts, metrics); err != nil {
+		return err
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	switch s.url.Scheme {
+	case "tcp":
+		return s.writeTCP(buf.Bytes())
+	case "udp":
+		return s.writeUDP(buf.Bytes())
+	}
+	return s.writeHTTP(buf.Bytes())
+}
+
+func (s *Sink) writeTCP(data []byte) error {
+	conn, err := net.DialTimeout("tcp", s.url.Host, s.timeout)
+	if err != nil {
+		return errors.Wrap(err, "connecting")
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return errors.Wrap(err, "setting deadline")
+	}
+	if _, err := conn.Write(data); err != nil {
+		return errors.Wrap(err, "writing")
+	}
+	return nil
+}
+
+// writeUDP sends the lines of data in as few datagrams as possible, a
+// single line larger than the max packet size is sent on its own
+func (s *Sink) writeUDP(data []byte) error {
+	conn, err := net.DialTimeout("udp", s.url.Host, s.timeout)
+	if err != nil {
+		return errors.Wrap(err, "connecting")
+	}
+	defer conn.Close()
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > s.maxPacketSize {
+			n = bytes.LastIndexByte(data[:s.maxPacketSize], '\n') + 1
+			if n == 0 {
+				n = bytes.IndexByte(data, '\n') + 1
+				if n == 0 {
+					n = len(data)
+				}
+			}
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return errors.Wrap(err, "writing")
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *Sink) writeHTTP(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", s.url.String(), bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", s.contentType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s (%s)", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sinks
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics"
+)
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config")
+	{
+		tests := []struct {
+			cfg *Config
+			err string
+		}{
+			{nil, "invalid configuration (nil)"},
+			{&Config{Format: "foo", URL: "tcp://127.0.0.1:2003"}, "invalid format (foo)"},
+			{&Config{Format: FormatGraphite, URL: "ftp://127.0.0.1"}, "invalid url scheme (ftp)"},
+			{&Config{Format: FormatGraphite, URL: "tcp://"}, "invalid url, no host (tcp://)"},
+			{&Config{Format: FormatGraphite, URL: "tcp://127.0.0.1:2003", Timeout: "0s"}, "invalid timeout (0s)"},
+			{&Config{Format: FormatGraphite, URL: "tcp://127.0.0.1:2003", StreamTags: "foo"}, "invalid stream tags option (foo)"},
+			{&Config{Format: FormatGraphite, URL: "tcp://127.0.0.1:2003", Quantiles: []float64{2}}, "invalid quantile (2)"},
+			{&Config{Format: FormatGraphite, URL: "tcp://127.0.0.1:2003", MaxPacketSize: -1}, "invalid max packet size (-1)"},
+		}
+		for _, test := range tests {
+			_, err := New(test.cfg)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("Expected '%s', got '%v'", test.err, err)
+			}
+		}
+	}
+
+	t.Log("defaults")
+	{
+		s, err := New(&Config{Format: FormatGraphite, URL: "tcp://127.0.0.1:2003"})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if s.separator != defaultSeparator {
+			t.Fatalf("Expected '%s', got '%s'", defaultSeparator, s.separator)
+		}
+		if s.timeout != 10*time.Second {
+			t.Fatalf("Expected 10s, got %v", s.timeout)
+		}
+		if len(s.quantiles) != 3 {
+			t.Fatalf("Expected 3 quantiles, got %v", s.quantiles)
+		}
+	}
+}
+
+func TestWriteTCP(t *testing.T) {
+	t.Log("tcp")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	s := testSink(t, &Config{Format: FormatGraphite, URL: "tcp://" + ln.Addr().String()})
+	if err := s.Write(testTS, cgm.Metrics{"foo": cgm.Metric{Type: "L", Value: uint64(1)}}); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	select {
+	case line := <-lines:
+		expected := "foo 1 1500000000"
+		if line != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a line")
+	}
+}
+
+func TestWriteUDP(t *testing.T) {
+	t.Log("udp, split into packets")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer conn.Close()
+
+	s := testSink(t, &Config{Format: FormatGraphite, URL: "udp://" + conn.LocalAddr().String(), MaxPacketSize: 40})
+	metrics := cgm.Metrics{
+		"foo": cgm.Metric{Type: "L", Value: uint64(1)},
+		"bar": cgm.Metric{Type: "L", Value: uint64(2)},
+		"baz": cgm.Metric{Type: "L", Value: uint64(3)},
+	}
+	if err := s.Write(testTS, metrics); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	expected := []string{
+		"bar 2 1500000000\nbaz 3 1500000000\n",
+		"foo 1 1500000000\n",
+	}
+	buf := make([]byte, 1024)
+	for _, exp := range expected {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if string(buf[:n]) != exp {
+			t.Fatalf("Expected '%s', got '%s'", exp, string(buf[:n]))
+		}
+	}
+}
+
+func TestWriteHTTP(t *testing.T) {
+	var body, contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		contentType = r.Header.Get("Content-Type")
+		if r.URL.Query().Get("db") == "missing" {
+			http.Error(w, "database not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	metrics := cgm.Metrics{"foo": cgm.Metric{Type: "L", Value: uint64(1)}}
+
+	t.Log("influx")
+	{
+		s := testSink(t, &Config{Format: FormatInflux, URL: ts.URL + "/write?db=app"})
+		if err := s.Write(testTS, metrics); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		expected := "foo value=1 1500000000000000000\n"
+		if body != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, body)
+		}
+		if contentType != "text/plain" {
+			t.Fatalf("Expected text/plain, got '%s'", contentType)
+		}
+	}
+
+	t.Log("opentsdb")
+	{
+		s := testSink(t, &Config{Format: FormatOpenTSDB, URL: ts.URL + "/api/put"})
+		if err := s.Write(testTS, metrics); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if !strings.HasPrefix(body, `[{"metric":"foo"`) {
+			t.Fatalf("Expected json, got '%s'", body)
+		}
+		if contentType != "application/json" {
+			t.Fatalf("Expected application/json, got '%s'", contentType)
+		}
+	}
+
+	t.Log("error response")
+	{
+		s := testSink(t, &Config{Format: FormatInflux, URL: ts.URL + "/write?db=missing"})
+		expectedError := "404 Not Found (database not found)"
+		if err := s.Write(testTS, metrics); err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected '%s', got '%v'", expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+// instrumentedDriver wraps a driver, instrumenting the connections it opens
+type instrumentedDriver struct {
+	driver driver.Driver
+	rec    *recorder
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn: conn, rec: d.rec}, nil
+}
+
+// instrumentedDriverContext is used when the wrapped driver is a driver.DriverContext
+type instrumentedDriverContext struct {
+	*instrumentedDriver
+	driverContext driver.DriverContext
+}
+
+func (d *instrumentedDriverContext) OpenConnector(name string) (driver.Connector, error) {
+	connector, err := d.driverContext.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConnector{connector: connector, driver: d}, nil
+}
+
+type instrumentedConnector struct {
+	connector driver.Connector
+	driver    *instrumentedDriverContext
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn: conn, rec: c.driver.rec}, nil
+}
+
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// instrumentedConn implements all of the optional connection interfaces, if
+// the wrapped connection does not, the database/sql fallback is triggered
+// with driver.ErrSkip or the database/sql default behavior is mimicked.
+type instrumentedConn struct {
+	conn driver.Conn
+	rec  *recorder
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	start := time.Now()
+	stmt, err := c.conn.Prepare(query)
+	c.rec.record("prepare", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt: stmt, conn: c.conn, rec: c.rec}, nil
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	cpc, ok := c.conn.(driver.ConnPrepareContext)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Prepare(query)
+	}
+
+	start := time.Now()
+	stmt, err := cpc.PrepareContext(ctx, query)
+	c.rec.record("prepare", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt: stmt, conn: c.conn, rec: c.rec}, nil
+}
+
+func (c *instrumentedConn) Close() error {
+	return c.conn.Close()
+}
+
+// Begin is deprecated (see driver.Conn), it is not called by database/sql
+// as BeginTx is implemented
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+
+	start := time.Now()
+	if cbt, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = cbt.BeginTx(ctx, opts)
+	} else {
+		// same restrictions database/sql applies to drivers without BeginTx
+		if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+			return nil, errors.New("sql: driver does not support non-default isolation level")
+		}
+		if opts.ReadOnly {
+			return nil, errors.New("sql: driver does not support read-only transactions")
+		}
+		if err = ctx.Err(); err == nil {
+			tx, err = c.conn.Begin()
+		}
+	}
+	c.rec.count("begin")
+	c.rec.record("begin", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{tx: tx, rec: c.rec}, nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	var err error
+
+	start := time.Now()
+	if ec, ok := c.conn.(driver.ExecerContext); ok {
+		res, err = ec.ExecContext(ctx, query, args)
+	} else if e, ok := c.conn.(driver.Execer); ok {
+		var vals []driver.Value
+		if vals, err = namedValueToValue(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				res, err = e.Exec(query, vals)
+			}
+		}
+	} else {
+		return nil, driver.ErrSkip
+	}
+	c.rec.record("exec", start, err)
+
+	return res, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	var err error
+
+	start := time.Now()
+	if qc, ok := c.conn.(driver.QueryerContext); ok {
+		rows, err = qc.QueryContext(ctx, query, args)
+	} else if q, ok := c.conn.(driver.Queryer); ok {
+		var vals []driver.Value
+		if vals, err = namedValueToValue(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				rows, err = q.Query(query, vals)
+			}
+		}
+	} else {
+		return nil, driver.ErrSkip
+	}
+	c.rec.record("query", start, err)
+
+	return rows, err
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip // database/sql default conversion
+}
+
+type instrumentedStmt struct {
+	stmt driver.Stmt
+	conn driver.Conn
+	rec  *recorder
+}
+
+func (s *instrumentedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *instrumentedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.stmt.Exec(args)
+	s.rec.record("exec", start, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.stmt.Query(args)
+	s.rec.record("query", start, err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	sec, ok := s.stmt.(driver.StmtExecContext)
+	if !ok {
+		vals, err := namedValueToValue(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Exec(vals)
+	}
+
+	start := time.Now()
+	res, err := sec.ExecContext(ctx, args)
+	s.rec.record("exec", start, err)
+	return res, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	sqc, ok := s.stmt.(driver.StmtQueryContext)
+	if !ok {
+		vals, err := namedValueToValue(args)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Query(vals)
+	}
+
+	start := time.Now()
+	rows, err := sqc.QueryContext(ctx, args)
+	s.rec.record("query", start, err)
+	return rows, err
+}
+
+func (s *instrumentedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// CheckNamedValue uses the statement's checker, then the connection's (as database/sql does)
+func (s *instrumentedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	if nvc, ok := s.conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type instrumentedTx struct {
+	tx  driver.Tx
+	rec *recorder
+}
+
+func (t *instrumentedTx) Commit() error {
+	start := time.Now()
+	err := t.tx.Commit()
+	t.rec.count("commit")
+	t.rec.record("commit", start, err)
+	return err
+}
+
+func (t *instrumentedTx) Rollback() error {
+	start := time.Now()
+	err := t.tx.Rollback()
+	t.rec.count("rollback")
+	t.rec.record("rollback", start, err)
+	return err
+}
+
+// namedValueToValue converts arguments for drivers without context support,
+// which do not support named parameters (as database/sql does)
+func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
+	args := make([]driver.Value, len(named))
+	for n, param := range named {
+		if len(param.Name) > 0 {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		args[n] = param.Value
+	}
+	return args, nil
+}
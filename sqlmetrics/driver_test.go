@@ -0,0 +1,217 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// testDriver is a minimal driver, without any of the optional interfaces
+type testDriver struct{}
+
+func (d *testDriver) Open(name string) (driver.Conn, error) {
+	if name == "fail" {
+		return nil, errors.New("open failed")
+	}
+	return &testConn{}, nil
+}
+
+type testConn struct{}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) {
+	if query == "bad" {
+		return nil, errors.New("syntax error")
+	}
+	return &testStmt{query: query}, nil
+}
+func (c *testConn) Close() error              { return nil }
+func (c *testConn) Begin() (driver.Tx, error) { return &testTx{}, nil }
+
+type testStmt struct {
+	query string
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.query == "fail" {
+		return nil, errors.New("exec failed")
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &testRows{}, nil
+}
+
+type testRows struct {
+	done bool
+}
+
+func (r *testRows) Columns() []string { return []string{"n"} }
+func (r *testRows) Close() error      { return nil }
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+type testTx struct{}
+
+func (t *testTx) Commit() error   { return nil }
+func (t *testTx) Rollback() error { return errors.New("rollback failed") }
+
+// testContextDriver has connections implementing the context interfaces
+type testContextDriver struct{}
+
+func (d *testContextDriver) Open(name string) (driver.Conn, error) {
+	return &testContextConn{}, nil
+}
+
+type testContextConn struct {
+	testConn
+}
+
+func (c *testContextConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if query == "fail" {
+		return nil, errors.New("exec failed")
+	}
+	return driver.RowsAffected(int64(len(args))), nil
+}
+
+func (c *testContextConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return &testRows{}, nil
+}
+
+func (c *testContextConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return &testTx{}, nil
+}
+
+var testDrivers int
+
+func testDB(t *testing.T, drv driver.Driver, dsn string) (*testRecorder, *sql.DB) {
+	r := newTestRecorder()
+	testDrivers++
+	name := fmt.Sprintf("cgm-test-%d", testDrivers)
+	Register(name, drv, r, &Options{Name: "test"})
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	return r, db
+}
+
+func TestInstrumentedConn(t *testing.T) {
+	t.Log("minimal driver, database/sql fallbacks")
+	{
+		r, db := testDB(t, &testDriver{}, "")
+		defer db.Close()
+
+		if _, err := db.Exec("insert", 1); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := db.Exec("fail"); err == nil {
+			t.Fatal("Expected error")
+		}
+		if _, err := db.Exec("bad"); err == nil {
+			t.Fatal("Expected error")
+		}
+		var n int
+		if err := db.QueryRow("select").Scan(&n); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if n != 1 {
+			t.Fatalf("Expected 1, got %d", n)
+		}
+		if _, err := db.Exec("insert", sql.Named("foo", 1)); err == nil {
+			t.Fatal("Expected named parameter error")
+		}
+
+		r.expectHistogram(t, "go`SQL`test`exec`latency", 2)
+		r.expectHistogram(t, "go`SQL`test`query`latency", 1)
+		r.expectHistogram(t, "go`SQL`test`prepare`latency", 5)
+		r.expectCounter(t, "go`SQL`test`exec`errors", 1)
+		r.expectCounter(t, "go`SQL`test`prepare`errors", 1)
+	}
+
+	t.Log("context driver")
+	{
+		r, db := testDB(t, &testContextDriver{}, "")
+		defer db.Close()
+
+		res, err := db.Exec("insert", 1, 2)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if n, _ := res.RowsAffected(); n != 2 {
+			t.Fatalf("Expected 2, got %d", n)
+		}
+		if _, err := db.Exec("fail"); err == nil {
+			t.Fatal("Expected error")
+		}
+		rows, err := db.Query("select")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		rows.Close()
+
+		r.expectHistogram(t, "go`SQL`test`exec`latency", 2)
+		r.expectHistogram(t, "go`SQL`test`query`latency", 1)
+		r.expectHistogram(t, "go`SQL`test`prepare`latency", 0)
+		r.expectCounter(t, "go`SQL`test`exec`errors", 1)
+	}
+}
+
+func TestInstrumentedTx(t *testing.T) {
+	t.Log("transactions")
+
+	r, db := testDB(t, &testDriver{}, "")
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if err := tx.Rollback(); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true}); err == nil {
+		t.Fatal("Expected read-only error")
+	}
+
+	r.expectCounter(t, "go`SQL`test`tx`begin", 2)
+	r.expectCounter(t, "go`SQL`test`tx`commit", 1)
+	r.expectCounter(t, "go`SQL`test`tx`rollback", 1)
+	r.expectCounter(t, "go`SQL`test`rollback`errors", 1)
+	r.expectHistogram(t, "go`SQL`test`begin`latency", 2)
+}
+
+func TestInstrumentedDriverOpen(t *testing.T) {
+	t.Log("open error")
+
+	_, db := testDB(t, &testDriver{}, "fail")
+	defer db.Close()
+
+	if err := db.Ping(); err == nil {
+		t.Fatal("Expected error")
+	}
+}
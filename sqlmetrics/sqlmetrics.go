@@ -0,0 +1,133 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sqlmetrics provides an instrumented database/sql/driver wrapper.
+//
+// Wrap (or Register) an existing driver to track, in seconds:
+//
+//	<prefix><name>`<op>`latency  histogram of latencies, op is one of
+//	                             query, exec, prepare, begin, commit, rollback
+//	<prefix><name>`<op>`errors   counter of failed operations
+//	<prefix><name>`tx`<op>       counter of begin, commit and rollback calls
+//
+// and RegisterDBStats to sample sql.DB.Stats() as gauges at each flush.
+//
+//	sqlmetrics.Register("postgres-cgm", &pq.Driver{}, metrics, &sqlmetrics.Options{Name: "users"})
+//	db, err := sql.Open("postgres-cgm", dsn)
+//	...
+//	sqlmetrics.RegisterDBStats(metrics, "users", db)
+package sqlmetrics
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"time"
+)
+
+const (
+	defaultPrefix = "go`SQL`"
+	defaultName   = "db"
+)
+
+// Recorder is the subset of CirconusMetrics used to record metrics
+type Recorder interface {
+	Increment(metric string)
+	RecordValue(metric string, val float64)
+	SetGaugeFunc(metric string, fn func() int64)
+}
+
+// Options for the instrumented driver
+type Options struct {
+	// Prefix for all metric names (default: go`SQL`)
+	Prefix string
+	// Name identifies the database in metric names (default: db)
+	Name string
+}
+
+// Register wraps drv and registers it with database/sql as driverName
+func Register(driverName string, drv driver.Driver, m Recorder, opts *Options) {
+	sql.Register(driverName, Wrap(drv, m, opts))
+}
+
+// Wrap returns an instrumented driver wrapping drv
+func Wrap(drv driver.Driver, m Recorder, opts *Options) driver.Driver {
+	d := &instrumentedDriver{
+		driver: drv,
+		rec:    newRecorder(m, opts),
+	}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		return &instrumentedDriverContext{instrumentedDriver: d, driverContext: dc}
+	}
+	return d
+}
+
+// RegisterDBStats registers gauge funcs sampling db.Stats() at each flush:
+//
+//	<prefix><name>`conns`open, in_use, idle and max_open
+//	<prefix><name>`conns`wait_count (total connections waited for)
+//	<prefix><name>`conns`wait_ns (total time blocked waiting for a connection)
+func RegisterDBStats(m Recorder, name string, db *sql.DB) {
+	RegisterDBStatsWithOptions(m, &Options{Name: name}, db)
+}
+
+// RegisterDBStatsWithOptions is RegisterDBStats using the Prefix and Name from opts
+func RegisterDBStatsWithOptions(m Recorder, opts *Options, db *sql.DB) {
+	base := newRecorder(m, opts).base + "conns`"
+
+	m.SetGaugeFunc(base+"open", func() int64 {
+		return int64(db.Stats().OpenConnections)
+	})
+	m.SetGaugeFunc(base+"in_use", func() int64 {
+		return int64(db.Stats().InUse)
+	})
+	m.SetGaugeFunc(base+"idle", func() int64 {
+		return int64(db.Stats().Idle)
+	})
+	m.SetGaugeFunc(base+"max_open", func() int64 {
+		return int64(db.Stats().MaxOpenConnections)
+	})
+	m.SetGaugeFunc(base+"wait_count", func() int64 {
+		return db.Stats().WaitCount
+	})
+	m.SetGaugeFunc(base+"wait_ns", func() int64 {
+		return int64(db.Stats().WaitDuration)
+	})
+}
+
+// recorder records operation metrics for one instrumented driver
+type recorder struct {
+	m    Recorder
+	base string
+}
+
+func newRecorder(m Recorder, opts *Options) *recorder {
+	prefix := defaultPrefix
+	name := defaultName
+	if opts != nil {
+		if opts.Prefix != "" {
+			prefix = opts.Prefix
+		}
+		if opts.Name != "" {
+			name = opts.Name
+		}
+	}
+	return &recorder{m: m, base: prefix + name + "`"}
+}
+
+// record tracks the latency of an operation and, if it failed, an error.
+// driver.ErrSkip is not an error, it directs database/sql to a fallback.
+func (r *recorder) record(op string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	r.m.RecordValue(r.base+op+"`latency", time.Since(start).Seconds())
+	if err != nil {
+		r.m.Increment(r.base + op + "`errors")
+	}
+}
+
+// count increments the counter for a transaction operation
+func (r *recorder) count(op string) {
+	r.m.Increment(r.base + "tx`" + op)
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlmetrics
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRecorder struct {
+	sync.Mutex
+	counters   map[string]uint64
+	histograms map[string][]float64
+	gauges     map[string]func() int64
+}
+
+func newTestRecorder() *testRecorder {
+	return &testRecorder{
+		counters:   make(map[string]uint64),
+		histograms: make(map[string][]float64),
+		gauges:     make(map[string]func() int64),
+	}
+}
+
+func (r *testRecorder) Increment(metric string) {
+	r.Lock()
+	defer r.Unlock()
+	r.counters[metric]++
+}
+
+func (r *testRecorder) RecordValue(metric string, val float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.histograms[metric] = append(r.histograms[metric], val)
+}
+
+func (r *testRecorder) SetGaugeFunc(metric string, fn func() int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.gauges[metric] = fn
+}
+
+func (r *testRecorder) expectCounter(t *testing.T, metric string, expected uint64) {
+	r.Lock()
+	defer r.Unlock()
+	if v := r.counters[metric]; v != expected {
+		t.Fatalf("Expected %s %d, found %d", metric, expected, v)
+	}
+}
+
+func (r *testRecorder) expectHistogram(t *testing.T, metric string, samples int) {
+	r.Lock()
+	defer r.Unlock()
+	if v := len(r.histograms[metric]); v != samples {
+		t.Fatalf("Expected %s %d samples, found %d", metric, samples, v)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	t.Log("defaults")
+	{
+		r := newTestRecorder()
+		rec := newRecorder(r, nil)
+		rec.record("exec", time.Now(), nil)
+		r.expectHistogram(t, "go`SQL`db`exec`latency", 1)
+		r.expectCounter(t, "go`SQL`db`exec`errors", 0)
+	}
+
+	t.Log("error")
+	{
+		r := newTestRecorder()
+		rec := newRecorder(r, &Options{Prefix: "sql`", Name: "users"})
+		rec.record("query", time.Now(), errors.New("failed"))
+		r.expectHistogram(t, "sql`users`query`latency", 1)
+		r.expectCounter(t, "sql`users`query`errors", 1)
+	}
+
+	t.Log("skip")
+	{
+		r := newTestRecorder()
+		rec := newRecorder(r, nil)
+		rec.record("exec", time.Now(), driver.ErrSkip)
+		r.expectHistogram(t, "go`SQL`db`exec`latency", 0)
+		r.expectCounter(t, "go`SQL`db`exec`errors", 0)
+	}
+}
+
+func TestRegisterDBStats(t *testing.T) {
+	t.Log("db stats gauges")
+
+	_, db := testDB(t, &testDriver{}, "")
+	defer db.Close()
+	db.SetMaxOpenConns(5)
+
+	conn, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer conn.Commit()
+
+	r := newTestRecorder()
+	RegisterDBStats(r, "test", db)
+
+	expected := map[string]int64{
+		"go`SQL`test`conns`open":       1,
+		"go`SQL`test`conns`in_use":     1,
+		"go`SQL`test`conns`idle":       0,
+		"go`SQL`test`conns`max_open":   5,
+		"go`SQL`test`conns`wait_count": 0,
+		"go`SQL`test`conns`wait_ns":    0,
+	}
+	for name, val := range expected {
+		fn, ok := r.gauges[name]
+		if !ok {
+			t.Fatalf("Expected gauge %s", name)
+		}
+		if v := fn(); v != val {
+			t.Fatalf("Expected %s %d, found %d", name, val, v)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package statsd
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// statsd metric types
+const (
+	typeCounter      = "c"
+	typeGauge        = "g"
+	typeTimer        = "ms"
+	typeHistogram    = "h"
+	typeDistribution = "d"
+	typeSet          = "s"
+)
+
+// sample is one parsed statsd line
+type sample struct {
+	name string    // metric name, including stream tags
+	typ  string    // statsd metric type
+	vals []float64 // numeric values (counters, gauges, timers)
+	raw  []string  // raw values
+	rate float64   // sample rate, 1 if not sampled
+}
+
+// parseLine parses a single statsd line, with the DogStatsD extensions
+// for tags and multiple values:
+//
+//	<name>:<value>[:<value>...]|<type>[|@<rate>][|#<tag>[:<val>],...]
+func parseLine(line string) (*sample, error) {
+	sep := strings.Index(line, ":")
+	if sep < 1 {
+		return nil, errors.Errorf("invalid line, no name (%s)", line)
+	}
+
+	s := &sample{name: line[:sep], rate: 1}
+
+	fields := strings.Split(line[sep+1:], "|")
+	if len(fields) < 2 || fields[0] == "" {
+		return nil, errors.Errorf("invalid line, no value or type (%s)", line)
+	}
+
+	s.typ = fields[1]
+	switch s.typ {
+	case typeCounter, typeGauge, typeTimer, typeHistogram, typeDistribution, typeSet:
+	default:
+		return nil, errors.Errorf("invalid metric type (%s)", s.typ)
+	}
+
+	var tags []string
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing sample rate")
+			}
+			if rate <= 0 || rate > 1 {
+				return nil, errors.Errorf("invalid sample rate (%s)", field[1:])
+			}
+			s.rate = rate
+		case strings.HasPrefix(field, "#"):
+			tags = append(tags, strings.Split(field[1:], ",")...)
+		default:
+			// other extensions (e.g. container id) are ignored
+		}
+	}
+	s.name += streamTags(tags)
+
+	if s.typ == typeSet {
+		// set members are opaque, they may contain ':'
+		s.raw = []string{fields[0]}
+		return s, nil
+	}
+
+	s.raw = strings.Split(fields[0], ":")
+
+	for _, raw := range s.raw {
+		if raw == "" {
+			return nil, errors.Errorf("invalid line, empty value (%s)", line)
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing value")
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, errors.Errorf("invalid value (%s)", raw)
+		}
+		if s.typ == typeCounter && v < 0 {
+			return nil, errors.Errorf("invalid counter value (%s), counters cannot be decremented", raw)
+		}
+		s.vals = append(s.vals, v)
+	}
+
+	return s, nil
+}
+
+// isDelta reports whether a gauge value is a +/- delta, a gauge cannot be set
+// to a negative value directly (as with statsd, set it to 0 then -value)
+func isDelta(raw string) bool {
+	return strings.HasPrefix(raw, "+") || strings.HasPrefix(raw, "-")
+}
+
+// streamTags returns the tags formatted as circonus stream tags,
+// |ST[<cat>:<val>,...], sorted, with duplicates removed
+func streamTags(tags []string) string {
+	seen := make(map[string]bool, len(tags))
+	uniq := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		uniq = append(uniq, tag)
+	}
+	if len(uniq) == 0 {
+		return ""
+	}
+	sort.Strings(uniq)
+	return "|ST[" + strings.Join(uniq, ",") + "]"
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package statsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	t.Log("valid lines")
+	{
+		tests := []struct {
+			line string
+			name string
+			typ  string
+			vals []float64
+			raw  []string
+			rate float64
+		}{
+			{"foo:1|c", "foo", typeCounter, []float64{1}, []string{"1"}, 1},
+			{"foo:1|c|@0.1", "foo", typeCounter, []float64{1}, []string{"1"}, 0.1},
+			{"foo:-2|g", "foo", typeGauge, []float64{-2}, []string{"-2"}, 1},
+			{"foo:+2.5|g", "foo", typeGauge, []float64{2.5}, []string{"+2.5"}, 1},
+			{"foo:320|ms|@0.5", "foo", typeTimer, []float64{320}, []string{"320"}, 0.5},
+			{"foo:1:2:3|h", "foo", typeHistogram, []float64{1, 2, 3}, []string{"1", "2", "3"}, 1},
+			{"foo:4|d", "foo", typeDistribution, []float64{4}, []string{"4"}, 1},
+			{"foo:user:1|s", "foo", typeSet, nil, []string{"user:1"}, 1},
+			{"foo:1|c|#env:prod,az:1a", "foo|ST[az:1a,env:prod]", typeCounter, []float64{1}, []string{"1"}, 1},
+			{"foo:1|c|@0.5|#b,a,b|c:abc", "foo|ST[a,b]", typeCounter, []float64{1}, []string{"1"}, 0.5},
+		}
+
+		for _, test := range tests {
+			s, err := parseLine(test.line)
+			if err != nil {
+				t.Fatalf("Expected no error, got '%v' (%s)", err, test.line)
+			}
+			if s.name != test.name {
+				t.Fatalf("Expected name '%s', got '%s'", test.name, s.name)
+			}
+			if s.typ != test.typ {
+				t.Fatalf("Expected type '%s', got '%s'", test.typ, s.typ)
+			}
+			if !reflect.DeepEqual(s.vals, test.vals) {
+				t.Fatalf("Expected values %v, got %v (%s)", test.vals, s.vals, test.line)
+			}
+			if !reflect.DeepEqual(s.raw, test.raw) {
+				t.Fatalf("Expected raw values %v, got %v (%s)", test.raw, s.raw, test.line)
+			}
+			if s.rate != test.rate {
+				t.Fatalf("Expected rate %f, got %f", test.rate, s.rate)
+			}
+		}
+	}
+
+	t.Log("invalid lines")
+	{
+		tests := []string{
+			"foo",
+			":1|c",
+			"foo:1",
+			"foo:|c",
+			"foo:1|x",
+			"foo:abc|c",
+			"foo:1::2|ms",
+			"foo:-1|c",
+			"foo:NaN|g",
+			"foo:1|c|@abc",
+			"foo:1|c|@0",
+			"foo:1|c|@2",
+		}
+
+		for _, line := range tests {
+			if _, err := parseLine(line); err == nil {
+				t.Fatalf("Expected error (%s)", line)
+			}
+		}
+	}
+}
+
+func TestIsDelta(t *testing.T) {
+	t.Log("gauge deltas")
+
+	tests := map[string]bool{
+		"1":   false,
+		"1.5": false,
+		"+1":  true,
+		"-1":  true,
+	}
+
+	for raw, expected := range tests {
+		if isDelta(raw) != expected {
+			t.Fatalf("Expected %v for '%s'", expected, raw)
+		}
+	}
+}
+
+func TestStreamTags(t *testing.T) {
+	t.Log("no tags")
+	{
+		if st := streamTags(nil); st != "" {
+			t.Fatalf("Expected '', got '%s'", st)
+		}
+		if st := streamTags([]string{"", " "}); st != "" {
+			t.Fatalf("Expected '', got '%s'", st)
+		}
+	}
+
+	t.Log("sorted, unique")
+	{
+		expected := "|ST[a:1,b:2]"
+		if st := streamTags([]string{"b:2", "a:1", " b:2"}); st != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, st)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package statsd provides an embedded StatsD listener feeding circonus-gometrics.
+//
+// Lines received over UDP (and optionally TCP or a unix datagram socket) are
+// mapped onto the metrics of the check:
+//
+//	counters (c)                        Add, scaled by the sample rate
+//	gauges (g)                          SetGauge, +/- deltas are applied to the last value received
+//	timers (ms), histograms (h, d)      RecordValue, or RecordCountForValue when sampled
+//	sets (s)                            a gauge of the unique values seen since the last flush
+//
+// The set gauges are removed from the metrics when the listener is stopped.
+//
+// DogStatsD tags (|#tag:val,...) are added to the metric name as stream tags.
+//
+// The listener tracks its own activity as cgm`statsd`packets, cgm`statsd`packet_size
+// (histogram of bytes) and cgm`statsd`parse_errors. Each line of a TCP stream
+// is counted as a packet.
+package statsd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultUDPAddr       = "127.0.0.1:8125"
+	defaultMaxPacketSize = 65535
+
+	metricPackets     = "cgm`statsd`packets"
+	metricPacketSize  = "cgm`statsd`packet_size"
+	metricParseErrors = "cgm`statsd`parse_errors"
+)
+
+// Metrics is the subset of CirconusMetrics the listener records to
+type Metrics interface {
+	Increment(metric string)
+	Add(metric string, val uint64)
+	SetGauge(metric string, val interface{})
+	SetGaugeFunc(metric string, fn func() int64)
+	RemoveGaugeFunc(metric string)
+	RecordValue(metric string, val float64)
+	RecordCountForValue(metric string, val float64, n int64)
+}
+
+// Config options for the statsd listener
+type Config struct {
+	Log   *log.Logger
+	Debug bool
+
+	// UDPAddr address to listen on for UDP packets (default: 127.0.0.1:8125)
+	UDPAddr string
+	// TCPAddr optional address to listen on for newline delimited TCP streams
+	TCPAddr string
+	// UnixAddr optional path of a unix datagram socket to listen on
+	UnixAddr string
+	// Prefix prepended to every metric name, e.g. "statsd`" (default: none)
+	Prefix string
+	// MaxPacketSize largest datagram or TCP line accepted, in bytes (default: 65535)
+	MaxPacketSize int
+}
+
+// Server is a statsd listener
+type Server struct {
+	Log   *log.Logger
+	Debug bool
+
+	metrics       Metrics
+	udpAddr       string
+	tcpAddr       string
+	unixAddr      string
+	prefix        string
+	maxPacketSize int
+
+	mu       sync.Mutex
+	running  bool
+	udpConn  net.PacketConn
+	unixConn net.PacketConn
+	tcpLn    net.Listener
+	tcpConns map[net.Conn]bool
+	wg       sync.WaitGroup
+	gaugesmu sync.Mutex
+	gauges   map[string]float64
+	setsmu   sync.Mutex
+	sets     map[string]map[string]bool
+}
+
+// New returns a new statsd listener recording to m, call Start to begin listening
+func New(m Metrics, cfg *Config) (*Server, error) {
+	if m == nil {
+		return nil, errors.New("invalid metrics (nil)")
+	}
+	if cfg == nil {
+		return nil, errors.New("invalid configuration (nil)")
+	}
+
+	s := &Server{
+		Debug:         cfg.Debug,
+		Log:           cfg.Log,
+		metrics:       m,
+		udpAddr:       defaultUDPAddr,
+		tcpAddr:       cfg.TCPAddr,
+		unixAddr:      cfg.UnixAddr,
+		prefix:        cfg.Prefix,
+		maxPacketSize: defaultMaxPacketSize,
+		tcpConns:      make(map[net.Conn]bool),
+		gauges:        make(map[string]float64),
+		sets:          make(map[string]map[string]bool),
+	}
+
+	if s.Debug && s.Log == nil {
+		s.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	if s.Log == nil {
+		s.Log = log.New(ioutil.Discard, "", log.LstdFlags)
+	}
+
+	if cfg.UDPAddr != "" {
+		s.udpAddr = cfg.UDPAddr
+	}
+	if cfg.MaxPacketSize < 0 {
+		return nil, errors.Errorf("invalid max packet size (%d)", cfg.MaxPacketSize)
+	}
+	if cfg.MaxPacketSize > 0 {
+		s.maxPacketSize = cfg.MaxPacketSize
+	}
+
+	return s, nil
+}
+
+// Start opens the listeners and begins processing metrics
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("already running")
+	}
+
+	udpConn, err := net.ListenPacket("udp", s.udpAddr)
+	if err != nil {
+		return errors.Wrap(err, "listening udp")
+	}
+
+	var tcpLn net.Listener
+	if s.tcpAddr != "" {
+		tcpLn, err = net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			udpConn.Close()
+			return errors.Wrap(err, "listening tcp")
+		}
+	}
+
+	var unixConn net.PacketConn
+	if s.unixAddr != "" {
+		unixConn, err = net.ListenPacket("unixgram", s.unixAddr)
+		if err != nil {
+			udpConn.Close()
+			if tcpLn != nil {
+				tcpLn.Close()
+			}
+			return errors.Wrap(err, "listening unixgram")
+		}
+	}
+
+	s.udpConn = udpConn
+	s.tcpLn = tcpLn
+	s.unixConn = unixConn
+	s.running = true
+
+	s.wg.Add(1)
+	go s.servePackets(udpConn)
+	if tcpLn != nil {
+		s.wg.Add(1)
+		go s.serveTCP(tcpLn)
+	}
+	if unixConn != nil {
+		s.wg.Add(1)
+		go s.servePackets(unixConn)
+	}
+
+	return nil
+}
+
+// Stop closes the listeners, waits for in progress packets to be processed
+// and removes the set gauges
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+
+	s.udpConn.Close()
+	if s.tcpLn != nil {
+		s.tcpLn.Close()
+	}
+	for conn := range s.tcpConns {
+		conn.Close()
+	}
+	if s.unixConn != nil {
+		s.unixConn.Close()
+		os.Remove(s.unixAddr)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.setsmu.Lock()
+	sets := s.sets
+	s.sets = make(map[string]map[string]bool)
+	s.setsmu.Unlock()
+
+	for name := range sets {
+		s.metrics.RemoveGaugeFunc(name)
+	}
+
+	return nil
+}
+
+// UDPAddr returns the address of the udp listener, nil if not started
+func (s *Server) UDPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
+
+// TCPAddr returns the address of the tcp listener, nil if not enabled or not started
+func (s *Server) TCPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tcpLn == nil {
+		return nil
+	}
+	return s.tcpLn.Addr()
+}
+
+func (s *Server) servePackets(conn net.PacketConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, s.maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if n > 0 {
+			s.handlePacket(buf[:n])
+		}
+		if err != nil {
+			if s.isRunning() {
+				s.Log.Printf("[ERROR] reading packet, %v", err)
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (s *Server) serveTCP(ln net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isRunning() {
+				s.Log.Printf("[ERROR] accepting connection, %v", err)
+				continue
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if !s.running {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.tcpConns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.tcpConns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), s.maxPacketSize)
+	for scanner.Scan() {
+		s.handlePacket(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil && s.isRunning() {
+		s.Log.Printf("[ERROR] reading %s, %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *Server) isRunning() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// handlePacket processes the newline delimited lines in a packet
+func (s *Server) handlePacket(packet []byte) {
+	s.metrics.Increment(metricPackets)
+	s.metrics.RecordValue(metricPacketSize, float64(len(packet)))
+
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+			// DogStatsD events and service checks are not metrics
+			if s.Debug {
+				s.Log.Printf("[DEBUG] ignoring event/service check %s", line)
+			}
+			continue
+		}
+		if err := s.handleLine(line); err != nil {
+			s.metrics.Increment(metricParseErrors)
+			if s.Debug {
+				s.Log.Printf("[DEBUG] %v", err)
+			}
+		}
+	}
+}
+
+// handleLine parses a line and records its value(s)
+func (s *Server) handleLine(line string) error {
+	sample, err := parseLine(line)
+	if err != nil {
+		return err
+	}
+
+	name := s.prefix + sample.name
+
+	switch sample.typ {
+	case typeCounter:
+		for _, v := range sample.vals {
+			s.metrics.Add(name, uint64(math.Round(v/sample.rate)))
+		}
+	case typeGauge:
+		for i, v := range sample.vals {
+			s.metrics.SetGauge(name, s.updateGauge(name, v, isDelta(sample.raw[i])))
+		}
+	case typeTimer, typeHistogram, typeDistribution:
+		n := int64(math.Round(1 / sample.rate))
+		for _, v := range sample.vals {
+			if n > 1 {
+				s.metrics.RecordCountForValue(name, v, n)
+			} else {
+				s.metrics.RecordValue(name, v)
+			}
+		}
+	case typeSet:
+		s.addSetMember(name, sample.raw[0])
+	}
+
+	return nil
+}
+
+// updateGauge returns the new value of a gauge, a delta is applied to the
+// last value received rather than the metric's value, which is cleared at
+// each flush when gauges are reset
+func (s *Server) updateGauge(name string, v float64, delta bool) float64 {
+	s.gaugesmu.Lock()
+	defer s.gaugesmu.Unlock()
+
+	if delta {
+		v += s.gauges[name]
+	}
+	s.gauges[name] = v
+
+	return v
+}
+
+// addSetMember adds a member to a set, the first time a set is seen a gauge
+// func is registered which reports (and resets) the number of unique members
+func (s *Server) addSetMember(name, member string) {
+	s.setsmu.Lock()
+	set, ok := s.sets[name]
+	if !ok {
+		set = make(map[string]bool)
+		s.sets[name] = set
+	}
+	set[member] = true
+	s.setsmu.Unlock()
+
+	// registered without holding setsmu, the func is called during a
+	// flush while the metrics gauge func lock is held
+	if !ok {
+		s.metrics.SetGaugeFunc(name, func() int64 {
+			s.setsmu.Lock()
+			defer s.setsmu.Unlock()
+			n := len(s.sets[name])
+			s.sets[name] = make(map[string]bool)
+			return int64(n)
+		})
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package statsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	sync.Mutex
+	counters   map[string]uint64
+	gauges     map[string]float64
+	gaugeFuncs map[string]func() int64
+	histograms map[string]int64
+	values     map[string][]float64
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counters:   make(map[string]uint64),
+		gauges:     make(map[string]float64),
+		gaugeFuncs: make(map[string]func() int64),
+		histograms: make(map[string]int64),
+		values:     make(map[string][]float64),
+	}
+}
+
+func (m *testMetrics) Increment(metric string) {
+	m.Add(metric, 1)
+}
+
+func (m *testMetrics) Add(metric string, val uint64) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[metric] += val
+}
+
+func (m *testMetrics) SetGauge(metric string, val interface{}) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges[metric] = val.(float64)
+}
+
+func (m *testMetrics) RemoveGaugeFunc(metric string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.gaugeFuncs, metric)
+}
+
+func (m *testMetrics) SetGaugeFunc(metric string, fn func() int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.gaugeFuncs[metric] = fn
+}
+
+func (m *testMetrics) RecordValue(metric string, val float64) {
+	m.RecordCountForValue(metric, val, 1)
+}
+
+func (m *testMetrics) RecordCountForValue(metric string, val float64, n int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.histograms[metric] += n
+	m.values[metric] = append(m.values[metric], val)
+}
+
+func (m *testMetrics) counter(metric string) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[metric]
+}
+
+// waitFor waits for the packets counter to reach n
+func (m *testMetrics) waitFor(t *testing.T, n uint64) {
+	for i := 0; i < 200; i++ {
+		if m.counter(metricPackets) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d packets, got %d", n, m.counter(metricPackets))
+}
+
+func TestNew(t *testing.T) {
+	t.Log("invalid config")
+	{
+		if _, err := New(newTestMetrics(), nil); err == nil {
+			t.Fatal("Expected error")
+		}
+		if _, err := New(nil, &Config{}); err == nil {
+			t.Fatal("Expected error")
+		}
+		expectedError := "invalid max packet size (-1)"
+		_, err := New(newTestMetrics(), &Config{MaxPacketSize: -1})
+		if err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected '%s', got '%v'", expectedError, err)
+		}
+	}
+
+	t.Log("defaults")
+	{
+		s, err := New(newTestMetrics(), &Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if s.udpAddr != defaultUDPAddr {
+			t.Fatalf("Expected '%s', got '%s'", defaultUDPAddr, s.udpAddr)
+		}
+		if s.maxPacketSize != defaultMaxPacketSize {
+			t.Fatalf("Expected %d, got %d", defaultMaxPacketSize, s.maxPacketSize)
+		}
+	}
+}
+
+func TestHandlePacket(t *testing.T) {
+	m := newTestMetrics()
+	s, err := New(m, &Config{Prefix: "sd`"})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	t.Log("counters")
+	{
+		s.handlePacket([]byte("hits:1|c\nhits:2|c|@0.5\nhits:1|c|#env:prod\n"))
+		if v := m.counter("sd`hits"); v != 5 {
+			t.Fatalf("Expected 5, got %d", v)
+		}
+		if v := m.counter("sd`hits|ST[env:prod]"); v != 1 {
+			t.Fatalf("Expected 1, got %d", v)
+		}
+	}
+
+	t.Log("gauges")
+	{
+		s.handlePacket([]byte("temp:10|g\ntemp:+5|g\ntemp:-3|g"))
+		if v := m.gauges["sd`temp"]; v != 12 {
+			t.Fatalf("Expected 12, got %f", v)
+		}
+		s.handlePacket([]byte("temp:1|g"))
+		if v := m.gauges["sd`temp"]; v != 1 {
+			t.Fatalf("Expected 1, got %f", v)
+		}
+		// gauges reset at flush
+		delete(m.gauges, "sd`temp")
+		s.handlePacket([]byte("temp:+2|g"))
+		if v := m.gauges["sd`temp"]; v != 3 {
+			t.Fatalf("Expected 3, got %f", v)
+		}
+	}
+
+	t.Log("timers")
+	{
+		s.handlePacket([]byte("rt:10|ms\nrt:20|ms|@0.1\nsize:1:2|h"))
+		if v := m.histograms["sd`rt"]; v != 11 {
+			t.Fatalf("Expected 11, got %d", v)
+		}
+		if v := m.histograms["sd`size"]; v != 2 {
+			t.Fatalf("Expected 2, got %d", v)
+		}
+	}
+
+	t.Log("sets")
+	{
+		s.handlePacket([]byte("users:a|s\nusers:b|s\nusers:a|s"))
+		fn, ok := m.gaugeFuncs["sd`users"]
+		if !ok {
+			t.Fatal("Expected set gauge func")
+		}
+		if v := fn(); v != 2 {
+			t.Fatalf("Expected 2, got %d", v)
+		}
+		if v := fn(); v != 0 {
+			t.Fatalf("Expected 0 after reset, got %d", v)
+		}
+		s.handlePacket([]byte("users:c|s"))
+		if v := fn(); v != 1 {
+			t.Fatalf("Expected 1, got %d", v)
+		}
+	}
+
+	t.Log("parse errors, events")
+	{
+		before := m.counter(metricParseErrors)
+		s.handlePacket([]byte("bad\nbad:x|c\n_e{5,4}:title|text\n_sc|svc|0"))
+		if v := m.counter(metricParseErrors) - before; v != 2 {
+			t.Fatalf("Expected 2 parse errors, got %d", v)
+		}
+	}
+
+	t.Log("self metrics")
+	{
+		if v := m.counter(metricPackets); v != 8 {
+			t.Fatalf("Expected 8 packets, got %d", v)
+		}
+		if v := m.histograms[metricPacketSize]; v != 8 {
+			t.Fatalf("Expected 8 packet sizes, got %d", v)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgm-statsd")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "statsd.sock")
+
+	m := newTestMetrics()
+	s, err := New(m, &Config{
+		UDPAddr:  "127.0.0.1:0",
+		TCPAddr:  "127.0.0.1:0",
+		UnixAddr: sock,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer s.Stop()
+
+	t.Log("already running")
+	{
+		expectedError := "already running"
+		if err := s.Start(); err == nil || err.Error() != expectedError {
+			t.Fatalf("Expected '%s', got '%v'", expectedError, err)
+		}
+	}
+
+	t.Log("udp")
+	{
+		conn, err := net.Dial("udp", s.UDPAddr().String())
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		fmt.Fprint(conn, "udp:1|c")
+		conn.Close()
+		m.waitFor(t, 1)
+		if v := m.counter("udp"); v != 1 {
+			t.Fatalf("Expected 1, got %d", v)
+		}
+	}
+
+	t.Log("tcp")
+	{
+		conn, err := net.Dial("tcp", s.TCPAddr().String())
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		fmt.Fprint(conn, "tcp:1|c\ntcp:2|c\n")
+		conn.Close()
+		m.waitFor(t, 3)
+		if v := m.counter("tcp"); v != 3 {
+			t.Fatalf("Expected 3, got %d", v)
+		}
+	}
+
+	t.Log("unixgram")
+	{
+		conn, err := net.Dial("unixgram", sock)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		fmt.Fprint(conn, "unix:1|c\nunix_users:a|s")
+		conn.Close()
+		m.waitFor(t, 4)
+		if v := m.counter("unix"); v != 1 {
+			t.Fatalf("Expected 1, got %d", v)
+		}
+	}
+
+	t.Log("stop")
+	{
+		if err := s.Stop(); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if _, err := os.Stat(sock); !os.IsNotExist(err) {
+			t.Fatalf("Expected socket to be removed, got '%v'", err)
+		}
+		m.Lock()
+		_, ok := m.gaugeFuncs["unix_users"]
+		m.Unlock()
+		if ok {
+			t.Fatal("Expected set gauge func removed")
+		}
+	}
+}
@@ -148,17 +148,22 @@ func (m *CirconusMetrics) trapCall(payload []byte) (int, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
+		if attempts == client.RetryMax {
+			// may fail over to another broker instance (or refresh the trap)
+			m.check.ReportSubmission(err)
+		}
 		if lastHTTPError != nil {
 			return 0, fmt.Errorf("[ERROR] submitting: %+v %+v", err, lastHTTPError)
 		}
-		if attempts == client.RetryMax {
-			m.check.RefreshTrap()
-		}
 		return 0, errors.Wrap(err, "trap call")
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
+		m.check.ReportSubmission(nil)
+	}
+
 	// no content - expected result from
 	// circonus-agent when metrics accepted
 	if resp.StatusCode == http.StatusNoContent {
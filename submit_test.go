@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/circonus-labs/circonus-gometrics/api"
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
 )
 
 func fakeBroker() *httptest.Server {
@@ -87,3 +88,52 @@ func TestTrapCall(t *testing.T) {
 		t.Errorf("Expected 1, got %d", numStats)
 	}
 }
+
+func TestSubmitTLS(t *testing.T) {
+	t.Log("Testing submit.submit [tls, broker ca]")
+
+	broker, err := brokertest.New(&brokertest.Config{TLS: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	defer broker.Close()
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = broker.SubmissionURL("uuid", "secret")
+	cfg.CheckManager.Broker.TLSConfig = broker.TLSConfig()
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	for !cm.check.IsReady() {
+		t.Log("\twaiting for cm to init")
+		time.Sleep(1 * time.Second)
+	}
+
+	cm.RecordValue("bar", 1)
+	bar, err := cm.GetHistogramTest("bar")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	cm.submit(Metrics{"foo": Metric{Type: "L", Value: uint64(2)}, "bar": Metric{Type: "n", Value: bar}}, nil)
+
+	s, ok := broker.Last()
+	if !ok {
+		t.Fatal("Expected a submission")
+	}
+	if s.UUID != "uuid" {
+		t.Fatalf("Expected uuid, got '%s'", s.UUID)
+	}
+	if v, err := s.Number("foo"); err != nil || v != 2 {
+		t.Fatalf("Expected 2, got %v (%v)", v, err)
+	}
+	bins, err := s.Histogram("bar")
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if len(bins) != 1 || bins[0].Value != 1 || bins[0].Count != 1 {
+		t.Fatalf("Expected [{1 1}], got %v", bins)
+	}
+}
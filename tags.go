@@ -0,0 +1,67 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+)
+
+// Tag is a stream tag, a category and an optional value. Stream tags are
+// appended to a metric name, name|ST[cat:val,...], each unique set of tags
+// is a separate stream of the metric.
+type Tag struct {
+	Category string
+	Value    string
+}
+
+// Tags is a list of stream tags
+type Tags []Tag
+
+// MetricNameWithStreamTags returns the metric name with the stream tags
+// appended, e.g. foo|ST[env:prod,zone:1a]. Tags are sorted and duplicates
+// removed. A category or value containing characters other than letters,
+// digits and _-./@ is base64 encoded (b"...").
+func MetricNameWithStreamTags(metric string, tags Tags) string {
+	if len(tags) == 0 {
+		return metric
+	}
+
+	seen := make(map[string]bool, len(tags))
+	encoded := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag.Category == "" {
+			continue
+		}
+		st := encodeStreamTag(tag.Category)
+		if tag.Value != "" {
+			st += ":" + encodeStreamTag(tag.Value)
+		}
+		if seen[st] {
+			continue
+		}
+		seen[st] = true
+		encoded = append(encoded, st)
+	}
+	if len(encoded) == 0 {
+		return metric
+	}
+	sort.Strings(encoded)
+
+	return metric + "|ST[" + strings.Join(encoded, ",") + "]"
+}
+
+func encodeStreamTag(s string) string {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_' || r == '-' || r == '.' || r == '/' || r == '@':
+		default:
+			return `b"` + base64.StdEncoding.EncodeToString([]byte(s)) + `"`
+		}
+	}
+	return s
+}
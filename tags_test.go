@@ -0,0 +1,44 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"testing"
+)
+
+func TestMetricNameWithStreamTags(t *testing.T) {
+	t.Log("no tags")
+	{
+		if name := MetricNameWithStreamTags("foo", nil); name != "foo" {
+			t.Fatalf("Expected 'foo', got '%s'", name)
+		}
+		if name := MetricNameWithStreamTags("foo", Tags{{"", "bar"}}); name != "foo" {
+			t.Fatalf("Expected 'foo', got '%s'", name)
+		}
+	}
+
+	t.Log("sorted, unique")
+	{
+		expected := "foo|ST[env:prod,region:us-east-1,shard]"
+		name := MetricNameWithStreamTags("foo", Tags{
+			{"region", "us-east-1"},
+			{"shard", ""},
+			{"env", "prod"},
+			{"region", "us-east-1"},
+		})
+		if name != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, name)
+		}
+	}
+
+	t.Log("encoded")
+	{
+		expected := `foo|ST[path:b"L2E6Yg=="]`
+		name := MetricNameWithStreamTags("foo", Tags{{"path", "/a:b"}})
+		if name != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// InstrumentRoundTripper returns an http.RoundTripper which wraps rt (http.DefaultTransport if nil)
+// tracking, per request host (in seconds for latencies):
+//
+//	go`HTTP`client`<name>`<host>`<method>`latency        histogram of request latencies
+//	go`HTTP`client`<name>`<host>`<method>`status`<class> counter of responses by status class (e.g. 2xx)
+//	go`HTTP`client`<name>`<host>`<method>`errors         counter of requests failing without a response
+//	go`HTTP`client`<name>`<host>`conn`reused             counter of requests using an idle connection
+//	go`HTTP`client`<name>`<host>`conn`new                counter of requests using a new connection
+//	go`HTTP`client`<name>`<host>`dns                     histogram of dns lookup latencies
+//	go`HTTP`client`<name>`<host>`connect                 histogram of connect latencies
+//	go`HTTP`client`<name>`<host>`tls                     histogram of tls handshake latencies
+//
+// Each call to RoundTrip is tracked, so when used as the Transport of a retrying
+// client (e.g. retryablehttp.Client.HTTPClient.Transport) every attempt is counted.
+func (m *CirconusMetrics) InstrumentRoundTripper(name string, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &instrumentedRoundTripper{
+		m:      m,
+		prefix: "go`HTTP`client`" + name + "`",
+		next:   rt,
+	}
+}
+
+type instrumentedRoundTripper struct {
+	m      *CirconusMetrics
+	prefix string
+	next   http.RoundTripper
+}
+
+// RoundTrip executes a single HTTP transaction, see http.RoundTripper
+func (rt *instrumentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	hostBase := rt.prefix + req.URL.Host + "`"
+	base := hostBase + req.Method + "`"
+
+	var mu sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				rt.m.Increment(hostBase + "conn`reused")
+			} else {
+				rt.m.Increment(hostBase + "conn`new")
+			}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			start := dnsStart
+			mu.Unlock()
+			if !start.IsZero() {
+				rt.m.RecordValue(hostBase+"dns", time.Since(start).Seconds())
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[network+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			start, ok := connectStart[network+addr]
+			mu.Unlock()
+			if ok && err == nil {
+				rt.m.RecordValue(hostBase+"connect", time.Since(start).Seconds())
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			start := tlsStart
+			mu.Unlock()
+			if !start.IsZero() && err == nil {
+				rt.m.RecordValue(hostBase+"tls", time.Since(start).Seconds())
+			}
+		},
+	}
+
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	rt.m.RecordValue(base+"latency", time.Since(start).Seconds())
+
+	if err != nil {
+		rt.m.Increment(base + "errors")
+		return resp, err
+	}
+
+	rt.m.Increment(base + "status`" + statusClass(resp.StatusCode))
+
+	return resp, nil
+}
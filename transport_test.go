@@ -0,0 +1,133 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+func TestInstrumentRoundTripper(t *testing.T) {
+	t.Log("Testing transport.InstrumentRoundTripper")
+
+	cm := &CirconusMetrics{}
+	cm.counters = make(map[string]uint64)
+	cm.histograms = make(map[string]*Histogram)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	base := "go`HTTP`client`test`" + u.Host + "`"
+
+	client := &http.Client{Transport: cm.InstrumentRoundTripper("test", &http.Transport{})}
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	counters := map[string]uint64{
+		base + "GET`status`2xx": 2,
+		base + "GET`status`4xx": 1,
+		base + "conn`new":       1,
+		base + "conn`reused":    2,
+	}
+	for name, expected := range counters {
+		val, err := cm.GetCounterTest(name)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != expected {
+			t.Fatalf("Expected %s %d, found %d", name, expected, val)
+		}
+	}
+
+	for _, name := range []string{base + "GET`latency", base + "connect"} {
+		if _, err := cm.GetHistogramTest(name); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+
+	t.Log("error")
+	{
+		server.Close()
+		if _, err := client.Get(server.URL); err == nil {
+			t.Fatal("Expected error")
+		}
+		val, err := cm.GetCounterTest(base + "GET`errors")
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if val != 1 {
+			t.Fatalf("Expected 1, found %d", val)
+		}
+	}
+}
+
+func TestInstrumentRoundTripperRetryable(t *testing.T) {
+	t.Log("Testing transport.InstrumentRoundTripper with retryablehttp")
+
+	cm := &CirconusMetrics{}
+	cm.counters = make(map[string]uint64)
+	cm.histograms = make(map[string]*Histogram)
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	base := "go`HTTP`client`trap`" + u.Host + "`PUT`"
+
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Transport = cm.InstrumentRoundTripper("trap", client.HTTPClient.Transport)
+	client.RetryWaitMin = 1 * time.Millisecond
+	client.RetryWaitMax = 2 * time.Millisecond
+	client.Logger = log.New(ioutil.Discard, "", log.LstdFlags)
+
+	req, err := retryablehttp.NewRequest("PUT", server.URL, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	resp.Body.Close()
+
+	if val, _ := cm.GetCounterTest(base + "status`5xx"); val != 2 {
+		t.Fatalf("Expected 2, found %d", val)
+	}
+	if val, _ := cm.GetCounterTest(base + "status`2xx"); val != 1 {
+		t.Fatalf("Expected 1, found %d", val)
+	}
+}
@@ -31,6 +31,9 @@ func (m *CirconusMetrics) Reset() {
 	m.tfm.Lock()
 	defer m.tfm.Unlock()
 
+	m.clm.Lock()
+	defer m.clm.Unlock()
+
 	m.counters = make(map[string]uint64)
 	m.counterFuncs = make(map[string]func() uint64)
 	m.gauges = make(map[string]interface{})
@@ -38,15 +41,33 @@ func (m *CirconusMetrics) Reset() {
 	m.histograms = make(map[string]*Histogram)
 	m.text = make(map[string]string)
 	m.textFuncs = make(map[string]func() string)
+	m.collectors = make(map[string]Collector)
 }
 
-// snapshot returns a copy of the values of all registered counters and gauges.
+// snapshot returns a copy of the values of all registered counters and gauges,
+// including the output of registered collectors.
 func (m *CirconusMetrics) snapshot() (c map[string]uint64, g map[string]interface{}, h map[string]*circonusllhist.Histogram, t map[string]string) {
+	// collectors first, so their self-metrics are part of this snapshot
+	collected := m.snapCollectors()
+
 	c = m.snapCounters()
 	g = m.snapGauges()
 	h = m.snapHistograms()
 	t = m.snapText()
 
+	for n, v := range collected.counters {
+		c[n] = v
+	}
+	for n, v := range collected.gauges {
+		g[n] = v
+	}
+	for n, v := range collected.histograms {
+		h[n] = v
+	}
+	for n, v := range collected.text {
+		t[n] = v
+	}
+
 	return
 }
 
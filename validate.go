@@ -0,0 +1,85 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ConfigErrors are the problems found in a configuration by Validate or
+// Preflight (returned by New in strict mode)
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the configuration, including CheckManager, without
+// connecting to the API or a broker. It returns all the problems found
+// (nil if there are none), where New would stop at the first one or only
+// log them once initialization runs in the background.
+func (cfg *Config) Validate() []error {
+	var errs []error
+
+	if cfg.Interval != "" {
+		if dur, err := time.ParseDuration(cfg.Interval); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing flush interval"))
+		} else if dur < 0 {
+			errs = append(errs, errors.Errorf("invalid flush interval (%s)", cfg.Interval))
+		}
+	}
+
+	if cfg.CollectorTimeout != "" {
+		if dur, err := time.ParseDuration(cfg.CollectorTimeout); err != nil {
+			errs = append(errs, errors.Wrap(err, "parsing collector timeout"))
+		} else if dur <= 0 {
+			errs = append(errs, errors.Errorf("invalid collector timeout (%s)", cfg.CollectorTimeout))
+		}
+	}
+
+	for _, r := range []struct{ name, v string }{
+		{"reset counters", cfg.ResetCounters},
+		{"reset gauges", cfg.ResetGauges},
+		{"reset histograms", cfg.ResetHistograms},
+		{"reset text", cfg.ResetText},
+	} {
+		if r.v == "" {
+			continue
+		}
+		if _, err := strconv.ParseBool(r.v); err != nil {
+			errs = append(errs, errors.Wrapf(err, "parsing %s", r.name))
+		}
+	}
+
+	for _, err := range cfg.CheckManager.Validate() {
+		errs = append(errs, errors.Wrap(err, "check manager"))
+	}
+
+	return errs
+}
+
+// Preflight runs Validate and, if there are no problems, verifies the
+// configuration online (see checkmgr.Config.Preflight): the API token, the
+// check or a usable broker, and the submission url. Returns all the problems
+// found (nil if there are none).
+func (cfg *Config) Preflight() []error {
+	if errs := cfg.Validate(); len(errs) > 0 {
+		return errs
+	}
+
+	var errs []error
+	for _, err := range cfg.CheckManager.Preflight() {
+		errs = append(errs, errors.Wrap(err, "check manager preflight"))
+	}
+	return errs
+}
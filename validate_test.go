@@ -0,0 +1,98 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/circonus-labs/circonus-gometrics/brokertest"
+)
+
+func TestConfigErrors(t *testing.T) {
+	err := ConfigErrors{errors.New("a"), errors.New("b")}
+	if err.Error() != "invalid configuration: a; b" {
+		t.Fatalf("Expected 'invalid configuration: a; b', got '%s'", err.Error())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Log("valid")
+	{
+		cfg := &Config{Interval: "0", CollectorTimeout: "1s", ResetCounters: "false"}
+		cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:2609/write/foo"
+		if errs := cfg.Validate(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+	}
+
+	t.Log("all problems")
+	{
+		cfg := &Config{
+			Interval:         "-1s",
+			CollectorTimeout: "0",
+			ResetCounters:    "a",
+			ResetGauges:      "b",
+			ResetHistograms:  "c",
+			ResetText:        "d",
+		}
+		cfg.CheckManager.Check.MaxURLAge = "x"
+		errs := cfg.Validate()
+		if len(errs) != 8 {
+			t.Fatalf("Expected 8 errors, got %d %v", len(errs), errs)
+		}
+		if !strings.HasPrefix(errs[6].Error(), "check manager: ") {
+			t.Fatalf("Expected check manager error, got '%v'", errs[6])
+		}
+	}
+}
+
+func TestNewStrict(t *testing.T) {
+	t.Log("strict validation")
+	{
+		cfg := &Config{Interval: "10", StrictValidation: true}
+		_, err := New(cfg)
+		errs, ok := err.(ConfigErrors)
+		if !ok {
+			t.Fatalf("Expected ConfigErrors, got %T '%v'", err, err)
+		}
+		if len(errs) != 2 {
+			t.Fatalf("Expected 2 errors (interval, no token or url), got %v", errs)
+		}
+	}
+
+	t.Log("strict preflight")
+	{
+		broker, err := brokertest.New(&brokertest.Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		broker.Close()
+
+		cfg := &Config{Interval: "0", StrictPreflight: true}
+		cfg.CheckManager.Check.SubmissionURL = broker.SubmissionURL("abc", "xyz")
+		_, err = New(cfg)
+		errs, ok := err.(ConfigErrors)
+		if !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), "check manager preflight") {
+			t.Fatalf("Expected preflight error, got '%v'", err)
+		}
+	}
+
+	t.Log("valid")
+	{
+		broker, err := brokertest.New(&brokertest.Config{})
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		defer broker.Close()
+
+		cfg := &Config{Interval: "0", StrictPreflight: true}
+		cfg.CheckManager.Check.SubmissionURL = broker.SubmissionURL("abc", "xyz")
+		if _, err := New(cfg); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+	}
+}